@@ -0,0 +1,301 @@
+// Package canary drives canary releases: it compares the canary pool of a
+// split route to its stable pool over a sliding window, steps the canary
+// weight up on a schedule while it is healthy, and rolls it back otherwise.
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/router"
+)
+
+// Policy describes the schedule and the health thresholds of a rollout
+type Policy struct {
+	// Steps are the successive canary weights, in percent of the traffic
+	Steps []int
+	// Interval is the time spent at each step before stepping up
+	Interval time.Duration
+	// Window is the period over which the canary and stable pools are compared
+	Window time.Duration
+	// MinRequests is the number of canary requests in the window needed to judge the canary
+	MinRequests int
+	// MaxErrorRateIncrease is the largest acceptable canary error rate over the
+	// stable one, in percentage points
+	MaxErrorRateIncrease float64
+	// MaxLatencyRatio is the largest acceptable ratio of the canary latency to
+	// the stable latency, at LatencyPercentile
+	MaxLatencyRatio   float64
+	LatencyPercentile float64
+}
+
+// State is the progress of a rollout
+type State string
+
+const (
+	// Pending rollouts have not started yet
+	Pending     State = "pending"
+	Progressing State = "progressing"
+	Promoted    State = "promoted"
+	RolledBack  State = "rolled_back"
+)
+
+// Actions of the decisions of a rollout
+const (
+	ActionStart    = "start"
+	ActionStep     = "step"
+	ActionHold     = "hold"
+	ActionPromote  = "promote"
+	ActionRollback = "rollback"
+)
+
+// maxDecisions is the number of decisions kept per rollout
+const maxDecisions = 100
+
+// Decision is a change of the canary weight, or the reason it is held
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Weight is the canary weight after the decision
+	Weight int    `json:"weight"`
+	Reason string `json:"reason"`
+}
+
+// Rollout moves the traffic of a two-pool split from its stable pool to its canary pool
+type Rollout struct {
+	Route string
+	Split *router.Split
+	// Stable and Canary are the indexes of the targets of the split
+	Stable, Canary int
+	Policy         Policy
+
+	mu          sync.Mutex
+	state       State
+	step        int
+	stepStarted time.Time
+	samples     []sample
+	decisions   []Decision
+	// held is the reason of the last hold decision, to record it only once
+	held string
+}
+
+// sample holds the counts of the split targets at a point in time
+type sample struct {
+	time           time.Time
+	stable, canary router.Counts
+}
+
+// Window is the outcome of the requests of a pool over the analysis window
+type Window struct {
+	Pool     string `json:"pool"`
+	Requests uint64 `json:"requests"`
+	// ErrorRate is in percent
+	ErrorRate float64 `json:"error_rate"`
+	// LatencyMS is the latency at the policy percentile, in milliseconds
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Status is the progress of a rollout and the decisions it made
+type Status struct {
+	Route     string     `json:"route"`
+	State     State      `json:"state"`
+	Weight    int        `json:"weight"`
+	Steps     []int      `json:"steps"`
+	Stable    Window     `json:"stable"`
+	Canary    Window     `json:"canary"`
+	Decisions []Decision `json:"decisions"`
+}
+
+// Run starts the rollout at its first step, unless it already started, and
+// evaluates the canary every tick until ctx is done or the rollout is over
+func (r *Rollout) Run(ctx context.Context, tick time.Duration) {
+	if r.start(time.Now()) != Progressing {
+		return
+	}
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if r.evaluate(now) != Progressing {
+				return
+			}
+		}
+	}
+}
+
+// start sets the canary weight to the first step of a pending rollout
+func (r *Rollout) start(now time.Time) State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != "" {
+		return r.state
+	}
+	r.state = Progressing
+	r.step = 0
+	r.stepStarted = now
+	r.sample(now)
+	r.decide(now, ActionStart, r.Policy.Steps[0], fmt.Sprintf("starting at %d%%", r.Policy.Steps[0]))
+	return r.state
+}
+
+// Rebind moves the rollout to split, a split of the same targets, e.g. after
+// a reload. The progress, the decisions and the window samples are kept.
+func (r *Rollout) Rebind(split *router.Split) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Split = split
+}
+
+// evaluate compares the pools over the window and steps the canary up, holds it, or rolls it back
+func (r *Rollout) evaluate(now time.Time) State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != Progressing {
+		return r.state
+	}
+
+	r.sample(now)
+	stable, canary := r.window()
+	p := r.Policy
+
+	if canary.Requests >= uint64(p.MinRequests) {
+		increase := (canary.ErrorRate() - stable.ErrorRate()) * 100
+		if increase > p.MaxErrorRateIncrease {
+			r.rollback(now, fmt.Sprintf("canary error rate %.2f%% exceeds stable %.2f%% by %.2f points (max %.2f)",
+				canary.ErrorRate()*100, stable.ErrorRate()*100, increase, p.MaxErrorRateIncrease))
+			return r.state
+		}
+		q := p.LatencyPercentile / 100
+		cl, sl := canary.Quantile(q), stable.Quantile(q)
+		if stable.Requests >= uint64(p.MinRequests) && sl > 0 && float64(cl)/float64(sl) > p.MaxLatencyRatio {
+			r.rollback(now, fmt.Sprintf("canary p%g latency %s is %.2f times stable %s (max %.2f)",
+				p.LatencyPercentile, cl.Round(time.Microsecond), float64(cl)/float64(sl), sl.Round(time.Microsecond), p.MaxLatencyRatio))
+			return r.state
+		}
+	}
+
+	if now.Sub(r.stepStarted) < p.Interval {
+		return r.state
+	}
+	if canary.Requests < uint64(p.MinRequests) {
+		r.hold(now, fmt.Sprintf("waiting for %d canary requests in the window", p.MinRequests), fmt.Sprintf(", got %d", canary.Requests))
+		return r.state
+	}
+
+	healthy := fmt.Sprintf("canary healthy over %s: %d requests, error rate %.2f%% (stable %.2f%%)",
+		p.Window, canary.Requests, canary.ErrorRate()*100, stable.ErrorRate()*100)
+	if r.step == len(p.Steps)-1 {
+		r.state = Promoted
+		r.decide(now, ActionPromote, p.Steps[r.step], healthy)
+		return r.state
+	}
+	r.step++
+	r.stepStarted = now
+	r.decide(now, ActionStep, p.Steps[r.step], healthy)
+	return r.state
+}
+
+// Status returns the progress of the rollout
+func (r *Rollout) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stable, canary := r.window()
+	q := r.Policy.LatencyPercentile / 100
+	weights := r.Split.Weights()
+	return Status{
+		Route:     r.Route,
+		State:     r.current(),
+		Weight:    weights[r.Canary],
+		Steps:     r.Policy.Steps,
+		Stable:    newWindow(r.Split.Targets[r.Stable].Pool.Name, stable, q),
+		Canary:    newWindow(r.Split.Targets[r.Canary].Pool.Name, canary, q),
+		Decisions: append([]Decision{}, r.decisions...),
+	}
+}
+
+// Active reports whether the rollout is changing, or about to change, the weights of its split
+func (r *Rollout) Active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current() == Pending || r.current() == Progressing
+}
+
+// current returns the state of the rollout, pending until it starts
+func (r *Rollout) current() State {
+	if r.state == "" {
+		return Pending
+	}
+	return r.state
+}
+
+func newWindow(pool string, c router.Counts, q float64) Window {
+	return Window{
+		Pool:      pool,
+		Requests:  c.Requests,
+		ErrorRate: c.ErrorRate() * 100,
+		LatencyMS: float64(c.Quantile(q)) / float64(time.Millisecond),
+	}
+}
+
+// sample records the counts of the pools, keeping a single sample older than the window
+func (r *Rollout) sample(now time.Time) {
+	r.samples = append(r.samples, sample{
+		time:   now,
+		stable: r.Split.Targets[r.Stable].Counts(),
+		canary: r.Split.Targets[r.Canary].Counts(),
+	})
+	for len(r.samples) > 2 && !r.samples[1].time.After(now.Add(-r.Policy.Window)) {
+		r.samples = r.samples[1:]
+	}
+}
+
+// window returns the outcome of the requests of the pools since the oldest sample
+func (r *Rollout) window() (stable, canary router.Counts) {
+	if len(r.samples) == 0 {
+		return stable, canary
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	return last.stable.Sub(first.stable), last.canary.Sub(first.canary)
+}
+
+func (r *Rollout) rollback(now time.Time, reason string) {
+	r.state = RolledBack
+	r.decide(now, ActionRollback, 0, reason)
+}
+
+// hold records why the canary is not stepped up, once per reason: the detail,
+// e.g. the request count, is recorded with the first hold only
+func (r *Rollout) hold(now time.Time, reason, detail string) {
+	if reason == r.held {
+		return
+	}
+	r.held = reason
+	r.record(Decision{Time: now, Action: ActionHold, Weight: r.Policy.Steps[r.step], Reason: reason + detail})
+}
+
+// decide applies the canary weight and records the decision
+func (r *Rollout) decide(now time.Time, action string, weight int, reason string) {
+	weights := make([]int, len(r.Split.Targets))
+	weights[r.Stable] = 100 - weight
+	weights[r.Canary] = weight
+	if err := r.Split.SetWeights(weights); err != nil {
+		log.Printf("Canary (%s): %s", r.Route, err)
+	}
+	r.held = ""
+	r.record(Decision{Time: now, Action: action, Weight: weight, Reason: reason})
+}
+
+func (r *Rollout) record(d Decision) {
+	r.decisions = append(r.decisions, d)
+	if len(r.decisions) > maxDecisions {
+		r.decisions = r.decisions[len(r.decisions)-maxDecisions:]
+	}
+	log.Printf("Canary (%s): %s at %d%%: %s", r.Route, d.Action, d.Weight, d.Reason)
+}
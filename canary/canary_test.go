@@ -0,0 +1,192 @@
+package canary
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
+)
+
+func newTestRollout(t *testing.T) *Rollout {
+	t.Helper()
+	split, err := router.NewSplit([]*core.ServerPool{{Name: "stable"}, {Name: "canary"}}, []int{100, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Rollout{
+		Route:  "web",
+		Split:  split,
+		Stable: 0,
+		Canary: 1,
+		Policy: Policy{
+			Steps:                []int{10, 50, 100},
+			Interval:             time.Minute,
+			Window:               time.Minute,
+			MinRequests:          10,
+			MaxErrorRateIncrease: 1,
+			MaxLatencyRatio:      1.5,
+			LatencyPercentile:    95,
+		},
+	}
+}
+
+// serve records n requests on a target, errors of them failing
+func serve(r *Rollout, target, n, errors int, latency time.Duration) {
+	for i := range n {
+		status := 200
+		if i < errors {
+			status = 503
+		}
+		r.Split.Targets[target].Done(status, latency)
+	}
+}
+
+func TestRollout_Promote(t *testing.T) {
+	r := newTestRollout(t)
+	now := time.Now()
+	r.start(now)
+	if w := r.Split.Weights(); w[0] != 90 || w[1] != 10 {
+		t.Fatalf("Expected the first step to be applied, got %v", w)
+	}
+
+	for i, expected := range []int{50, 100} {
+		serve(r, 0, 100, 0, 10*time.Millisecond)
+		serve(r, 1, 20, 0, 12*time.Millisecond)
+		now = now.Add(30 * time.Second)
+		if r.evaluate(now); r.Split.Weights()[1] != r.Policy.Steps[i] {
+			t.Errorf("Expected the weight to hold before the interval, got %v", r.Split.Weights())
+		}
+		now = now.Add(30 * time.Second)
+		if state := r.evaluate(now); state != Progressing || r.Split.Weights()[1] != expected {
+			t.Fatalf("Expected to step up to %d%%, got %s %v", expected, state, r.Split.Weights())
+		}
+	}
+
+	serve(r, 1, 20, 0, 12*time.Millisecond)
+	if state := r.evaluate(now.Add(time.Minute)); state != Promoted {
+		t.Fatalf("Expected the canary to be promoted, got %s", state)
+	}
+
+	status := r.Status()
+	var actions []string
+	for _, d := range status.Decisions {
+		actions = append(actions, d.Action)
+	}
+	if got := strings.Join(actions, ","); got != "start,step,step,promote" || status.Weight != 100 {
+		t.Errorf("Expected start,step,step,promote at 100%%, got %s at %d%%", got, status.Weight)
+	}
+}
+
+func TestRollout_Rollback(t *testing.T) {
+	tests := []struct {
+		name           string
+		canaryErrors   int
+		canaryLatency  time.Duration
+		expectedReason string
+	}{
+		{"Error Rate", 3, 10 * time.Millisecond, "canary error rate 15.00% exceeds stable 0.00% by 15.00 points (max 1.00)"},
+		{"Latency", 0, 40 * time.Millisecond, "canary p95 latency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRollout(t)
+			now := time.Now()
+			r.start(now)
+
+			serve(r, 0, 100, 0, 20*time.Millisecond)
+			serve(r, 1, 20, tt.canaryErrors, tt.canaryLatency)
+			if state := r.evaluate(now.Add(10 * time.Second)); state != RolledBack {
+				t.Fatalf("Expected a rollback, got %s", state)
+			}
+			if w := r.Split.Weights(); w[0] != 100 || w[1] != 0 {
+				t.Errorf("Expected every request back on the stable pool, got %v", w)
+			}
+			last := r.Status().Decisions[len(r.Status().Decisions)-1]
+			if last.Action != ActionRollback || !strings.HasPrefix(last.Reason, tt.expectedReason) {
+				t.Errorf("Expected rollback %q, got %+v", tt.expectedReason, last)
+			}
+		})
+	}
+}
+
+func TestRollout_Window(t *testing.T) {
+	r := newTestRollout(t)
+	now := time.Now()
+	r.start(now)
+
+	// Errors older than the window are forgotten
+	serve(r, 1, 20, 20, 10*time.Millisecond)
+	serve(r, 0, 20, 20, 10*time.Millisecond)
+	now = now.Add(30 * time.Second)
+	r.evaluate(now)
+	now = now.Add(90 * time.Second)
+	serve(r, 0, 100, 0, 10*time.Millisecond)
+	serve(r, 1, 5, 0, 10*time.Millisecond)
+	if state := r.evaluate(now); state != Progressing {
+		t.Fatalf("Expected the rollout to go on, got %s", state)
+	}
+
+	status := r.Status()
+	if status.Canary.Requests != 5 || status.Canary.ErrorRate != 0 || status.Stable.Requests != 100 {
+		t.Errorf("Expected the window to hold the last requests only, got %+v %+v", status.Stable, status.Canary)
+	}
+	last := status.Decisions[len(status.Decisions)-1]
+	if last.Action != ActionHold || last.Reason != "waiting for 10 canary requests in the window, got 5" {
+		t.Errorf("Expected a hold for lack of traffic, got %+v", last)
+	}
+
+	// The same hold is recorded once, as the canary requests trickle in
+	serve(r, 1, 2, 0, 10*time.Millisecond)
+	r.evaluate(now.Add(time.Second))
+	if n := len(r.Status().Decisions); n != len(status.Decisions) {
+		t.Errorf("Expected the hold to be recorded once, got %d decisions", n)
+	}
+}
+
+func TestRollout_Resume(t *testing.T) {
+	tests := []struct {
+		name     string
+		finish   func(r *Rollout, now time.Time)
+		expected State
+		weight   int
+	}{
+		{"Progressing", func(r *Rollout, now time.Time) {
+			serve(r, 1, 20, 0, 10*time.Millisecond)
+			r.evaluate(now.Add(time.Minute))
+		}, Progressing, 50},
+		{"Rolled Back", func(r *Rollout, now time.Time) {
+			serve(r, 1, 20, 20, 10*time.Millisecond)
+			r.evaluate(now.Add(time.Second))
+		}, RolledBack, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRollout(t)
+			now := time.Now()
+			r.start(now)
+			tt.finish(r, now)
+			decisions := len(r.Status().Decisions)
+
+			// Run again, e.g. after a reload, with a split sharing the weights
+			split, err := r.Split.Rebind([]*core.ServerPool{{Name: "stable"}, {Name: "canary"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Rebind(split)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r.Run(ctx, time.Hour)
+
+			status := r.Status()
+			if status.State != tt.expected || status.Weight != tt.weight {
+				t.Errorf("Expected %s at %d%%, got %s at %d%%", tt.expected, tt.weight, status.State, status.Weight)
+			}
+			if len(status.Decisions) != decisions {
+				t.Errorf("Expected the rollout not to restart, got %+v", status.Decisions)
+			}
+		})
+	}
+}
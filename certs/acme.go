@@ -0,0 +1,431 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACME challenge types
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// DefaultRenewBefore is how long before their expiry certificates are renewed by default
+const DefaultRenewBefore = 30 * 24 * time.Hour
+
+// obtainTimeout bounds the issuance of a certificate, challenges included
+const obtainTimeout = 5 * time.Minute
+
+// RetryInterval is the first delay before a failed certificate is requested
+// again, doubled after each failure up to the check interval
+var RetryInterval = time.Minute
+
+// Manager obtains and renews certificates from an ACME certificate authority,
+// e.g. Let's Encrypt, for a list of hosts. It answers the HTTP-01 challenges
+// through HTTPHandler and the TLS-ALPN-01 challenges through GetCertificate.
+//
+// The account key and the certificates are stored in Dir as account.key,
+// <host>.crt and <host>.key, so they survive restarts; renewed certificates
+// are served to new connections as soon as they are issued.
+type Manager struct {
+	Client *acme.Client
+	Dir    string
+	// Email is the contact of the ACME account, optional
+	Email string
+	// Challenges are the challenge types to use, by order of preference
+	Challenges []string
+	// RenewBefore is how long before their expiry certificates are renewed
+	RenewBefore time.Duration
+
+	mu         sync.RWMutex
+	hosts      []string
+	certs      map[string]*tls.Certificate
+	tokens     map[string]string           // HTTP-01 token to key authorization
+	alpnCerts  map[string]*tls.Certificate // host to TLS-ALPN-01 challenge certificate
+	registered bool
+	wake       chan struct{}
+}
+
+// NewManager returns a manager storing its files in dir. The account key of
+// client is loaded from dir, or generated, when it has none, and the
+// certificates stored by a previous run are loaded.
+func NewManager(dir string, client *acme.Client) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		Client:      client,
+		Dir:         dir,
+		Challenges:  []string{ChallengeTLSALPN01, ChallengeHTTP01},
+		RenewBefore: DefaultRenewBefore,
+		certs:       map[string]*tls.Certificate{},
+		tokens:      map[string]string{},
+		alpnCerts:   map[string]*tls.Certificate{},
+		wake:        make(chan struct{}, 1),
+	}
+	if client.Key == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return nil, err
+		}
+		client.Key = key
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, certFile := range files {
+		host := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		cert, err := tls.LoadX509KeyPair(certFile, m.keyFile(host))
+		if err != nil {
+			log.Printf("ACME (%s): ignoring stored certificate: %s", host, err)
+			continue
+		}
+		m.certs[host] = &cert
+	}
+	return m, nil
+}
+
+// SetHosts replaces the hosts certificates are obtained for. The missing
+// certificates are requested right away when Run is in progress.
+func (m *Manager) SetHosts(hosts []string) {
+	m.mu.Lock()
+	m.hosts = slices.Clone(hosts)
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hosts returns the hosts certificates are obtained for
+func (m *Manager) Hosts() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.hosts)
+}
+
+// Run obtains the missing certificates and renews the expiring ones, then
+// checks them again every interval and whenever the hosts change, until ctx
+// is done. Failures are retried sooner, backing off from RetryInterval.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	retry := RetryInterval
+	for {
+		wait := interval
+		if !m.renew(ctx) {
+			wait = min(retry, interval)
+			retry *= 2
+		} else {
+			retry = RetryInterval
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		case <-m.wake:
+			t.Stop()
+		}
+	}
+}
+
+// renew obtains the certificates of the hosts which have none or whose
+// certificate expires soon, and reports whether all of them succeeded
+func (m *Manager) renew(ctx context.Context) bool {
+	ok := true
+	for _, host := range m.Hosts() {
+		m.mu.RLock()
+		cert := m.certs[host]
+		m.mu.RUnlock()
+		if cert != nil && time.Until(cert.Leaf.NotAfter) > m.RenewBefore {
+			continue
+		}
+
+		octx, cancel := context.WithTimeout(ctx, obtainTimeout)
+		err := m.Obtain(octx, host)
+		cancel()
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			log.Printf("ACME (%s): %s", host, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Obtain requests a certificate for host, stores it and starts serving it
+func (m *Manager) Obtain(ctx context.Context, host string) error {
+	if err := m.register(ctx); err != nil {
+		return fmt.Errorf("registering the account: %w", err)
+	}
+
+	order, err := m.Client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return fmt.Errorf("ordering a certificate: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if _, err := m.Client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("waiting for the order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.Client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing the order: %w", err)
+	}
+
+	cert, err := m.store(host, chain, key)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certs[host] = cert
+	m.mu.Unlock()
+	log.Printf("ACME (%s): obtained a certificate valid until %s", host, cert.Leaf.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// register creates the ACME account, or finds the existing one of the key
+func (m *Manager) register(ctx context.Context) error {
+	m.mu.RLock()
+	registered := m.registered
+	m.mu.RUnlock()
+	if registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	if _, err := m.Client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	m.mu.Lock()
+	m.registered = true
+	m.mu.Unlock()
+	return nil
+}
+
+// authorize answers a challenge of an authorization and waits for it to be valid
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	z, err := m.Client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("fetching the authorization: %w", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	host := z.Identifier.Value
+
+	var chal *acme.Challenge
+	for _, typ := range m.Challenges {
+		if i := slices.IndexFunc(z.Challenges, func(c *acme.Challenge) bool { return c.Type == typ }); i >= 0 {
+			chal = z.Challenges[i]
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no supported challenge offered for %s", host)
+	}
+
+	switch chal.Type {
+	case ChallengeHTTP01:
+		keyAuth, err := m.Client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.tokens[chal.Token] = keyAuth
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.tokens, chal.Token)
+			m.mu.Unlock()
+		}()
+	case ChallengeTLSALPN01:
+		cert, err := m.Client.TLSALPN01ChallengeCert(chal.Token, host)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.alpnCerts[host] = &cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, host)
+			m.mu.Unlock()
+		}()
+	}
+
+	if _, err := m.Client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting the %s challenge: %w", chal.Type, err)
+	}
+	if _, err := m.Client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("%s challenge failed: %w", chal.Type, err)
+	}
+	return nil
+}
+
+// GetCertificate answers the TLS-ALPN-01 challenges and returns the
+// certificate obtained for the server name of a handshake, or nil when it
+// has none
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		if cert, ok := m.alpnCerts[name]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no pending TLS-ALPN-01 challenge for %q", name)
+	}
+	return m.certs[name], nil
+}
+
+// HTTPHandler answers the HTTP-01 challenges under /.well-known/acme-challenge/,
+// other requests being passed to fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[token]
+		m.mu.RUnlock()
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// Certificates describes the certificates obtained, sorted by host
+func (m *Manager) Certificates() []Info {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]Info, 0, len(m.certs))
+	for _, host := range slices.Sorted(maps.Keys(m.certs)) {
+		cert := m.certs[host]
+		infos = append(infos, Info{CertFile: m.certFile(host), Names: names(cert), NotBefore: cert.Leaf.NotBefore, NotAfter: cert.Leaf.NotAfter})
+	}
+	return infos
+}
+
+// store writes a certificate chain and its key to Dir, and returns them loaded
+func (m *Manager) store(host string, chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate issued: %w", err)
+	}
+	// The key is written first, so that a stored certificate always has its key
+	if err := writeFile(m.keyFile(host), keyPEM); err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.certFile(host), certPEM); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// accountKey loads the account key from Dir, or generates and stores one
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.Dir, "account.key")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key found", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func (m *Manager) certFile(host string) string {
+	return filepath.Join(m.Dir, host+".crt")
+}
+
+func (m *Manager) keyFile(host string) string {
+	return filepath.Join(m.Dir, host+".key")
+}
+
+// writeFile replaces a file atomically, so that it is never read partially written
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,447 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is a minimal RFC 8555 certificate authority, in the spirit of
+// Pebble: it validates the challenges for real, by dialing httpAddr for
+// HTTP-01 and tlsAddr for TLS-ALPN-01 whatever the host, but does not check
+// the signatures of the requests
+type fakeACME struct {
+	*httptest.Server
+	httpAddr, tlsAddr string
+	validity          time.Duration
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	thumbprint string
+	orders     []*fakeOrder
+	accounts   int
+}
+
+type fakeOrder struct {
+	host        string
+	token       string
+	authzStatus string
+	status      string
+	chain       []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	f := &fakeACME{caKey: key, caCert: caCert, validity: 90 * 24 * time.Hour}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]any{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+			"revokeCert": f.URL + "/revoke",
+			"keyChange":  f.URL + "/key-change",
+			"meta":       map[string]any{"termsOfService": f.URL + "/terms"},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	var protected struct {
+		JWK map[string]string `json:"jwk"`
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(header, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var o *fakeOrder
+	if len(parts) > 1 {
+		i, _ := strconv.Atoi(parts[1])
+		if i >= len(f.orders) {
+			f.problem(w, http.StatusNotFound, "malformed", "unknown order")
+			return
+		}
+		o = f.orders[i]
+	}
+
+	switch {
+	case parts[0] == "account":
+		jwk := protected.JWK
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])))
+		f.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		f.accounts++
+		w.Header().Set("Location", f.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"status": "valid"})
+
+	case parts[0] == "order" && o == nil:
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		o = &fakeOrder{host: req.Identifiers[0].Value, token: fmt.Sprintf("token-%d", len(f.orders)), authzStatus: "pending", status: "pending"}
+		f.orders = append(f.orders, o)
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.URL, len(f.orders)-1))
+		w.WriteHeader(http.StatusCreated)
+		f.writeOrder(w, len(f.orders)-1)
+
+	case parts[0] == "order":
+		f.writeOrder(w, f.index(o))
+
+	case parts[0] == "authz":
+		f.writeAuthz(w, f.index(o))
+
+	case parts[0] == "challenge":
+		typ := parts[2]
+		if err := f.validate(o, typ); err != nil {
+			o.authzStatus, o.status = "invalid", "invalid"
+		} else {
+			o.authzStatus, o.status = "valid", "ready"
+		}
+		json.NewEncoder(w).Encode(f.challenge(f.index(o), typ))
+
+	case parts[0] == "finalize":
+		if o.status != "ready" {
+			f.problem(w, http.StatusForbidden, "orderNotReady", "order is "+o.status)
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		o.chain = f.issue(csr)
+		o.status = "valid"
+		f.writeOrder(w, f.index(o))
+
+	case parts[0] == "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.chain)
+
+	default:
+		f.problem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+func (f *fakeACME) index(o *fakeOrder) int {
+	for i, other := range f.orders {
+		if other == o {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, i int) {
+	o := f.orders[i]
+	order := map[string]any{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.host}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", f.URL, i)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", f.URL, i),
+	}
+	if o.status == "valid" {
+		order["certificate"] = fmt.Sprintf("%s/cert/%d", f.URL, i)
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+func (f *fakeACME) writeAuthz(w http.ResponseWriter, i int) {
+	o := f.orders[i]
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     o.authzStatus,
+		"identifier": map[string]string{"type": "dns", "value": o.host},
+		"challenges": []map[string]string{f.challenge(i, ChallengeHTTP01), f.challenge(i, ChallengeTLSALPN01)},
+	})
+}
+
+func (f *fakeACME) challenge(i int, typ string) map[string]string {
+	o := f.orders[i]
+	return map[string]string{"type": typ, "url": fmt.Sprintf("%s/challenge/%d/%s", f.URL, i, typ), "token": o.token, "status": o.authzStatus}
+}
+
+// validate checks the answer to a challenge the way a real CA does
+func (f *fakeACME) validate(o *fakeOrder, typ string) error {
+	keyAuth := o.token + "." + f.thumbprint
+	switch typ {
+	case ChallengeHTTP01:
+		req, _ := http.NewRequest("GET", "http://"+f.httpAddr+"/.well-known/acme-challenge/"+o.token, nil)
+		req.Host = o.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("unexpected key authorization %q", body)
+		}
+		return nil
+	case ChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", f.tlsAddr, &tls.Config{ServerName: o.host, NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != acme.ALPNProto {
+			return fmt.Errorf("unexpected protocol %q", state.NegotiatedProtocol)
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		expected, _ := asn1.Marshal(sum[:])
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && string(ext.Value) == string(expected) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no matching acmeIdentifier extension")
+	}
+	return fmt.Errorf("unknown challenge %s", typ)
+}
+
+// issue signs a certificate for the names of a CSR, and returns it with the CA as a PEM chain
+func (f *fakeACME) issue(csr *x509.CertificateRequest) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(f.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+}
+
+// issued returns the number of certificates issued
+func (f *fakeACME) issued() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, o := range f.orders {
+		if o.status == "valid" {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestManager(t *testing.T, ca *fakeACME, dir string) *Manager {
+	t.Helper()
+	m, err := NewManager(dir, &acme.Client{DirectoryURL: ca.URL + "/directory"})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	return m
+}
+
+func servedCert(t *testing.T, m *Manager, host string) *x509.Certificate {
+	t.Helper()
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	if err != nil || cert == nil {
+		t.Fatalf("Expected a certificate for %s, got %v", host, err)
+	}
+	return cert.Leaf
+}
+
+func TestManager_HTTP01(t *testing.T) {
+	ca := newFakeACME(t)
+	dir := t.TempDir()
+	m := newTestManager(t, ca, dir)
+	m.Challenges = []string{ChallengeHTTP01}
+
+	challenges := httptest.NewServer(m.HTTPHandler(http.NotFoundHandler()))
+	defer challenges.Close()
+	ca.httpAddr = challenges.Listener.Addr().String()
+
+	if err := m.Obtain(context.Background(), "shop.example.com"); err != nil {
+		t.Fatalf("Obtain failed: %v", err)
+	}
+	if leaf := servedCert(t, m, "shop.example.com"); leaf.DNSNames[0] != "shop.example.com" || leaf.Issuer.CommonName != "Fake ACME CA" {
+		t.Errorf("Expected a certificate issued for shop.example.com, got %v by %s", leaf.DNSNames, leaf.Issuer.CommonName)
+	}
+	if cert, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); cert != nil {
+		t.Error("Expected no certificate for another host")
+	}
+
+	// Answered tokens are forgotten
+	w := httptest.NewRecorder()
+	m.HTTPHandler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/acme-challenge/token-0", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an answered challenge, got %d", w.Code)
+	}
+
+	// The account key and certificate are reused after a restart
+	for _, file := range []string{"account.key", "shop.example.com.crt", "shop.example.com.key"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("Expected %s stored: %v", file, err)
+		}
+	}
+	restarted := newTestManager(t, ca, dir)
+	if infos := restarted.Certificates(); len(infos) != 1 || infos[0].Names[0] != "shop.example.com" {
+		t.Errorf("Expected the stored certificate loaded, got %+v", infos)
+	}
+	if !restarted.Client.Key.(*ecdsa.PrivateKey).Equal(m.Client.Key) {
+		t.Error("Expected the stored account key reused")
+	}
+}
+
+func TestManager_TLSALPN01(t *testing.T) {
+	ca := newFakeACME(t)
+	m := newTestManager(t, ca, t.TempDir())
+	m.Challenges = []string{ChallengeTLSALPN01}
+
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{"http/1.1", acme.ALPNProto}}
+	srv.StartTLS()
+	defer srv.Close()
+	ca.tlsAddr = srv.Listener.Addr().String()
+
+	if err := m.Obtain(context.Background(), "api.example.com"); err != nil {
+		t.Fatalf("Obtain failed: %v", err)
+	}
+	if leaf := servedCert(t, m, "api.example.com"); leaf.DNSNames[0] != "api.example.com" {
+		t.Errorf("Expected a certificate issued for api.example.com, got %v", leaf.DNSNames)
+	}
+}
+
+func TestManager_Renew(t *testing.T) {
+	ca := newFakeACME(t)
+	m := newTestManager(t, ca, t.TempDir())
+	m.Challenges = []string{ChallengeHTTP01}
+	challenges := httptest.NewServer(m.HTTPHandler(http.NotFoundHandler()))
+	defer challenges.Close()
+	ca.httpAddr = challenges.Listener.Addr().String()
+	m.SetHosts([]string{"shop.example.com"})
+
+	// A certificate expiring within RenewBefore is renewed on every check
+	ca.validity = 10 * 24 * time.Hour
+	m.renew(context.Background())
+	first := servedCert(t, m, "shop.example.com")
+	m.renew(context.Background())
+	renewed := servedCert(t, m, "shop.example.com")
+	if ca.issued() != 2 || renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("Expected the expiring certificate renewed and served, got %d issued", ca.issued())
+	}
+
+	// A fresh certificate is kept
+	ca.validity = 90 * 24 * time.Hour
+	m.renew(context.Background())
+	m.renew(context.Background())
+	if ca.issued() != 3 {
+		t.Errorf("Expected a fresh certificate kept, got %d issued", ca.issued())
+	}
+	if ca.accounts != 1 {
+		t.Errorf("Expected the account registered once, got %d", ca.accounts)
+	}
+}
+
+func TestManager_FailedChallenge(t *testing.T) {
+	ca := newFakeACME(t)
+	m := newTestManager(t, ca, t.TempDir())
+	m.Challenges = []string{ChallengeHTTP01}
+
+	// The host points to a server which does not answer the challenges
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	ca.httpAddr = other.Listener.Addr().String()
+
+	err := m.Obtain(context.Background(), "shop.example.com")
+	if err == nil || !strings.Contains(err.Error(), "http-01 challenge failed") {
+		t.Errorf("Expected the challenge to fail, got %v", err)
+	}
+	if len(m.Certificates()) != 0 {
+		t.Error("Expected no certificate")
+	}
+}
+
+func TestManager_Run(t *testing.T) {
+	ca := newFakeACME(t)
+	m := newTestManager(t, ca, t.TempDir())
+	m.Challenges = []string{ChallengeHTTP01}
+	challenges := httptest.NewServer(m.HTTPHandler(http.NotFoundHandler()))
+	defer challenges.Close()
+	ca.httpAddr = challenges.Listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, time.Hour)
+
+	// New hosts are certified right away, not at the next check
+	m.SetHosts([]string{"shop.example.com"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.Certificates()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if infos := m.Certificates(); len(infos) != 1 || infos[0].Names[0] != "shop.example.com" {
+		t.Errorf("Expected a certificate for the new host, got %+v", infos)
+	}
+}
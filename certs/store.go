@@ -0,0 +1,230 @@
+// Package certs holds the certificates served by the TLS listeners.
+//
+// A Store selects the certificate of a connection by its SNI server name,
+// wildcard certificates included, and reloads the certificates from disk
+// when their files change so that renewed certificates are served without
+// a restart. A Manager obtains and renews certificates with the ACME protocol.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pair is a PEM certificate chain and its private key
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Info describes a certificate served by a store
+type Info struct {
+	CertFile  string
+	Names     []string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Store holds the certificates loaded from a list of pairs
+type Store struct {
+	// Name describes the store in logs, e.g. the listener serving it
+	Name string
+
+	mu      sync.Mutex // serializes reloads
+	entries []*entry
+	index   atomic.Pointer[index]
+}
+
+// entry is a loaded pair and the state of its files when it was read
+type entry struct {
+	pair    Pair
+	cert    *tls.Certificate
+	certMod fileState
+	keyMod  fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// index maps the lowercase names of the certificates, "*.example.com" for
+// wildcards, to the certificates serving them in the order of the pairs
+type index struct {
+	names    map[string][]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// NewStore loads the pairs, the first one being served to clients which
+// send no server name or one no certificate matches
+func NewStore(name string, pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("at least one certificate is required")
+	}
+	s := &Store{Name: name}
+	for _, p := range pairs {
+		e := &entry{pair: p}
+		if err := e.load(); err != nil {
+			return nil, err
+		}
+		s.entries = append(s.entries, e)
+	}
+	s.buildIndex()
+	return s, nil
+}
+
+// GetCertificate returns the certificate of a TLS handshake: one for the exact
+// server name, or else a wildcard one, or else the first certificate. Among
+// certificates for the same name, the first one the client supports is used,
+// e.g. an ECDSA certificate for modern clients and an RSA one for the others.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	idx := s.index.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	candidates := idx.names[name]
+	if len(candidates) == 0 {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			candidates = idx.names["*"+name[i:]]
+		}
+	}
+	if len(candidates) == 0 {
+		return idx.fallback, nil
+	}
+	for _, c := range candidates {
+		if hello.SupportsCertificate(c) == nil {
+			return c, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+// Certificate returns the first certificate, e.g. the client certificate
+// presented to a backend
+func (s *Store) Certificate() *tls.Certificate {
+	return s.index.Load().fallback
+}
+
+// Reload reads the pairs whose files changed since they were loaded. A pair
+// which cannot be loaded, e.g. while it is being written, keeps being served
+// from its previous files and is retried on the next reload.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	changed := false
+	for _, e := range s.entries {
+		if !e.changed() {
+			continue
+		}
+		if err := e.load(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changed = true
+		log.Printf("Certificates (%s): reloaded %s, valid until %s", s.Name, e.pair.CertFile, e.cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	if changed {
+		s.buildIndex()
+	}
+	return errors.Join(errs...)
+}
+
+// Watch reloads the certificates every interval until ctx is done
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.Reload(); err != nil {
+				log.Printf("Certificates (%s): keeping the current certificates: %s", s.Name, err)
+			}
+		}
+	}
+}
+
+// Certificates describes the certificates currently served, in the order of the pairs
+func (s *Store) Certificates() []Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]Info, 0, len(s.entries))
+	for _, e := range s.entries {
+		leaf := e.cert.Leaf
+		infos = append(infos, Info{CertFile: e.pair.CertFile, Names: names(e.cert), NotBefore: leaf.NotBefore, NotAfter: leaf.NotAfter})
+	}
+	return infos
+}
+
+// buildIndex publishes the names of the loaded certificates, s.mu being held
+func (s *Store) buildIndex() {
+	idx := &index{names: map[string][]*tls.Certificate{}, fallback: s.entries[0].cert}
+	for _, e := range s.entries {
+		for _, name := range names(e.cert) {
+			name = strings.ToLower(name)
+			idx.names[name] = append(idx.names[name], e.cert)
+		}
+	}
+	s.index.Store(idx)
+}
+
+// load reads the pair and records the state of its files
+func (e *entry) load() error {
+	certMod, err := stat(e.pair.CertFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := stat(e.pair.KeyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(e.pair.CertFile, e.pair.KeyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.pair.CertFile, err)
+	}
+	e.cert, e.certMod, e.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// changed reports whether the files of the pair changed since they were loaded
+func (e *entry) changed() bool {
+	certMod, err := stat(e.pair.CertFile)
+	if err != nil {
+		return false
+	}
+	keyMod, err := stat(e.pair.KeyFile)
+	if err != nil {
+		return false
+	}
+	return certMod != e.certMod || keyMod != e.keyMod
+}
+
+func stat(path string) (fileState, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// names returns the DNS names of a certificate, or its common name when it has none
+func names(cert *tls.Certificate) []string {
+	if len(cert.Leaf.DNSNames) > 0 {
+		return slices.Clone(cert.Leaf.DNSNames)
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "" {
+		return []string{cn}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names, valid until notAfter
+func writePair(t *testing.T, dir, file string, names []string, notAfter time.Time) Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Pair{CertFile: filepath.Join(dir, file+".crt"), KeyFile: filepath.Join(dir, file+".key")}
+	if err := os.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestStore_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	expiry := time.Now().Add(24 * time.Hour)
+	s, err := NewStore("test", []Pair{
+		writePair(t, dir, "default", []string{"default.example.com"}, expiry),
+		writePair(t, dir, "shop", []string{"shop.example.com"}, expiry),
+		writePair(t, dir, "wildcard", []string{"*.example.com"}, expiry),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		expected   string
+	}{
+		{"Exact Name", "shop.example.com", "shop.example.com"},
+		{"Case And Trailing Dot", "SHOP.Example.com.", "shop.example.com"},
+		{"Wildcard", "api.example.com", "*.example.com"},
+		{"Wildcard Covers One Label", "a.b.example.com", "default.example.com"},
+		{"Wildcard Excludes Apex", "example.com", "default.example.com"},
+		{"No Server Name", "", "default.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cert.Leaf.DNSNames[0]; got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	first := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	p := writePair(t, dir, "shop", []string{"shop.example.com"}, first)
+	s, err := NewStore("test", []Pair{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renew the certificate, making sure its modification time changes
+	renewed := first.Add(90 * 24 * time.Hour)
+	writePair(t, dir, "shop", []string{"shop.example.com"}, renewed)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(p.CertFile, later, later)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := s.Certificates()[0].NotAfter; !got.Equal(renewed) {
+		t.Errorf("Expected the renewed certificate valid until %s, got %s", renewed, got)
+	}
+	cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"})
+	if !cert.Leaf.NotAfter.Equal(renewed) {
+		t.Errorf("Expected the renewed certificate served, got one valid until %s", cert.Leaf.NotAfter)
+	}
+
+	// A partially written certificate is ignored
+	os.WriteFile(p.CertFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(p.CertFile, later, later)
+	if err := s.Reload(); err == nil {
+		t.Error("Expected an error for an invalid certificate")
+	}
+	if got := s.Certificates()[0].NotAfter; !got.Equal(renewed) {
+		t.Errorf("Expected the previous certificate kept, got one valid until %s", got)
+	}
+}
+
+func TestNewStore_Errors(t *testing.T) {
+	if _, err := NewStore("test", nil); err == nil {
+		t.Error("Expected an error without certificates")
+	}
+	if _, err := NewStore("test", []Pair{{CertFile: "missing.crt", KeyFile: "missing.key"}}); err == nil {
+		t.Error("Expected an error for missing files")
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/canary"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
+)
+
+// addBackendRequest is the body of POST /admin/pools/{pool}/backends
+type addBackendRequest struct {
+	URL string `json:"url"`
+	// Weight defaults to 1 when omitted
+	Weight *int              `json:"weight"`
+	Labels map[string]string `json:"labels"`
+}
+
+// updateBackendRequest is the body of POST /admin/pools/{pool}/backends/{id}.
+// Omitted fields are left unchanged.
+type updateBackendRequest struct {
+	Weight *int    `json:"weight"`
+	State  *string `json:"state"`
+}
+
+// splitRequest is the body of POST /admin/routes/{route}/split.
+// Pools of the split omitted from Weights keep their weight.
+type splitRequest struct {
+	Weights map[string]int `json:"weights"`
+}
+
+// adminWeight is a backend weight set through the admin API, and the
+// configured weight it replaced, -1 for a backend not in the configuration
+type adminWeight struct {
+	weight, configured int
+}
+
+// The changes made through the admin API, by pool and backend URL, kept
+// across reloads until the configuration changes the same settings. Guarded
+// by reloadMu.
+var (
+	adminWeights  = map[string]map[string]adminWeight{}
+	adminBackends = map[string]map[string]*core.Backend{}
+)
+
+// setAdminChange records a change made through the admin API
+func setAdminChange[T any](changes map[string]map[string]T, pool, u string, v T) {
+	if changes[pool] == nil {
+		changes[pool] = map[string]T{}
+	}
+	changes[pool][u] = v
+}
+
+// configuredWeight returns the weight of a backend in the configuration of its pool, or -1
+func configuredWeight(pc *config.Pool, u string) int {
+	if pc != nil {
+		for _, bc := range pc.Backends {
+			if normalizeURL(bc.URL) == u {
+				return *bc.Weight
+			}
+		}
+	}
+	return -1
+}
+
+// keepAdminWeight sets the weight set through the admin API back on a backend,
+// unless its configured weight changed since, the configuration then winning
+func keepAdminWeight(pool string, b *core.Backend, configured int) {
+	o, ok := adminWeights[pool][b.URL.String()]
+	switch {
+	case !ok:
+	case o.configured != configured:
+		delete(adminWeights[pool], b.URL.String())
+	default:
+		b.SetWeight(o.weight)
+	}
+}
+
+// explainRequest is the body of POST /admin/routes/explain, describing a request to route
+type explainRequest struct {
+	// Method defaults to GET
+	Method string `json:"method"`
+	// URL is a path or an absolute URL, whose host is used unless Host is set
+	URL      string            `json:"url"`
+	Host     string            `json:"host"`
+	Headers  map[string]string `json:"headers"`
+	ClientIP string            `json:"client_ip"`
+}
+
+// explainResponse tells which route and pool would serve a request, and why
+type explainResponse struct {
+	Route string `json:"route,omitempty"`
+	Pool  string `json:"pool,omitempty"`
+	// Status is answered when no pool serves the request, Redirect being its location for a redirect
+	Status   int    `json:"status,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	// Rewrite is the host and path sent to the pool, when the route rewrites them
+	Rewrite string        `json:"rewrite,omitempty"`
+	Steps   []explainStep `json:"steps"`
+}
+
+// explainStep is a route considered, in priority order
+type explainStep struct {
+	Route   string `json:"route"`
+	Hosts   string `json:"hosts"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// newAdminServer creates the listener of the admin API
+func newAdminServer(cfg *config.Admin) (*http.Server, error) {
+	server := &http.Server{
+		Addr:              cfg.Address,
+		Handler:           adminHandler(cfg.Token),
+		ReadHeaderTimeout: 2 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	if cfg.TLS != nil {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.TLS.ClientCAFile != "" {
+			cas, err := loadCertPool(cfg.TLS.ClientCAFile, false)
+			if err != nil {
+				return nil, err
+			}
+			server.TLSConfig.ClientCAs = cas
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return server, nil
+}
+
+// serveAdmin starts the admin listener, over TLS when configured
+func serveAdmin(server *http.Server, cfg *config.Admin) error {
+	if cfg.TLS != nil {
+		return server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// adminHandler routes the admin API, requiring the bearer token when set
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/pools", adminListPools)
+	mux.HandleFunc("GET /admin/pools/{pool}/backends", adminListBackends)
+	mux.HandleFunc("POST /admin/pools/{pool}/backends", adminAddBackend)
+	mux.HandleFunc("GET /admin/pools/{pool}/backends/{id}", adminGetBackend)
+	mux.HandleFunc("POST /admin/pools/{pool}/backends/{id}", adminUpdateBackend)
+	mux.HandleFunc("DELETE /admin/pools/{pool}/backends/{id}", adminRemoveBackend)
+	mux.HandleFunc("POST /admin/reload", adminReload)
+	mux.HandleFunc("GET /admin/routes", adminListRoutes)
+	mux.HandleFunc("POST /admin/routes/{route}/split", adminSetSplit)
+	mux.HandleFunc("POST /admin/routes/explain", adminExplainRoute)
+	mux.HandleFunc("GET /admin/rollouts", adminListRollouts)
+	mux.HandleFunc("GET /admin/rollouts/{route}", adminGetRollout)
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminListPools(w http.ResponseWriter, r *http.Request) {
+	pools := currentTable().pools
+	stats := make([]PoolStats, 0, len(pools))
+	for _, p := range pools {
+		stats = append(stats, poolStats(p))
+	}
+	writeJSON(w, stats)
+}
+
+func adminListBackends(w http.ResponseWriter, r *http.Request) {
+	pool := adminPool(w, r)
+	if pool == nil {
+		return
+	}
+	writeJSON(w, poolStats(pool).Backends)
+}
+
+func adminGetBackend(w http.ResponseWriter, r *http.Request) {
+	_, b := adminBackend(w, r)
+	if b == nil {
+		return
+	}
+	writeJSON(w, b.GetStats())
+}
+
+func adminAddBackend(w http.ResponseWriter, r *http.Request) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	pool := adminPool(w, r)
+	if pool == nil {
+		return
+	}
+
+	var req addBackendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if err := config.ValidateBackendURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	weight := 1
+	if req.Weight != nil {
+		weight = *req.Weight
+	}
+	if weight < 1 {
+		writeError(w, http.StatusBadRequest, "weight must be at least 1")
+		return
+	}
+
+	bc := &config.Backend{URL: req.URL, Weight: &weight, Labels: req.Labels}
+	hc := config.HealthCheck{Timeout: config.DefaultHealthCheckTimeout}
+	var bt config.BackendTransport
+	if pc := activePoolConfig(pool.Name); pc != nil {
+		hc = pc.BackendHealthCheck(bc)
+		bt = pc.BackendTransport(bc)
+	}
+	b, err := newBackend(bc, hc, bt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pool.FindBackend(b.ID()) != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("backend %s already exists in pool %s", b.ID(), pool.Name))
+		return
+	}
+
+	pool.AddBackend(b)
+	setAdminChange(adminBackends, pool.Name, b.URL.String(), b)
+	log.Printf("Admin: added server %s to pool %s", b.URL, pool.Name)
+	writeJSONStatus(w, http.StatusCreated, b.GetStats())
+}
+
+func adminUpdateBackend(w http.ResponseWriter, r *http.Request) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	pool, b := adminBackend(w, r)
+	if b == nil {
+		return
+	}
+
+	var req updateBackendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	var state core.AdminState
+	if req.State != nil {
+		s, err := core.ParseAdminState(*req.State)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		state = s
+	}
+	if req.Weight != nil && *req.Weight < 1 {
+		writeError(w, http.StatusBadRequest, "weight must be at least 1")
+		return
+	}
+
+	if req.Weight != nil {
+		o, ok := adminWeights[pool.Name][b.URL.String()]
+		if !ok {
+			o.configured = configuredWeight(activePoolConfig(pool.Name), b.URL.String())
+		}
+		o.weight = *req.Weight
+		setAdminChange(adminWeights, pool.Name, b.URL.String(), o)
+		b.SetWeight(*req.Weight)
+		log.Printf("Admin: set weight of %s in pool %s to %d", b.URL, pool.Name, *req.Weight)
+	}
+	if state != "" {
+		b.SetAdminState(state)
+		log.Printf("Admin: set state of %s in pool %s to %s", b.URL, pool.Name, state)
+	}
+	writeJSON(w, b.GetStats())
+}
+
+func adminRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	pool, b := adminBackend(w, r)
+	if b == nil {
+		return
+	}
+
+	pool.RemoveBackend(b)
+	b.SetStatus(core.StatusDraining)
+	go drainBackend(b)
+	delete(adminWeights[pool.Name], b.URL.String())
+	delete(adminBackends[pool.Name], b.URL.String())
+	log.Printf("Admin: removed server %s from pool %s", b.URL, pool.Name)
+	writeJSON(w, b.GetStats())
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if configPath == "" {
+		writeError(w, http.StatusConflict, "the load balancer was not started with a configuration file")
+		return
+	}
+	if err := reload(configPath); err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %s", err)
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
+
+func adminListRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := currentTable().routes.Routes()
+	stats := make([]RouteStats, 0, len(routes))
+	for _, route := range routes {
+		stats = append(stats, routeStats(route))
+	}
+	writeJSON(w, stats)
+}
+
+// adminSetSplit changes the weights of the pools of a split route
+func adminSetSplit(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("route")
+	t := currentTable()
+	route := t.routes.Route(name)
+	if route == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("route %s not found", name))
+		return
+	}
+	if route.Split == nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("route %s does not split its traffic", name))
+		return
+	}
+	if rollout := t.rollout(name); rollout != nil && rollout.Active() {
+		writeError(w, http.StatusConflict, fmt.Sprintf("route %s is being rolled out automatically", name))
+		return
+	}
+
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	weights := route.Split.Weights()
+	for pool, weight := range req.Weights {
+		i := slices.IndexFunc(route.Split.Targets, func(t *router.SplitTarget) bool { return t.Pool.Name == pool })
+		if i < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("pool %s is not part of the split of route %s", pool, name))
+			return
+		}
+		weights[i] = weight
+	}
+	if err := route.Split.SetWeights(weights); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("Admin: route %s split weights set to %v", name, weights)
+	writeJSON(w, routeStats(route))
+}
+
+func adminListRollouts(w http.ResponseWriter, r *http.Request) {
+	rollouts := currentTable().rollouts
+	status := make([]canary.Status, 0, len(rollouts))
+	for _, rollout := range rollouts {
+		status = append(status, rollout.Status())
+	}
+	writeJSON(w, status)
+}
+
+func adminGetRollout(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("route")
+	rollout := currentTable().rollout(name)
+	if rollout == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no rollout for route %s", name))
+		return
+	}
+	writeJSON(w, rollout.Status())
+}
+
+// adminExplainRoute routes a described request without sending it
+func adminExplainRoute(w http.ResponseWriter, r *http.Request) {
+	var req explainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.URL == "" {
+		req.URL = "/"
+	}
+	probe, err := http.NewRequest(strings.ToUpper(req.Method), req.URL, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Host != "" {
+		probe.Host = req.Host
+	}
+	for name, value := range req.Headers {
+		probe.Header.Set(name, value)
+	}
+	if req.ClientIP != "" {
+		addr, err := netip.ParseAddr(req.ClientIP)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid client_ip %q", req.ClientIP))
+			return
+		}
+		probe.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+	}
+
+	t := currentTable()
+	route, steps := t.routes.Explain(probe)
+	resp := explainResponse{Steps: make([]explainStep, 0, len(steps))}
+	for _, s := range steps {
+		resp.Steps = append(resp.Steps, explainStep{Route: s.Route.Name, Hosts: s.Group, Matched: s.Reason == "", Reason: s.Reason})
+	}
+	var pool *core.ServerPool
+	switch {
+	case route == nil:
+		pool, resp.Status = t.unrouted(probe)
+	case route.Redirect != nil:
+		resp.Route = route.Name
+		if location, ok := route.Redirect.Location(probe, route.Rewrite); ok {
+			resp.Status, resp.Redirect = route.Redirect.Status, location
+			break
+		}
+		if pool, _ = route.Target(probe); pool == nil {
+			resp.Status = http.StatusNotFound
+		}
+	default:
+		// A split route reports the pool picked for this request
+		resp.Route = route.Name
+		pool, _ = route.Target(probe)
+	}
+	if pool != nil {
+		resp.Pool = pool.Name
+		if route != nil && route.Rewrite != nil {
+			route.Rewrite.Apply(probe)
+			resp.Rewrite = probe.Host + probe.URL.Path
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// adminPool returns the pool named in the request path, or writes a 404
+func adminPool(w http.ResponseWriter, r *http.Request) *core.ServerPool {
+	name := r.PathValue("pool")
+	for _, p := range currentTable().pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("pool %s not found", name))
+	return nil
+}
+
+// adminBackend returns the pool and backend named in the request path, or writes a 404
+func adminBackend(w http.ResponseWriter, r *http.Request) (*core.ServerPool, *core.Backend) {
+	pool := adminPool(w, r)
+	if pool == nil {
+		return nil, nil
+	}
+	id := r.PathValue("id")
+	b := pool.FindBackend(id)
+	if b == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backend %s not found in pool %s", id, pool.Name))
+		return nil, nil
+	}
+	return pool, b
+}
+
+// activePoolConfig returns the configuration of a pool, or nil
+func activePoolConfig(name string) *config.Pool {
+	if activeConfig == nil {
+		return nil
+	}
+	for i := range activeConfig.Pools {
+		if activeConfig.Pools[i].Name == name {
+			return &activeConfig.Pools[i]
+		}
+	}
+	return nil
+}
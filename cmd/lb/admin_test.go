@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/canary"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	resetPool()
+	h := adminHandler("secret")
+
+	tests := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{"No Token", "", http.StatusUnauthorized},
+		{"Wrong Token", "Bearer nope", http.StatusUnauthorized},
+		{"Valid Token", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/pools", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdmin_Backends(t *testing.T) {
+	pool := resetPool()
+	// Forget the backends added and the weights set by this test
+	defer func() {
+		adminWeights, adminBackends = map[string]map[string]adminWeight{}, map[string]map[string]*core.Backend{}
+	}()
+	pool.Name = "web"
+	u, _ := url.Parse("http://localhost:8081")
+	b1 := &core.Backend{URL: u}
+	b1.SetAlive(true)
+	pool.AddBackend(b1)
+
+	h := adminHandler("secret")
+
+	t.Run("List", func(t *testing.T) {
+		w := adminRequest(t, h, "GET", "/admin/pools/web/backends", "")
+		var stats []core.BackendStats
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("Invalid JSON: %v", err)
+		}
+		if len(stats) != 1 || stats[0].ID != "http://localhost:8081" {
+			t.Errorf("Unexpected backends: %+v", stats)
+		}
+	})
+
+	t.Run("Unknown Pool", func(t *testing.T) {
+		w := adminRequest(t, h, "GET", "/admin/pools/api/backends", "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		w := adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "http://localhost:8082", "weight": 2}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+		}
+		b := pool.FindBackend("localhost:8082")
+		if b == nil || b.GetWeight() != 2 {
+			t.Fatalf("Expected backend to be added with weight 2")
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "http://localhost:8082"}`)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 for duplicate backend, got %d", w.Code)
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "localhost:8083"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for invalid URL, got %d", w.Code)
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "http://localhost:8083", "weight": 0}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for weight 0, got %d", w.Code)
+		}
+
+		// Backends on the same host and port differ by their path
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "http://localhost:8082/api"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 for another path, got %d: %s", w.Code, w.Body)
+		}
+		if w := adminRequest(t, h, "GET", "/admin/pools/web/backends/"+url.PathEscape("http://localhost:8082/api"), ""); w.Code != http.StatusOK {
+			t.Errorf("Expected the backend found by its URL, got %d", w.Code)
+		}
+		if w := adminRequest(t, h, "GET", "/admin/pools/web/backends/localhost:8082", ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a host shared by two backends, got %d", w.Code)
+		}
+		adminRequest(t, h, "DELETE", "/admin/pools/web/backends/"+url.PathEscape("http://localhost:8082/api"), "")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		w := adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:8081", `{"weight": 5, "state": "disabled"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+		}
+		if b1.GetWeight() != 5 || b1.GetAdminState() != core.AdminDisabled {
+			t.Errorf("Expected weight 5 and disabled, got %d and %s", b1.GetWeight(), b1.GetAdminState())
+		}
+		if b1.IsAvailable() {
+			t.Error("Disabled backend should not receive new requests")
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:8081", `{"weight": 0}`)
+		if w.Code != http.StatusBadRequest || b1.GetWeight() != 5 {
+			t.Errorf("Expected 400 for weight 0 and weight 5 kept, got %d and %d", w.Code, b1.GetWeight())
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:8081", `{"state": "asleep"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for invalid state, got %d", w.Code)
+		}
+
+		w = adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:9999", `{"state": "enabled"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for unknown backend, got %d", w.Code)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		w := adminRequest(t, h, "DELETE", "/admin/pools/web/backends/localhost:8081", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if pool.FindBackend("localhost:8081") != nil {
+			t.Error("Expected backend to be removed")
+		}
+		if b1.GetStatus() != core.StatusDraining {
+			t.Errorf("Expected removed backend to be draining, got %s", b1.GetStatus())
+		}
+	})
+}
+
+// writeTestCA writes a self-signed CA certificate and key to dir
+func writeTestCA(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return certFile, keyFile
+}
+
+func TestNewAdminServer_MutualTLS(t *testing.T) {
+	certFile, keyFile := writeTestCA(t, t.TempDir())
+
+	srv, err := newAdminServer(&config.Admin{
+		Address: "127.0.0.1:0",
+		TLS:     &config.AdminTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile},
+	})
+	if err != nil {
+		t.Fatalf("newAdminServer failed: %v", err)
+	}
+	if srv.TLSConfig == nil || srv.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("Expected client certificates to be required")
+	}
+
+	_, err = newAdminServer(&config.Admin{
+		Address: "127.0.0.1:0",
+		TLS:     &config.AdminTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+	})
+	if err == nil {
+		t.Error("Expected error for a CA file without certificate")
+	}
+}
+
+func TestAdmin_Reload(t *testing.T) {
+	old := configPath
+	defer func() { configPath = old }()
+
+	h := adminHandler("secret")
+
+	configPath = ""
+	if w := adminRequest(t, h, "POST", "/admin/reload", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without configuration file, got %d", w.Code)
+	}
+
+	configPath = filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig(t, configPath, "pools:\n  - name: web\n    backends:\n      - url: http://localhost:8081\n")
+	if w := adminRequest(t, h, "POST", "/admin/reload", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	writeConfig(t, configPath, "pools: []\n")
+	if w := adminRequest(t, h, "POST", "/admin/reload", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for invalid configuration, got %d", w.Code)
+	}
+}
+
+func TestAdmin_ExplainRoute(t *testing.T) {
+	cfg, err := config.Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+  - name: canary
+    backends:
+      - url: http://localhost:8082
+routes:
+  - name: canary
+    hosts: [shop.example.com]
+    headers:
+      - name: X-Canary
+        value: "1"
+    client_cidrs: [10.0.0.0/8]
+    path_prefix: /
+    pool: canary
+  - hosts: [shop.example.com]
+    path_prefix: /
+    pool: web
+    rewrite:
+      add_prefix: /shop
+  - name: old
+    hosts: [old.example.com]
+    redirect:
+      host: shop.example.com
+      status: 301
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	rt, err := buildTable(cfg, nil)
+	if err != nil {
+		t.Fatalf("buildTable failed: %v", err)
+	}
+	table.Store(rt)
+	defer resetPool()
+	h := adminHandler("secret")
+
+	tests := []struct {
+		name     string
+		body     string
+		expected explainResponse
+		steps    int
+	}{
+		{
+			name:     "Conditions Met",
+			body:     `{"url": "http://shop.example.com/cart", "headers": {"X-Canary": "1"}, "client_ip": "10.0.0.7"}`,
+			expected: explainResponse{Route: "canary", Pool: "canary"},
+			steps:    1,
+		},
+		{
+			name:     "Client Outside Network",
+			body:     `{"method": "post", "url": "/cart", "host": "shop.example.com", "headers": {"X-Canary": "1"}, "client_ip": "192.0.2.1"}`,
+			expected: explainResponse{Route: "routes[1]", Pool: "web"},
+			steps:    2,
+		},
+		{
+			name:     "Unknown Host",
+			body:     `{"url": "http://other.example.com/"}`,
+			expected: explainResponse{Status: http.StatusNotFound},
+		},
+		{
+			name: "Reason",
+			body: `{"url": "http://shop.example.com/", "client_ip": "10.0.0.7"}`,
+			expected: explainResponse{Route: "routes[1]", Pool: "web", Steps: []explainStep{
+				{Route: "canary", Hosts: "shop.example.com", Reason: "header X-Canary is missing"},
+			}},
+			steps: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequest(t, h, "POST", "/admin/routes/explain", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+			}
+			var got explainResponse
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if got.Route != tt.expected.Route || got.Pool != tt.expected.Pool || got.Status != tt.expected.Status {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+			if len(got.Steps) != tt.steps || (tt.steps > 0 && got.Steps[0].Route != "canary") {
+				t.Errorf("Expected %d steps starting with the canary route, got %+v", tt.steps, got.Steps)
+			}
+			if len(tt.expected.Steps) > 0 && got.Steps[0] != tt.expected.Steps[0] {
+				t.Errorf("Expected step %+v, got %+v", tt.expected.Steps[0], got.Steps[0])
+			}
+		})
+	}
+
+	var got explainResponse
+	w := adminRequest(t, h, "POST", "/admin/routes/explain", `{"url": "http://shop.example.com/cart"}`)
+	if json.Unmarshal(w.Body.Bytes(), &got); got.Rewrite != "shop.example.com/shop/cart" {
+		t.Errorf("Expected the rewritten path, got %+v", got)
+	}
+	w = adminRequest(t, h, "POST", "/admin/routes/explain", `{"url": "http://old.example.com/cart"}`)
+	if json.Unmarshal(w.Body.Bytes(), &got); got.Route != "old" || got.Status != 301 || got.Redirect != "http://shop.example.com/cart" {
+		t.Errorf("Expected a redirect to the shop, got %+v", got)
+	}
+
+	if w := adminRequest(t, h, "POST", "/admin/routes/explain", `{"client_ip": "nope"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid client IP, got %d", w.Code)
+	}
+}
+
+func TestAdmin_Split(t *testing.T) {
+	backend := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	}
+	stable, canary := backend(http.StatusOK, "stable"), backend(http.StatusInternalServerError, "canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	cfg, err := config.Parse([]byte(`pools:
+  - name: stable
+    backends:
+      - url: ` + stable.URL + `
+  - name: canary
+    backends:
+      - url: ` + canary.URL + `
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 50
+      - pool: canary
+        weight: 50
+    sticky:
+      header: X-User
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	defer resetPool()
+	h := adminHandler("secret")
+
+	send := func(user string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		lbHandler(w, r)
+		return w.Body.String()
+	}
+	for i := range 100 {
+		user := fmt.Sprintf("user-%d", i)
+		if first := send(user); send(user) != first {
+			t.Fatalf("Expected %s to stay on the %s pool", user, first)
+		}
+	}
+
+	var routes []RouteStats
+	json.Unmarshal(adminRequest(t, h, "GET", "/admin/routes", "").Body.Bytes(), &routes)
+	if len(routes) != 1 || len(routes[0].Split) != 2 || routes[0].Sticky != "header X-User" {
+		t.Fatalf("Expected the split route, got %+v", routes)
+	}
+	s, c := routes[0].Split[0], routes[0].Split[1]
+	if s.Requests+c.Requests != 200 || s.Errors != 0 || c.Errors != c.Requests || c.Requests == 0 {
+		t.Errorf("Expected 200 requests with every canary request failing, got %+v", routes[0].Split)
+	}
+
+	w := adminRequest(t, h, "POST", "/admin/routes/web/split", `{"weights": {"canary": 0}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	for i := range 20 {
+		if got := send(fmt.Sprintf("user-%d", i)); got != "stable" {
+			t.Fatalf("Expected every user on the stable pool, got %s", got)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"Unknown Route", "/admin/routes/api/split", `{"weights": {"stable": 1}}`, http.StatusNotFound},
+		{"Unknown Pool", "/admin/routes/web/split", `{"weights": {"beta": 1}}`, http.StatusBadRequest},
+		{"No Positive Weight", "/admin/routes/web/split", `{"weights": {"stable": 0}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := adminRequest(t, h, "POST", tt.path, tt.body); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdmin_Rollouts(t *testing.T) {
+	oldTick := canaryTick
+	canaryTick = 10 * time.Millisecond
+	defer func() { canaryTick = oldTick }()
+
+	backend := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+	}
+	stable, failing := backend(http.StatusOK), backend(http.StatusInternalServerError)
+	defer stable.Close()
+	defer failing.Close()
+
+	cfg, err := config.Parse([]byte(`pools:
+  - name: stable
+    backends:
+      - url: ` + stable.URL + `
+  - name: canary
+    backends:
+      - url: ` + failing.URL + `
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 100
+      - pool: canary
+        weight: 0
+    canary:
+      steps: [50, 100]
+      interval: 1h
+      window: 1m
+      min_requests: 5
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	defer resetPool()
+	h := adminHandler("secret")
+
+	status := func() canary.Status {
+		var s canary.Status
+		json.Unmarshal(adminRequest(t, h, "GET", "/admin/rollouts/web", "").Body.Bytes(), &s)
+		return s
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for status().State != canary.Progressing && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := status(); s.State != canary.Progressing || s.Weight != 50 {
+		t.Fatalf("Expected the rollout to start at 50%%, got %+v", s)
+	}
+	if w := adminRequest(t, h, "POST", "/admin/routes/web/split", `{"weights": {"canary": 100}}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected manual weights to be refused during the rollout, got %d", w.Code)
+	}
+
+	// The failing canary is rolled back
+	for status().State == canary.Progressing && time.Now().Before(deadline) {
+		lbHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		time.Sleep(time.Millisecond)
+	}
+	s := status()
+	if s.State != canary.RolledBack || s.Weight != 0 {
+		t.Fatalf("Expected the canary to be rolled back, got %+v", s)
+	}
+	last := s.Decisions[len(s.Decisions)-1]
+	if last.Action != canary.ActionRollback || !strings.HasPrefix(last.Reason, "canary error rate 100.00% exceeds stable 0.00%") {
+		t.Errorf("Expected a rollback on the error rate, got %+v", last)
+	}
+
+	var all []canary.Status
+	json.Unmarshal(adminRequest(t, h, "GET", "/admin/rollouts", "").Body.Bytes(), &all)
+	if len(all) != 1 || all[0].Route != "web" {
+		t.Errorf("Expected the rollout of web, got %+v", all)
+	}
+	if w := adminRequest(t, h, "GET", "/admin/rollouts/api", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a route without rollout, got %d", w.Code)
+	}
+	if w := adminRequest(t, h, "POST", "/admin/routes/web/split", `{"weights": {"canary": 10}}`); w.Code != http.StatusOK {
+		t.Errorf("Expected manual weights to be accepted after the rollback, got %d: %s", w.Code, w.Body)
+	}
+}
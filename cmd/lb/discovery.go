@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/discovery"
+)
+
+// newProvider creates the discovery provider described by the configuration
+func newProvider(d *config.Discovery) discovery.Provider {
+	switch {
+	case d.File != nil:
+		return &discovery.File{Path: d.File.Path, Interval: d.File.Interval, Debounce: d.File.Debounce}
+	case d.DNS != nil:
+		return &discovery.DNS{
+			Domain:      d.DNS.Name,
+			SRV:         d.DNS.Type == config.DNSTypeSRV,
+			Port:        d.DNS.Port,
+			Scheme:      d.DNS.Scheme,
+			Server:      d.DNS.Server,
+			MinInterval: d.DNS.MinInterval,
+			MaxInterval: d.DNS.MaxInterval,
+		}
+	case d.Consul != nil:
+		return &discovery.Consul{
+			Address:    d.Consul.Address,
+			Service:    d.Consul.Service,
+			Tag:        d.Consul.Tag,
+			Datacenter: d.Consul.Datacenter,
+			Token:      d.Consul.Token,
+			Scheme:     d.Consul.Scheme,
+			Wait:       d.Consul.Wait,
+		}
+	case d.Docker != nil:
+		return &discovery.Docker{Socket: d.Docker.Socket, Pool: d.Docker.Pool, Network: d.Docker.Network, Scheme: d.Docker.Scheme}
+	}
+	return nil
+}
+
+// runDiscovery keeps the backends of a pool in sync with its discovery provider until ctx is done
+func runDiscovery(ctx context.Context, pool *core.ServerPool, pc *config.Pool) {
+	provider := newProvider(pc.Discovery)
+	if provider == nil {
+		return
+	}
+
+	updates := make(chan []discovery.Target)
+	go provider.Run(ctx, updates)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-updates:
+			reconcile(ctx, pool, pc, targets)
+			log.Printf("Discovery (%s): pool %s has %d backends", provider.Name(), pool.Name, len(pool.GetBackends()))
+		}
+	}
+}
+
+// reconcile applies the targets found by discovery to a pool: new targets are added,
+// known ones are updated, or replaced when their transport settings changed, and
+// discovered backends which disappeared are drained.
+// Static backends of the configuration and those added through the admin API
+// are left untouched.
+func reconcile(ctx context.Context, pool *core.ServerPool, pc *config.Pool, targets []discovery.Target) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	// The routing table may have been replaced since the update was sent
+	if ctx.Err() != nil {
+		return
+	}
+
+	static := make(map[string]bool, len(pc.Backends))
+	for _, b := range pc.Backends {
+		static[normalizeURL(b.URL)] = true
+	}
+
+	wanted := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		u := normalizeURL(t.URL)
+		wanted[u] = true
+		if static[u] {
+			continue
+		}
+
+		weight := max(t.Weight, 1)
+		bc := &config.Backend{URL: t.URL, Weight: &weight, Tier: t.Tier, Labels: t.Labels}
+		hc, bt := pc.BackendHealthCheck(bc), pc.BackendTransport(bc)
+		if b := findBackendByURL(pool, u); b != nil {
+			if sameTransport(b, bt) {
+				updateBackend(b, bc, hc, bt)
+				keepAdminWeight(pool.Name, b, -1)
+				continue
+			}
+			// A backend whose TLS settings or protocol changed is replaced, the old one being drained
+			pool.RemoveBackend(b)
+			b.SetStatus(core.StatusDraining)
+			go drainBackend(b)
+		}
+
+		b, err := newBackend(bc, hc, bt)
+		if err != nil {
+			log.Printf("Discovery: invalid target %s: %s", t.URL, err)
+			continue
+		}
+		pool.AddBackend(b)
+		log.Printf("Discovered server: %s (pool %s, weight %d)", b.URL, pool.Name, b.GetWeight())
+	}
+
+	for _, b := range pool.GetBackends() {
+		u := b.URL.String()
+		if static[u] || wanted[u] || adminBackends[pool.Name][u] != nil {
+			continue
+		}
+		pool.RemoveBackend(b)
+		b.SetStatus(core.StatusDraining)
+		go drainBackend(b)
+	}
+}
+
+// findBackendByURL returns the backend of the pool with the given URL, or nil
+func findBackendByURL(pool *core.ServerPool, u string) *core.Backend {
+	for _, b := range pool.GetBackends() {
+		if b.URL.String() == u {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/discovery"
+)
+
+func TestReconcile(t *testing.T) {
+	weight := 1
+	pc := &config.Pool{
+		Name:        "web",
+		HealthCheck: config.HealthCheck{Path: "/health"},
+		Backends:    []config.Backend{{URL: "http://localhost:8081", Weight: &weight}},
+	}
+	pool := &core.ServerPool{Name: "web"}
+	static, _ := newBackend(&pc.Backends[0], pc.HealthCheck, config.BackendTransport{})
+	pool.AddBackend(static)
+	ctx := context.Background()
+
+	reconcile(ctx, pool, pc, []discovery.Target{
+		{URL: "http://localhost:8082", Weight: 2},
+		{URL: "http://localhost:8083", Tier: 1, Labels: map[string]string{"zone": "a"}},
+	})
+	if got := len(pool.GetBackends()); got != 3 {
+		t.Fatalf("Expected 3 backends, got %d", got)
+	}
+	b2 := findBackendByURL(pool, "http://localhost:8082")
+	if b2 == nil || b2.GetWeight() != 2 || b2.HealthCheckURL().Path != "/health" {
+		t.Fatalf("Expected discovered backend with weight 2 and the pool health check")
+	}
+
+	// Discovered backends are updated in place, or drained when they disappear
+	b3 := findBackendByURL(pool, "http://localhost:8083")
+	if b3.GetTier() != 1 || b3.GetLabels()["zone"] != "a" {
+		t.Errorf("Expected discovered backend with tier 1 and its labels")
+	}
+	b3.IncConn()
+	reconcile(ctx, pool, pc, []discovery.Target{{URL: "http://localhost:8082", Weight: 5}})
+
+	if findBackendByURL(pool, "http://localhost:8082") != b2 || b2.GetWeight() != 5 {
+		t.Error("Expected the known backend to be re-weighted in place")
+	}
+	if findBackendByURL(pool, "http://localhost:8083") != nil {
+		t.Error("Expected the vanished backend to be removed")
+	}
+	if b3.GetStatus() != core.StatusDraining {
+		t.Errorf("Expected the vanished backend to be draining, got %s", b3.GetStatus())
+	}
+	b3.DecConn()
+
+	// Changed TLS settings replace the backend, the old one being drained
+	insecure := *pc
+	insecure.BackendTLS = &config.BackendTLS{InsecureSkipVerify: true}
+	reconcile(ctx, pool, &insecure, []discovery.Target{{URL: "http://localhost:8082", Weight: 5}})
+	replaced := findBackendByURL(pool, "http://localhost:8082")
+	if replaced == nil || replaced == b2 || replaced.Transport == nil {
+		t.Error("Expected the backend to be replaced with one using the new TLS settings")
+	}
+	if b2.GetStatus() != core.StatusDraining {
+		t.Errorf("Expected the replaced backend to be draining, got %s", b2.GetStatus())
+	}
+
+	// Static backends are never removed by discovery
+	reconcile(ctx, pool, pc, nil)
+	if backends := pool.GetBackends(); len(backends) != 1 || backends[0] != static {
+		t.Errorf("Expected only the static backend to remain, got %d backends", len(backends))
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	targets := filepath.Join(dir, "targets.yaml")
+	os.WriteFile(targets, []byte("- url: http://localhost:8082\n"), 0o644)
+
+	path := filepath.Join(dir, "lb.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: web
+    discovery:
+      file:
+        path: `+targets+`
+        interval: 10ms
+        debounce: 10ms
+`)
+	setupFromFile(t, path)
+
+	waitBackends := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(currentTable().pools[0].GetBackends()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d backends, got %d", n, len(currentTable().pools[0].GetBackends()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitBackends(1)
+
+	os.WriteFile(targets, []byte("- url: http://localhost:8082\n- url: http://localhost:8083\n"), 0o644)
+	waitBackends(2)
+
+	// Discovered backends survive a configuration reload
+	before := findBackendByURL(currentTable().pools[0], "http://localhost:8083")
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if findBackendByURL(currentTable().pools[0], "http://localhost:8083") != before {
+		t.Error("Expected discovered backend to be kept across reload")
+	}
+	if before.GetStatus() == core.StatusDraining {
+		t.Error("Expected discovered backend not to be drained by the reload")
+	}
+
+	// A change of the pool TLS settings replaces them, as static backends
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backend_tls:
+      insecure_skip_verify: true
+    discovery:
+      file:
+        path: `+targets+`
+        interval: 10ms
+        debounce: 10ms
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	after := findBackendByURL(currentTable().pools[0], "http://localhost:8083")
+	if after == nil || after == before || after.Transport == nil {
+		t.Error("Expected discovered backend to be replaced with one using the new TLS settings")
+	}
+	if before.GetStatus() != core.StatusDraining {
+		t.Errorf("Expected the replaced backend to be draining, got %s", before.GetStatus())
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
+)
+
+// grpcCodeNames names the gRPC status codes in the logs and stats
+var grpcCodeNames = func() []string {
+	names := make([]string, len(config.GRPCCodes))
+	for name, code := range config.GRPCCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+// grpcPolicy balances the gRPC calls of a pool: each call is forwarded to
+// the backend picked by the pool strategy, and retried on another backend
+// while it fails with a retryable status before any response is sent
+type grpcPolicy struct {
+	retryOn          map[int]bool
+	maxRetries       int
+	maxRetryBodySize int64
+	timeout          time.Duration
+
+	calls   atomic.Uint64
+	retries atomic.Uint64
+	// codes counts the calls by final status code, unknown codes as GRPCUnknown
+	codes [router.GRPCUnauthenticated + 1]atomic.Uint64
+}
+
+func newGRPCPolicy(c *config.GRPC) *grpcPolicy {
+	g := &grpcPolicy{retryOn: map[int]bool{}, maxRetries: c.MaxRetries, maxRetryBodySize: c.MaxRetryBodySize, timeout: c.Timeout}
+	for _, name := range c.RetryOn {
+		g.retryOn[config.GRPCCodes[name]] = true
+	}
+	return g
+}
+
+// stats returns the outcome of the calls of the pool
+func (g *grpcPolicy) stats() *GRPCStats {
+	s := &GRPCStats{Calls: g.calls.Load(), Retries: g.retries.Load()}
+	for code := range g.codes {
+		if n := g.codes[code].Load(); n > 0 {
+			if s.Codes == nil {
+				s.Codes = map[string]uint64{}
+			}
+			s.Codes[grpcCodeNames[code]] = n
+		}
+	}
+	return s
+}
+
+// serve forwards a gRPC call to the backends of pool and returns its status
+// code. The deadline of the call, from its grpc-timeout or the pool timeout,
+// bounds all the attempts; each attempt is sent the time remaining.
+func (g *grpcPolicy) serve(w http.ResponseWriter, r *http.Request, pool *core.ServerPool, forward func(http.ResponseWriter, *http.Request, *core.Backend)) int {
+	g.calls.Add(1)
+	code := g.call(w, r, pool, forward)
+	if code < 0 || code >= len(g.codes) {
+		code = router.GRPCUnknown
+	}
+	g.codes[code].Add(1)
+	return code
+}
+
+func (g *grpcPolicy) call(w http.ResponseWriter, r *http.Request, pool *core.ServerPool, forward func(http.ResponseWriter, *http.Request, *core.Backend)) int {
+	timeout := g.timeout
+	if v := r.Header.Get(router.HeaderGRPCTimeout); v != "" {
+		d, err := router.ParseGRPCTimeout(v)
+		if err != nil {
+			router.WriteGRPCError(w, router.GRPCInvalidArgument, err.Error())
+			return router.GRPCInvalidArgument
+		}
+		timeout = d
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	body := &grpcBody{src: r.Body, limit: g.maxRetryBodySize}
+	tried := map[*core.Backend]bool{}
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			code := router.GRPCCanceled
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = router.GRPCDeadlineExceeded
+			}
+			router.WriteGRPCError(w, code, err.Error())
+			return code
+		}
+		peer := pool.GetPeerExcept(tried)
+		if peer == nil && len(tried) > 0 {
+			// Every backend was tried, the failure may have been transient
+			peer = pool.GetPeer()
+		}
+		if peer == nil {
+			router.WriteGRPCError(w, router.GRPCUnavailable, "no backend available")
+			return router.GRPCUnavailable
+		}
+		tried[peer] = true
+
+		req := r.Clone(ctx)
+		req.Body = body.reader()
+		if deadline, ok := ctx.Deadline(); ok {
+			req.Header.Set(router.HeaderGRPCTimeout, router.FormatGRPCTimeout(time.Until(deadline)))
+		}
+		// The response of an attempt which may be retried is held until its
+		// first message, a failure being answered by its headers alone
+		last := attempt >= g.maxRetries || len(g.retryOn) == 0
+		a := &grpcAttempt{w: w, header: http.Header{}, committed: last}
+		forward(a, req, peer)
+		code := a.code()
+		if a.committed {
+			return code
+		}
+		if !g.retryOn[code] || !body.replay() {
+			a.commit()
+			return code
+		}
+		g.retries.Add(1)
+		log.Printf("gRPC (%s): retrying %s after %s from %s", pool.Name, r.URL.Path, grpcCodeNames[code], peer.URL)
+	}
+}
+
+// grpcAttempt is the response writer of an attempt of a gRPC call. Until it
+// is committed, by the first message or flush, the response is held so that
+// the attempt can be retried.
+type grpcAttempt struct {
+	w         http.ResponseWriter
+	header    http.Header
+	status    int
+	committed bool
+}
+
+func (a *grpcAttempt) Header() http.Header {
+	if a.committed {
+		return a.w.Header()
+	}
+	return a.header
+}
+
+func (a *grpcAttempt) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		a.status = status
+	}
+	if a.committed {
+		a.w.WriteHeader(status)
+	}
+	// Informational responses of a held attempt are dropped
+}
+
+func (a *grpcAttempt) Write(b []byte) (int, error) {
+	a.commit()
+	return a.w.Write(b)
+}
+
+// Flush commits the response, e.g. when the reverse proxy flushes the headers of a stream
+func (a *grpcAttempt) Flush() {
+	a.commit()
+	http.NewResponseController(a.w).Flush()
+}
+
+// commit sends the held response
+func (a *grpcAttempt) commit() {
+	if a.committed {
+		return
+	}
+	a.committed = true
+	h := a.w.Header()
+	for k, v := range a.header {
+		h[k] = v
+	}
+	a.w.WriteHeader(max(a.status, http.StatusOK))
+}
+
+// code returns the status code of the attempt, from its grpc-status or else its HTTP status
+func (a *grpcAttempt) code() int {
+	if code, ok := router.GRPCStatus(a.Header()); ok {
+		return code
+	}
+	return router.GRPCCodeFromHTTP(max(a.status, http.StatusOK))
+}
+
+var errAttemptRetried = errors.New("the call is retried on another backend")
+
+// grpcBody is the request body of a gRPC call, recorded as the attempts read
+// it, up to limit, so that a retry can replay it before reading the rest
+type grpcBody struct {
+	src   io.ReadCloser
+	limit int64
+
+	// readMu serializes the reads of src, which a previous attempt may still be doing
+	readMu sync.Mutex
+	mu     sync.Mutex
+	buf    []byte
+	// read counts the bytes read from src, more than buf holds once beyond limit
+	read    int64
+	err     error
+	current *grpcBodyReader
+}
+
+// reader returns the body of a new attempt, the previous one being cut off
+func (b *grpcBody) reader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = &grpcBodyReader{body: b}
+	return b.current
+}
+
+// replay reports whether the body read so far can be sent again
+func (b *grpcBody) replay() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read <= b.limit
+}
+
+// grpcBodyReader reads the body of an attempt
+type grpcBodyReader struct {
+	body *grpcBody
+	// pos counts the bytes returned to the attempt
+	pos int64
+}
+
+func (r *grpcBodyReader) Read(p []byte) (int, error) {
+	b := r.body
+	if n, done, err := r.buffered(p); done {
+		return n, err
+	}
+
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+	// A previous attempt may have read more meanwhile
+	if n, done, err := r.buffered(p); done {
+		return n, err
+	}
+	n, err := b.src.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += int64(n)
+	if b.read <= b.limit {
+		b.buf = append(b.buf, p[:n]...)
+	}
+	if err != nil {
+		b.err = err
+	}
+	if b.current != r {
+		// The data is recorded for the current attempt
+		return 0, errAttemptRetried
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+// buffered reads what the previous attempts read beyond the position of
+// the reader, done being false when the reader must read src itself
+func (r *grpcBodyReader) buffered(p []byte) (int, bool, error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.current != r:
+		return 0, true, errAttemptRetried
+	case r.pos < int64(len(b.buf)):
+		n := copy(p, b.buf[r.pos:])
+		r.pos += int64(n)
+		return n, true, nil
+	case r.pos < b.read:
+		// A previous attempt read beyond limit, the body cannot be replayed
+		return 0, true, errAttemptRetried
+	case b.err != nil:
+		return 0, true, b.err
+	}
+	return 0, false, nil
+}
+
+// Close leaves the client body open for a retry, the server closes it
+func (r *grpcBodyReader) Close() error {
+	return nil
+}
+
+// grpcHealthRequest is an empty grpc.health.v1.HealthCheckRequest, checking
+// the whole server, as a length-prefixed gRPC message
+var grpcHealthRequest = []byte{0, 0, 0, 0, 0}
+
+// grpcServing is the grpc.health.v1.HealthCheckResponse of a serving backend:
+// field 1, the status, set to SERVING
+var grpcServing = []byte{0x08, 0x01}
+
+// isGRPCServing checks whether a backend is serving with the gRPC health
+// checking protocol, through transport, http.DefaultTransport when nil
+func isGRPCServing(u *url.URL, timeout time.Duration, transport http.RoundTripper) bool {
+	if timeout == 0 {
+		timeout = config.DefaultHealthCheckTimeout
+	}
+	client := http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+	req, err := http.NewRequest("POST", u.JoinPath("/grpc.health.v1.Health/Check").String(), bytes.NewReader(grpcHealthRequest))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	code, ok := router.GRPCStatus(resp.Header)
+	if !ok {
+		code, ok = router.GRPCStatus(http.Header(resp.Trailer))
+	}
+	// An uncompressed message holding the serving status
+	return ok && code == router.GRPCOK && len(msg) > 5 && msg[0] == 0 && bytes.Equal(msg[5:], grpcServing)
+}
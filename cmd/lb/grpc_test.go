@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testHealthServer answers health checks according to the service checked
+type testHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	name  string
+	calls atomic.Int64
+}
+
+func (s *testHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	s.calls.Add(1)
+	switch req.Service {
+	case "unavailable":
+		return nil, status.Error(codes.Unavailable, s.name+" is unavailable")
+	case "missing":
+		return nil, status.Error(codes.NotFound, "unknown service")
+	case "slow":
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	md := metadata.Pairs("backend", s.name)
+	if deadline, ok := ctx.Deadline(); ok {
+		md.Set("timeout", time.Until(deadline).String())
+	}
+	grpc.SetHeader(ctx, md)
+	grpc.SetTrailer(ctx, metadata.Pairs("served-by", s.name))
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+// startGRPCBackend serves a health server over h2c and returns its URL
+func startGRPCBackend(t *testing.T, name string) (*testHealthServer, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &testHealthServer{name: name}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+	return hs, "http://" + ln.Addr().String()
+}
+
+func TestSetupServers_GRPC(t *testing.T) {
+	one, oneURL := startGRPCBackend(t, "one")
+	two, twoURL := startGRPCBackend(t, "two")
+	// A backend refusing connections, until the health checks mark it down
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "http://" + ln.Addr().String()
+	ln.Close()
+
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - address: "127.0.0.1:0"
+    protocols: [h2c]
+pools:
+  - name: grpc
+    strategy: round_robin
+    grpc:
+      max_retries: 2
+      timeout: 300ms
+    backends:
+      - url: ` + oneURL + `
+      - url: ` + deadURL + `
+      - url: ` + twoURL + `
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	servers, err := setupServers(cfg)
+	if err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	lbln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servers[0].Serve(lbln)
+	defer servers[0].Close()
+
+	conn, err := grpc.NewClient("passthrough:///"+lbln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	check := func(ctx context.Context, service string, opts ...grpc.CallOption) (*grpc_health_v1.HealthCheckResponse, error) {
+		return client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service}, opts...)
+	}
+
+	t.Run("Per-Call Balancing", func(t *testing.T) {
+		served := map[string]int{}
+		for i := 0; i < 6; i++ {
+			var header, trailer metadata.MD
+			resp, err := check(context.Background(), "", grpc.Header(&header), grpc.Trailer(&trailer))
+			if err != nil {
+				t.Fatalf("Call %d failed: %v", i, err)
+			}
+			if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+				t.Errorf("Expected SERVING, got %v", resp.Status)
+			}
+			backend := header.Get("backend")
+			if len(backend) != 1 || !equalMD(trailer.Get("served-by"), backend) {
+				t.Errorf("Expected the backend in the headers and trailers, got %v and %v", backend, trailer)
+				continue
+			}
+			served[backend[0]]++
+		}
+		// The calls share one connection to the load balancer, the dead backend being retried
+		if served["one"] == 0 || served["two"] == 0 || served["one"]+served["two"] != 6 {
+			t.Errorf("Expected the calls spread over both live backends, got %v", served)
+		}
+	})
+
+	t.Run("Status Propagation", func(t *testing.T) {
+		before := one.calls.Load() + two.calls.Load()
+		_, err := check(context.Background(), "missing")
+		if s := status.Convert(err); s.Code() != codes.NotFound || s.Message() != "unknown service" {
+			t.Errorf("Expected NotFound, got %v", err)
+		}
+		if n := one.calls.Load() + two.calls.Load() - before; n != 1 {
+			t.Errorf("Expected NotFound not retried, got %d attempts", n)
+		}
+	})
+
+	t.Run("Retry On Unavailable", func(t *testing.T) {
+		before := one.calls.Load() + two.calls.Load()
+		_, err := check(context.Background(), "unavailable")
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable, got %v", err)
+		}
+		// The first attempt and 2 retries, the dead backend included
+		if n := one.calls.Load() + two.calls.Load() - before; n < 2 || n > 3 {
+			t.Errorf("Expected the call retried on the live backends, got %d attempts", n)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		var header metadata.MD
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := check(ctx, "", grpc.Header(&header)); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		timeout, err := time.ParseDuration(header.Get("timeout")[0])
+		if err != nil || timeout <= 0 || timeout > 5*time.Second {
+			t.Errorf("Expected the backend to receive the remaining deadline, got %v", header.Get("timeout"))
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = check(ctx, "slow")
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("Expected DeadlineExceeded, got %v", err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("Expected the call to end at its deadline, took %v", d)
+		}
+
+		// Without grpc-timeout, the pool timeout applies
+		_, err = check(context.Background(), "slow")
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("Expected DeadlineExceeded from the pool timeout, got %v", err)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		// The load balancer ends the slow call at its deadline, as the backend does
+		time.Sleep(100 * time.Millisecond)
+		stats := poolStats(currentTable().pools[0]).GRPC
+		if stats == nil {
+			t.Fatal("Expected gRPC stats")
+		}
+		expected := map[string]uint64{"ok": 7, "not_found": 1, "unavailable": 1}
+		for name, n := range expected {
+			if stats.Codes[name] != n {
+				t.Errorf("Expected %d %s calls, got %v", n, name, stats.Codes)
+			}
+		}
+		// The client may cancel the call with a deadline first
+		if n := stats.Codes["deadline_exceeded"]; n < 1 || n+stats.Codes["cancelled"] != 2 {
+			t.Errorf("Expected the calls past their deadline, got %v", stats.Codes)
+		}
+		if stats.Calls != 11 || stats.Retries < 3 {
+			t.Errorf("Expected 11 calls and their retries, got %+v", stats)
+		}
+	})
+
+	t.Run("Health Check", func(t *testing.T) {
+		u, _ := url.Parse(oneURL)
+		b := currentTable().pools[0].GetBackends()[0]
+		if !isGRPCServing(u, time.Second, b.Transport) {
+			t.Error("Expected the live backend to be serving")
+		}
+		u, _ = url.Parse(deadURL)
+		if isGRPCServing(u, time.Second, b.Transport) {
+			t.Error("Expected the dead backend not to be serving")
+		}
+		if !b.GetHealthCheck().GRPC {
+			t.Error("Expected the gRPC health check for a gRPC pool")
+		}
+	})
+}
+
+func equalMD(a, b []string) bool {
+	return len(a) == len(b) && (len(a) == 0 || a[0] == b[0])
+}
+
+func TestGRPCBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		replay bool
+	}{
+		{"Within Limit", 16, true},
+		{"Beyond Limit", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &grpcBody{src: io.NopCloser(strings.NewReader("message")), limit: tt.limit}
+			first := b.reader()
+			buf := make([]byte, 3)
+			if n, err := first.Read(buf); n != 3 || err != nil {
+				t.Fatalf("Expected 3 bytes, got %d, %v", n, err)
+			}
+			if b.replay() != tt.replay {
+				t.Fatalf("Expected replay %v", tt.replay)
+			}
+
+			second := b.reader()
+			if _, err := first.Read(buf); err != errAttemptRetried {
+				t.Errorf("Expected the previous attempt cut off, got %v", err)
+			}
+			got, err := io.ReadAll(second)
+			if tt.replay && (err != nil || string(got) != "message") {
+				t.Errorf("Expected the whole body replayed, got %q, %v", got, err)
+			}
+		})
+	}
+}
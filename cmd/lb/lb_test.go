@@ -2,20 +2,32 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/P4ST4S/go-load-balancer/config"
 	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
 )
 
+// resetPool replaces the configured pools and routes by a single empty pool
+func resetPool() *core.ServerPool {
+	pool := &core.ServerPool{}
+	table.Store(&routingTable{pools: []*core.ServerPool{pool}, routes: router.New(nil)})
+	return pool
+}
+
 func TestLbHandler(t *testing.T) {
-	// Reset serverPool for isolation
-	serverPool = core.ServerPool{}
+	// Reset the pools for isolation
+	resetPool()
 
 	t.Run("No Backends Available", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/", nil)
@@ -41,13 +53,12 @@ func TestLbHandler(t *testing.T) {
 
 		b := &core.Backend{
 			URL:          backendUrl,
-			Alive:        true,
 			ReverseProxy: proxy,
 		}
+		b.SetAlive(true)
 
 		// Reset pool and add backend
-		serverPool = core.ServerPool{}
-		serverPool.AddBackend(b)
+		resetPool().AddBackend(b)
 
 		req := httptest.NewRequest("GET", "/", nil)
 		w := httptest.NewRecorder()
@@ -79,10 +90,113 @@ func TestLbHandler(t *testing.T) {
 	})
 }
 
+func TestLbHandler_StickyBackend(t *testing.T) {
+	pool := resetPool()
+	pool.StickyCookie = "lb_backend"
+	table.Load().trustedProxies = router.TrustedProxies{netip.MustParsePrefix("192.0.2.0/24")}
+	for _, name := range []string{"app1", "app2"} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer ts.Close()
+		u, _ := url.Parse(ts.URL)
+		b := &core.Backend{URL: u, ReverseProxy: httputil.NewSingleHostReverseProxy(u)}
+		b.SetAlive(true)
+		pool.AddBackend(b)
+	}
+
+	// send serves a request, with the cookie when set, and returns the
+	// backend which answered and the cookie set by the response, if any
+	send := func(cookie string) (string, string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "lb_backend", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		lbHandler(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "lb_backend" {
+				return w.Body.String(), c.Value
+			}
+		}
+		return w.Body.String(), ""
+	}
+
+	first, cookie := send("")
+	if cookie == "" {
+		t.Fatalf("Expected the sticky cookie to be set")
+	}
+	other := "app1"
+	if first == "app1" {
+		other = "app2"
+	}
+	var stuck *core.Backend
+	for _, b := range pool.GetBackends() {
+		if b.SessionKey() == cookie {
+			stuck = b
+		}
+	}
+	if stuck == nil {
+		t.Fatalf("Expected the cookie to name a backend of the pool, got %q", cookie)
+	}
+
+	t.Run("Stuck Client", func(t *testing.T) {
+		for range 3 {
+			if got, set := send(cookie); got != first || set != "" {
+				t.Errorf("Expected %s without a new cookie, got %s (cookie %q)", first, got, set)
+			}
+		}
+	})
+
+	t.Run("Secure Behind A TLS Proxy", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		lbHandler(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+			t.Errorf("Expected a secure cookie, got %v", cookies)
+		}
+	})
+
+	stuck.SetStatus(core.StatusDraining)
+	t.Run("Draining Backend Keeps Its Sessions", func(t *testing.T) {
+		if got, _ := send(cookie); got != first {
+			t.Errorf("Expected %s, got %s", first, got)
+		}
+	})
+	t.Run("Draining Backend Gets No New Client", func(t *testing.T) {
+		if got, set := send(""); got != other || set == "" || set == cookie {
+			t.Errorf("Expected %s with a new cookie, got %s (cookie %q)", other, got, set)
+		}
+	})
+
+	stuck.SetStatus(core.StatusMaintenance)
+	t.Run("Backend In Maintenance", func(t *testing.T) {
+		if got, set := send(cookie); got != other || set == "" {
+			t.Errorf("Expected %s with a new cookie, got %s (cookie %q)", other, got, set)
+		}
+	})
+
+	stuck.SetStatus(core.StatusReady)
+	stuck.SetAdminState(core.AdminDisabled)
+	t.Run("Disabled Backend", func(t *testing.T) {
+		if got, set := send(cookie); got != other || set == "" {
+			t.Errorf("Expected %s with a new cookie, got %s (cookie %q)", other, got, set)
+		}
+	})
+	t.Run("Unknown Cookie", func(t *testing.T) {
+		if got, set := send("unknown"); got != other || set == "" {
+			t.Errorf("Expected %s with a new cookie, got %s (cookie %q)", other, got, set)
+		}
+	})
+}
+
 func TestStatsHandler(t *testing.T) {
-	serverPool = core.ServerPool{}
 	u, _ := url.Parse("http://localhost:8080")
-	serverPool.AddBackend(&core.Backend{URL: u, Alive: true})
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
+	resetPool().AddBackend(b)
 
 	req := httptest.NewRequest("GET", "/stats", nil)
 	w := httptest.NewRecorder()
@@ -96,8 +210,12 @@ func TestStatsHandler(t *testing.T) {
 		t.Errorf("Expected application/json, got %s", w.Header().Get("Content-Type"))
 	}
 
-	if !strings.Contains(w.Body.String(), "http://localhost:8080") {
-		t.Errorf("Expected stats to contain backend URL")
+	var stats []PoolStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid stats: %v", err)
+	}
+	if len(stats) != 1 || len(stats[0].Backends) != 1 || stats[0].Backends[0].URL != "http://localhost:8080" {
+		t.Errorf("Expected the backend grouped under its pool, got %+v", stats)
 	}
 }
 
@@ -121,7 +239,7 @@ func TestIsBackendAlive(t *testing.T) {
 		defer server.Close()
 
 		u, _ := url.Parse(server.URL)
-		if !isBackendAlive(u) {
+		if !isBackendAlive(u, time.Second, nil) {
 			t.Error("Expected backend to be detected as alive")
 		}
 	})
@@ -129,7 +247,7 @@ func TestIsBackendAlive(t *testing.T) {
 	t.Run("Backend Dead (Connection Refused)", func(t *testing.T) {
 		// Use a port that is definitely closed or invalid host
 		u, _ := url.Parse("http://localhost:59999")
-		if isBackendAlive(u) {
+		if isBackendAlive(u, time.Second, nil) {
 			t.Error("Expected backend to be detected as dead")
 		}
 	})
@@ -141,7 +259,7 @@ func TestIsBackendAlive(t *testing.T) {
 		defer server.Close()
 
 		u, _ := url.Parse(server.URL)
-		if isBackendAlive(u) {
+		if isBackendAlive(u, time.Second, nil) {
 			t.Error("Expected backend returning 500 to be considered dead")
 		}
 	})
@@ -152,7 +270,7 @@ func TestUpdateBackendStats(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/health" {
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`{"memory_usage": 5000}`))
+			w.Write([]byte(`{"memory_usage": 5000, "cpu_usage": 42.5, "goroutines": 12, "in_flight": 3, "gc_pause_ns": 1500, "gauges": {"queue_depth": 7}}`))
 			return
 		}
 		w.WriteHeader(http.StatusNotFound)
@@ -160,13 +278,62 @@ func TestUpdateBackendStats(t *testing.T) {
 	defer ts.Close()
 
 	u, _ := url.Parse(ts.URL)
-	b := &core.Backend{URL: u, Alive: true}
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
 
 	updateBackendStats(b)
 
 	if mem := b.GetMemoryUsage(); mem != 5000 {
 		t.Errorf("Expected memory usage 5000, got %d", mem)
 	}
+
+	m := b.GetMetrics()
+	if m.CPUUsage != 42.5 {
+		t.Errorf("Expected cpu usage 42.5, got %v", m.CPUUsage)
+	}
+	if m.Goroutines != 12 || m.InFlight != 3 {
+		t.Errorf("Expected 12 goroutines and 3 in-flight requests, got %d and %d", m.Goroutines, m.InFlight)
+	}
+	if m.GCPause != 1500*time.Nanosecond {
+		t.Errorf("Expected gc pause 1.5µs, got %s", m.GCPause)
+	}
+	if m.Gauges["queue_depth"] != 7 {
+		t.Errorf("Expected queue_depth gauge 7, got %v", m.Gauges["queue_depth"])
+	}
+}
+
+func TestUpdateBackendStats_Status(t *testing.T) {
+	status := "draining"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "` + status + `"}`))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
+
+	updateBackendStats(b)
+	if got := b.GetStatus(); got != core.StatusDraining {
+		t.Errorf("Expected status draining, got %s", got)
+	}
+	if b.IsAvailable() {
+		t.Error("Draining backend should not receive new requests")
+	}
+
+	status = "ready"
+	updateBackendStats(b)
+	if got := b.GetStatus(); got != core.StatusReady {
+		t.Errorf("Expected status ready, got %s", got)
+	}
+
+	// Unknown statuses are rejected and the previous status is kept
+	status = "bogus"
+	updateBackendStats(b)
+	if got := b.GetStatus(); got != core.StatusReady {
+		t.Errorf("Expected status to remain ready, got %s", got)
+	}
 }
 
 func TestUpdateBackendStats_Error(t *testing.T) {
@@ -177,7 +344,8 @@ func TestUpdateBackendStats_Error(t *testing.T) {
 	defer ts.Close()
 
 	u, _ := url.Parse(ts.URL)
-	b := &core.Backend{URL: u, Alive: true}
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
 
 	// Should not panic and should log error (we can't easily check log output here without capturing it,
 	// but we can check that memory usage wasn't updated if we set it to something else first)
@@ -198,7 +366,8 @@ func TestUpdateBackendStats_JSONError(t *testing.T) {
 	defer ts.Close()
 
 	u, _ := url.Parse(ts.URL)
-	b := &core.Backend{URL: u, Alive: true}
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
 
 	// Should log error and not update memory
 	b.SetMemoryUsage(100)
@@ -212,7 +381,8 @@ func TestUpdateBackendStats_JSONError(t *testing.T) {
 func TestUpdateBackendStats_NetworkError(t *testing.T) {
 	// Use a URL that will definitely fail (invalid port or non-existent host)
 	u, _ := url.Parse("http://localhost:54321")
-	b := &core.Backend{URL: u, Alive: true}
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
 
 	// Should log error and return (not panic)
 	updateBackendStats(b)
@@ -226,17 +396,18 @@ func TestHealthCheck(t *testing.T) {
 	defer ts.Close()
 
 	u, _ := url.Parse(ts.URL)
-	b := &core.Backend{URL: u, Alive: true}
+	b := &core.Backend{URL: u}
+	b.SetAlive(true)
 
-	serverPool = core.ServerPool{}
-	serverPool.AddBackend(b)
+	pool := resetPool()
+	pool.AddBackend(b)
 
 	// Run healthCheck with a very short interval and a context that cancels quickly
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
 
 	// This should run at least once or twice
-	healthCheck(ctx, 10*time.Millisecond)
+	healthCheck(ctx, pool, 10*time.Millisecond)
 
 	// If it returns, it means context cancellation worked.
 	// We can verify if IsAlive was called or updated, but since it's already alive, it stays alive.
@@ -253,45 +424,169 @@ func TestHealthCheck_StatusChange(t *testing.T) {
 
 	u, _ := url.Parse(ts.URL)
 	// Backend marked as dead, but server is actually up
-	b := &core.Backend{URL: u, Alive: false}
+	b := &core.Backend{URL: u}
 
-	serverPool = core.ServerPool{}
-	serverPool.AddBackend(b)
+	pool := resetPool()
+	pool.AddBackend(b)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
-	healthCheck(ctx, 10*time.Millisecond)
+	healthCheck(ctx, pool, 10*time.Millisecond)
 
 	if !b.IsAlive() {
 		t.Error("Backend should have been marked as alive")
 	}
 }
 
-func TestSetupServer(t *testing.T) {
-	serverPool = core.ServerPool{}
+func TestSetupServers(t *testing.T) {
+	cfg, err := config.FromFlags("http://localhost:8081,http://localhost:8082", 3031)
+	if err != nil {
+		t.Fatalf("FromFlags failed: %v", err)
+	}
 
-	srv, err := setupServer("http://localhost:8081,http://localhost:8082", 3031)
+	servers, err := setupServers(cfg)
 	if err != nil {
-		t.Fatalf("setupServer failed: %v", err)
+		t.Fatalf("setupServers failed: %v", err)
 	}
 
-	if srv.Addr != ":3031" {
-		t.Errorf("Expected port :3031, got %s", srv.Addr)
+	if len(servers) != 1 || servers[0].Addr != ":3031" {
+		t.Fatalf("Expected a single server on :3031, got %d servers", len(servers))
+	}
+	if servers[0].ReadHeaderTimeout != config.DefaultReadHeaderTimeout {
+		t.Errorf("Expected default read header timeout, got %s", servers[0].ReadHeaderTimeout)
 	}
 
-	if len(serverPool.Backends) != 2 {
-		t.Errorf("Expected 2 backends, got %d", len(serverPool.Backends))
+	pools := currentTable().pools
+	if len(pools) != 1 || len(pools[0].GetBackends()) != 2 {
+		t.Errorf("Expected 1 pool with 2 backends, got %d pools", len(pools))
 	}
 }
 
-func TestSetupServer_Error(t *testing.T) {
-	_, err := setupServer(":%^&", 3031) // Invalid URL
+func TestSetupServers_Error(t *testing.T) {
+	_, err := config.FromFlags(":%^&", 3031) // Invalid URL
 	if err == nil {
 		t.Error("Expected error for invalid URL")
 	}
 }
 
+func TestSetupServers_Routes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer web.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: web
+    backends:
+      - url: ` + web.URL + `
+  - name: api
+    strategy: round_robin
+    backends:
+      - url: ` + api.URL + `
+        weight: 3
+        health_check:
+          path: /health
+routes:
+  - path_prefix: /api
+    pool: api
+  - path: /api/version
+    pool: web
+  - path_regex: \.css$
+    pool: web
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/users", "api"},
+		{"/api/version", "web"},
+		{"/api/theme.css", "api"},
+		{"/theme.css", "web"},
+		{"/", "web"},
+		{"/static/app.js", "web"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		lbHandler(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Body.String() != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.path, tt.expected, w.Body.String())
+		}
+	}
+
+	b := currentTable().pools[1].GetBackends()[0]
+	if b.GetWeight() != 3 || b.HealthCheckURL().Path != "/health" {
+		t.Errorf("Expected weight 3 and /health check, got %d and %s", b.GetWeight(), b.HealthCheckURL())
+	}
+}
+
+func TestSetupServers_VirtualHosts(t *testing.T) {
+	backend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+	}
+	shop, blog := backend("shop"), backend("blog")
+	defer shop.Close()
+	defer blog.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: shop
+    backends:
+      - url: ` + shop.URL + `
+  - name: blog
+    backends:
+      - url: ` + blog.URL + `
+routes:
+  - hosts: [shop.example.com]
+    pool: shop
+  - hosts: ["*.blog.example.com"]
+    path_prefix: /posts
+    pool: blog
+unknown_host_status: 421
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+		body   string
+	}{
+		{"shop.example.com", "/cart", http.StatusOK, "shop"},
+		{"alice.blog.example.com:3030", "/posts/1", http.StatusOK, "blog"},
+		{"alice.blog.example.com", "/about", http.StatusNotFound, ""},
+		{"unknown.example.net", "/", http.StatusMisdirectedRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		lbHandler(w, r)
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s%s: expected %d %q, got %d %q", tt.host, tt.path, tt.status, tt.body, w.Code, w.Body.String())
+		}
+	}
+}
+
 func TestHealthCheck_PoolFull(t *testing.T) {
 	// Mock updateBackendStatsFunc to block
 	old := updateBackendStatsFunc
@@ -311,25 +606,333 @@ func TestHealthCheck_PoolFull(t *testing.T) {
 	// So the channel size is exactly enough to hold one update per backend.
 	// So it should NEVER be full unless a previous tick's updates are still pending?
 	// Yes, if workers are slow, previous updates accumulate?
-	// No, we iterate `for _, b := range serverPool.Backends`.
+	// No, we iterate `for _, b := range pool.GetBackends()`.
 	// If channel is full, we skip.
 
 	// So to trigger it:
 	// 1. Tick 1: Send all backends. Workers are blocked. Channel fills up.
 	// 2. Tick 2: Try to send again. Channel is full. Default case triggers.
 
-	serverPool = core.ServerPool{}
-	// Add 5 backends. Channel size 5. Workers 3.
-	for i := 0; i < 5; i++ {
+	pool := resetPool()
+	// Add 20 backends. Channel size 20 (more than minStatsQueue). Workers 3.
+	for i := 0; i < 20; i++ {
 		u, _ := url.Parse("http://localhost:8080")
-		serverPool.AddBackend(&core.Backend{URL: u, Alive: true})
+		b := &core.Backend{URL: u}
+		b.SetAlive(true)
+		pool.AddBackend(b)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
 	defer cancel()
 
 	// Run with very short interval to trigger multiple ticks
-	healthCheck(ctx, 10*time.Millisecond)
+	healthCheck(ctx, pool, 10*time.Millisecond)
 
 	// We can't easily assert that the log was printed, but this executes the code path.
 }
+
+func TestSetupServers_Mirror(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("web"))
+	}))
+	defer web.Close()
+
+	type mirrored struct{ tag, body string }
+	copies := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		copies <- mirrored{r.Header.Get("X-Mirrored-From"), string(body)}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: web
+    backends:
+      - url: ` + web.URL + `
+  - name: shadow
+    backends:
+      - url: ` + shadow.URL + `
+routes:
+  - name: orders
+    pool: web
+    mirror:
+      pool: shadow
+      max_body_size: 8
+      compare_status: true
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	for _, body := range []string{"order=1", "order=1234567890"} {
+		w := httptest.NewRecorder()
+		lbHandler(w, httptest.NewRequest("POST", "/orders", strings.NewReader(body)))
+		if w.Code != http.StatusOK || w.Body.String() != "web" {
+			t.Errorf("Expected the primary response, got %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	select {
+	case c := <-copies:
+		if c.tag != "orders" || c.body != "order=1" {
+			t.Errorf("Expected the small request tagged with its route, got %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+	select {
+	case c := <-copies:
+		t.Errorf("Expected the large request not to be mirrored, got %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	route := currentTable().routes.Route("orders")
+	deadline := time.Now().Add(time.Second)
+	for route.Mirror.Counts().Failed == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := routeStats(route).Mirror
+	if stats.Mirrored != 1 || stats.Skipped != 1 || stats.Failed != 1 || stats.Mismatches["200/500"] != 1 {
+		t.Errorf("Expected 1 mirrored, 1 skipped and a 200/500 mismatch, got %+v", stats)
+	}
+}
+
+func TestSetupServers_MirrorHeaderRules(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Backend")))
+	}))
+	defer web.Close()
+	copies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copies <- r.Header.Get("X-Backend")
+	}))
+	defer shadow.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: web
+    backends:
+      - url: ` + web.URL + `
+  - name: shadow
+    backends:
+      - url: ` + shadow.URL + `
+routes:
+  - name: orders
+    pool: web
+    request_headers:
+      set:
+        X-Backend: ${backend_url}
+    mirror:
+      pool: shadow
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	lbHandler(w, httptest.NewRequest("GET", "/orders", nil))
+	if w.Body.String() != web.URL {
+		t.Errorf("Expected the primary backend URL, got %q", w.Body.String())
+	}
+	select {
+	case got := <-copies:
+		if got != "" {
+			t.Errorf("Expected the copy without the header set for the primary backend, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+}
+
+func TestSetupServers_Rewrite(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.RequestURI()))
+	}))
+	defer api.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: api
+    backends:
+      - url: ` + api.URL + `
+routes:
+  - path_prefix: /api
+    pool: api
+    rewrite:
+      strip_prefix: /api
+      add_prefix: /v2
+      host: api.internal
+  - path_regex: ^/users/(\d+)$
+    pool: api
+    rewrite:
+      regex: ^/users/(\d+)$
+      replacement: /accounts/$1
+  - path_prefix: /old
+    rewrite:
+      strip_prefix: /old
+      add_prefix: /new
+    redirect:
+      status: 301
+  - hosts: [shop.example.com]
+    redirect:
+      scheme: https
+      status: 308
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	tests := []struct {
+		url      string
+		status   int
+		expected string
+	}{
+		{"http://lb/api/users?page=2", http.StatusOK, "api.internal/v2/users?page=2"},
+		{"http://lb/users/42", http.StatusOK, "lb/accounts/42"},
+		{"http://lb/old/page?a=1", http.StatusMovedPermanently, "http://lb/new/page?a=1"},
+		{"http://shop.example.com:8080/cart", http.StatusPermanentRedirect, "https://shop.example.com/cart"},
+		{"https://shop.example.com/cart", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		lbHandler(w, httptest.NewRequest("GET", tt.url, nil))
+		got := w.Body.String()
+		if w.Code != http.StatusOK {
+			got = w.Header().Get("Location")
+		}
+		if w.Code != tt.status || got != tt.expected {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.url, tt.status, tt.expected, w.Code, got)
+		}
+	}
+}
+
+func TestSetupServers_HeaderRules(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "app/1.0")
+		w.Header().Set("X-Seen-Backend", r.Header.Get("X-LB-Backend"))
+		w.Header().Set("X-Seen-Debug", r.Header.Get("X-Debug"))
+		w.Header().Set("X-Seen-Start", r.Header.Get("X-Request-Start"))
+		w.Write([]byte("ok"))
+	}))
+	defer app.Close()
+
+	cfg, err := config.Parse([]byte(`
+pools:
+  - name: web
+    backends:
+      - url: ` + app.URL + `
+    request_headers:
+      set:
+        X-LB-Backend: ${backend_url}
+    response_headers:
+      remove: [Server]
+      set:
+        X-Served-By: pool
+routes:
+  - name: shop
+    pool: web
+    request_headers:
+      remove: [X-Debug]
+      set:
+        X-Request-Start: t=${request_start}
+    response_headers:
+      set:
+        Strict-Transport-Security: max-age=63072000
+        X-Served-By: ${route}
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Debug", "1")
+	w := httptest.NewRecorder()
+	lbHandler(w, r)
+
+	h := w.Header()
+	if h.Get("X-Seen-Backend") != app.URL || h.Get("X-Seen-Debug") != "" || !strings.HasPrefix(h.Get("X-Seen-Start"), "t=") {
+		t.Errorf("Expected the request rules of the pool and route applied, got %v", h)
+	}
+	if h.Get("Server") != "" || h.Get("Strict-Transport-Security") == "" || h.Get("X-Served-By") != "shop" {
+		t.Errorf("Expected the response rules of the route applied after those of the pool, got %v", h)
+	}
+
+	// Responses of the load balancer follow the rules too
+	currentTable().pools[0].GetBackends()[0].SetAlive(false)
+	w = httptest.NewRecorder()
+	lbHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Strict-Transport-Security") == "" {
+		t.Errorf("Expected a 503 with the response headers, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestSetupServers_TrustedProxies(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Header.Get("X-Forwarded-For") + " " + r.Header.Get("X-Forwarded-Proto")))
+		}))
+	}
+	internal, public := backend("internal"), backend("public")
+	defer internal.Close()
+	defer public.Close()
+
+	cfg, err := config.Parse([]byte(`
+trusted_proxies: [192.0.2.0/24]
+pools:
+  - name: internal
+    backends:
+      - url: ` + internal.URL + `
+  - name: public
+    backends:
+      - url: ` + public.URL + `
+routes:
+  - client_cidrs: [10.0.0.0/8]
+    pool: internal
+  - pool: public
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		xff      string
+		expected string
+	}{
+		{"Through A Trusted Proxy", "192.0.2.1:1234", "10.1.2.3", "internal 10.1.2.3, 192.0.2.1 https"},
+		{"Spoofed By A Direct Client", "198.51.100.7:1234", "10.1.2.3", "public 198.51.100.7 http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			r.Header.Set("X-Forwarded-Proto", "https")
+			w := httptest.NewRecorder()
+			lbHandler(w, r)
+			if w.Body.String() != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, w.Body.String())
+			}
+		})
+	}
+}
@@ -3,21 +3,33 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"os"
+	"regexp"
+	"slices"
+	"sync/atomic"
 	"time"
 
+	"github.com/P4ST4S/go-load-balancer/canary"
+	"github.com/P4ST4S/go-load-balancer/certs"
+	"github.com/P4ST4S/go-load-balancer/config"
 	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
 )
 
 // Configuration constants
 const (
 	RetryAttempts int = 3
+	// minStatsQueue is the minimum capacity of the stats update queue of a pool,
+	// leaving room for backends added after the health checks started
+	minStatsQueue = 16
 )
 
 // lbHandler is the orchestrator for each incoming request
@@ -28,32 +40,434 @@ func lbHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. Get the backend with the least active connections
-	peer := serverPool.GetLeastConnPeer()
+	// 1. Find the route serving this request: answer its redirect, or pick the
+	// backend the client is stuck to, even while it drains, or else a backend of
+	// its pool according to the pool strategy
+	t := currentTable()
+	// The real client is resolved once, for routing, header rules and logs
+	client := t.trustedProxies.Client(r)
+	r = router.WithClient(r, client)
+	route, pool, split, status := t.poolFor(r)
+	requestRules, responseRules := t.headerRules(route, pool)
+	var vars *router.HeaderVars
+	if len(requestRules) > 0 || len(responseRules) > 0 {
+		vars = router.NewHeaderVars(r, time.Now())
+		if route != nil {
+			vars.Route = route.Name
+		}
+		if pool != nil {
+			vars.Pool = pool.Name
+		}
+	}
+	if len(responseRules) > 0 {
+		w = &headerWriter{ResponseWriter: w, apply: func(h http.Header) {
+			for _, rules := range responseRules {
+				rules.Apply(h, vars)
+			}
+		}}
+	}
+	if route != nil && route.Redirect != nil {
+		if location, ok := route.Redirect.Location(r, route.Rewrite); ok {
+			http.Redirect(w, r, location, route.Redirect.Status)
+			return
+		}
+	}
+	if route != nil && route.ClientCert != nil {
+		if err := route.ClientCert.Allow(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if pool == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if route != nil && route.Rewrite != nil {
+		// The backends and the shadow pool receive the rewritten path and host
+		route.Rewrite.Apply(r)
+	}
+	var mirror *router.Mirror
+	var body []byte
+	if route != nil && route.Mirror != nil && route.Mirror.Sample() {
+		// Buffer the body before the timer starts, for the copy
+		if b, ok := route.Mirror.Capture(r); ok {
+			mirror, body = route.Mirror, b
+		}
+	}
+	var rec *statusRecorder
+	if split != nil || mirror != nil {
+		// Record the outcome of the request for the split target, and mirror
+		// it once the response is written so the shadow pool adds no latency
+		rec = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		defer func() {
+			if split != nil {
+				split.Done(rec.status, time.Since(start))
+			}
+			if mirror != nil {
+				mirror.Send(r, body, rec.status)
+			}
+		}()
+		w = rec
+	}
 
-	if peer != nil {
+	// Rules can override the forwarding and client certificate headers
+	client.SetHeaders(r.Header)
+	router.SetClientCertHeaders(r.Header, router.VerifiedClientCert(r))
+	forward := func(w http.ResponseWriter, r *http.Request, peer *core.Backend) {
 		// 2. Increment connection counter, ensure decrement after response
 		peer.IncConn()
 		defer peer.DecConn()
 
+		if len(requestRules) > 0 {
+			// The rules apply to a copy, so that the mirrored request and the
+			// retried gRPC calls start again from the headers as received
+			r = r.Clone(r.Context())
+			vars.Backend = peer.URL.String()
+			for _, rules := range requestRules {
+				rules.Apply(r.Header, vars)
+			}
+		}
+
 		// Forward the request
 		peer.ReverseProxy.ServeHTTP(w, r)
+	}
+
+	// gRPC calls are balanced and retried one by one
+	if g := t.grpc[pool]; g != nil && router.IsGRPC(r) {
+		code := g.serve(w, r, pool, forward)
+		if rec != nil {
+			// Failed calls are answered with 200, record them as errors
+			rec.status = router.GRPCHTTPStatus(code)
+		}
 		return
 	}
 
-	// 3. If no server is available (GetNextPeer returned nil)
+	// A client stuck to a backend stays on it, even while it drains
+	if peer := stickyPeer(pool, r); peer != nil {
+		forward(w, r, peer)
+		return
+	}
+	if peer := pool.GetPeer(); peer != nil {
+		if pool.StickyCookie != "" {
+			http.SetCookie(w, &http.Cookie{Name: pool.StickyCookie, Value: peer.SessionKey(), Path: "/", HttpOnly: true, Secure: router.Scheme(r) == "https"})
+		}
+		forward(w, r, peer)
+		return
+	}
+
+	// 3. If no server is available (GetPeer returned nil)
 	http.Error(w, "Service not available", http.StatusServiceUnavailable)
 }
 
-var serverPool core.ServerPool
+// stickyPeer returns the backend of the pool named by the sticky cookie of the
+// request, if the pool has one and the backend still serves its sessions
+func stickyPeer(pool *core.ServerPool, r *http.Request) *core.Backend {
+	if pool.StickyCookie == "" {
+		return nil
+	}
+	c, err := r.Cookie(pool.StickyCookie)
+	if err != nil {
+		return nil
+	}
+	return pool.GetSessionPeer(c.Value)
+}
+
+// routingTable is an immutable snapshot of the pools and routes.
+// It is replaced as a whole on configuration reload so in-flight requests are unaffected.
+type routingTable struct {
+	// pools holds every configured pool, the first one receives the requests matching no route
+	pools  []*core.ServerPool
+	routes *router.Table
+	// rollouts holds the automated canary rollouts of the split routes
+	rollouts []*canary.Rollout
+	// unknownHostStatus answers the requests for hosts no route is restricted to
+	unknownHostStatus int
+	// poolHeaders holds the header rules of the pools having some
+	poolHeaders map[*core.ServerPool]poolHeaders
+	// trustedProxies are believed to forward the real client of the requests
+	trustedProxies router.TrustedProxies
+	// grpc holds the gRPC policies of the pools having one
+	grpc map[*core.ServerPool]*grpcPolicy
+}
+
+// poolHeaders holds the request and response header rules of a pool
+type poolHeaders struct {
+	request, response *router.HeaderRules
+}
+
+var table atomic.Pointer[routingTable]
+
+// currentTable returns the routing table in use, never nil
+func currentTable() *routingTable {
+	if t := table.Load(); t != nil {
+		return t
+	}
+	return &routingTable{routes: router.New(nil)}
+}
+
+// poolFor returns the route matching the request, its pool, and its split target
+// when the route splits its traffic. If no route matches, the first pool is
+// returned, unless routes are restricted to hosts: nil is then returned with the
+// status to answer, 404 or the unknown host status.
+func (t *routingTable) poolFor(r *http.Request) (*router.Route, *core.ServerPool, *router.SplitTarget, int) {
+	if route := t.routes.Match(r); route != nil {
+		pool, split := route.Target(r)
+		if pool == nil {
+			// A redirect route without pool, for a request already at its location
+			return route, nil, nil, http.StatusNotFound
+		}
+		return route, pool, split, 0
+	}
+	pool, status := t.unrouted(r)
+	return nil, pool, nil, status
+}
+
+// headerRules returns the request and response header rules of a pool and
+// of a route, either being nil, the rules of the pool first
+func (t *routingTable) headerRules(route *router.Route, pool *core.ServerPool) (request, response []*router.HeaderRules) {
+	if h, ok := t.poolHeaders[pool]; ok {
+		request, response = appendRules(request, h.request), appendRules(response, h.response)
+	}
+	if route != nil {
+		request, response = appendRules(request, route.RequestHeaders), appendRules(response, route.ResponseHeaders)
+	}
+	return request, response
+}
+
+func appendRules(rules []*router.HeaderRules, r *router.HeaderRules) []*router.HeaderRules {
+	if r == nil {
+		return rules
+	}
+	return append(rules, r)
+}
+
+// headerWriter applies the response header rules before the response is written
+type headerWriter struct {
+	http.ResponseWriter
+	apply   func(http.Header)
+	applied bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	// Informational responses precede the final one
+	if !w.applied && status >= http.StatusOK {
+		w.applied = true
+		w.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-// healthCheck pings the backends and updates their status
-func healthCheck(ctx context.Context, interval time.Duration) {
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// unrouted returns the pool receiving a request matching no route, or the status to answer
+func (t *routingTable) unrouted(r *http.Request) (*core.ServerPool, int) {
+	if t.routes.VirtualHosts() {
+		if t.routes.KnownHost(r) {
+			return nil, http.StatusNotFound
+		}
+		return nil, t.unknownHostStatus
+	}
+	if len(t.pools) == 0 {
+		return nil, http.StatusNotFound
+	}
+	return t.pools[0], 0
+}
+
+// routeName returns the name of the i-th configured route. Unnamed routes are
+// reported by their position, e.g. by the explain endpoint.
+func routeName(r *config.Route, i int) string {
+	if r.Name == "" {
+		return fmt.Sprintf("routes[%d]", i)
+	}
+	return r.Name
+}
+
+// newRoute compiles the matchers of a configured route and resolves its pools
+func newRoute(r *config.Route, pools map[string]*core.ServerPool) (*router.Route, error) {
+	route := &router.Route{Name: r.Name, Hosts: r.Hosts, Path: r.Path, PathPrefix: r.PathPrefix, Methods: r.Methods}
+	var err error
+	if route.Pool, route.Split, err = routePools(r, pools); err != nil {
+		return nil, err
+	}
+	if r.PathRegex != "" {
+		if route.PathRegex, err = regexp.Compile(r.PathRegex); err != nil {
+			return nil, err
+		}
+	}
+	if route.Headers, err = valueMatches(r.Headers); err != nil {
+		return nil, err
+	}
+	if route.Query, err = valueMatches(r.Query); err != nil {
+		return nil, err
+	}
+	for _, cidr := range r.ClientCIDRs {
+		p, err := config.ParseClientCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		route.ClientCIDRs = append(route.ClientCIDRs, p)
+	}
+	if m := r.Mirror; m != nil {
+		pool, ok := pools[m.Pool]
+		if !ok {
+			return nil, fmt.Errorf("unknown pool %q", m.Pool)
+		}
+		route.Mirror = router.NewMirror(pool, m.MaxInFlight)
+		route.Mirror.Percent, route.Mirror.MaxBodySize = *m.Percent, *m.MaxBodySize
+		route.Mirror.Header, route.Mirror.Value = m.Header, r.Name
+		route.Mirror.Timeout, route.Mirror.CompareStatus = m.Timeout, m.CompareStatus
+	}
+	if rw := r.Rewrite; rw != nil {
+		route.Rewrite = &router.Rewrite{StripPrefix: rw.StripPrefix, Replacement: rw.Replacement, AddPrefix: rw.AddPrefix, Host: rw.Host}
+		if rw.Regex != "" {
+			if route.Rewrite.Regex, err = regexp.Compile(rw.Regex); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if rd := r.Redirect; rd != nil {
+		route.Redirect = &router.Redirect{Status: rd.Status, Scheme: rd.Scheme, Host: rd.Host, Port: rd.Port}
+	}
+	if cc := r.ClientCert; cc != nil {
+		route.ClientCert = &router.ClientCert{Subjects: cc.Subjects, SANs: cc.SANs}
+	}
+	route.RequestHeaders, route.ResponseHeaders = headerRules(r.RequestHeaders), headerRules(r.ResponseHeaders)
+	return route, nil
+}
+
+// headerRules converts configured header rules, setting and adding headers in name order
+func headerRules(c *config.HeaderRules) *router.HeaderRules {
+	if c == nil {
+		return nil
+	}
+	rules := &router.HeaderRules{Remove: c.Remove}
+	for _, name := range slices.Sorted(maps.Keys(c.Set)) {
+		rules.Set = append(rules.Set, router.Header{Name: name, Value: c.Set[name]})
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Add)) {
+		rules.Add = append(rules.Add, router.Header{Name: name, Value: c.Add[name]})
+	}
+	return rules
+}
+
+// routePools returns the pool of a route, or its split among pools
+func routePools(r *config.Route, pools map[string]*core.ServerPool) (*core.ServerPool, *router.Split, error) {
+	if len(r.Split) == 0 {
+		if r.Pool == "" && r.Redirect != nil {
+			return nil, nil, nil
+		}
+		pool, ok := pools[r.Pool]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown pool %q", r.Pool)
+		}
+		return pool, nil, nil
+	}
+
+	targets := make([]*core.ServerPool, 0, len(r.Split))
+	weights := make([]int, 0, len(r.Split))
+	for _, t := range r.Split {
+		pool, ok := pools[t.Pool]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown pool %q", t.Pool)
+		}
+		targets = append(targets, pool)
+		weights = append(weights, t.Weight)
+	}
+	split, err := router.NewSplit(targets, weights)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Sticky != nil {
+		split.StickyHeader, split.StickyCookie = r.Sticky.Header, r.Sticky.Cookie
+	}
+	return nil, split, nil
+}
+
+// newRollout creates the automated rollout of a split route
+func newRollout(route *router.Route, c *config.Canary) *canary.Rollout {
+	r := &canary.Rollout{
+		Route: route.Name,
+		Split: route.Split,
+		Policy: canary.Policy{
+			Steps:                c.Steps,
+			Interval:             c.Interval,
+			Window:               c.Window,
+			MinRequests:          c.MinRequests,
+			MaxErrorRateIncrease: *c.MaxErrorRateIncrease,
+			MaxLatencyRatio:      c.MaxLatencyRatio,
+			LatencyPercentile:    c.LatencyPercentile,
+		},
+	}
+	for i, t := range route.Split.Targets {
+		if t.Pool.Name == c.Pool {
+			r.Canary = i
+		} else {
+			r.Stable = i
+		}
+	}
+	return r
+}
+
+// rollout returns the automated rollout of a route, or nil
+func (t *routingTable) rollout(route string) *canary.Rollout {
+	for _, r := range t.rollouts {
+		if r.Route == route {
+			return r
+		}
+	}
+	return nil
+}
+
+func valueMatches(ms []config.ValueMatch) ([]router.ValueMatch, error) {
+	var out []router.ValueMatch
+	for _, m := range ms {
+		vm := router.ValueMatch{Name: m.Name, Value: m.Value}
+		if m.Regex != "" {
+			re, err := regexp.Compile(m.Regex)
+			if err != nil {
+				return nil, err
+			}
+			vm.Regex = re
+		}
+		out = append(out, vm)
+	}
+	return out, nil
+}
+
+// healthCheck pings the backends of a pool and updates their status
+func healthCheck(ctx context.Context, pool *core.ServerPool, interval time.Duration) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
 
 	// Worker pool for stats updates
-	jobs := make(chan *core.Backend, len(serverPool.Backends))
+	jobs := make(chan *core.Backend, max(len(pool.GetBackends()), minStatsQueue))
 	for i := 0; i < 3; i++ { // 3 workers
 		go func() {
 			for {
@@ -72,8 +486,14 @@ func healthCheck(ctx context.Context, interval time.Duration) {
 		case <-ctx.Done():
 			return
 		case <-t.C:
-			for _, b := range serverPool.Backends {
-				alive := isBackendAlive(b.URL)
+			for _, b := range pool.GetBackends() {
+				hc := b.GetHealthCheck()
+				var alive bool
+				if hc.GRPC {
+					alive = isGRPCServing(b.URL, hc.Timeout, b.Transport)
+				} else {
+					alive = isBackendAlive(b.HealthCheckURL(), hc.Timeout, b.Transport)
+				}
 
 				if b.IsAlive() != alive {
 					status := "up"
@@ -85,7 +505,8 @@ func healthCheck(ctx context.Context, interval time.Duration) {
 					b.SetAlive(alive)
 				}
 
-				if alive {
+				// gRPC backends have no stats endpoint
+				if alive && !hc.GRPC {
 					// Non-blocking send to avoid blocking the health check loop
 					select {
 					case jobs <- b:
@@ -98,15 +519,23 @@ func healthCheck(ctx context.Context, interval time.Duration) {
 	}
 }
 
+// HealthResponse is the payload returned by a backend on its /health endpoint
 type HealthResponse struct {
-	MemoryUsage uint64 `json:"memory_usage"`
+	Status      string             `json:"status"`
+	MemoryUsage uint64             `json:"memory_usage"`
+	CPUUsage    float64            `json:"cpu_usage"`
+	Goroutines  uint64             `json:"goroutines"`
+	InFlight    uint64             `json:"in_flight"`
+	GCPauseNs   uint64             `json:"gc_pause_ns"`
+	Gauges      map[string]float64 `json:"gauges,omitempty"`
 }
 
 var updateBackendStatsFunc = updateBackendStats
 
 func updateBackendStats(b *core.Backend) {
 	client := &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   5 * time.Second,
+		Transport: b.Transport,
 	}
 	resp, err := client.Get(b.URL.String() + "/health")
 	if err != nil {
@@ -126,14 +555,35 @@ func updateBackendStats(b *core.Backend) {
 		return
 	}
 
+	status, err := core.ParseBackendStatus(health.Status)
+	if err != nil {
+		log.Printf("Error decoding stats from %s: %s", b.URL, err)
+		return
+	}
+	if old := b.GetStatus(); old != status {
+		log.Printf("Status change: %s [%s]", b.URL, status)
+		b.SetStatus(status)
+	}
+
 	b.SetMemoryUsage(health.MemoryUsage)
+	b.SetMetrics(core.HealthMetrics{
+		CPUUsage:   health.CPUUsage,
+		Goroutines: health.Goroutines,
+		InFlight:   health.InFlight,
+		GCPause:    time.Duration(health.GCPauseNs),
+		Gauges:     health.Gauges,
+	})
 }
 
-// isBackendAlive checks whether a backend is alive by establishing a TCP connection
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
+// isBackendAlive checks whether a backend is alive by requesting its health check URL
+// through transport, http.DefaultTransport when nil
+func isBackendAlive(u *url.URL, timeout time.Duration, transport http.RoundTripper) bool {
+	if timeout == 0 {
+		timeout = config.DefaultHealthCheckTimeout
+	}
 	client := http.Client{
-		Timeout: timeout,
+		Timeout:   timeout,
+		Transport: transport,
 	}
 	resp, err := client.Get(u.String())
 	if err != nil {
@@ -151,69 +601,299 @@ func isBackendAlive(u *url.URL) bool {
 func main() {
 	var serverList string
 	var port int
+	var stickyCookie string
+	var watchInterval time.Duration
+	var adminAddress string
+	var adminToken string
 
 	flag.StringVar(&serverList, "backends", "", "Load balanced backends, use commas to separate")
 	flag.IntVar(&port, "port", 3030, "Port to serve")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML or JSON configuration file (instead of -backends, -port and -sticky-cookie)")
+	flag.StringVar(&stickyCookie, "sticky-cookie", "", "Keep each client on the backend which served it first with this cookie, even while the backend drains")
+	flag.DurationVar(&watchInterval, "watch", 0, "Reload the configuration file when it changes, checking at this interval (e.g. 2s)")
+	flag.StringVar(&adminAddress, "admin", "", "Address of the admin API listener (e.g. 127.0.0.1:3031)")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("LB_ADMIN_TOKEN"), "Bearer token required by the admin API (defaults to $LB_ADMIN_TOKEN)")
 	flag.Parse()
-
-	if len(serverList) == 0 {
-		log.Fatal("Please provide one or more backends using -backends")
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var cfg *config.Config
+	var err error
+	switch {
+	case configPath != "" && (set["backends"] || set["port"] || set["sticky-cookie"]):
+		log.Fatal("-config cannot be combined with -backends, -port or -sticky-cookie: declare the backends, listeners and sticky cookie in the configuration file")
+	case configPath != "":
+		cfg, err = config.Load(configPath)
+	case len(serverList) != 0:
+		cfg, err = config.FromFlags(serverList, port)
+		if err == nil && stickyCookie != "" {
+			cfg.Pools[0].Sticky = &config.PoolSticky{Cookie: stickyCookie}
+			err = cfg.Validate()
+		}
+	default:
+		log.Fatal("Please provide one or more backends using -backends, or a configuration file using -config")
+	}
+	if err == nil && adminAddress != "" {
+		cfg.Admin = &config.Admin{Address: adminAddress, Token: adminToken}
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	server, err := setupServer(serverList, port)
+	servers, err := setupServers(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Start health checking in a separate goroutine
-	go healthCheck(context.Background(), 20*time.Second)
+	// Reload the configuration on SIGHUP, and on file change if requested
+	if configPath != "" {
+		go reloadOnSignal(configPath)
+		if watchInterval > 0 {
+			go watchConfig(context.Background(), configPath, watchInterval)
+		}
+	}
 
-	log.Printf("Load Balancer started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	errs := make(chan error, len(servers)+1)
+	for _, server := range servers {
+		log.Printf("Load Balancer started at %s\n", server.Addr)
+		go func() {
+			errs <- serve(server)
+		}()
+	}
+	if m := acmeManager.Load(); m != nil {
+		// Started with the listeners, which answer the challenges
+		go m.Run(context.Background(), cfg.ACME.CheckInterval)
 	}
+
+	if cfg.Admin != nil {
+		admin, err := newAdminServer(cfg.Admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Admin API started at %s\n", admin.Addr)
+		go func() {
+			errs <- serveAdmin(admin, cfg.Admin)
+		}()
+	}
+	log.Fatal(<-errs)
 }
 
-func setupServer(serverList string, port int) (*http.Server, error) {
-	// Parse servers
-	tokens := strings.SplitSeq(serverList, ",")
-	for tok := range tokens {
-		serverUrl, err := url.Parse(tok)
+// setupServers creates the pools, routes and listeners described by the configuration,
+// and starts the health checks of the pools.
+func setupServers(cfg *config.Config) ([]*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", lbHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/stats/certificates", certificateStatsHandler)
+	mux.HandleFunc("/stats/listeners", listenerStatsHandler)
+
+	var manager *certs.Manager
+	if cfg.ACME != nil {
+		var err error
+		if manager, err = newACMEManager(cfg.ACME); err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		manager.SetHosts(cfg.ACMEHosts())
+		// The HTTP-01 challenges are answered on every listener, before routing
+		mux.Handle("/.well-known/acme-challenge/", manager.HTTPHandler(http.HandlerFunc(lbHandler)))
+	}
+
+	servers := make([]*http.Server, 0, len(cfg.Listeners))
+	stores := []*certs.Store{}
+	states := make([]*listenerState, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		state := &listenerState{listener: l}
+		states = append(states, state)
+		server := &http.Server{
+			Addr:      l.Address,
+			Handler:   state.countRequests(mux),
+			Protocols: httpProtocols(l.Protocols),
+			// Timeouts to prevent Slow Loris attacks and resource leaks
+			ReadHeaderTimeout: l.Timeouts.ReadHeader,
+			ReadTimeout:       l.Timeouts.Read,
+			WriteTimeout:      l.Timeouts.Write,
+			IdleTimeout:       l.Timeouts.Idle,
+		}
+		if l.TLS != nil {
+			tc, store, err := newListenerTLS(l, manager)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %w", listenerName(l), err)
+			}
+			server.TLSConfig = tc
+			if store != nil {
+				stores = append(stores, store)
+				go store.Watch(context.Background(), l.TLS.ReloadInterval)
+			}
+		}
+		servers = append(servers, server)
+	}
+
+	t, err := buildTable(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	adminWeights, adminBackends = map[string]map[string]adminWeight{}, map[string]map[string]*core.Backend{}
+	activate(cfg, t)
+	listenerCerts.Store(&stores)
+	listenerStates.Store(&states)
+	acmeManager.Store(manager)
+
+	return servers, nil
+}
+
+// buildTable creates the pools and routes described by the configuration.
+// Backends found in existing (keyed by backendKey) are reused, keeping their
+// connection counters and health status, and updated with their new settings.
+func buildTable(cfg *config.Config, existing map[string]*core.Backend) (*routingTable, error) {
+	t := &routingTable{pools: make([]*core.ServerPool, 0, len(cfg.Pools))}
+	byName := make(map[string]*core.ServerPool, len(cfg.Pools))
+	for i := range cfg.Pools {
+		p := &cfg.Pools[i]
+		pool := &core.ServerPool{Name: p.Name, Strategy: core.Strategy(p.Strategy)}
+		if p.Sticky != nil {
+			pool.StickyCookie = p.Sticky.Cookie
+		}
+		for j := range p.Backends {
+			bc := &p.Backends[j]
+			hc := p.BackendHealthCheck(bc)
+			bt := p.BackendTransport(bc)
+			// A backend whose TLS settings or protocol changed is replaced, the old one being drained
+			if b, ok := existing[backendKey(p.Name, normalizeURL(bc.URL))]; ok && sameTransport(b, bt) {
+				updateBackend(b, bc, hc, bt)
+				pool.AddBackend(b)
+				continue
+			}
+			b, err := newBackend(bc, hc, bt)
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: backend %s: %w", p.Name, bc.URL, err)
+			}
+			pool.AddBackend(b)
+			log.Printf("Configured server: %s (pool %s, weight %d)\n", b.URL, p.Name, b.GetWeight())
+		}
+		t.pools = append(t.pools, pool)
+		byName[p.Name] = pool
+		if p.RequestHeaders != nil || p.ResponseHeaders != nil {
+			if t.poolHeaders == nil {
+				t.poolHeaders = map[*core.ServerPool]poolHeaders{}
+			}
+			t.poolHeaders[pool] = poolHeaders{request: headerRules(p.RequestHeaders), response: headerRules(p.ResponseHeaders)}
+		}
+		if p.GRPC != nil {
+			if t.grpc == nil {
+				t.grpc = map[*core.ServerPool]*grpcPolicy{}
+			}
+			t.grpc[pool] = newGRPCPolicy(p.GRPC)
+		}
+	}
+
+	routes := make([]*router.Route, 0, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		r.Name = routeName(&r, i)
+		route, err := newRoute(&r, byName)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", r.Name, err)
+		}
+		routes = append(routes, route)
+	}
+	t.routes = router.New(routes)
+	for i, r := range cfg.Routes {
+		if r.Canary != nil {
+			t.rollouts = append(t.rollouts, newRollout(routes[i], r.Canary))
+		}
+	}
+	t.unknownHostStatus = cfg.UnknownHostStatus
+	for _, cidr := range cfg.TrustedProxies {
+		p, err := config.ParseClientCIDR(cidr)
 		if err != nil {
 			return nil, err
 		}
+		t.trustedProxies = append(t.trustedProxies, p)
+	}
 
-		// Create the Proxy
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	return t, nil
+}
 
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-		}
+// sameTransport reports whether a backend connects with the settings bt
+func sameTransport(b *core.Backend, bt config.BackendTransport) bool {
+	transport, err := backendTransport(bt)
+	if err != nil || transport == nil {
+		return err == nil && b.Transport == nil
+	}
+	return b.Transport == transport
+}
 
-		// Add to pool
-		serverPool.AddBackend(&core.Backend{
-			URL:          serverUrl,
-			Alive:        true,
-			ReverseProxy: proxy,
-			StartTime:    time.Now(),
-		})
-		log.Printf("Configured server: %s\n", serverUrl)
+// updateBackend applies the settings of its configuration to a backend kept
+// by a reload or found again by discovery, whose transport is unchanged
+func updateBackend(b *core.Backend, bc *config.Backend, hc config.HealthCheck, bt config.BackendTransport) {
+	b.MaxStreams.Store(uint64(bt.MaxStreams))
+	b.SetWeight(*bc.Weight)
+	b.SetTier(bc.Tier)
+	b.SetLabels(bc.Labels)
+	b.SetHealthCheck(core.HealthCheck{Path: hc.Path, Timeout: hc.Timeout, GRPC: hc.GRPC})
+}
+
+// backendKey identifies a backend across configuration reloads
+func backendKey(pool, url string) string {
+	return pool + "|" + url
+}
+
+// normalizeURL returns the URL as formatted by the backends, so it can be compared to backend.URL.String()
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
 	}
+	return u.String()
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", lbHandler)
-	mux.HandleFunc("/stats", statsHandler)
+// newBackend creates a backend and its reverse proxy from its configuration,
+// connecting with the protocol, limits and TLS settings bt
+func newBackend(cfg *config.Backend, hc config.HealthCheck, bt config.BackendTransport) (*core.Backend, error) {
+	serverUrl, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.BackendProtocolError(cfg.URL, bt.Protocol); err != nil {
+		return nil, err
+	}
+	transport, err := backendTransport(bt)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create HTTP server
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
-		// Timeouts to prevent Slow Loris attacks and resource leaks
-		ReadHeaderTimeout: 2 * time.Second,
-		ReadTimeout:       15 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
+	// Create the Proxy
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		log.Printf("[%s] %s (client %s)\n", serverUrl.Host, e.Error(), router.ClientAddr(request))
+		if router.IsGRPC(request) {
+			// gRPC clients read the failure from the status, which a retry policy may retry
+			code := router.GRPCUnavailable
+			if errors.Is(e, context.DeadlineExceeded) {
+				code = router.GRPCDeadlineExceeded
+			}
+			router.WriteGRPCError(writer, code, e.Error())
+			return
+		}
+		writer.WriteHeader(http.StatusBadGateway)
 	}
 
-	return server, nil
+	b := &core.Backend{
+		URL:          serverUrl,
+		ReverseProxy: proxy,
+		Weight:       *cfg.Weight,
+		Tier:         cfg.Tier,
+		Labels:       cfg.Labels,
+		HealthCheck:  core.HealthCheck{Path: hc.Path, Timeout: hc.Timeout, GRPC: hc.GRPC},
+		Protocol:     bt.Protocol,
+	}
+	b.MaxStreams.Store(uint64(bt.MaxStreams))
+	var rt http.RoundTripper = http.DefaultTransport
+	if transport != nil {
+		rt, b.Transport = transport, transport
+	}
+	proxy.Transport = &streamCounter{RoundTripper: rt, backend: b}
+	b.SetAlive(true)
+	return b, nil
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+var (
+	// reloadMu serializes configuration changes
+	reloadMu sync.Mutex
+	// activeConfig is the configuration currently applied
+	activeConfig *config.Config
+	// configPath is the configuration file, empty when configured with flags
+	configPath string
+	// stopHealthChecks stops the health checks of the current routing table
+	stopHealthChecks context.CancelFunc
+)
+
+// canaryTick is how often the automated canary rollouts sample and evaluate their pools
+var canaryTick = time.Second
+
+// drainPollInterval is how often a removed backend is checked for remaining connections
+var drainPollInterval = 100 * time.Millisecond
+
+// activate swaps the routing table in use and restarts the health checks for its pools,
+// and the canary rollouts of its routes
+func activate(cfg *config.Config, t *routingTable) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	table.Store(t)
+	if stopHealthChecks != nil {
+		stopHealthChecks()
+	}
+	stopHealthChecks = cancel
+	activeConfig = cfg
+
+	// Start health checking, and discovery when configured, of each pool in a separate goroutine
+	for i := range cfg.Pools {
+		p := &cfg.Pools[i]
+		go healthCheck(ctx, t.pools[i], p.HealthCheck.Interval)
+		if p.Discovery != nil {
+			go runDiscovery(ctx, t.pools[i], p)
+		}
+	}
+	for _, r := range t.rollouts {
+		go r.Run(ctx, canaryTick)
+	}
+}
+
+// reload re-reads the configuration file and applies it to the running load balancer.
+// Backends kept by the new configuration are reused as-is, new ones are added and
+// removed ones are drained. On error the current configuration is left untouched.
+func reload(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	// Renewed certificates are picked up even when the configuration is invalid
+	reloadCertificates()
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	if activeConfig != nil && !slices.EqualFunc(activeConfig.Listeners, cfg.Listeners, func(a, b config.Listener) bool {
+		return a.Address == b.Address && a.Timeouts == b.Timeouts && reflect.DeepEqual(a.TLS, b.TLS) && slices.Equal(a.Protocols, b.Protocols)
+	}) {
+		log.Printf("Listener changes require a restart, keeping the current listeners")
+	}
+	if activeConfig != nil && !sameACME(activeConfig.ACME, cfg.ACME) {
+		log.Printf("ACME setting changes require a restart, keeping the current settings")
+	}
+
+	old := currentTable()
+	existing := map[string]*core.Backend{}
+	for _, p := range old.pools {
+		for _, b := range p.GetBackends() {
+			existing[backendKey(p.Name, b.URL.String())] = b
+		}
+	}
+
+	t, err := buildTable(cfg, existing)
+	if err != nil {
+		return err
+	}
+	keepDiscovered(cfg, old, t)
+	keepAdminChanges(cfg, t)
+	keepSplits(activeConfig, cfg, old, t)
+	activate(cfg, t)
+	if m := acmeManager.Load(); m != nil && cfg.ACME != nil {
+		// Certificates are obtained for the hosts of the new routes
+		m.SetHosts(cfg.ACMEHosts())
+	}
+
+	// Drain the backends which are not part of the configuration anymore
+	kept := map[*core.Backend]bool{}
+	for _, p := range t.pools {
+		for _, b := range p.GetBackends() {
+			kept[b] = true
+		}
+	}
+	for _, b := range existing {
+		if !kept[b] {
+			b.SetStatus(core.StatusDraining)
+			go drainBackend(b)
+		}
+	}
+	releaseTransports(t)
+
+	log.Printf("Configuration reloaded from %s", path)
+	return nil
+}
+
+// keepDiscovered carries the backends found by discovery over to the pools of
+// the same name which still use discovery, until their provider reconciles them.
+// Like static backends, they are updated with the settings of the pool, or
+// replaced when their transport settings changed, the old ones being drained.
+func keepDiscovered(cfg *config.Config, old, t *routingTable) {
+	for i, pool := range t.pools {
+		pc := &cfg.Pools[i]
+		if pc.Discovery == nil {
+			continue
+		}
+		for _, op := range old.pools {
+			if op.Name != pool.Name {
+				continue
+			}
+			for _, b := range op.GetBackends() {
+				// Backends added through the admin API are carried over by keepAdminChanges
+				if findBackendByURL(pool, b.URL.String()) != nil || adminBackends[pool.Name][b.URL.String()] != nil {
+					continue
+				}
+				weight := b.GetWeight()
+				bc := &config.Backend{URL: b.URL.String(), Weight: &weight, Tier: b.GetTier(), Labels: b.GetLabels()}
+				hc, bt := pc.BackendHealthCheck(bc), pc.BackendTransport(bc)
+				if sameTransport(b, bt) {
+					updateBackend(b, bc, hc, bt)
+				} else {
+					nb, err := newBackend(bc, hc, bt)
+					if err != nil {
+						log.Printf("Discovery: cannot replace %s: %s", b.URL, err)
+						continue
+					}
+					b = nb
+				}
+				pool.AddBackend(b)
+			}
+		}
+	}
+}
+
+// keepAdminChanges carries the changes made through the admin API over to
+// the new table: backends added at runtime stay in their pool unless the
+// configuration now lists them, and weights set at runtime are kept unless
+// the configured weight of their backend changed. The changes to pools which
+// are gone are forgotten.
+func keepAdminChanges(cfg *config.Config, t *routingTable) {
+	pools := map[string]*core.ServerPool{}
+	for _, pool := range t.pools {
+		pools[pool.Name] = pool
+	}
+	for name := range adminBackends {
+		if pools[name] == nil {
+			delete(adminBackends, name)
+		}
+	}
+	for name := range adminWeights {
+		if pools[name] == nil {
+			delete(adminWeights, name)
+		}
+	}
+
+	for i := range cfg.Pools {
+		pc := &cfg.Pools[i]
+		pool := pools[pc.Name]
+		for u, b := range adminBackends[pc.Name] {
+			if findBackendByURL(pool, u) != nil {
+				// Configured or discovered meanwhile
+				delete(adminBackends[pc.Name], u)
+				continue
+			}
+			weight := b.GetWeight()
+			bc := &config.Backend{URL: u, Weight: &weight, Labels: b.GetLabels()}
+			hc, bt := pc.BackendHealthCheck(bc), pc.BackendTransport(bc)
+			if sameTransport(b, bt) {
+				updateBackend(b, bc, hc, bt)
+			} else {
+				nb, err := newBackend(bc, hc, bt)
+				if err != nil {
+					log.Printf("Admin: cannot replace %s in pool %s: %s", u, pc.Name, err)
+					delete(adminBackends[pc.Name], u)
+					continue
+				}
+				adminBackends[pc.Name][u], b = nb, nb
+			}
+			pool.AddBackend(b)
+			log.Printf("Admin: keeping server %s added to pool %s", u, pc.Name)
+		}
+		for _, b := range pool.GetBackends() {
+			keepAdminWeight(pc.Name, b, configuredWeight(pc, b.URL.String()))
+		}
+	}
+}
+
+// keepSplits carries the weights and counts of the splits over to the routes
+// of the same name whose split is unchanged in cfg, so that the weights set
+// through the admin API and the outcome of the requests survive the reload.
+// The canary rollouts of those routes go on where they were, unless their
+// policy changed.
+func keepSplits(prev, cfg *config.Config, old, t *routingTable) {
+	if prev == nil {
+		return
+	}
+	previous := map[string]*config.Route{}
+	for i := range prev.Routes {
+		previous[routeName(&prev.Routes[i], i)] = &prev.Routes[i]
+	}
+	for i := range cfg.Routes {
+		rc := &cfg.Routes[i]
+		name := routeName(rc, i)
+		route, oldRoute := t.routes.Route(name), old.routes.Route(name)
+		pc := previous[name]
+		if route == nil || route.Split == nil || oldRoute == nil || oldRoute.Split == nil || pc == nil {
+			continue
+		}
+		if !reflect.DeepEqual(pc.Split, rc.Split) || !reflect.DeepEqual(pc.Sticky, rc.Sticky) {
+			continue
+		}
+		pools := make([]*core.ServerPool, 0, len(route.Split.Targets))
+		for _, target := range route.Split.Targets {
+			pools = append(pools, target.Pool)
+		}
+		split, err := oldRoute.Split.Rebind(pools)
+		if err != nil {
+			continue
+		}
+		route.Split = split
+		r := t.rollout(name)
+		if r == nil {
+			continue
+		}
+		if o := old.rollout(name); o != nil && reflect.DeepEqual(pc.Canary, rc.Canary) {
+			o.Rebind(split)
+			t.rollouts[slices.Index(t.rollouts, r)] = o
+		} else {
+			r.Split = split
+		}
+	}
+}
+
+// drainBackend waits for the in-flight requests of a removed backend to complete
+func drainBackend(b *core.Backend) {
+	log.Printf("Draining server: %s (%d active connections)", b.URL, b.GetConnCount())
+	for b.GetConnCount() > 0 {
+		time.Sleep(drainPollInterval)
+	}
+	log.Printf("Removed server: %s", b.URL)
+}
+
+// reloadOnSignal reloads the configuration each time the process receives SIGHUP
+func reloadOnSignal(path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := reload(path); err != nil {
+			log.Printf("Reload failed, keeping the current configuration: %s", err)
+		}
+	}
+}
+
+// watchConfig reloads the configuration when the file modification time or size changes
+func watchConfig(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	last, _ := os.Stat(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+			if err := reload(path); err != nil {
+				log.Printf("Reload failed, keeping the current configuration: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/canary"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setupFromFile(t *testing.T, path string) {
+	t.Helper()
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+}
+
+func findBackend(pool *core.ServerPool, u string) *core.Backend {
+	for _, b := range pool.GetBackends() {
+		if b.URL.String() == u {
+			return b
+		}
+	}
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8082
+`)
+	setupFromFile(t, path)
+
+	pool := currentTable().pools[0]
+	kept := findBackend(pool, "http://localhost:8081")
+	removed := findBackend(pool, "http://localhost:8082")
+
+	// Simulate in-flight requests
+	kept.IncConn()
+	removed.IncConn()
+
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+        weight: 5
+      - url: http://localhost:8083
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	pool = currentTable().pools[0]
+	if len(pool.GetBackends()) != 2 {
+		t.Fatalf("Expected 2 backends, got %d", len(pool.GetBackends()))
+	}
+	if b := findBackend(pool, "http://localhost:8081"); b != kept {
+		t.Error("Expected the kept backend to be reused")
+	}
+	if kept.GetConnCount() != 1 || kept.GetWeight() != 5 {
+		t.Errorf("Expected kept backend with 1 connection and weight 5, got %d and %d", kept.GetConnCount(), kept.GetWeight())
+	}
+	if findBackend(pool, "http://localhost:8083") == nil {
+		t.Error("Expected the new backend to be added")
+	}
+	if findBackend(pool, "http://localhost:8082") != nil {
+		t.Error("Expected the removed backend to be gone from the pool")
+	}
+
+	// The removed backend keeps serving its in-flight request
+	if removed.GetStatus() != core.StatusDraining {
+		t.Errorf("Expected removed backend to be draining, got %s", removed.GetStatus())
+	}
+	removed.DecConn()
+}
+
+func TestReload_AdminChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8082
+`)
+	setupFromFile(t, path)
+	h := adminHandler("secret")
+	adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:8081", `{"weight": 7}`)
+	adminRequest(t, h, "POST", "/admin/pools/web/backends/localhost:8082", `{"weight": 3}`)
+	if w := adminRequest(t, h, "POST", "/admin/pools/web/backends", `{"url": "http://localhost:8083", "weight": 5}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	added := findBackend(currentTable().pools[0], "http://localhost:8083")
+
+	// The configured weight of 8082 changes, the configuration then winning
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8082
+        weight: 4
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	pool := currentTable().pools[0]
+	tests := []struct {
+		url    string
+		weight int
+	}{
+		{"http://localhost:8081", 7},
+		{"http://localhost:8082", 4},
+		{"http://localhost:8083", 5},
+	}
+	for _, tt := range tests {
+		if b := findBackend(pool, tt.url); b == nil || b.GetWeight() != tt.weight {
+			t.Errorf("Expected %s with weight %d", tt.url, tt.weight)
+		}
+	}
+	if findBackend(pool, "http://localhost:8083") != added || added.GetStatus() == core.StatusDraining {
+		t.Error("Expected the backend added at runtime to be kept")
+	}
+
+	// Changed TLS settings replace the added backend, keeping its weight
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backend_tls:
+      insecure_skip_verify: true
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8082
+        weight: 4
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	replaced := findBackend(currentTable().pools[0], "http://localhost:8083")
+	if replaced == nil || replaced == added || replaced.Transport == nil || replaced.GetWeight() != 5 {
+		t.Error("Expected the added backend to be replaced with one using the new TLS settings")
+	}
+
+	// Once configured, the added backend follows the configuration
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8083
+        weight: 2
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if backends := currentTable().pools[0].GetBackends(); len(backends) != 1 || backends[0].GetWeight() != 7 {
+		t.Errorf("Expected the configured backend with its runtime weight only, got %d backends", len(backends))
+	}
+}
+
+func TestReload_Split(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	pools := `
+pools:
+  - name: stable
+    backends:
+      - url: http://localhost:8081
+  - name: canary
+    backends:
+      - url: http://localhost:8082
+`
+	writeConfig(t, path, pools+`
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 90
+      - pool: canary
+        weight: 10
+`)
+	setupFromFile(t, path)
+	defer resetPool()
+
+	split := currentTable().routes.Route("web").Split
+	if err := split.SetWeights([]int{50, 50}); err != nil {
+		t.Fatalf("SetWeights failed: %v", err)
+	}
+	split.Targets[1].Done(http.StatusInternalServerError, time.Millisecond)
+
+	// The pools change, the split does not
+	writeConfig(t, path, strings.Replace(pools, "8082", "8083", 1)+`
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 90
+      - pool: canary
+        weight: 10
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	split = currentTable().routes.Route("web").Split
+	if w := split.Weights(); !slices.Equal(w, []int{50, 50}) {
+		t.Errorf("Expected the weights set at runtime kept, got %v", w)
+	}
+	if c := split.Targets[1].Counts(); c.Requests != 1 || c.Errors != 1 {
+		t.Errorf("Expected the counts kept, got %+v", c)
+	}
+	if split.Targets[1].Pool != currentTable().pools[1] {
+		t.Error("Expected the split to serve the reloaded pools")
+	}
+
+	// A changed split takes the configured weights
+	writeConfig(t, path, pools+`
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 80
+      - pool: canary
+        weight: 20
+`)
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	split = currentTable().routes.Route("web").Split
+	if w := split.Weights(); !slices.Equal(w, []int{80, 20}) {
+		t.Errorf("Expected the configured weights, got %v", w)
+	}
+	if c := split.Targets[1].Counts(); c.Requests != 0 {
+		t.Errorf("Expected new counts, got %+v", c)
+	}
+}
+
+func TestReload_Rollout(t *testing.T) {
+	oldTick := canaryTick
+	canaryTick = 10 * time.Millisecond
+	defer func() { canaryTick = oldTick }()
+
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer stable.Close()
+	defer failing.Close()
+
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	content := `
+pools:
+  - name: stable
+    backends:
+      - url: ` + stable.URL + `
+  - name: canary
+    backends:
+      - url: ` + failing.URL + `
+routes:
+  - name: web
+    split:
+      - pool: stable
+        weight: 100
+      - pool: canary
+        weight: 0
+    canary:
+      steps: [50, 100]
+      interval: 1h
+      window: 1m
+      min_requests: 5
+`
+	writeConfig(t, path, content)
+	setupFromFile(t, path)
+	defer resetPool()
+
+	status := func() canary.Status { return currentTable().rollout("web").Status() }
+	deadline := time.Now().Add(2 * time.Second)
+	for status().State != canary.Progressing && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An unchanged rollout goes on where it was
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := status(); s.State != canary.Progressing || s.Weight != 50 || len(s.Decisions) != 1 {
+		t.Fatalf("Expected the rollout to go on at 50%%, got %+v", s)
+	}
+
+	for status().State == canary.Progressing && time.Now().Before(deadline) {
+		lbHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		time.Sleep(time.Millisecond)
+	}
+	if s := status(); s.State != canary.RolledBack {
+		t.Fatalf("Expected the canary to be rolled back, got %+v", s)
+	}
+
+	// A rolled back rollout does not restart
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := status(); s.State != canary.RolledBack || s.Weight != 0 || len(s.Decisions) != 2 {
+		t.Errorf("Expected the rollout to stay rolled back, got %+v", s)
+	}
+
+	// A changed policy starts a new rollout
+	writeConfig(t, path, strings.Replace(content, "steps: [50, 100]", "steps: [20, 100]", 1))
+	if err := reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for status().State != canary.Progressing && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := status(); s.State != canary.Progressing || s.Weight != 20 {
+		t.Errorf("Expected a new rollout at 20%%, got %+v", s)
+	}
+}
+
+func TestReload_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+`)
+	setupFromFile(t, path)
+	before := currentTable()
+
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends: []
+`)
+	if err := reload(path); err == nil {
+		t.Fatal("Expected reload to fail")
+	}
+	if currentTable() != before {
+		t.Error("Expected the routing table to be kept on failed reload")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+`)
+	setupFromFile(t, path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, path, 10*time.Millisecond)
+	// Let the watcher record the initial state of the file
+	time.Sleep(50 * time.Millisecond)
+
+	writeConfig(t, path, `
+pools:
+  - name: web
+    backends:
+      - url: http://localhost:8081
+      - url: http://localhost:8082
+`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(currentTable().pools[0].GetBackends()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the configuration to be reloaded after the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
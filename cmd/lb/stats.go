@@ -2,16 +2,229 @@ package main
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/certs"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+	"github.com/P4ST4S/go-load-balancer/router"
 )
 
-// statsHandler returns the current status of the server pool
+// PoolStats represents the statistics of a pool and its backends
+type PoolStats struct {
+	Name     string              `json:"name"`
+	Strategy core.Strategy       `json:"strategy"`
+	Backends []core.BackendStats `json:"backends"`
+	GRPC     *GRPCStats          `json:"grpc,omitempty"`
+}
+
+// GRPCStats represents the gRPC calls of a pool
+type GRPCStats struct {
+	Calls   uint64 `json:"calls"`
+	Retries uint64 `json:"retries"`
+	// Codes counts the calls by final status code name
+	Codes map[string]uint64 `json:"codes,omitempty"`
+}
+
+// statsHandler returns the current status of the backends, grouped by pool
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	stats := serverPool.GetStats()
+	pools := currentTable().pools
+	stats := make([]PoolStats, 0, len(pools))
+	for _, pool := range pools {
+		stats = append(stats, poolStats(pool))
+	}
+	writeJSON(w, stats)
+}
+
+func poolStats(p *core.ServerPool) PoolStats {
+	stats := p.GetStats()
+	if stats == nil {
+		stats = []core.BackendStats{}
+	}
+	strategy := p.Strategy
+	if strategy == "" {
+		strategy = core.LeastConn
+	}
+	ps := PoolStats{Name: p.Name, Strategy: strategy, Backends: stats}
+	if g := currentTable().grpc[p]; g != nil {
+		ps.GRPC = g.stats()
+	}
+	return ps
+}
+
+// ListenerStats represents a listener and the requests it is serving
+type ListenerStats struct {
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address"`
+	Protocols []string `json:"protocols"`
+	// ActiveRequests counts the requests in flight, ActiveStreams the HTTP/2 ones among them
+	ActiveRequests int64 `json:"active_requests"`
+	ActiveStreams  int64 `json:"active_streams"`
+}
+
+// listenerState holds the counters of a listener
+type listenerState struct {
+	listener config.Listener
+	requests atomic.Int64
+	streams  atomic.Int64
+}
+
+// listenerStates are the counters of the listeners, in the order of the configuration
+var listenerStates atomic.Pointer[[]*listenerState]
+
+// countRequests counts the requests served by next as active on the listener
+func (s *listenerState) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		defer s.requests.Add(-1)
+		if r.ProtoMajor == 2 {
+			s.streams.Add(1)
+			defer s.streams.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenerStatsHandler returns the listeners and their active requests and streams
+func listenerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []ListenerStats{}
+	if states := listenerStates.Load(); states != nil {
+		for _, s := range *states {
+			stats = append(stats, ListenerStats{
+				Name:           s.listener.Name,
+				Address:        s.listener.Address,
+				Protocols:      s.listener.Protocols,
+				ActiveRequests: s.requests.Load(),
+				ActiveStreams:  s.streams.Load(),
+			})
+		}
+	}
+	writeJSON(w, stats)
+}
+
+// CertificateStats represents a certificate served by a TLS listener
+type CertificateStats struct {
+	Listener string `json:"listener,omitempty"`
+	// ACME is true for the certificates obtained by ACME, served by the listeners with tls.acme
+	ACME      bool      `json:"acme,omitempty"`
+	CertFile  string    `json:"cert_file"`
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// DaysLeft is the number of whole days before the certificate expires, negative once expired
+	DaysLeft int `json:"days_left"`
+}
+
+// certificateStatsHandler returns the certificates of the TLS listeners and their expiry dates
+func certificateStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []CertificateStats{}
+	if stores := listenerCerts.Load(); stores != nil {
+		for _, s := range *stores {
+			for _, c := range s.Certificates() {
+				stats = append(stats, certificateStats(c, s.Name))
+			}
+		}
+	}
+	if m := acmeManager.Load(); m != nil {
+		for _, c := range m.Certificates() {
+			cs := certificateStats(c, "")
+			cs.ACME = true
+			stats = append(stats, cs)
+		}
+	}
 	writeJSON(w, stats)
 }
 
+func certificateStats(c certs.Info, listener string) CertificateStats {
+	return CertificateStats{
+		Listener:  listener,
+		CertFile:  c.CertFile,
+		Names:     c.Names,
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		DaysLeft:  int(math.Floor(time.Until(c.NotAfter).Hours() / 24)),
+	}
+}
+
+// RouteStats represents a route and, when it splits its traffic, the outcome of each split target
+type RouteStats struct {
+	Name  string       `json:"name"`
+	Pool  string       `json:"pool,omitempty"`
+	Split []SplitStats `json:"split,omitempty"`
+	// Sticky is the request header or cookie keeping clients on a split target, e.g. "cookie session"
+	Sticky string       `json:"sticky,omitempty"`
+	Mirror *MirrorStats `json:"mirror,omitempty"`
+}
+
+// MirrorStats represents the shadow pool of a route and the outcome of the mirrored requests
+type MirrorStats struct {
+	Pool     string  `json:"pool"`
+	Percent  float64 `json:"percent"`
+	Mirrored uint64  `json:"mirrored"`
+	Skipped  uint64  `json:"skipped"`
+	Dropped  uint64  `json:"dropped"`
+	Failed   uint64  `json:"failed"`
+	// Matched and Mismatches are only counted when the status codes are compared,
+	// mismatches being keyed by "primary/shadow" status codes
+	CompareStatus bool              `json:"compare_status"`
+	Matched       uint64            `json:"matched"`
+	Mismatches    map[string]uint64 `json:"mismatches,omitempty"`
+}
+
+// SplitStats represents a pool of a split, its weight and the requests it served
+type SplitStats struct {
+	Pool     string `json:"pool"`
+	Weight   int    `json:"weight"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+func routeStats(r *router.Route) RouteStats {
+	stats := RouteStats{Name: r.Name}
+	if m := r.Mirror; m != nil {
+		c := m.Counts()
+		stats.Mirror = &MirrorStats{
+			Pool:          m.Pool.Name,
+			Percent:       m.Percent,
+			Mirrored:      c.Mirrored,
+			Skipped:       c.Skipped,
+			Dropped:       c.Dropped,
+			Failed:        c.Failed,
+			CompareStatus: m.CompareStatus,
+			Matched:       c.Matched,
+			Mismatches:    c.Mismatches,
+		}
+	}
+	if r.Split == nil {
+		// Redirect routes may have no pool
+		if r.Pool != nil {
+			stats.Pool = r.Pool.Name
+		}
+		return stats
+	}
+	weights := r.Split.Weights()
+	for i, t := range r.Split.Targets {
+		c := t.Counts()
+		stats.Split = append(stats.Split, SplitStats{Pool: t.Pool.Name, Weight: weights[i], Requests: c.Requests, Errors: c.Errors})
+	}
+	switch {
+	case r.Split.StickyHeader != "":
+		stats.Sticky = "header " + r.Split.StickyHeader
+	case r.Split.StickyCookie != "":
+		stats.Sticky = "cookie " + r.Split.StickyCookie
+	}
+	return stats
+}
+
 func writeJSON(w http.ResponseWriter, data interface{}) {
+	writeJSONStatus(w, http.StatusOK, data)
+}
+
+// writeJSONStatus writes data as JSON with the given status code
+func writeJSONStatus(w http.ResponseWriter, status int, data interface{}) {
 	js, err := json.Marshal(data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -19,5 +232,11 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(js)
 }
+
+// writeError writes an error message as a JSON object
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSONStatus(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/P4ST4S/go-load-balancer/certs"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"golang.org/x/crypto/acme"
+)
+
+// listenerCerts are the certificate stores of the TLS listeners
+var listenerCerts atomic.Pointer[[]*certs.Store]
+
+// acmeManager obtains the certificates of the listeners with tls.acme, nil without ACME
+var acmeManager atomic.Pointer[certs.Manager]
+
+// newListenerTLS loads the certificates of a listener and returns its TLS
+// configuration, selecting the certificate of each connection by SNI. The
+// certificates obtained by m are served first when the listener uses ACME;
+// the store is nil when the listener has no certificate files.
+func newListenerTLS(l config.Listener, m *certs.Manager) (*tls.Config, *certs.Store, error) {
+	var store *certs.Store
+	if len(l.TLS.Certificates) > 0 {
+		pairs := make([]certs.Pair, 0, len(l.TLS.Certificates))
+		for _, c := range l.TLS.Certificates {
+			pairs = append(pairs, certs.Pair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+		}
+		var err error
+		if store, err = certs.NewStore(listenerName(l), pairs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tc := &tls.Config{MinVersion: config.TLSVersions[l.TLS.MinVersion]}
+	if l.TLS.ACME {
+		// The TLS-ALPN-01 challenges are answered by m
+		tc.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, err := m.GetCertificate(hello); cert != nil || err != nil {
+				return cert, err
+			}
+			if store == nil {
+				return nil, fmt.Errorf("no certificate for %q yet", hello.ServerName)
+			}
+			return store.GetCertificate(hello)
+		}
+	} else {
+		tc.GetCertificate = store.GetCertificate
+	}
+	for _, name := range l.TLS.CipherSuites {
+		id, _ := config.CipherSuiteID(name)
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	if l.TLS.ClientCAFile != "" {
+		cas, err := loadCertPool(l.TLS.ClientCAFile, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		tc.ClientCAs = cas
+		// Routes without client_cert accept clients without a certificate,
+		// but a certificate which is presented must be valid
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if l.TLS.ClientAuth == config.ClientAuthRequire {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tc, store, nil
+}
+
+// loadCertPool reads the PEM certificates of file, added to the system roots if system is set
+func loadCertPool(file string, system bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if system {
+		if roots, err := x509.SystemCertPool(); err == nil {
+			pool = roots
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificate found", file)
+	}
+	return pool, nil
+}
+
+// newACMEManager creates the manager obtaining the certificates of the route hosts
+func newACMEManager(cfg *config.ACME) (*certs.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL, UserAgent: "go-load-balancer"}
+	if cfg.CAFile != "" {
+		roots, err := loadCertPool(cfg.CAFile, true)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	m, err := certs.NewManager(cfg.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+	m.Email = cfg.Email
+	m.Challenges = cfg.Challenges
+	m.RenewBefore = cfg.RenewBefore
+	return m, nil
+}
+
+// sameACME reports whether two ACME settings only differ by their hosts,
+// which are applied without a restart
+func sameACME(a, b *config.ACME) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ca, cb := *a, *b
+	ca.Hosts, cb.Hosts = nil, nil
+	return reflect.DeepEqual(ca, cb)
+}
+
+// listenerName names a listener in logs and stats
+func listenerName(l config.Listener) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Address
+}
+
+// serve accepts the connections of a listener, terminating TLS when configured
+func serve(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// The certificates are provided by TLSConfig.GetCertificate
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// reloadCertificates re-reads the certificate files of the TLS listeners which changed
+func reloadCertificates() {
+	stores := listenerCerts.Load()
+	if stores == nil {
+		return
+	}
+	for _, s := range *stores {
+		if err := s.Reload(); err != nil {
+			log.Printf("Certificates (%s): keeping the current certificates: %s", s.Name, err)
+		}
+	}
+}
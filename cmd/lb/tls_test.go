@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/router"
+	"golang.org/x/crypto/acme"
+)
+
+// writeTestCert writes a self-signed certificate for dnsNames, valid for days, to dir
+func writeTestCert(t *testing.T, dir, name string, days int, dnsNames ...string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(days)*24*time.Hour + time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return certFile, keyFile
+}
+
+// writeTestLeaf writes a certificate for commonName and dnsNames signed by the CA of writeTestCA
+func writeTestLeaf(t *testing.T, dir, name, caCertFile, caKeyFile, commonName string, dnsNames ...string) (certFile, keyFile string) {
+	t.Helper()
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return certFile, keyFile
+}
+
+func TestSetupServers_TLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	shopCert, shopKey := writeTestCert(t, dir, "shop", 30, "shop.example.com")
+	wildcardCert, wildcardKey := writeTestCert(t, dir, "wildcard", 90, "*.example.com")
+
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - name: https
+    address: "127.0.0.1:0"
+    tls:
+      certificates:
+        - cert_file: ` + shopCert + `
+          key_file: ` + shopKey + `
+        - cert_file: ` + wildcardCert + `
+          key_file: ` + wildcardKey + `
+      min_version: "1.2"
+pools:
+  - name: web
+    backends:
+      - url: ` + backend.URL + `
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	servers, err := setupServers(cfg)
+	if err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	if servers[0].TLSConfig == nil {
+		t.Fatal("Expected the listener to terminate TLS")
+	}
+
+	ts := httptest.NewUnstartedServer(servers[0].Handler)
+	ts.TLS = servers[0].TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(serverName string, maxVersion uint16) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			MaxVersion:         maxVersion,
+			InsecureSkipVerify: true,
+		}}}
+		return client.Get(ts.URL)
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		expected   string
+	}{
+		{"Exact Certificate", "shop.example.com", "shop.example.com"},
+		{"Wildcard Certificate", "api.example.com", "*.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := get(tt.serverName, 0)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if got := resp.TLS.PeerCertificates[0].DNSNames[0]; got != tt.expected {
+				t.Errorf("Expected the %s certificate, got %s", tt.expected, got)
+			}
+			if string(body) != "https" {
+				t.Errorf("Expected X-Forwarded-Proto https, got %q", body)
+			}
+		})
+	}
+
+	t.Run("Min Version", func(t *testing.T) {
+		if _, err := get("shop.example.com", tls.VersionTLS11); err == nil {
+			t.Error("Expected a TLS 1.1 handshake to fail")
+		}
+	})
+
+	t.Run("Certificate Stats", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		certificateStatsHandler(w, httptest.NewRequest("GET", "/stats/certificates", nil))
+		var stats []CertificateStats
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("Invalid stats: %v", err)
+		}
+		if len(stats) != 2 || stats[0].Listener != "https" || stats[0].CertFile != shopCert || stats[0].DaysLeft != 30 || stats[1].DaysLeft != 90 {
+			t.Errorf("Expected both certificates with their expiry, got %+v", stats)
+		}
+	})
+}
+
+func TestSetupServers_TLSError(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - address: "127.0.0.1:0"
+    tls:
+      certificates:
+        - cert_file: /nonexistent/shop.crt
+          key_file: /nonexistent/shop.key
+pools:
+  - name: web
+    backends:
+      - url: http://127.0.0.1:1
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := setupServers(cfg); err == nil {
+		t.Error("Expected an error for missing certificate files")
+	}
+}
+
+func TestSetupServers_ACME(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	// A certificate obtained by a previous run
+	storage := t.TempDir()
+	writeTestCert(t, storage, "shop.example.com", 60, "shop.example.com")
+
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - name: http
+    address: "127.0.0.1:0"
+  - name: https
+    address: "127.0.0.1:1"
+    tls:
+      acme: true
+pools:
+  - name: web
+    backends:
+      - url: ` + backend.URL + `
+routes:
+  - hosts: [shop.example.com, "*.example.com"]
+    pool: web
+acme:
+  accept_tos: true
+  storage: ` + storage + `
+  directory_url: http://127.0.0.1:1/directory
+  hosts: [www.example.com]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	servers, err := setupServers(cfg)
+	if err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+
+	m := acmeManager.Load()
+	if hosts := m.Hosts(); len(hosts) != 2 || hosts[0] != "shop.example.com" || hosts[1] != "www.example.com" {
+		t.Errorf("Expected the exact route hosts and the acme hosts, got %v", hosts)
+	}
+	tc := servers[1].TLSConfig
+	if !slices.Contains(tc.NextProtos, acme.ALPNProto) {
+		t.Errorf("Expected the TLS-ALPN-01 protocol offered, got %v", tc.NextProtos)
+	}
+	cert, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"})
+	if err != nil || cert.Leaf.DNSNames[0] != "shop.example.com" {
+		t.Errorf("Expected the stored certificate served, got %v", err)
+	}
+	if _, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"}); err == nil {
+		t.Error("Expected no certificate before one is obtained")
+	}
+
+	// Unknown challenge tokens are routed as usual
+	w := httptest.NewRecorder()
+	servers[0].Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://shop.example.com/.well-known/acme-challenge/unknown", nil))
+	if w.Body.String() != "backend /.well-known/acme-challenge/unknown" {
+		t.Errorf("Expected the request proxied, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	certificateStatsHandler(w, httptest.NewRequest("GET", "/stats/certificates", nil))
+	var stats []CertificateStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if len(stats) != 1 || !stats[0].ACME || stats[0].DaysLeft != 60 {
+		t.Errorf("Expected the ACME certificate in the stats, got %+v", stats)
+	}
+}
+
+func TestSetupServers_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := writeTestCA(t, dir)
+	caPEM, _ := os.ReadFile(caCert)
+	cas := x509.NewCertPool()
+	cas.AppendCertsFromPEM(caPEM)
+
+	// The backend only accepts the client certificate of the load balancer
+	backendCert, backendKey := writeTestLeaf(t, dir, "backend", caCert, caKey, "backend", "backend.internal")
+	backendPair, _ := tls.LoadX509KeyPair(backendCert, backendKey)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(router.HeaderClientCertSubject) + "|" + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{backendPair}, ClientCAs: cas, ClientAuth: tls.RequireAndVerifyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	lbCert, lbKey := writeTestLeaf(t, dir, "lb", caCert, caKey, "lb")
+	shopCert, shopKey := writeTestCert(t, dir, "shop", 30, "shop.example.com")
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - name: https
+    address: "127.0.0.1:0"
+    tls:
+      certificates:
+        - cert_file: ` + shopCert + `
+          key_file: ` + shopKey + `
+      client_ca_file: ` + caCert + `
+pools:
+  - name: billing
+    backend_tls:
+      ca_file: ` + caCert + `
+      cert_file: ` + lbCert + `
+      key_file: ` + lbKey + `
+      server_name: backend.internal
+    backends:
+      - url: ` + backend.URL + `
+routes:
+  - path_prefix: /billing
+    pool: billing
+    client_cert:
+      subjects: ["CN=accounting"]
+      sans: [reports.example.com]
+  - pool: billing
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	servers, err := setupServers(cfg)
+	if err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(servers[0].Handler)
+	ts.TLS = servers[0].TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientCert := func(name, commonName string, dnsNames ...string) []tls.Certificate {
+		certFile, keyFile := writeTestLeaf(t, dir, name, caCert, caKey, commonName, dnsNames...)
+		pair, _ := tls.LoadX509KeyPair(certFile, keyFile)
+		return []tls.Certificate{pair}
+	}
+	accounting := clientCert("accounting", "accounting")
+	reports := clientCert("reports", "reports", "reports.example.com")
+	other := clientCert("other", "other")
+
+	tests := []struct {
+		name         string
+		path         string
+		certificates []tls.Certificate
+		status       int
+		body         string
+	}{
+		{"Allowed Subject", "/billing", accounting, http.StatusOK, "CN=accounting|lb"},
+		{"Allowed SAN", "/billing", reports, http.StatusOK, "CN=reports|lb"},
+		{"Denied Certificate", "/billing", other, http.StatusForbidden, ""},
+		{"Missing Certificate", "/billing", nil, http.StatusForbidden, ""},
+		{"Optional Certificate", "/", nil, http.StatusOK, "|lb"},
+		{"Any Certificate Forwarded", "/", other, http.StatusOK, "CN=other|lb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				Certificates:       tt.certificates,
+				InsecureSkipVerify: true,
+			}}}
+			req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+			// Forged headers are never forwarded
+			req.Header.Set(router.HeaderClientCertSubject, "CN=forged")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
+			}
+			if tt.status == http.StatusOK && string(body) != tt.body {
+				t.Errorf("Expected body %q, got %q", tt.body, body)
+			}
+		})
+	}
+
+	t.Run("Health Check", func(t *testing.T) {
+		b := currentTable().pools[0].GetBackends()[0]
+		if !isBackendAlive(b.HealthCheckURL(), time.Second, b.Transport) {
+			t.Error("Expected the backend to be reached with the client certificate")
+		}
+		if isBackendAlive(b.HealthCheckURL(), time.Second, nil) {
+			t.Error("Expected the backend to be unreachable without the client certificate")
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/P4ST4S/go-load-balancer/certs"
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+// httpProtocols returns the protocols of a listener or backend transport
+func httpProtocols(protocols []string) *http.Protocols {
+	p := new(http.Protocols)
+	for _, proto := range protocols {
+		switch proto {
+		case config.ProtocolHTTP1:
+			p.SetHTTP1(true)
+		case config.ProtocolH2:
+			p.SetHTTP2(true)
+		case config.ProtocolH2C:
+			p.SetUnencryptedHTTP2(true)
+		}
+	}
+	return p
+}
+
+// transportKey identifies the backend settings requiring their own transport
+type transportKey struct {
+	tls config.BackendTLS
+	// ca is the digest of the CA file, so that a CA replaced at the same path is read again
+	ca             [sha256.Size]byte
+	protocol       string
+	maxConnections int
+}
+
+// sharedTransport is a backend transport and the reloading of its client certificate
+type sharedTransport struct {
+	transport *http.Transport
+	stop      context.CancelFunc
+}
+
+// backendTransports are shared by the backends having the same settings
+var (
+	backendTransportsMu sync.Mutex
+	backendTransports   = map[transportKey]*sharedTransport{}
+)
+
+// backendTransport returns the transport connecting to the backends with the
+// settings bt, nil for http.DefaultTransport. The client certificate is
+// reloaded when its files change; a changed CA file gets a new transport.
+func backendTransport(bt config.BackendTransport) (*http.Transport, error) {
+	if bt.TLS == nil && bt.Protocol == "" && bt.MaxConnections == 0 {
+		return nil, nil
+	}
+	key := transportKey{protocol: bt.Protocol, maxConnections: bt.MaxConnections}
+	var roots *x509.CertPool
+	if bt.TLS != nil {
+		key.tls = *bt.TLS
+		if key.tls.CAFile != "" {
+			pem, err := os.ReadFile(key.tls.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			key.ca = sha256.Sum256(pem)
+			if roots = x509.NewCertPool(); !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificate found", key.tls.CAFile)
+			}
+		}
+	}
+	backendTransportsMu.Lock()
+	defer backendTransportsMu.Unlock()
+	if s, ok := backendTransports[key]; ok {
+		return s.transport, nil
+	}
+
+	tc := &tls.Config{ServerName: key.tls.ServerName, InsecureSkipVerify: key.tls.InsecureSkipVerify, RootCAs: roots}
+	ctx, stop := context.WithCancel(context.Background())
+	if key.tls.CertFile != "" {
+		store, err := certs.NewStore("backend "+key.tls.CertFile, []certs.Pair{{CertFile: key.tls.CertFile, KeyFile: key.tls.KeyFile}})
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		go store.Watch(ctx, config.DefaultTLSReloadInterval)
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return store.Certificate(), nil
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	// HTTP/2 connections count too: requests beyond their streams wait for one
+	t.MaxConnsPerHost = bt.MaxConnections
+	if bt.Protocol != "" {
+		t.Protocols = httpProtocols([]string{bt.Protocol})
+	}
+	backendTransports[key] = &sharedTransport{transport: t, stop: stop}
+	return t, nil
+}
+
+// releaseTransports forgets the transports no backend of t uses anymore: their
+// client certificate stops being reloaded and their idle connections are
+// closed. Draining backends keep using theirs until their requests complete.
+func releaseTransports(t *routingTable) {
+	used := map[http.RoundTripper]bool{}
+	for _, p := range t.pools {
+		for _, b := range p.GetBackends() {
+			used[b.Transport] = true
+		}
+	}
+	backendTransportsMu.Lock()
+	defer backendTransportsMu.Unlock()
+	for key, s := range backendTransports {
+		if !used[s.transport] {
+			s.stop()
+			s.transport.CloseIdleConnections()
+			delete(backendTransports, key)
+		}
+	}
+}
+
+// streamCounter counts the HTTP/2 streams of the requests proxied to a backend,
+// from the request until its response body is closed
+type streamCounter struct {
+	http.RoundTripper
+	backend *core.Backend
+}
+
+func (c *streamCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	// The protocol of a negotiated connection is only known from the response
+	h2 := c.backend.Protocol == config.ProtocolH2 || c.backend.Protocol == config.ProtocolH2C
+	if h2 {
+		c.backend.ActiveStreams.Add(1)
+	}
+	resp, err := c.RoundTripper.RoundTrip(r)
+	switch {
+	case err != nil || resp.ProtoMajor != 2:
+		if h2 {
+			c.backend.ActiveStreams.Add(-1)
+		}
+		return resp, err
+	case !h2:
+		c.backend.ActiveStreams.Add(1)
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, active: &c.backend.ActiveStreams}
+	return resp, nil
+}
+
+// streamBody ends the stream of a response once closed
+type streamBody struct {
+	io.ReadCloser
+	active *atomic.Int64
+	closed atomic.Bool
+}
+
+func (b *streamBody) Close() error {
+	if !b.closed.Swap(true) {
+		b.active.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
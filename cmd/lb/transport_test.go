@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func TestSetupServers_HTTP2(t *testing.T) {
+	// Requests to /slow wait for release, to observe the open streams
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/grpc/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(r.Proto))
+	})
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	cfg, err := config.Parse([]byte(`
+listeners:
+  - name: h2c
+    address: "127.0.0.1:0"
+    protocols: [http1, h2c]
+pools:
+  - name: grpc
+    protocol: h2c
+    max_streams: 1
+    backends:
+      - url: ` + h2c.URL + `
+  - name: secure
+    protocol: h2
+    backend_tls:
+      insecure_skip_verify: true
+    backends:
+      - url: ` + h2.URL + `
+routes:
+  - path_prefix: /grpc
+    pool: grpc
+  - path_prefix: /secure
+    pool: secure
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	servers, err := setupServers(cfg)
+	if err != nil {
+		t.Fatalf("setupServers failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servers[0].Serve(ln)
+	defer servers[0].Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	get := func(path string) (int, string, string) {
+		resp, err := client.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Proto, string(body)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"H2C Backend", "/grpc"},
+		{"H2 Backend", "/secure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, proto, body := get(tt.path)
+			if status != http.StatusOK || proto != "HTTP/2.0" || body != "HTTP/2.0" {
+				t.Errorf("Expected HTTP/2 on both sides, got %d %s, backend %q", status, proto, body)
+			}
+		})
+	}
+
+	t.Run("Max Streams", func(t *testing.T) {
+		done := make(chan int)
+		go func() {
+			resp, err := client.Get("http://" + ln.Addr().String() + "/grpc/slow")
+			if err != nil {
+				done <- 0
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		<-arrived
+
+		b := currentTable().pools[0].GetBackends()[0]
+		if n := b.ActiveStreams.Load(); n != 1 {
+			t.Errorf("Expected 1 active backend stream, got %d", n)
+		}
+		w := httptest.NewRecorder()
+		listenerStatsHandler(w, httptest.NewRequest("GET", "/stats/listeners", nil))
+		var stats []ListenerStats
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		if len(stats) != 1 || stats[0].ActiveStreams != 1 || stats[0].ActiveRequests != 1 {
+			t.Errorf("Expected 1 active listener stream, got %+v", stats)
+		}
+
+		// The only backend is at its limit
+		if status, _, _ := get("/grpc"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 beyond max_streams, got %d", status)
+		}
+
+		close(release)
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("Expected the slow request to succeed, got %d", status)
+		}
+		deadline := time.Now().Add(time.Second)
+		for b.ActiveStreams.Load() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := b.ActiveStreams.Load(); n != 0 {
+			t.Errorf("Expected the stream closed, got %d", n)
+		}
+		if st := b.GetStats(); st.Protocol != config.ProtocolH2C || st.MaxStreams != 1 {
+			t.Errorf("Expected the protocol and limit in the backend stats, got %+v", st)
+		}
+	})
+}
+
+func TestBackendTransport(t *testing.T) {
+	if tr, err := backendTransport(config.BackendTransport{}); tr != nil || err != nil {
+		t.Errorf("Expected the default transport, got %v, %v", tr, err)
+	}
+
+	bt := config.BackendTransport{Protocol: config.ProtocolH2C, MaxConnections: 4, MaxStreams: 10}
+	tr, err := backendTransport(bt)
+	if err != nil {
+		t.Fatalf("backendTransport failed: %v", err)
+	}
+	if !tr.Protocols.UnencryptedHTTP2() || tr.Protocols.HTTP1() || tr.MaxConnsPerHost != 4 {
+		t.Errorf("Expected an h2c transport limited to 4 connections, got %v, %d", tr.Protocols, tr.MaxConnsPerHost)
+	}
+	// max_streams is enforced by the balancer, it does not need another transport
+	bt.MaxStreams = 20
+	if again, _ := backendTransport(bt); again != tr {
+		t.Error("Expected the transport to be shared")
+	}
+
+	_, err = backendTransport(config.BackendTransport{TLS: &config.BackendTLS{CAFile: "/nonexistent/ca.pem"}})
+	if err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+
+	// A CA replaced at the same path is read again
+	dir := t.TempDir()
+	caFile, _ := writeTestCA(t, dir)
+	tlsBT := config.BackendTransport{TLS: &config.BackendTLS{CAFile: caFile}}
+	first, err := backendTransport(tlsBT)
+	if err != nil {
+		t.Fatalf("backendTransport failed: %v", err)
+	}
+	writeTestCA(t, dir)
+	rotated, err := backendTransport(tlsBT)
+	if err != nil {
+		t.Fatalf("backendTransport failed: %v", err)
+	}
+	if rotated == first {
+		t.Error("Expected a new transport for the rotated CA")
+	}
+
+	// The transports no backend uses are released
+	pool := &core.ServerPool{Name: "web"}
+	pool.AddBackend(&core.Backend{URL: &url.URL{Scheme: "https", Host: "app1:443"}, Transport: rotated})
+	releaseTransports(&routingTable{pools: []*core.ServerPool{pool}})
+	if again, _ := backendTransport(tlsBT); again != rotated {
+		t.Error("Expected the transport in use to be kept")
+	}
+	if again, _ := backendTransport(bt); again == tr {
+		t.Error("Expected the unused transport to be released")
+	}
+}
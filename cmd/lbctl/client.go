@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+var errUsage = errors.New("invalid usage")
+
+// poolStats mirrors the pools returned by GET /admin/pools
+type poolStats struct {
+	Name     string              `json:"name"`
+	Strategy string              `json:"strategy"`
+	Backends []core.BackendStats `json:"backends"`
+}
+
+// addBackendRequest is the body of POST /admin/pools/{pool}/backends
+type addBackendRequest struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// updateBackendRequest is the body of POST /admin/pools/{pool}/backends/{id}
+type updateBackendRequest struct {
+	Weight *int    `json:"weight,omitempty"`
+	State  *string `json:"state,omitempty"`
+}
+
+// routeStats mirrors the routes returned by GET /admin/routes
+type routeStats struct {
+	Name  string `json:"name"`
+	Pool  string `json:"pool,omitempty"`
+	Split []struct {
+		Pool     string `json:"pool"`
+		Weight   int    `json:"weight"`
+		Requests uint64 `json:"requests"`
+		Errors   uint64 `json:"errors"`
+	} `json:"split,omitempty"`
+	Sticky string `json:"sticky,omitempty"`
+	Mirror *struct {
+		Pool          string            `json:"pool"`
+		Percent       float64           `json:"percent"`
+		Mirrored      uint64            `json:"mirrored"`
+		Skipped       uint64            `json:"skipped"`
+		Dropped       uint64            `json:"dropped"`
+		Failed        uint64            `json:"failed"`
+		CompareStatus bool              `json:"compare_status"`
+		Matched       uint64            `json:"matched"`
+		Mismatches    map[string]uint64 `json:"mismatches,omitempty"`
+	} `json:"mirror,omitempty"`
+}
+
+// splitRequest is the body of POST /admin/routes/{route}/split
+type splitRequest struct {
+	Weights map[string]int `json:"weights"`
+}
+
+// rolloutWindow mirrors the window stats of a pool of a rollout
+type rolloutWindow struct {
+	Pool      string  `json:"pool"`
+	Requests  uint64  `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// rolloutStatus mirrors the rollouts returned by GET /admin/rollouts
+type rolloutStatus struct {
+	Route     string        `json:"route"`
+	State     string        `json:"state"`
+	Weight    int           `json:"weight"`
+	Steps     []int         `json:"steps"`
+	Stable    rolloutWindow `json:"stable"`
+	Canary    rolloutWindow `json:"canary"`
+	Decisions []struct {
+		Time   time.Time `json:"time"`
+		Action string    `json:"action"`
+		Weight int       `json:"weight"`
+		Reason string    `json:"reason"`
+	} `json:"decisions"`
+}
+
+// explainRequest is the body of POST /admin/routes/explain
+type explainRequest struct {
+	Method   string            `json:"method,omitempty"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	ClientIP string            `json:"client_ip,omitempty"`
+}
+
+// explanation mirrors the response of POST /admin/routes/explain
+type explanation struct {
+	Route    string `json:"route,omitempty"`
+	Pool     string `json:"pool,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	Rewrite  string `json:"rewrite,omitempty"`
+	Steps    []struct {
+		Route   string `json:"route"`
+		Hosts   string `json:"hosts"`
+		Matched bool   `json:"matched"`
+		Reason  string `json:"reason,omitempty"`
+	} `json:"steps"`
+}
+
+// client calls the admin API of a load balancer
+type client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func newClient(addr, token string, timeout time.Duration) *client {
+	return &client{
+		addr:  strings.TrimSuffix(addr, "/"),
+		token: token,
+		http:  &http.Client{Timeout: timeout},
+	}
+}
+
+// pools returns every pool, or only the named one when pool is not empty
+func (c *client) pools(pool string) ([]poolStats, error) {
+	var pools []poolStats
+	if err := c.do("GET", "/admin/pools", nil, &pools); err != nil {
+		return nil, err
+	}
+	if pool == "" {
+		return pools, nil
+	}
+	for _, p := range pools {
+		if p.Name == pool {
+			return []poolStats{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("pool %s not found", pool)
+}
+
+func (c *client) addBackend(pool string, req addBackendRequest) (core.BackendStats, error) {
+	var b core.BackendStats
+	err := c.do("POST", backendsPath(pool), req, &b)
+	return b, err
+}
+
+func (c *client) updateBackend(pool, id string, req updateBackendRequest) (core.BackendStats, error) {
+	var b core.BackendStats
+	err := c.do("POST", backendsPath(pool)+"/"+url.PathEscape(id), req, &b)
+	return b, err
+}
+
+func (c *client) removeBackend(pool, id string) (core.BackendStats, error) {
+	var b core.BackendStats
+	err := c.do("DELETE", backendsPath(pool)+"/"+url.PathEscape(id), nil, &b)
+	return b, err
+}
+
+func (c *client) reload() error {
+	return c.do("POST", "/admin/reload", nil, nil)
+}
+
+func (c *client) routes() ([]routeStats, error) {
+	var routes []routeStats
+	err := c.do("GET", "/admin/routes", nil, &routes)
+	return routes, err
+}
+
+func (c *client) setSplit(route string, req splitRequest) (routeStats, error) {
+	var r routeStats
+	err := c.do("POST", "/admin/routes/"+url.PathEscape(route)+"/split", req, &r)
+	return r, err
+}
+
+// rollouts returns every rollout, or only the one of the route when route is not empty
+func (c *client) rollouts(route string) ([]rolloutStatus, error) {
+	if route != "" {
+		var r rolloutStatus
+		err := c.do("GET", "/admin/rollouts/"+url.PathEscape(route), nil, &r)
+		return []rolloutStatus{r}, err
+	}
+	var rollouts []rolloutStatus
+	err := c.do("GET", "/admin/rollouts", nil, &rollouts)
+	return rollouts, err
+}
+
+func (c *client) explain(req explainRequest) (explanation, error) {
+	var e explanation
+	err := c.do("POST", "/admin/routes/explain", req, &e)
+	return e, err
+}
+
+func backendsPath(pool string) string {
+	return "/admin/pools/" + url.PathEscape(pool) + "/backends"
+}
+
+// do sends a JSON request and decodes the JSON response into out (when not nil).
+// Errors reported by the admin API are returned with their message.
+func (c *client) do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (%d)", apiErr.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
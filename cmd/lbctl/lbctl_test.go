@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const poolsJSON = `[{"name": "web", "strategy": "least_conn", "backends": [
+	{"id": "http://app1:80", "url": "http://app1:80", "alive": true, "status": "ready", "admin_state": "enabled", "weight": 2, "conn_count": 3, "uptime": "00h:01m:00s", "memory_usage": "1.00 MB", "cpu_usage": 4.2},
+	{"id": "app2:80", "url": "http://app2:80", "alive": false, "status": "ready", "admin_state": "disabled", "weight": 1}
+]}]`
+
+const routesJSON = `[
+	{"name": "api", "pool": "api", "mirror": {"pool": "shadow", "percent": 10, "mirrored": 120, "skipped": 1,
+		"dropped": 0, "failed": 3, "compare_status": true, "matched": 116, "mismatches": {"200/500": 3, "404/200": 1}}},
+	{"name": "web", "split": [
+		{"pool": "stable", "weight": 95, "requests": 950, "errors": 1},
+		{"pool": "canary", "weight": 5, "requests": 50, "errors": 2}
+	], "sticky": "cookie session"}
+]`
+
+const rolloutJSON = `{"route": "web", "state": "rolled_back", "weight": 0, "steps": [5, 25, 100],
+	"stable": {"pool": "stable", "requests": 900, "error_rate": 0.1, "latency_ms": 12.5},
+	"canary": {"pool": "canary", "requests": 100, "error_rate": 7, "latency_ms": 13},
+	"decisions": [
+		{"time": "2026-01-02T10:00:00Z", "action": "start", "weight": 5, "reason": "starting at 5%"},
+		{"time": "2026-01-02T10:03:00Z", "action": "rollback", "weight": 0, "reason": "canary error rate 7.00% exceeds stable 0.10% by 6.90 points (max 1.00)"}
+	]}`
+
+// fakeAdmin serves a canned admin API and records the last mutation received
+type fakeAdmin struct {
+	method, path, body string
+}
+
+func (f *fakeAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid or missing bearer token"}`))
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/admin/pools" {
+		w.Write([]byte(poolsJSON))
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/admin/rollouts/web" {
+		w.Write([]byte(rolloutJSON))
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/admin/rollouts" {
+		w.Write([]byte("[" + rolloutJSON + "]"))
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/admin/routes" {
+		w.Write([]byte(routesJSON))
+		return
+	}
+
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	f.method, f.path, f.body = r.Method, r.URL.EscapedPath(), body.String()
+
+	switch {
+	case r.URL.Path == "/admin/reload":
+		w.Write([]byte(`{"status": "reloaded"}`))
+	case strings.HasSuffix(r.URL.Path, "/split"):
+		w.Write([]byte(`{"name": "web", "split": [{"pool": "stable", "weight": 80}, {"pool": "canary", "weight": 20}]}`))
+	case r.URL.Path == "/admin/routes/explain":
+		w.Write([]byte(`{"route": "web", "pool": "web", "steps": [
+	{"route": "canary", "hosts": "*", "matched": false, "reason": "header X-Canary is missing"},
+	{"route": "web", "hosts": "*", "matched": true}
+]}`))
+	case strings.HasSuffix(r.URL.Path, "/app9:80"):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "backend app9:80 not found in pool web"}`))
+	default:
+		w.Write([]byte(`{"id": "http://app1:80", "url": "http://app1:80", "admin_state": "draining"}`))
+	}
+}
+
+func runLbctl(t *testing.T, addr string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-addr", addr, "-token", "secret"}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestBackends(t *testing.T) {
+	ts := httptest.NewServer(&fakeAdmin{})
+	defer ts.Close()
+
+	t.Run("Table", func(t *testing.T) {
+		code, out, _ := runLbctl(t, ts.URL, "backends")
+		if code != 0 {
+			t.Fatalf("Expected exit code 0, got %d", code)
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[0], "POOL") {
+			t.Fatalf("Expected a header and 2 rows, got:\n%s", out)
+		}
+		if fields := strings.Fields(lines[1]); fields[1] != "http://app1:80" || fields[6] != "3" {
+			t.Errorf("Unexpected row: %s", lines[1])
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		_, out, _ := runLbctl(t, ts.URL, "-o", "json", "backends", "web")
+		var pools []poolStats
+		if err := json.Unmarshal([]byte(out), &pools); err != nil {
+			t.Fatalf("Invalid JSON: %v", err)
+		}
+		if len(pools) != 1 || len(pools[0].Backends) != 2 {
+			t.Errorf("Unexpected pools: %+v", pools)
+		}
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		_, out, _ := runLbctl(t, ts.URL, "-o", "yaml", "backends")
+		var pools []map[string]any
+		if err := yaml.Unmarshal([]byte(out), &pools); err != nil {
+			t.Fatalf("Invalid YAML: %v", err)
+		}
+		if !strings.Contains(out, "- name: web") || !strings.Contains(out, "conn_count: 3") {
+			t.Errorf("Expected block style YAML with API field names, got:\n%s", out)
+		}
+	})
+
+	t.Run("Unknown Pool", func(t *testing.T) {
+		code, _, stderr := runLbctl(t, ts.URL, "backends", "api")
+		if code != 1 || !strings.Contains(stderr, "pool api not found") {
+			t.Errorf("Expected pool not found error, got %d: %s", code, stderr)
+		}
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-addr", ts.URL, "backends"}, &stdout, &stderr)
+		if code != 1 || !strings.Contains(stderr.String(), "invalid or missing bearer token (401)") {
+			t.Errorf("Expected API error, got %d: %s", code, stderr.String())
+		}
+	})
+}
+
+func TestMutations(t *testing.T) {
+	admin := &fakeAdmin{}
+	ts := httptest.NewServer(admin)
+	defer ts.Close()
+
+	tests := []struct {
+		args   []string
+		method string
+		path   string
+		body   string
+	}{
+		{[]string{"drain", "web", "app1:80"}, "POST", "/admin/pools/web/backends/app1:80", `{"state":"draining"}`},
+		{[]string{"drain", "web", "http://app1:80/api"}, "POST", "/admin/pools/web/backends/http:%2F%2Fapp1:80%2Fapi", `{"state":"draining"}`},
+		{[]string{"enable", "web", "app1:80"}, "POST", "/admin/pools/web/backends/app1:80", `{"state":"enabled"}`},
+		{[]string{"disable", "web", "app1:80"}, "POST", "/admin/pools/web/backends/app1:80", `{"state":"disabled"}`},
+		{[]string{"weight", "web", "app1:80", "4"}, "POST", "/admin/pools/web/backends/app1:80", `{"weight":4}`},
+		{[]string{"add", "web", "http://app4:80", "2"}, "POST", "/admin/pools/web/backends", `{"url":"http://app4:80","weight":2}`},
+		{[]string{"remove", "web", "app1:80"}, "DELETE", "/admin/pools/web/backends/app1:80", ``},
+		{[]string{"reload"}, "POST", "/admin/reload", ``},
+		{[]string{"split", "web", "stable=80", "canary=20"}, "POST", "/admin/routes/web/split", `{"weights":{"canary":20,"stable":80}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.args[0], func(t *testing.T) {
+			code, _, stderr := runLbctl(t, ts.URL, tt.args...)
+			if code != 0 {
+				t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+			}
+			if admin.method != tt.method || admin.path != tt.path || admin.body != tt.body {
+				t.Errorf("Expected %s %s %s, got %s %s %s", tt.method, tt.path, tt.body, admin.method, admin.path, admin.body)
+			}
+		})
+	}
+
+	t.Run("API Error", func(t *testing.T) {
+		code, _, stderr := runLbctl(t, ts.URL, "drain", "web", "app9:80")
+		if code != 1 || !strings.Contains(stderr, "backend app9:80 not found in pool web (404)") {
+			t.Errorf("Expected not found error, got %d: %s", code, stderr)
+		}
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		for _, args := range [][]string{{}, {"drain", "web"}, {"weight", "web", "app1:80", "x"}, {"split", "web"}, {"split", "web", "canary"}, {"explode"}} {
+			if code, _, _ := runLbctl(t, ts.URL, args...); code == 0 {
+				t.Errorf("Expected %v to fail", args)
+			}
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	ts := httptest.NewServer(&fakeAdmin{})
+	defer ts.Close()
+
+	code, out, _ := runLbctl(t, ts.URL, "-o", "json", "watch", "-interval", "10ms", "-n", "2")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if got := strings.Count(out, `"name": "web"`); got != 2 {
+		t.Errorf("Expected 2 refreshes, got %d", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	os.WriteFile(valid, []byte("pools:\n  - name: web\n    backends:\n      - url: http://app1:80\n"), 0o644)
+	invalid := filepath.Join(dir, "invalid.yaml")
+	os.WriteFile(invalid, []byte("pools:\n  - name: web\n    backend: []\n"), 0o644)
+
+	code, out, _ := runLbctl(t, "http://unused", "validate", valid)
+	if code != 0 || !strings.Contains(out, "is valid: 1 listener(s), 1 pool(s), 1 backend(s), 0 route(s)") {
+		t.Errorf("Expected valid configuration, got %d: %s", code, out)
+	}
+
+	code, _, stderr := runLbctl(t, "http://unused", "validate", invalid)
+	if code != 1 || !strings.Contains(stderr, `line 3: pools[0].backend: unknown field "backend"`) {
+		t.Errorf("Expected validation error with line number, got %d: %s", code, stderr)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	admin := &fakeAdmin{}
+	ts := httptest.NewServer(admin)
+	defer ts.Close()
+
+	code, out, stderr := runLbctl(t, ts.URL, "explain", "-X", "POST", "-H", "X-Canary: 0", "-client", "10.0.0.1", "http://shop.example.com/cart")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+	}
+	expected := `{"method":"POST","url":"http://shop.example.com/cart","headers":{"X-Canary":"0"},"client_ip":"10.0.0.1"}`
+	if admin.path != "/admin/routes/explain" || admin.body != expected {
+		t.Errorf("Expected %s, got %s %s", expected, admin.path, admin.body)
+	}
+	for _, want := range []string{"canary  *      header X-Canary is missing", "web     *      matched", "Route web, pool web"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	if code, _, _ := runLbctl(t, ts.URL, "explain", "-H", "nocolon", "/"); code != 2 {
+		t.Errorf("Expected usage error for an invalid header, got %d", code)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	ts := httptest.NewServer(&fakeAdmin{})
+	defer ts.Close()
+
+	code, out, stderr := runLbctl(t, ts.URL, "routes")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+	}
+	for _, want := range []string{
+		"api    api     -       100%   -         -       -           -",
+		"web    stable  95      95.0%  950       1       0.11%       cookie session",
+		"web    canary  5       5.0%   50        2       4.00%       cookie session",
+		"api    shadow  10%      120       1        0        3       4/120 (200/500: 3, 404/200: 1)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRollouts(t *testing.T) {
+	ts := httptest.NewServer(&fakeAdmin{})
+	defer ts.Close()
+
+	code, out, stderr := runLbctl(t, ts.URL, "rollouts")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+	}
+	for _, want := range []string{
+		"web    rolled_back  0%      5,25,100  canary  100       7.00%       13.0ms",
+		"                                      stable  900       0.10%       12.5ms",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "REASON") {
+		t.Errorf("Expected no decisions without route, got:\n%s", out)
+	}
+
+	code, out, _ = runLbctl(t, ts.URL, "rollouts", "web")
+	if code != 0 || !strings.Contains(out, "rollback  0%      canary error rate 7.00% exceeds stable 0.10%") {
+		t.Errorf("Expected the decisions of the rollout, got %d:\n%s", code, out)
+	}
+
+	code, out, _ = runLbctl(t, ts.URL, "-o", "json", "rollouts", "web")
+	var r rolloutStatus
+	if code != 0 || json.Unmarshal([]byte(out), &r) != nil || len(r.Decisions) != 2 {
+		t.Errorf("Expected the rollout as JSON, got %d:\n%s", code, out)
+	}
+}
@@ -0,0 +1,311 @@
+// Command lbctl manages a running load balancer through its admin API.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+)
+
+const usage = `Usage: lbctl [flags] <command> [arguments]
+
+Commands:
+  backends [pool]             List the backends, of every pool or of one pool
+  watch [-interval 1s] [-n 0] [pool]
+                              Refresh the backends list until interrupted (or n times)
+  add <pool> <url> [weight]   Add a backend to a pool
+  remove <pool> <id>          Remove a backend once its in-flight requests complete
+  enable <pool> <id>          Put a backend back in rotation
+  disable <pool> <id>         Take a backend out of rotation
+  drain <pool> <id>           Take a backend out of rotation, letting in-flight requests complete
+  weight <pool> <id> <n>      Change the weight of a backend
+  routes                      List the routes, with the weights and outcome of the split ones
+  split <route> <pool>=<weight>...
+                              Change the weights of the pools of a split route
+  rollouts [route]            Show the automated canary rollouts, and the decisions of one
+  explain [-X method] [-H "name: value"] [-client ip] <url>
+                              Show which route and pool would serve a request
+  reload                      Reload the configuration file of the load balancer
+  validate <file>             Validate a configuration file offline
+
+A backend id is its URL, or the host:port of the URL when no other backend
+of the pool shares it.
+
+Flags:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes lbctl with the given arguments and returns the exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("lbctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", envOr("LBCTL_ADDR", "http://127.0.0.1:3031"), "Admin API address (defaults to $LBCTL_ADDR)")
+	token := fs.String("token", os.Getenv("LB_ADMIN_TOKEN"), "Admin API bearer token (defaults to $LB_ADMIN_TOKEN)")
+	output := fs.String("o", "table", "Output format: table, json or yaml")
+	timeout := fs.Duration("timeout", 10*time.Second, "Request timeout")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	format, err := parseFormat(*output)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c := newClient(*addr, *token, *timeout)
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+
+	err = dispatch(c, cmd, rest, format, stdout)
+	if err == errUsage {
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "lbctl %s: %s\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+func dispatch(c *client, cmd string, args []string, format outputFormat, stdout io.Writer) error {
+	switch cmd {
+	case "backends":
+		if len(args) > 1 {
+			return errUsage
+		}
+		pools, err := c.pools(optionalArg(args))
+		if err != nil {
+			return err
+		}
+		return printPools(stdout, format, pools)
+
+	case "watch":
+		return watch(c, args, format, stdout)
+
+	case "add":
+		if len(args) != 2 && len(args) != 3 {
+			return errUsage
+		}
+		req := addBackendRequest{URL: args[1]}
+		if len(args) == 3 {
+			w, err := strconv.Atoi(args[2])
+			if err != nil || w < 1 {
+				return fmt.Errorf("invalid weight %q", args[2])
+			}
+			req.Weight = w
+		}
+		b, err := c.addBackend(args[0], req)
+		if err != nil {
+			return err
+		}
+		return printBackend(stdout, format, args[0], b)
+
+	case "remove":
+		if len(args) != 2 {
+			return errUsage
+		}
+		b, err := c.removeBackend(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return printBackend(stdout, format, args[0], b)
+
+	case "enable", "disable", "drain":
+		if len(args) != 2 {
+			return errUsage
+		}
+		state := map[string]string{"enable": "enabled", "disable": "disabled", "drain": "draining"}[cmd]
+		b, err := c.updateBackend(args[0], args[1], updateBackendRequest{State: &state})
+		if err != nil {
+			return err
+		}
+		return printBackend(stdout, format, args[0], b)
+
+	case "weight":
+		if len(args) != 3 {
+			return errUsage
+		}
+		w, err := strconv.Atoi(args[2])
+		if err != nil || w < 1 {
+			return fmt.Errorf("invalid weight %q", args[2])
+		}
+		b, err := c.updateBackend(args[0], args[1], updateBackendRequest{Weight: &w})
+		if err != nil {
+			return err
+		}
+		return printBackend(stdout, format, args[0], b)
+
+	case "routes":
+		if len(args) != 0 {
+			return errUsage
+		}
+		routes, err := c.routes()
+		if err != nil {
+			return err
+		}
+		return printRoutes(stdout, format, routes)
+
+	case "split":
+		if len(args) < 2 {
+			return errUsage
+		}
+		req := splitRequest{Weights: map[string]int{}}
+		for _, arg := range args[1:] {
+			pool, weight, ok := strings.Cut(arg, "=")
+			w, err := strconv.Atoi(weight)
+			if !ok || err != nil {
+				return fmt.Errorf("invalid pool weight %q (expected pool=weight)", arg)
+			}
+			req.Weights[pool] = w
+		}
+		r, err := c.setSplit(args[0], req)
+		if err != nil {
+			return err
+		}
+		return printRoutes(stdout, format, []routeStats{r})
+
+	case "rollouts":
+		if len(args) > 1 {
+			return errUsage
+		}
+		rollouts, err := c.rollouts(optionalArg(args))
+		if err != nil {
+			return err
+		}
+		return printRollouts(stdout, format, rollouts, len(args) == 1)
+
+	case "explain":
+		return explain(c, args, format, stdout)
+
+	case "reload":
+		if len(args) != 0 {
+			return errUsage
+		}
+		if err := c.reload(); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Configuration reloaded")
+		return nil
+
+	case "validate":
+		if len(args) != 1 {
+			return errUsage
+		}
+		cfg, err := config.Load(args[0])
+		if err != nil {
+			return err
+		}
+		backends := 0
+		for _, p := range cfg.Pools {
+			backends += len(p.Backends)
+		}
+		fmt.Fprintf(stdout, "%s is valid: %d listener(s), %d pool(s), %d backend(s), %d route(s)\n",
+			args[0], len(cfg.Listeners), len(cfg.Pools), backends, len(cfg.Routes))
+		return nil
+	}
+
+	return errUsage
+}
+
+// watch prints the backends every interval until interrupted
+func watch(c *client, args []string, format outputFormat, stdout io.Writer) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	count := fs.Int("n", 0, "Number of refreshes, 0 for no limit")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	pool := optionalArg(fs.Args())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.C:
+			}
+		}
+
+		pools, err := c.pools(pool)
+		if err != nil {
+			return err
+		}
+		if format == formatTable {
+			// Clear the screen and redraw
+			fmt.Fprint(stdout, "\033[H\033[2J")
+			fmt.Fprintf(stdout, "%s (every %s)\n\n", time.Now().Format(time.TimeOnly), *interval)
+		}
+		if err := printPools(stdout, format, pools); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explain asks the load balancer how it would route a request
+func explain(c *client, args []string, format outputFormat, stdout io.Writer) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	req := explainRequest{Headers: map[string]string{}}
+	fs.StringVar(&req.Method, "X", "GET", "Request method")
+	fs.StringVar(&req.ClientIP, "client", "", "Client IP address")
+	fs.Func("H", "Request header, repeatable", func(h string) error {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q", h)
+		}
+		req.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	req.URL = fs.Arg(0)
+
+	e, err := c.explain(req)
+	if err != nil {
+		return err
+	}
+	return printExplanation(stdout, format, e)
+}
+
+func optionalArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+	"gopkg.in/yaml.v3"
+)
+
+type outputFormat string
+
+const (
+	formatTable outputFormat = "table"
+	formatJSON  outputFormat = "json"
+	formatYAML  outputFormat = "yaml"
+)
+
+func parseFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(s); f {
+	case formatTable, formatJSON, formatYAML:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (expected table, json or yaml)", s)
+}
+
+// printPools prints the backends of the pools
+func printPools(w io.Writer, format outputFormat, pools []poolStats) error {
+	if format != formatTable {
+		return printData(w, format, pools)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tURL\tALIVE\tSTATUS\tSTATE\tWEIGHT\tCONNS\tUPTIME\tMEMORY\tCPU")
+	for _, p := range pools {
+		for _, b := range p.Backends {
+			printRow(tw, p.Name, b)
+		}
+	}
+	return tw.Flush()
+}
+
+// printBackend prints a single backend of a pool
+func printBackend(w io.Writer, format outputFormat, pool string, b core.BackendStats) error {
+	return printPools(w, format, []poolStats{{Name: pool, Backends: []core.BackendStats{b}}})
+}
+
+func printRow(w io.Writer, pool string, b core.BackendStats) {
+	fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%d\t%d\t%s\t%s\t%.1f%%\n",
+		pool, b.URL, b.Alive, b.Status, b.AdminState, b.Weight, b.ConnCount, b.UpTime, b.MemoryUsage, b.CPUUsage)
+}
+
+// printRoutes prints the routes, with a row per pool of the split routes
+func printRoutes(w io.Writer, format outputFormat, routes []routeStats) error {
+	if format != formatTable {
+		return printData(w, format, routes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tPOOL\tWEIGHT\tSHARE\tREQUESTS\tERRORS\tERROR RATE\tSTICKY")
+	for _, r := range routes {
+		if len(r.Split) == 0 {
+			pool := r.Pool
+			if pool == "" {
+				// Redirect route
+				pool = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t-\t100%%\t-\t-\t-\t-\n", r.Name, pool)
+			continue
+		}
+		total := 0
+		for _, t := range r.Split {
+			total += t.Weight
+		}
+		sticky := r.Sticky
+		if sticky == "" {
+			sticky = "-"
+		}
+		for _, t := range r.Split {
+			rate := 0.0
+			if t.Requests > 0 {
+				rate = float64(t.Errors) / float64(t.Requests) * 100
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f%%\t%d\t%d\t%.2f%%\t%s\n",
+				r.Name, t.Pool, t.Weight, float64(t.Weight)/float64(max(total, 1))*100, t.Requests, t.Errors, rate, sticky)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(routes, func(r routeStats) bool { return r.Mirror != nil }) {
+		return nil
+	}
+
+	// Mirrored routes and how their shadow pool answered
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tSHADOW\tPERCENT\tMIRRORED\tSKIPPED\tDROPPED\tFAILED\tSTATUS DIFF")
+	for _, r := range routes {
+		m := r.Mirror
+		if m == nil {
+			continue
+		}
+		diff := "-"
+		if m.CompareStatus {
+			var total uint64
+			var pairs []string
+			for _, k := range slices.Sorted(maps.Keys(m.Mismatches)) {
+				total += m.Mismatches[k]
+				pairs = append(pairs, fmt.Sprintf("%s: %d", k, m.Mismatches[k]))
+			}
+			diff = fmt.Sprintf("%d/%d", total, total+m.Matched)
+			if len(pairs) > 0 {
+				diff += " (" + strings.Join(pairs, ", ") + ")"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%g%%\t%d\t%d\t%d\t%d\t%s\n",
+			r.Name, m.Pool, m.Percent, m.Mirrored, m.Skipped, m.Dropped, m.Failed, diff)
+	}
+	return tw.Flush()
+}
+
+// printRollouts prints the progress of the rollouts, and the decisions of a single one
+func printRollouts(w io.Writer, format outputFormat, rollouts []rolloutStatus, decisions bool) error {
+	if format != formatTable {
+		if decisions {
+			return printData(w, format, rollouts[0])
+		}
+		return printData(w, format, rollouts)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tSTATE\tWEIGHT\tSTEPS\tPOOL\tREQUESTS\tERROR RATE\tLATENCY")
+	for _, r := range rollouts {
+		steps := make([]string, len(r.Steps))
+		for i, s := range r.Steps {
+			steps[i] = fmt.Sprintf("%d", s)
+		}
+		for i, p := range []rolloutWindow{r.Canary, r.Stable} {
+			route, state, weight, stepList := r.Route, r.State, fmt.Sprintf("%d%%", r.Weight), strings.Join(steps, ",")
+			if i > 0 {
+				route, state, weight, stepList = "", "", "", ""
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%.2f%%\t%.1fms\n",
+				route, state, weight, stepList, p.Pool, p.Requests, p.ErrorRate, p.LatencyMS)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !decisions {
+		return nil
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTION\tWEIGHT\tREASON")
+	for _, d := range rollouts[0].Decisions {
+		fmt.Fprintf(tw, "%s\t%s\t%d%%\t%s\n", d.Time.Local().Format(time.DateTime), d.Action, d.Weight, d.Reason)
+	}
+	return tw.Flush()
+}
+
+// printExplanation prints the routes considered for a request, then the route serving it
+func printExplanation(w io.Writer, format outputFormat, e explanation) error {
+	if format != formatTable {
+		return printData(w, format, e)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tHOSTS\tRESULT")
+	for _, s := range e.Steps {
+		result := s.Reason
+		if s.Matched {
+			result = "matched"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Route, s.Hosts, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case e.Redirect != "":
+		_, err := fmt.Fprintf(w, "\nRoute %s, redirected with status %d to %s\n", e.Route, e.Status, e.Redirect)
+		return err
+	case e.Route != "" && e.Pool != "":
+		rewrite := ""
+		if e.Rewrite != "" {
+			rewrite = ", rewritten to " + e.Rewrite
+		}
+		_, err := fmt.Fprintf(w, "\nRoute %s, pool %s%s\n", e.Route, e.Pool, rewrite)
+		return err
+	case e.Route != "":
+		_, err := fmt.Fprintf(w, "\nRoute %s, answered with status %d\n", e.Route, e.Status)
+		return err
+	case e.Pool != "":
+		_, err := fmt.Fprintf(w, "\nNo route matches, default pool %s\n", e.Pool)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nNo route matches, answered with status %d\n", e.Status)
+	return err
+}
+
+// printData prints data as JSON or YAML, with the field names of the JSON API
+func printData(w io.Writer, format outputFormat, data any) error {
+	js, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == formatJSON {
+		_, err = fmt.Fprintf(w, "%s\n", js)
+		return err
+	}
+
+	// JSON is valid YAML: re-encode it in block style, keeping the field order
+	var node yaml.Node
+	if err := yaml.Unmarshal(js, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	out, err := yaml.Marshal(&node)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, strings.TrimPrefix(string(out), "---\n"))
+	return err
+}
+
+func blockStyle(n *yaml.Node) {
+	n.Style &^= yaml.FlowStyle | yaml.DoubleQuotedStyle
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// cpuSampler periodically measures the CPU utilisation of the process
+// as a percentage of the total capacity of the machine (0-100).
+type cpuSampler struct {
+	percent uint64 // float64 bits, accessed atomically
+}
+
+func newCPUSampler() *cpuSampler {
+	return &cpuSampler{}
+}
+
+// run samples the process CPU time every interval. It never returns.
+func (c *cpuSampler) run(interval time.Duration) {
+	lastCPU := processCPUTime()
+	lastWall := time.Now()
+	for range time.Tick(interval) {
+		cpu := processCPUTime()
+		now := time.Now()
+		wall := now.Sub(lastWall)
+		if wall > 0 {
+			p := float64(cpu-lastCPU) / float64(wall) / float64(runtime.NumCPU()) * 100
+			atomic.StoreUint64(&c.percent, math.Float64bits(p))
+		}
+		lastCPU, lastWall = cpu, now
+	}
+}
+
+// usage returns the last sampled CPU utilisation
+func (c *cpuSampler) usage() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.percent))
+}
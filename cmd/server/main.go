@@ -1,17 +1,53 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type HealthResponse struct {
-	MemoryUsage uint64 `json:"memory_usage"`
+	Status      string             `json:"status"`
+	MemoryUsage uint64             `json:"memory_usage"`
+	CPUUsage    float64            `json:"cpu_usage"`
+	Goroutines  uint64             `json:"goroutines"`
+	InFlight    uint64             `json:"in_flight"`
+	GCPauseNs   uint64             `json:"gc_pause_ns"`
+	Gauges      map[string]float64 `json:"gauges,omitempty"`
+}
+
+// inFlight is the number of requests currently being served (excluding /health)
+var inFlight int64
+
+// sleeping is the number of /sleep requests currently in progress
+var sleeping int64
+
+// status is the readiness state reported on /health (ready, draining or maintenance)
+var status atomic.Value
+
+// gauges holds arbitrary named metrics reported on /health
+var gauges sync.Map
+
+func setGauge(name string, value float64) {
+	gauges.Store(name, value)
+}
+
+// trackInFlight counts the requests currently handled by next
+func trackInFlight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		next(w, r)
+	}
 }
 
 func main() {
@@ -20,28 +56,85 @@ func main() {
 		port = "80"
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// How long to keep serving after SIGTERM so the load balancer notices we are draining
+	drainTimeout := 25 * time.Second
+	if v := os.Getenv("DRAIN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid DRAIN_TIMEOUT: %s", err)
+		}
+		drainTimeout = d
+	}
+
+	status.Store("ready")
+
+	cpu := newCPUSampler()
+	go cpu.run(time.Second)
+
+	http.HandleFunc("/", trackInFlight(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello from backend! I am running on %s\n", os.Getenv("HOSTNAME"))
-	})
+	}))
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
 
+		setGauge("heap_objects", float64(m.HeapObjects))
+		setGauge("sleeping", float64(atomic.LoadInt64(&sleeping)))
+
 		resp := HealthResponse{
+			Status:      status.Load().(string),
 			MemoryUsage: m.Alloc,
+			CPUUsage:    cpu.usage(),
+			Goroutines:  uint64(runtime.NumGoroutine()),
+			InFlight:    uint64(atomic.LoadInt64(&inFlight)),
+			GCPauseNs:   m.PauseNs[(m.NumGC+255)%256],
+			Gauges:      make(map[string]float64),
 		}
+		gauges.Range(func(k, v any) bool {
+			resp.Gauges[k.(string)] = v.(float64)
+			return true
+		})
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	})
 
 	// /sleep simulates a slow request (5s) to help testing Least-Connections behavior
-	http.HandleFunc("/sleep", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/sleep", trackInFlight(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&sleeping, 1)
+		defer atomic.AddInt64(&sleeping, -1)
 		time.Sleep(5 * time.Second)
 		fmt.Fprintf(w, "Slept 5 seconds on %s\n", os.Getenv("HOSTNAME"))
-	})
+	}))
+
+	server := &http.Server{Addr: ":" + port}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		// Keep serving while the load balancer stops sending new traffic,
+		// then wait for in-flight requests to complete.
+		log.Printf("Draining for %s...", drainTimeout)
+		status.Store("draining")
+		time.Sleep(drainTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown error: %s", err)
+		}
+	}()
 
 	log.Printf("Backend server starting on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Backend server stopped")
 }
@@ -0,0 +1,1433 @@
+// Package config describes the declarative configuration of the load balancer.
+//
+// A configuration can be loaded from a YAML or JSON file with Load, or built
+// from the -backends/-port command line shorthand with FromFlags.
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the root of the configuration file
+type Config struct {
+	Listeners []Listener `yaml:"listeners"`
+	Pools     []Pool     `yaml:"pools"`
+	Routes    []Route    `yaml:"routes"`
+	// UnknownHostStatus answers the requests matching no route when routes
+	// are restricted to hosts: 404 (the default) or 421 Misdirected Request
+	UnknownHostStatus int `yaml:"unknown_host_status"`
+	// TrustedProxies are the networks of the proxies in front of the load
+	// balancer: their X-Forwarded-* and Forwarded headers are believed to find
+	// the real client, those of other peers are replaced
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Admin          *Admin   `yaml:"admin"`
+	// ACME obtains and renews the certificates of the route hosts, served
+	// by the listeners with tls.acme
+	ACME *ACME `yaml:"acme"`
+}
+
+// ACME obtains certificates from an ACME certificate authority, e.g. Let's
+// Encrypt, for the exact hosts of the routes and Hosts
+type ACME struct {
+	// AcceptTOS must be true: it accepts the terms of service of the authority
+	AcceptTOS    bool   `yaml:"accept_tos"`
+	Email        string `yaml:"email"`
+	DirectoryURL string `yaml:"directory_url"`
+	// CAFile is trusted to reach the directory, e.g. the CA of a Pebble test server
+	CAFile string `yaml:"ca_file"`
+	// Storage is the directory holding the account key and the certificates
+	Storage string `yaml:"storage"`
+	// Challenges are the challenge types answered, by order of preference
+	Challenges    []string      `yaml:"challenges"`
+	RenewBefore   time.Duration `yaml:"renew_before"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Hosts are certified in addition to the hosts of the routes
+	Hosts []string `yaml:"hosts"`
+}
+
+// Admin is the separate listener serving the runtime admin API.
+// It must be protected by a bearer token, mutual TLS, or both.
+type Admin struct {
+	Address string `yaml:"address"`
+	// Token is expected in an "Authorization: Bearer <token>" header
+	Token string    `yaml:"token"`
+	TLS   *AdminTLS `yaml:"tls"`
+}
+
+// AdminTLS serves the admin API over HTTPS.
+// Client certificates signed by ClientCAFile are required when it is set.
+type AdminTLS struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// Listener is an address the load balancer accepts requests on
+type Listener struct {
+	Name     string   `yaml:"name"`
+	Address  string   `yaml:"address"`
+	Timeouts Timeouts `yaml:"timeouts"`
+	// TLS terminates HTTPS on the listener when set
+	TLS *ListenerTLS `yaml:"tls"`
+	// Protocols are accepted by the listener: http1 and h2 (HTTP/2 over TLS)
+	// by default with tls, http1 and optionally h2c (cleartext HTTP/2) without
+	Protocols []string `yaml:"protocols"`
+}
+
+// ListenerTLS terminates TLS on a listener. The certificate of a connection
+// is selected by its server name (SNI), wildcard certificates included; the
+// first certificate is served when none matches.
+type ListenerTLS struct {
+	Certificates []Certificate `yaml:"certificates"`
+	// ACME serves the certificates obtained by ACME, before Certificates
+	ACME bool `yaml:"acme"`
+	// MinVersion is the lowest TLS version accepted: 1.0, 1.1, 1.2 (the default) or 1.3
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites, by their Go names
+	// (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). TLS 1.3 suites are not configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// ReloadInterval is how often the certificate files are checked for changes
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// ClientCAFile verifies the client certificates, which routes with
+	// client_cert require. ClientAuth is optional (the default), letting the
+	// other routes accept clients without a certificate, or require.
+	ClientCAFile string `yaml:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth"`
+}
+
+// Client certificate policies of a listener
+const (
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// Certificate is a PEM certificate chain and its private key
+type Certificate struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Timeouts are the server timeouts of a listener.
+// They prevent Slow Loris attacks and resource leaks.
+type Timeouts struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+// Pool is a named group of backends sharing a selection strategy
+type Pool struct {
+	Name        string      `yaml:"name"`
+	Strategy    string      `yaml:"strategy"`
+	HealthCheck HealthCheck `yaml:"health_check"`
+	Backends    []Backend   `yaml:"backends"`
+	// Discovery adds and removes backends dynamically, on top of the static Backends
+	Discovery *Discovery `yaml:"discovery"`
+	// BackendTLS applies to the backends without their own tls, discovered ones included
+	BackendTLS *BackendTLS `yaml:"backend_tls"`
+	// Protocol, MaxConnections and MaxStreams apply to the backends not overriding them
+	Protocol       string `yaml:"protocol"`
+	MaxConnections int    `yaml:"max_connections"`
+	MaxStreams     int    `yaml:"max_streams"`
+	// RequestHeaders and ResponseHeaders change the headers of the requests
+	// served by the pool, before those of their route
+	RequestHeaders  *HeaderRules `yaml:"request_headers"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers"`
+	// GRPC balances the gRPC calls served by the pool one by one
+	GRPC *GRPC `yaml:"grpc"`
+	// Sticky keeps each client on the backend which served it first
+	Sticky *PoolSticky `yaml:"sticky"`
+}
+
+// PoolSticky keeps the clients of a pool on the same backend with a cookie set
+// by the load balancer. A draining backend keeps serving the clients stuck to
+// it but gets no new ones.
+type PoolSticky struct {
+	Cookie string `yaml:"cookie"`
+}
+
+// GRPC balances each gRPC call of a pool independently, retries the calls
+// failing with a retryable status on another backend and enforces their
+// grpc-timeout deadlines. Its backends default to HTTP/2: h2c for http URLs
+// and h2 for https ones.
+type GRPC struct {
+	// RetryOn lists the status codes retried, by their GRPCCodes name,
+	// unavailable by default. An empty list disables the retries.
+	RetryOn []string `yaml:"retry_on"`
+	// MaxRetries bounds the retries of a call
+	MaxRetries int `yaml:"max_retries"`
+	// MaxRetryBodySize is the largest request body buffered for retries, in
+	// bytes: calls with a larger body, e.g. long client streams, are not retried
+	MaxRetryBodySize int64 `yaml:"max_retry_body_size"`
+	// Timeout is the deadline of the calls without grpc-timeout, none when omitted
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// HeaderRules changes the headers of the requests sent to the backends, or
+// of the responses sent to the clients. Headers are removed first, then set,
+// then added. Values can refer to HeaderVariables as ${name}.
+type HeaderRules struct {
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// HeaderVariables are the variables available to header values
+var HeaderVariables = []string{
+	"client_ip", "host", "method", "path", "scheme", "route", "pool", "backend_url", "request_id", "request_start",
+}
+
+// Discovery selects the provider finding the backends of a pool. Exactly one must be set.
+type Discovery struct {
+	File   *FileDiscovery   `yaml:"file"`
+	DNS    *DNSDiscovery    `yaml:"dns"`
+	Consul *ConsulDiscovery `yaml:"consul"`
+	Docker *DockerDiscovery `yaml:"docker"`
+}
+
+// FileDiscovery watches a YAML or JSON file listing the targets of a pool
+type FileDiscovery struct {
+	Path string `yaml:"path"`
+	// Interval is how often the file is checked for changes
+	Interval time.Duration `yaml:"interval"`
+	// Debounce is how long the file must stay unchanged before it is read
+	Debounce time.Duration `yaml:"debounce"`
+}
+
+// DNSDiscovery resolves a hostname (A/AAAA records) or an SRV record into backends.
+// The name is resolved again when the shortest TTL of the answer expires, bounded
+// by MinInterval and MaxInterval.
+type DNSDiscovery struct {
+	Name string `yaml:"name"`
+	// Type is a (A and AAAA records, the default) or srv
+	Type string `yaml:"type"`
+	// Port of the backends, required for A/AAAA records (SRV records carry their own)
+	Port int `yaml:"port"`
+	// Scheme of the backend URLs, http by default
+	Scheme string `yaml:"scheme"`
+	// Server is the address of the DNS server, the first nameserver of /etc/resolv.conf by default
+	Server      string        `yaml:"server"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+}
+
+// DNS record types supported by DNSDiscovery
+const (
+	DNSTypeA   = "a"
+	DNSTypeSRV = "srv"
+)
+
+// ConsulDiscovery follows the passing instances of a service registered in a
+// Consul-compatible catalog, using blocking queries
+type ConsulDiscovery struct {
+	// Address of the catalog HTTP API, e.g. http://127.0.0.1:8500
+	Address string `yaml:"address"`
+	Service string `yaml:"service"`
+	// Tag only selects the instances having this tag
+	Tag        string `yaml:"tag"`
+	Datacenter string `yaml:"datacenter"`
+	// Token is sent as X-Consul-Token
+	Token string `yaml:"token"`
+	// Scheme of the backend URLs, http by default
+	Scheme string `yaml:"scheme"`
+	// Wait is how long a blocking query waits for a change
+	Wait time.Duration `yaml:"wait"`
+}
+
+// DockerDiscovery follows the running containers labelled lb.pool=<pool> through
+// the Docker Engine API. The lb.port label gives the port of the backend and the
+// optional lb.weight and lb.tier labels its weight and tier.
+type DockerDiscovery struct {
+	// Socket is the Unix socket of the engine, /var/run/docker.sock by default
+	Socket string `yaml:"socket"`
+	// Pool is the value of the lb.pool label, the name of the pool by default
+	Pool string `yaml:"pool"`
+	// Network selects the address of containers attached to several networks
+	Network string `yaml:"network"`
+	// Scheme of the backend URLs, http by default
+	Scheme string `yaml:"scheme"`
+}
+
+// HealthCheck describes how the backends of a pool are probed
+type HealthCheck struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// GRPC probes the backends with the gRPC health checking protocol instead
+	// of requesting Path, set for the backends of the gRPC pools
+	GRPC bool `yaml:"-"`
+}
+
+// Backend is a single upstream server
+type Backend struct {
+	URL string `yaml:"url"`
+	// Weight defaults to 1 when omitted
+	Weight *int `yaml:"weight"`
+	// Tier groups backends by preference: backends of a higher tier only receive
+	// traffic when no backend of a lower tier is available
+	Tier   int               `yaml:"tier"`
+	Labels map[string]string `yaml:"labels"`
+	// HealthCheck overrides the path and timeout of the pool health check
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	// TLS overrides the backend_tls of the pool for an https backend
+	TLS *BackendTLS `yaml:"tls"`
+	// Protocol is spoken to the backend: http1, h2 (HTTP/2 over TLS) or h2c
+	// (cleartext HTTP/2). Without it, https backends negotiate HTTP/2 or HTTP/1.1.
+	Protocol string `yaml:"protocol"`
+	// MaxConnections limits the connections opened to the backend, 0 for no limit
+	MaxConnections int `yaml:"max_connections"`
+	// MaxStreams limits the requests in flight to the backend, HTTP/2 streams
+	// being multiplexed over its connections. A backend at its limit is not
+	// picked for new requests. 0 for no limit.
+	MaxStreams int `yaml:"max_streams"`
+}
+
+// BackendTransport describes how the load balancer connects to a backend
+type BackendTransport struct {
+	Protocol       string
+	MaxConnections int
+	MaxStreams     int
+	TLS            *BackendTLS
+}
+
+// BackendTLS configures the connections to https backends
+type BackendTLS struct {
+	// CAFile verifies the backend certificates instead of the system roots
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented to backends requiring mutual TLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName is sent as SNI and verified in the backend certificates instead of the URL host
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Route sends the matching requests to Pool.
+// At most one of Path, PathPrefix and PathRegex is set: exact paths are matched
+// first, then the longest matching prefix, then regular expressions in order.
+// A route without any of them and without conditions is the default route,
+// matching every path. Routes of the same path having more conditions
+// (headers, query, methods and client_cidrs) are tried first.
+type Route struct {
+	Name string `yaml:"name"`
+	// Hosts restricts the route to these hostnames, *.example.com matching every subdomain
+	Hosts []string `yaml:"hosts"`
+	// Path matches the request path exactly
+	Path       string `yaml:"path"`
+	PathPrefix string `yaml:"path_prefix"`
+	// PathRegex matches the request path against a regular expression
+	PathRegex string `yaml:"path_regex"`
+	// Headers and Query must all match the request
+	Headers []ValueMatch `yaml:"headers"`
+	Query   []ValueMatch `yaml:"query"`
+	// Methods restricts the route to these HTTP methods
+	Methods []string `yaml:"methods"`
+	// ClientCIDRs restricts the route to clients in these networks, a bare IP matching only itself
+	ClientCIDRs []string `yaml:"client_cidrs"`
+	// Pool serves the requests of the route, unless Split is set
+	Pool string `yaml:"pool"`
+	// Split spreads the requests among pools by weight, e.g. for a canary release
+	Split  []SplitTarget `yaml:"split"`
+	Sticky *Sticky       `yaml:"sticky"`
+	// Canary automates the rollout of a two-pool split
+	Canary *Canary `yaml:"canary"`
+	// Mirror sends a copy of the requests to a shadow pool
+	Mirror *Mirror `yaml:"mirror"`
+	// Rewrite changes the path and host of the requests before they are proxied
+	Rewrite *Rewrite `yaml:"rewrite"`
+	// Redirect answers the requests with a redirect instead of proxying them.
+	// The requests already at the redirect location, e.g. over HTTPS for a
+	// redirect to https, are served by the pool of the route if set.
+	Redirect *Redirect `yaml:"redirect"`
+	// RequestHeaders and ResponseHeaders change the headers sent to the backends and to the clients
+	RequestHeaders  *HeaderRules `yaml:"request_headers"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers"`
+	// ClientCert only serves the clients presenting a certificate verified by
+	// the client_ca_file of the listener, the others being answered 403
+	ClientCert *ClientCert `yaml:"client_cert"`
+}
+
+// ClientCert restricts the client certificates accepted by a route to those
+// whose subject, e.g. "CN=billing,O=Example", or one of whose subject
+// alternative names is listed. Any verified certificate is accepted when both
+// lists are empty.
+type ClientCert struct {
+	Subjects []string `yaml:"subjects"`
+	SANs     []string `yaml:"sans"`
+}
+
+// Rewrite changes the path of the requests in this order: StripPrefix is
+// removed, Regex is replaced by Replacement, which can refer to its capture
+// groups as $1 or ${name}, and AddPrefix is prepended. Host replaces the
+// Host header sent to the backend.
+type Rewrite struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	AddPrefix   string `yaml:"add_prefix"`
+	Host        string `yaml:"host"`
+}
+
+// Redirect sends the client to the request URL with its scheme, host and port
+// replaced by those set, and its path rewritten by the rewrite of the route.
+type Redirect struct {
+	// Status is 301, 302 (default), 307 or 308
+	Status int    `yaml:"status"`
+	Scheme string `yaml:"scheme"`
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+}
+
+// Mirror sends a copy of a share of the requests of a route to a shadow pool,
+// once the primary response is written. The shadow responses are discarded.
+type Mirror struct {
+	Pool string `yaml:"pool"`
+	// Percent is the share of the requests mirrored, all of them when omitted
+	Percent *float64 `yaml:"percent"`
+	// MaxBodySize is the largest request body mirrored, in bytes: requests
+	// with a larger body are not mirrored, 0 mirroring bodiless requests only
+	MaxBodySize *int64 `yaml:"max_body_size"`
+	// Header is set to the route name on the mirrored requests
+	Header string `yaml:"header"`
+	// Timeout bounds each mirrored request
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxInFlight is the number of concurrent mirrored requests, further copies are dropped
+	MaxInFlight int `yaml:"max_in_flight"`
+	// CompareStatus counts the shadow status codes differing from the primary ones
+	CompareStatus bool `yaml:"compare_status"`
+}
+
+// Canary moves the traffic of a split from its stable pool to its canary
+// pool by steps, as long as the canary compares well to the stable pool over
+// the sliding window, and rolls it back to 0% when a threshold is breached.
+type Canary struct {
+	// Pool is the canary pool of the split, the last one when omitted
+	Pool string `yaml:"pool"`
+	// Steps are the successive canary weights, in percent of the traffic
+	Steps []int `yaml:"steps"`
+	// Interval is the time spent at each step before stepping up
+	Interval time.Duration `yaml:"interval"`
+	// Window is the period over which the pools are compared, the interval when omitted
+	Window      time.Duration `yaml:"window"`
+	MinRequests int           `yaml:"min_requests"`
+	// MaxErrorRateIncrease is the largest acceptable canary error rate over
+	// the stable one, in percentage points, 0 rolling back on any increase
+	MaxErrorRateIncrease *float64 `yaml:"max_error_rate_increase"`
+	// MaxLatencyRatio is the largest acceptable canary latency over the stable
+	// one, at LatencyPercentile
+	MaxLatencyRatio   float64 `yaml:"max_latency_ratio"`
+	LatencyPercentile float64 `yaml:"latency_percentile"`
+}
+
+// SplitTarget is a pool receiving a share of the requests of a route
+type SplitTarget struct {
+	Pool   string `yaml:"pool"`
+	Weight int    `yaml:"weight"`
+}
+
+// Sticky keeps a client on the same pool of a split by hashing a request
+// header or cookie. Exactly one of Header and Cookie is set.
+type Sticky struct {
+	Header string `yaml:"header"`
+	Cookie string `yaml:"cookie"`
+}
+
+// conditional reports whether the route matches on more than its host and path
+func (r *Route) conditional() bool {
+	return len(r.Headers) > 0 || len(r.Query) > 0 || len(r.Methods) > 0 || len(r.ClientCIDRs) > 0
+}
+
+// ValueMatch matches a header or query parameter by name.
+// The parameter must be equal to Value, or match Regex, or when neither is
+// set simply be present.
+type ValueMatch struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+	Regex string `yaml:"regex"`
+}
+
+// Strategies supported by pools
+const (
+	StrategyLeastConn  = "least_conn"
+	StrategyRoundRobin = "round_robin"
+)
+
+// Protocols supported by listeners and backends
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+)
+
+// Default values applied to omitted settings
+const (
+	DefaultAddress             = ":3030"
+	DefaultReadHeaderTimeout   = 2 * time.Second
+	DefaultReadTimeout         = 15 * time.Second
+	DefaultWriteTimeout        = 15 * time.Second
+	DefaultIdleTimeout         = 60 * time.Second
+	DefaultHealthCheckInterval = 20 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultFileInterval        = time.Second
+	DefaultFileDebounce        = 500 * time.Millisecond
+	DefaultDNSMinInterval      = 5 * time.Second
+	DefaultDNSMaxInterval      = 5 * time.Minute
+	DefaultConsulWait          = 5 * time.Minute
+	DefaultDockerSocket        = "/var/run/docker.sock"
+	DefaultUnknownHostStatus   = http.StatusNotFound
+	DefaultCanaryInterval      = 5 * time.Minute
+	DefaultCanaryMinRequests   = 100
+	DefaultCanaryErrorRate     = 1.0
+	DefaultCanaryLatencyRatio  = 1.5
+	DefaultCanaryPercentile    = 95.0
+	DefaultMirrorPercent       = 100.0
+	DefaultMirrorMaxBodySize   = 1 << 20
+	DefaultMirrorHeader        = "X-Mirrored-From"
+	DefaultMirrorTimeout       = 10 * time.Second
+	DefaultMirrorMaxInFlight   = 100
+	DefaultRedirectStatus      = http.StatusFound
+	DefaultTLSMinVersion       = "1.2"
+	DefaultTLSReloadInterval   = time.Minute
+	DefaultACMEDirectoryURL    = "https://acme-v02.api.letsencrypt.org/directory"
+	DefaultACMERenewBefore     = 30 * 24 * time.Hour
+	DefaultACMECheckInterval   = 12 * time.Hour
+	DefaultGRPCMaxRetries      = 2
+	DefaultGRPCMaxRetryBody    = 64 << 10
+)
+
+// DefaultCanarySteps are the canary weights of a rollout without steps
+var DefaultCanarySteps = []int{5, 25, 50, 100}
+
+// DefaultACMEChallenges are the ACME challenge types answered by default, by order of preference
+var DefaultACMEChallenges = []string{"tls-alpn-01", "http-01"}
+
+// DefaultGRPCRetryOn are the status codes of the gRPC calls retried by default
+var DefaultGRPCRetryOn = []string{"unavailable"}
+
+// FromFlags builds the configuration equivalent to the -backends and -port flags:
+// a single listener and a single least-connections pool.
+func FromFlags(serverList string, port int) (*Config, error) {
+	cfg := &Config{
+		Listeners: []Listener{{Name: "default", Address: fmt.Sprintf(":%d", port)}},
+		Pools:     []Pool{{Name: "default"}},
+	}
+	for tok := range strings.SplitSeq(serverList, ",") {
+		cfg.Pools[0].Backends = append(cfg.Pools[0].Backends, Backend{URL: tok})
+	}
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyDefaults fills the omitted settings with their default values
+func (c *Config) ApplyDefaults() {
+	if len(c.Listeners) == 0 {
+		c.Listeners = []Listener{{Name: "default", Address: DefaultAddress}}
+	}
+	if c.UnknownHostStatus == 0 {
+		c.UnknownHostStatus = DefaultUnknownHostStatus
+	}
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		for j, m := range r.Methods {
+			r.Methods[j] = strings.ToUpper(m)
+		}
+		if r.Canary != nil {
+			cn := r.Canary
+			if cn.Pool == "" && len(r.Split) > 0 {
+				cn.Pool = r.Split[len(r.Split)-1].Pool
+			}
+			if len(cn.Steps) == 0 {
+				cn.Steps = slices.Clone(DefaultCanarySteps)
+			}
+			setDefault(&cn.Interval, DefaultCanaryInterval)
+			setDefault(&cn.Window, cn.Interval)
+			if cn.MinRequests == 0 {
+				cn.MinRequests = DefaultCanaryMinRequests
+			}
+			if cn.MaxErrorRateIncrease == nil {
+				cn.MaxErrorRateIncrease = ptr(DefaultCanaryErrorRate)
+			}
+			if cn.MaxLatencyRatio == 0 {
+				cn.MaxLatencyRatio = DefaultCanaryLatencyRatio
+			}
+			if cn.LatencyPercentile == 0 {
+				cn.LatencyPercentile = DefaultCanaryPercentile
+			}
+		}
+		if r.Redirect != nil && r.Redirect.Status == 0 {
+			r.Redirect.Status = DefaultRedirectStatus
+		}
+		if m := r.Mirror; m != nil {
+			if m.Percent == nil {
+				m.Percent = ptr(DefaultMirrorPercent)
+			}
+			if m.MaxBodySize == nil {
+				m.MaxBodySize = ptr(int64(DefaultMirrorMaxBodySize))
+			}
+			if m.Header == "" {
+				m.Header = DefaultMirrorHeader
+			}
+			setDefault(&m.Timeout, DefaultMirrorTimeout)
+			if m.MaxInFlight == 0 {
+				m.MaxInFlight = DefaultMirrorMaxInFlight
+			}
+		}
+	}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		setDefault(&l.Timeouts.ReadHeader, DefaultReadHeaderTimeout)
+		setDefault(&l.Timeouts.Read, DefaultReadTimeout)
+		setDefault(&l.Timeouts.Write, DefaultWriteTimeout)
+		setDefault(&l.Timeouts.Idle, DefaultIdleTimeout)
+		if l.TLS != nil {
+			if l.TLS.MinVersion == "" {
+				l.TLS.MinVersion = DefaultTLSMinVersion
+			}
+			setDefault(&l.TLS.ReloadInterval, DefaultTLSReloadInterval)
+			if l.TLS.ClientCAFile != "" && l.TLS.ClientAuth == "" {
+				l.TLS.ClientAuth = ClientAuthOptional
+			}
+		}
+		if len(l.Protocols) == 0 {
+			l.Protocols = []string{ProtocolHTTP1}
+			if l.TLS != nil {
+				l.Protocols = append(l.Protocols, ProtocolH2)
+			}
+		}
+	}
+	if a := c.ACME; a != nil {
+		if a.DirectoryURL == "" {
+			a.DirectoryURL = DefaultACMEDirectoryURL
+		}
+		if len(a.Challenges) == 0 {
+			a.Challenges = slices.Clone(DefaultACMEChallenges)
+		}
+		setDefault(&a.RenewBefore, DefaultACMERenewBefore)
+		setDefault(&a.CheckInterval, DefaultACMECheckInterval)
+	}
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if p.Strategy == "" {
+			p.Strategy = StrategyLeastConn
+		}
+		setDefault(&p.HealthCheck.Interval, DefaultHealthCheckInterval)
+		setDefault(&p.HealthCheck.Timeout, DefaultHealthCheckTimeout)
+		for j := range p.Backends {
+			b := &p.Backends[j]
+			if b.Weight == nil {
+				b.Weight = ptr(1)
+			}
+		}
+		if g := p.GRPC; g != nil {
+			if g.RetryOn == nil {
+				g.RetryOn = slices.Clone(DefaultGRPCRetryOn)
+			}
+			if g.MaxRetries == 0 {
+				g.MaxRetries = DefaultGRPCMaxRetries
+			}
+			if g.MaxRetryBodySize == 0 {
+				g.MaxRetryBodySize = DefaultGRPCMaxRetryBody
+			}
+		}
+		if p.Discovery != nil && p.Discovery.File != nil {
+			setDefault(&p.Discovery.File.Interval, DefaultFileInterval)
+			setDefault(&p.Discovery.File.Debounce, DefaultFileDebounce)
+		}
+		if p.Discovery != nil && p.Discovery.DNS != nil {
+			d := p.Discovery.DNS
+			if d.Type == "" {
+				d.Type = DNSTypeA
+			}
+			if d.Scheme == "" {
+				d.Scheme = "http"
+			}
+			setDefault(&d.MinInterval, DefaultDNSMinInterval)
+			setDefault(&d.MaxInterval, DefaultDNSMaxInterval)
+		}
+		if p.Discovery != nil && p.Discovery.Consul != nil {
+			if p.Discovery.Consul.Scheme == "" {
+				p.Discovery.Consul.Scheme = "http"
+			}
+			setDefault(&p.Discovery.Consul.Wait, DefaultConsulWait)
+		}
+		if p.Discovery != nil && p.Discovery.Docker != nil {
+			d := p.Discovery.Docker
+			if d.Socket == "" {
+				d.Socket = DefaultDockerSocket
+			}
+			if d.Pool == "" {
+				d.Pool = p.Name
+			}
+			if d.Scheme == "" {
+				d.Scheme = "http"
+			}
+		}
+	}
+}
+
+func setDefault(d *time.Duration, def time.Duration) {
+	if *d == 0 {
+		*d = def
+	}
+}
+
+// ptr returns a pointer to v, for the settings where 0 differs from omitted
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// ACMEHosts returns the hosts certificates are obtained for by ACME: the
+// exact hostnames of the routes, wildcards and IP addresses left out, and
+// the hosts of the acme section, lowercase and sorted
+func (c *Config) ACMEHosts() []string {
+	if c.ACME == nil {
+		return nil
+	}
+	var hosts []string
+	for _, r := range c.Routes {
+		for _, h := range r.Hosts {
+			if _, err := netip.ParseAddr(h); err == nil || strings.HasPrefix(h, "*.") {
+				continue
+			}
+			hosts = append(hosts, strings.ToLower(h))
+		}
+	}
+	for _, h := range c.ACME.Hosts {
+		hosts = append(hosts, strings.ToLower(h))
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// BackendHealthCheck returns the health check of a backend of the pool,
+// taking the backend overrides into account.
+func (p *Pool) BackendHealthCheck(b *Backend) HealthCheck {
+	hc := p.HealthCheck
+	hc.GRPC = p.GRPC != nil
+	if b.HealthCheck != nil {
+		if b.HealthCheck.Path != "" {
+			hc.Path = b.HealthCheck.Path
+		}
+		if b.HealthCheck.Timeout != 0 {
+			hc.Timeout = b.HealthCheck.Timeout
+		}
+	}
+	return hc
+}
+
+// BackendTLSConfig returns the TLS settings of a backend of the pool, nil for
+// the defaults of the system
+func (p *Pool) BackendTLSConfig(b *Backend) *BackendTLS {
+	if b.TLS != nil {
+		return b.TLS
+	}
+	return p.BackendTLS
+}
+
+// BackendTransport returns the protocol, limits and TLS settings of a backend
+// of the pool, taking the backend overrides into account
+func (p *Pool) BackendTransport(b *Backend) BackendTransport {
+	t := BackendTransport{Protocol: p.Protocol, MaxConnections: p.MaxConnections, MaxStreams: p.MaxStreams, TLS: p.BackendTLSConfig(b)}
+	if b.Protocol != "" {
+		t.Protocol = b.Protocol
+	}
+	if b.MaxConnections != 0 {
+		t.MaxConnections = b.MaxConnections
+	}
+	if b.MaxStreams != 0 {
+		t.MaxStreams = b.MaxStreams
+	}
+	if t.Protocol == "" && p.GRPC != nil {
+		// gRPC requires HTTP/2
+		t.Protocol = ProtocolH2C
+		if strings.HasPrefix(b.URL, "https://") {
+			t.Protocol = ProtocolH2
+		}
+	}
+	return t
+}
+
+// Validate checks the semantic consistency of the configuration.
+// All the problems found are reported, joined in a single error.
+func (c *Config) Validate() error {
+	return c.validate(nil)
+}
+
+func (c *Config) validate(lines map[string]int) error {
+	v := &validator{lines: lines}
+
+	names := map[string]bool{}
+	addresses := map[string]bool{}
+	acmeListener := false
+	clientCA := false
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if l.Address == "" {
+			v.errorf(path+".address", "address is required")
+		} else if addresses[l.Address] {
+			v.errorf(path+".address", "duplicate address %q", l.Address)
+		}
+		addresses[l.Address] = true
+		if l.Name != "" && names[l.Name] {
+			v.errorf(path+".name", "duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = true
+		v.positive(path+".timeouts.read_header", l.Timeouts.ReadHeader)
+		v.positive(path+".timeouts.read", l.Timeouts.Read)
+		v.positive(path+".timeouts.write", l.Timeouts.Write)
+		v.positive(path+".timeouts.idle", l.Timeouts.Idle)
+		for j, proto := range l.Protocols {
+			ppath := fmt.Sprintf("%s.protocols[%d]", path, j)
+			switch {
+			case !slices.Contains([]string{ProtocolHTTP1, ProtocolH2, ProtocolH2C}, proto):
+				v.errorf(ppath, "unknown protocol %q, expected %s, %s or %s", proto, ProtocolHTTP1, ProtocolH2, ProtocolH2C)
+			case proto == ProtocolH2 && l.TLS == nil:
+				v.errorf(ppath, "h2 requires tls, h2c being cleartext HTTP/2")
+			case proto == ProtocolH2C && l.TLS != nil:
+				v.errorf(ppath, "h2c requires a listener without tls, h2 being HTTP/2 over TLS")
+			}
+		}
+		if l.TLS != nil {
+			v.listenerTLS(path+".tls", l.TLS)
+			if l.TLS.ACME && c.ACME == nil {
+				v.errorf(path+".tls.acme", "tls.acme requires the acme section")
+			}
+			acmeListener = acmeListener || l.TLS.ACME
+			clientCA = clientCA || l.TLS.ClientCAFile != ""
+		}
+	}
+	if c.ACME != nil {
+		v.acme("acme", c.ACME)
+		if !acmeListener {
+			v.errorf("acme", "acme requires a listener with tls.acme: true")
+		}
+	}
+
+	if len(c.Pools) == 0 {
+		v.errorf("pools", "at least one pool is required")
+	}
+	pools := map[string]bool{}
+	for i, p := range c.Pools {
+		path := fmt.Sprintf("pools[%d]", i)
+		if p.Name == "" {
+			v.errorf(path+".name", "name is required")
+		} else if pools[p.Name] {
+			v.errorf(path+".name", "duplicate pool name %q", p.Name)
+		}
+		pools[p.Name] = true
+
+		switch p.Strategy {
+		case "", StrategyLeastConn, StrategyRoundRobin:
+		default:
+			v.errorf(path+".strategy", "unknown strategy %q (expected %s or %s)", p.Strategy, StrategyLeastConn, StrategyRoundRobin)
+		}
+		v.healthCheck(path+".health_check", &p.HealthCheck)
+		v.headerRules(path+".request_headers", p.RequestHeaders)
+		v.headerRules(path+".response_headers", p.ResponseHeaders)
+
+		if len(p.Backends) == 0 && p.Discovery == nil {
+			v.errorf(path+".backends", "at least one backend is required, or a discovery provider")
+		}
+		if p.Discovery != nil {
+			v.discovery(path+".discovery", p.Discovery)
+		}
+		if p.BackendTLS != nil {
+			v.backendTLS(path+".backend_tls", p.BackendTLS)
+		}
+		v.backendProtocol(path, p.Protocol, p.MaxConnections, p.MaxStreams)
+		if p.GRPC != nil {
+			v.grpc(path, p)
+		}
+		if p.Sticky != nil && (p.Sticky.Cookie == "" || strings.ContainsFunc(p.Sticky.Cookie, func(c rune) bool { return !isTokenChar(c) })) {
+			v.errorf(path+".sticky.cookie", "invalid cookie name %q", p.Sticky.Cookie)
+		}
+		urls := map[string]bool{}
+		for j, b := range p.Backends {
+			bpath := fmt.Sprintf("%s.backends[%d]", path, j)
+			if err := ValidateBackendURL(b.URL); err != nil {
+				v.errorf(bpath+".url", "%s", err)
+			} else if urls[b.URL] {
+				v.errorf(bpath+".url", "duplicate backend %q", b.URL)
+			}
+			urls[b.URL] = true
+			if *b.Weight < 1 {
+				v.errorf(bpath+".weight", "weight must be at least 1")
+			}
+			if b.Tier < 0 {
+				v.errorf(bpath+".tier", "tier must not be negative")
+			}
+			if b.HealthCheck != nil {
+				v.healthCheck(bpath+".health_check", b.HealthCheck)
+			}
+			if b.TLS != nil {
+				v.backendTLS(bpath+".tls", b.TLS)
+				if !strings.HasPrefix(b.URL, "https://") {
+					v.errorf(bpath+".tls", "tls requires an https backend url")
+				}
+			}
+			v.backendProtocol(bpath, b.Protocol, b.MaxConnections, b.MaxStreams)
+			if err := BackendProtocolError(b.URL, p.BackendTransport(&b).Protocol); err != nil {
+				v.errorf(bpath+".url", "%s", err)
+			}
+		}
+	}
+
+	routes := map[string]bool{}
+	// defaultRoutes holds the hosts having a default route, "" for the routes without hosts
+	defaultRoutes := map[string]bool{}
+	for i, r := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if r.Name != "" && routes[r.Name] {
+			v.errorf(path+".name", "duplicate route name %q", r.Name)
+		}
+		routes[r.Name] = true
+
+		for j, h := range r.Hosts {
+			if err := validateHost(h); err != nil {
+				v.errorf(fmt.Sprintf("%s.hosts[%d]", path, j), "%s", err)
+			}
+		}
+
+		matchers := 0
+		if r.Path != "" {
+			matchers++
+			if !strings.HasPrefix(r.Path, "/") {
+				v.errorf(path+".path", "path must start with /")
+			}
+		}
+		if r.PathPrefix != "" {
+			matchers++
+			if !strings.HasPrefix(r.PathPrefix, "/") {
+				v.errorf(path+".path_prefix", "path prefix must start with /")
+			}
+		}
+		if r.PathRegex != "" {
+			matchers++
+			if _, err := regexp.Compile(r.PathRegex); err != nil {
+				v.errorf(path+".path_regex", "invalid regular expression: %s", err)
+			}
+		}
+		switch {
+		case matchers > 1:
+			v.errorf(path, "only one of path, path_prefix and path_regex can be set")
+		case matchers == 0 && !r.conditional():
+			hosts := r.Hosts
+			if len(hosts) == 0 {
+				hosts = []string{""}
+			}
+			for _, h := range hosts {
+				h = strings.ToLower(h)
+				if defaultRoutes[h] {
+					v.errorf(path, "only one default route (without path, path_prefix, path_regex or conditions) can be set per host")
+					break
+				}
+				defaultRoutes[h] = true
+			}
+		}
+		for j, m := range r.Headers {
+			v.valueMatch(fmt.Sprintf("%s.headers[%d]", path, j), m)
+		}
+		for j, m := range r.Query {
+			v.valueMatch(fmt.Sprintf("%s.query[%d]", path, j), m)
+		}
+		for j, m := range r.Methods {
+			if m == "" || strings.ContainsFunc(m, func(c rune) bool { return !isTokenChar(c) }) {
+				v.errorf(fmt.Sprintf("%s.methods[%d]", path, j), "invalid method %q", m)
+			}
+		}
+		for j, cidr := range r.ClientCIDRs {
+			if _, err := ParseClientCIDR(cidr); err != nil {
+				v.errorf(fmt.Sprintf("%s.client_cidrs[%d]", path, j), "%s", err)
+			}
+		}
+		switch {
+		case r.Pool != "" && len(r.Split) > 0:
+			v.errorf(path, "only one of pool and split can be set")
+		case r.Pool == "" && len(r.Split) == 0 && r.Redirect == nil:
+			v.errorf(path+".pool", "pool, split or redirect is required")
+		case r.Pool != "" && !pools[r.Pool]:
+			v.errorf(path+".pool", "unknown pool %q", r.Pool)
+		}
+		v.split(path, r, pools)
+		if r.Canary != nil {
+			v.canary(path+".canary", r)
+		}
+		if r.Mirror != nil {
+			v.mirror(path+".mirror", r, pools)
+		}
+		if r.Rewrite != nil {
+			v.rewrite(path+".rewrite", r.Rewrite)
+		}
+		if r.Redirect != nil {
+			v.redirect(path+".redirect", r.Redirect)
+		}
+		v.headerRules(path+".request_headers", r.RequestHeaders)
+		v.headerRules(path+".response_headers", r.ResponseHeaders)
+		if r.ClientCert != nil {
+			v.clientCert(path+".client_cert", r.ClientCert)
+			if !clientCA {
+				v.errorf(path+".client_cert", "client_cert requires a listener with tls.client_ca_file")
+			}
+		}
+	}
+
+	for i, cidr := range c.TrustedProxies {
+		if _, err := ParseClientCIDR(cidr); err != nil {
+			v.errorf(fmt.Sprintf("trusted_proxies[%d]", i), "invalid trusted proxy %q: expected an IP address or CIDR", cidr)
+		}
+	}
+
+	switch c.UnknownHostStatus {
+	case http.StatusNotFound, http.StatusMisdirectedRequest:
+	default:
+		v.errorf("unknown_host_status", "unknown host status must be %d or %d", http.StatusNotFound, http.StatusMisdirectedRequest)
+	}
+
+	if c.Admin != nil {
+		a := c.Admin
+		if a.Address == "" {
+			v.errorf("admin.address", "address is required")
+		} else if addresses[a.Address] {
+			v.errorf("admin.address", "address %q is already used by a listener", a.Address)
+		}
+		if a.Token == "" && (a.TLS == nil || a.TLS.ClientCAFile == "") {
+			v.errorf("admin", "a token or a tls.client_ca_file is required to protect the admin API")
+		}
+		if a.TLS != nil && (a.TLS.CertFile == "" || a.TLS.KeyFile == "") {
+			v.errorf("admin.tls", "cert_file and key_file are required")
+		}
+	}
+
+	return v.err()
+}
+
+// listenerTLS checks the certificates, version and cipher suites of a listener
+func (v *validator) listenerTLS(path string, t *ListenerTLS) {
+	if len(t.Certificates) == 0 && !t.ACME {
+		v.errorf(path+".certificates", "at least one certificate is required, unless acme is true")
+	}
+	for i, c := range t.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			v.errorf(fmt.Sprintf("%s.certificates[%d]", path, i), "cert_file and key_file are required")
+		}
+	}
+	version, ok := TLSVersions[t.MinVersion]
+	if !ok {
+		v.errorf(path+".min_version", "min_version must be 1.0, 1.1, 1.2 or 1.3")
+	}
+	if len(t.CipherSuites) > 0 && version == tls.VersionTLS13 {
+		v.errorf(path+".cipher_suites", "cipher_suites do not apply to TLS 1.3")
+	}
+	for i, name := range t.CipherSuites {
+		if _, ok := CipherSuiteID(name); !ok {
+			v.errorf(fmt.Sprintf("%s.cipher_suites[%d]", path, i), "unknown or insecure cipher suite %q", name)
+		}
+	}
+	v.positive(path+".reload_interval", t.ReloadInterval)
+	switch t.ClientAuth {
+	case "":
+	case ClientAuthOptional, ClientAuthRequire:
+		if t.ClientCAFile == "" {
+			v.errorf(path+".client_auth", "client_auth requires client_ca_file")
+		}
+	default:
+		v.errorf(path+".client_auth", "client_auth must be %s or %s", ClientAuthOptional, ClientAuthRequire)
+	}
+}
+
+// backendTLS checks the TLS settings of the connections to backends
+func (v *validator) backendTLS(path string, t *BackendTLS) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		v.errorf(path, "cert_file and key_file must be set together")
+	}
+	if t.CAFile != "" && t.InsecureSkipVerify {
+		v.errorf(path+".insecure_skip_verify", "insecure_skip_verify cannot be set with ca_file")
+	}
+	if t.ServerName != "" {
+		if err := validateHost(t.ServerName); err != nil || strings.HasPrefix(t.ServerName, "*.") {
+			v.errorf(path+".server_name", "invalid server_name %q", t.ServerName)
+		}
+	}
+}
+
+// backendProtocol checks the protocol and limits of a pool or backend
+func (v *validator) backendProtocol(path, protocol string, maxConnections, maxStreams int) {
+	switch protocol {
+	case "", ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+	default:
+		v.errorf(path+".protocol", "unknown protocol %q, expected %s, %s or %s", protocol, ProtocolHTTP1, ProtocolH2, ProtocolH2C)
+	}
+	if maxConnections < 0 {
+		v.errorf(path+".max_connections", "max_connections must not be negative")
+	}
+	if maxStreams < 0 {
+		v.errorf(path+".max_streams", "max_streams must not be negative")
+	}
+}
+
+// grpc checks the gRPC settings of a pool, whose backends must speak HTTP/2
+func (v *validator) grpc(path string, p Pool) {
+	g := p.GRPC
+	for i, name := range g.RetryOn {
+		if _, ok := GRPCCodes[name]; !ok {
+			v.errorf(fmt.Sprintf("%s.grpc.retry_on[%d]", path, i), "unknown gRPC status code %q", name)
+		}
+	}
+	if g.MaxRetries < 0 {
+		v.errorf(path+".grpc.max_retries", "max_retries must not be negative")
+	}
+	if g.MaxRetryBodySize < 0 {
+		v.errorf(path+".grpc.max_retry_body_size", "max_retry_body_size must not be negative")
+	}
+	v.positive(path+".grpc.timeout", g.Timeout)
+	if p.Protocol == ProtocolHTTP1 {
+		v.errorf(path+".protocol", "grpc requires an HTTP/2 protocol, h2 or h2c")
+	}
+	for i, b := range p.Backends {
+		if b.Protocol == ProtocolHTTP1 {
+			v.errorf(fmt.Sprintf("%s.backends[%d].protocol", path, i), "grpc requires an HTTP/2 protocol, h2 or h2c")
+		}
+	}
+}
+
+// clientCert checks the allow-lists of the client certificates of a route
+func (v *validator) clientCert(path string, c *ClientCert) {
+	for i, s := range c.Subjects {
+		if s == "" {
+			v.errorf(fmt.Sprintf("%s.subjects[%d]", path, i), "subject must not be empty")
+		}
+	}
+	for i, s := range c.SANs {
+		if s == "" {
+			v.errorf(fmt.Sprintf("%s.sans[%d]", path, i), "san must not be empty")
+		}
+	}
+}
+
+// acme checks the ACME settings
+func (v *validator) acme(path string, a *ACME) {
+	if !a.AcceptTOS {
+		v.errorf(path+".accept_tos", "accept_tos must be true to accept the terms of service of the certificate authority")
+	}
+	if a.Storage == "" {
+		v.errorf(path+".storage", "storage is required")
+	}
+	if a.Email != "" && (!strings.Contains(a.Email, "@") || strings.ContainsAny(a.Email, " \r\n")) {
+		v.errorf(path+".email", "invalid email %q", a.Email)
+	}
+	if u, err := url.Parse(a.DirectoryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(path+".directory_url", "invalid directory_url %q: expected an http or https URL", a.DirectoryURL)
+	}
+	for i, c := range a.Challenges {
+		if !slices.Contains(DefaultACMEChallenges, c) {
+			v.errorf(fmt.Sprintf("%s.challenges[%d]", path, i), "unknown challenge %q, expected tls-alpn-01 or http-01", c)
+		}
+	}
+	v.positive(path+".renew_before", a.RenewBefore)
+	v.positive(path+".check_interval", a.CheckInterval)
+	for i, h := range a.Hosts {
+		if err := validateHost(h); err != nil {
+			v.errorf(fmt.Sprintf("%s.hosts[%d]", path, i), "%s", err)
+		} else if strings.HasPrefix(h, "*.") {
+			v.errorf(fmt.Sprintf("%s.hosts[%d]", path, i), "wildcard host %q requires a DNS-01 challenge, which is not supported", h)
+		}
+	}
+}
+
+// split checks the split and sticky settings of a route
+func (v *validator) split(path string, r Route, pools map[string]bool) {
+	total := 0
+	targets := map[string]bool{}
+	for j, t := range r.Split {
+		tpath := fmt.Sprintf("%s.split[%d]", path, j)
+		switch {
+		case t.Pool == "":
+			v.errorf(tpath+".pool", "pool is required")
+		case !pools[t.Pool]:
+			v.errorf(tpath+".pool", "unknown pool %q", t.Pool)
+		case targets[t.Pool]:
+			v.errorf(tpath+".pool", "duplicate pool %q", t.Pool)
+		}
+		targets[t.Pool] = true
+		if t.Weight < 0 {
+			v.errorf(tpath+".weight", "weight must not be negative")
+		}
+		total += max(t.Weight, 0)
+	}
+	if len(r.Split) > 0 && total == 0 {
+		v.errorf(path+".split", "at least one weight must be positive")
+	}
+
+	if r.Sticky != nil {
+		if len(r.Split) == 0 {
+			v.errorf(path+".sticky", "sticky requires a split")
+		}
+		if (r.Sticky.Header == "") == (r.Sticky.Cookie == "") {
+			v.errorf(path+".sticky", "exactly one of header and cookie must be set")
+		}
+	}
+}
+
+// canary checks the automated rollout of a split route
+func (v *validator) canary(path string, r Route) {
+	c := r.Canary
+	if len(r.Split) != 2 {
+		v.errorf(path, "canary requires a split between exactly two pools")
+	} else if c.Pool != r.Split[0].Pool && c.Pool != r.Split[1].Pool {
+		v.errorf(path+".pool", "pool %q is not part of the split", c.Pool)
+	}
+	for i, step := range c.Steps {
+		if step <= 0 || step > 100 || (i > 0 && step <= c.Steps[i-1]) {
+			v.errorf(path+".steps", "steps must be increasing percentages between 1 and 100")
+			break
+		}
+	}
+	// Promotion sends all the traffic to the canary
+	if len(c.Steps) > 0 && c.Steps[len(c.Steps)-1] != 100 {
+		v.errorf(path+".steps", "the last step must be 100")
+	}
+	v.positive(path+".interval", c.Interval)
+	v.positive(path+".window", c.Window)
+	if c.MinRequests < 0 {
+		v.errorf(path+".min_requests", "min_requests must not be negative")
+	}
+	if *c.MaxErrorRateIncrease < 0 {
+		v.errorf(path+".max_error_rate_increase", "max_error_rate_increase must not be negative")
+	}
+	if c.MaxLatencyRatio < 1 {
+		v.errorf(path+".max_latency_ratio", "max_latency_ratio must be at least 1")
+	}
+	if c.LatencyPercentile <= 0 || c.LatencyPercentile > 100 {
+		v.errorf(path+".latency_percentile", "latency_percentile must be between 0 and 100")
+	}
+}
+
+// mirror checks the shadow pool of a route
+func (v *validator) mirror(path string, r Route, pools map[string]bool) {
+	m := r.Mirror
+	switch {
+	case m.Pool == "":
+		v.errorf(path+".pool", "pool is required")
+	case !pools[m.Pool]:
+		v.errorf(path+".pool", "unknown pool %q", m.Pool)
+	case m.Pool == r.Pool || slices.ContainsFunc(r.Split, func(t SplitTarget) bool { return t.Pool == m.Pool }):
+		v.errorf(path+".pool", "pool %q already serves the route", m.Pool)
+	}
+	if *m.Percent <= 0 || *m.Percent > 100 {
+		v.errorf(path+".percent", "percent must be between 0 and 100")
+	}
+	if *m.MaxBodySize < 0 {
+		v.errorf(path+".max_body_size", "max_body_size must not be negative")
+	}
+	if strings.ContainsFunc(m.Header, func(c rune) bool { return !isTokenChar(c) }) {
+		v.errorf(path+".header", "invalid header name %q", m.Header)
+	}
+	v.positive(path+".timeout", m.Timeout)
+	if m.MaxInFlight < 0 {
+		v.errorf(path+".max_in_flight", "max_in_flight must not be negative")
+	}
+}
+
+// rewrite checks the path and host rewriting of a route
+func (v *validator) rewrite(path string, rw *Rewrite) {
+	if rw.StripPrefix != "" && !strings.HasPrefix(rw.StripPrefix, "/") {
+		v.errorf(path+".strip_prefix", "prefix must start with /")
+	}
+	if rw.AddPrefix != "" && !strings.HasPrefix(rw.AddPrefix, "/") {
+		v.errorf(path+".add_prefix", "prefix must start with /")
+	}
+	if rw.Regex != "" {
+		if _, err := regexp.Compile(rw.Regex); err != nil {
+			v.errorf(path+".regex", "invalid regular expression: %s", err)
+		}
+	} else if rw.Replacement != "" {
+		v.errorf(path+".replacement", "replacement requires a regex")
+	}
+	if strings.ContainsAny(rw.Host, "*/ ") {
+		v.errorf(path+".host", "invalid host %q", rw.Host)
+	}
+}
+
+// redirect checks the redirect of a route
+func (v *validator) redirect(path string, rd *Redirect) {
+	switch rd.Status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		v.errorf(path+".status", "redirect status must be 301, 302, 307 or 308")
+	}
+	if rd.Scheme != "" && rd.Scheme != "http" && rd.Scheme != "https" {
+		v.errorf(path+".scheme", "scheme must be http or https")
+	}
+	if rd.Host != "" {
+		if err := validateHost(rd.Host); err != nil || strings.HasPrefix(rd.Host, "*.") {
+			v.errorf(path+".host", "invalid host %q: expected a hostname, without port", rd.Host)
+		}
+	}
+	if rd.Port < 0 || rd.Port > 65535 {
+		v.errorf(path+".port", "port must be between 1 and 65535")
+	}
+}
+
+// headerRules checks the header names and the variables of the values
+func (v *validator) headerRules(path string, rules *HeaderRules) {
+	if rules == nil {
+		return
+	}
+	validName := func(name string) bool {
+		return name != "" && !strings.ContainsFunc(name, func(c rune) bool { return !isTokenChar(c) })
+	}
+	for i, name := range rules.Remove {
+		if !validName(name) {
+			v.errorf(fmt.Sprintf("%s.remove[%d]", path, i), "invalid header name %q", name)
+		}
+	}
+	for _, kind := range []string{"set", "add"} {
+		headers := rules.Set
+		if kind == "add" {
+			headers = rules.Add
+		}
+		for _, name := range slices.Sorted(maps.Keys(headers)) {
+			hpath := fmt.Sprintf("%s.%s.%s", path, kind, name)
+			if !validName(name) {
+				v.errorf(hpath, "invalid header name %q", name)
+			}
+			value := headers[name]
+			if strings.ContainsAny(value, "\r\n") {
+				v.errorf(hpath, "header value must not contain line breaks")
+			}
+			os.Expand(value, func(variable string) string {
+				if !slices.Contains(HeaderVariables, variable) {
+					v.errorf(hpath, "unknown variable %q, expected one of %s", variable, strings.Join(HeaderVariables, ", "))
+				}
+				return ""
+			})
+		}
+	}
+}
+
+// valueMatch checks a header or query parameter condition
+func (v *validator) valueMatch(path string, m ValueMatch) {
+	if m.Name == "" {
+		v.errorf(path+".name", "name is required")
+	}
+	if m.Value != "" && m.Regex != "" {
+		v.errorf(path, "only one of value and regex can be set")
+	}
+	if m.Regex != "" {
+		if _, err := regexp.Compile(m.Regex); err != nil {
+			v.errorf(path+".regex", "invalid regular expression: %s", err)
+		}
+	}
+}
+
+// isTokenChar reports whether c can appear in an HTTP token such as a method
+func isTokenChar(c rune) bool {
+	return c < 0x7f && c > 0x20 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
+
+// TLSVersions maps the min_version settings to their TLS versions
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// GRPCCodes maps the names of the gRPC status codes to their values
+var GRPCCodes = map[string]int{
+	"ok":                  0,
+	"cancelled":           1,
+	"unknown":             2,
+	"invalid_argument":    3,
+	"deadline_exceeded":   4,
+	"not_found":           5,
+	"already_exists":      6,
+	"permission_denied":   7,
+	"resource_exhausted":  8,
+	"failed_precondition": 9,
+	"aborted":             10,
+	"out_of_range":        11,
+	"unimplemented":       12,
+	"internal":            13,
+	"unavailable":         14,
+	"data_loss":           15,
+	"unauthenticated":     16,
+}
+
+// CipherSuiteID returns the ID of a secure TLS 1.0-1.2 cipher suite from its Go name
+func CipherSuiteID(name string) (uint16, bool) {
+	for _, c := range tls.CipherSuites() {
+		if c.Name == name && slices.Contains(c.SupportedVersions, tls.VersionTLS12) {
+			return c.ID, true
+		}
+	}
+	return 0, false
+}
+
+// ParseClientCIDR parses a client network, a bare IP address being a network of its own
+func ParseClientCIDR(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client network %q: expected an IP address or CIDR", s)
+	}
+	return p.Masked(), nil
+}
+
+// validateHost checks a route hostname, which may start with a *. wildcard
+func validateHost(h string) error {
+	name := strings.TrimPrefix(h, "*.")
+	if name == "" {
+		return fmt.Errorf("host is empty")
+	}
+	if strings.ContainsAny(name, "*:/ ") {
+		return fmt.Errorf("invalid host %q: expected a hostname or *.domain, without port", h)
+	}
+	return nil
+}
+
+// BackendProtocolError returns an error when the scheme of a backend URL
+// cannot carry protocol: h2 requires https and h2c http
+func BackendProtocolError(raw, protocol string) error {
+	switch {
+	case protocol == ProtocolH2 && !strings.HasPrefix(raw, "https://"):
+		return fmt.Errorf("protocol h2 requires an https backend url, h2c being cleartext HTTP/2")
+	case protocol == ProtocolH2C && !strings.HasPrefix(raw, "http://"):
+		return fmt.Errorf("protocol h2c requires an http backend url, h2 being HTTP/2 over TLS")
+	}
+	return nil
+}
+
+// ValidateBackendURL checks that a backend URL is an absolute http or https URL
+func ValidateBackendURL(raw string) error {
+	if raw == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid backend url %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid backend url %q: missing host", raw)
+	}
+	return nil
+}
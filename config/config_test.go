@@ -0,0 +1,1055 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validYAML = `
+listeners:
+  - name: public
+    address: ":8080"
+    timeouts:
+      read: 30s
+pools:
+  - name: web
+    strategy: round_robin
+    health_check:
+      path: /health
+      interval: 5s
+      timeout: 1s
+    backends:
+      - url: http://app1:80
+        weight: 3
+        labels:
+          zone: eu-west-1a
+      - url: http://app2:80
+        health_check:
+          path: /ready
+routes:
+  - name: web
+    path_prefix: /
+    pool: web
+`
+
+func TestParse_YAML(t *testing.T) {
+	cfg, err := Parse([]byte(validYAML))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	l := cfg.Listeners[0]
+	if l.Address != ":8080" || l.Timeouts.Read != 30*time.Second {
+		t.Errorf("Unexpected listener: %+v", l)
+	}
+	if l.Timeouts.ReadHeader != DefaultReadHeaderTimeout {
+		t.Errorf("Expected default read header timeout, got %s", l.Timeouts.ReadHeader)
+	}
+
+	p := cfg.Pools[0]
+	if p.Strategy != StrategyRoundRobin || p.HealthCheck.Interval != 5*time.Second {
+		t.Errorf("Unexpected pool: %+v", p)
+	}
+	if *p.Backends[0].Weight != 3 || p.Backends[0].Labels["zone"] != "eu-west-1a" {
+		t.Errorf("Unexpected backend: %+v", p.Backends[0])
+	}
+	if *p.Backends[1].Weight != 1 {
+		t.Errorf("Expected default weight 1, got %d", *p.Backends[1].Weight)
+	}
+
+	hc := p.BackendHealthCheck(&p.Backends[1])
+	if hc.Path != "/ready" || hc.Timeout != time.Second {
+		t.Errorf("Expected backend override of the path only, got %+v", hc)
+	}
+}
+
+func TestParse_JSON(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+	"pools": [{
+		"name": "web",
+		"health_check": {"interval": "10s"},
+		"backends": [{"url": "http://app1:80", "weight": 2}]
+	}]
+}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0].Address != DefaultAddress {
+		t.Errorf("Expected default listener, got %+v", cfg.Listeners)
+	}
+	if cfg.Pools[0].Strategy != StrategyLeastConn {
+		t.Errorf("Expected default strategy, got %s", cfg.Pools[0].Strategy)
+	}
+	if cfg.Pools[0].HealthCheck.Interval != 10*time.Second {
+		t.Errorf("Expected 10s interval, got %s", cfg.Pools[0].HealthCheck.Interval)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name: "Unknown Field",
+			config: `pools:
+  - name: web
+    backend:
+      - url: http://app1:80
+`,
+			expected: []string{`line 3: pools[0].backend: unknown field "backend"`},
+		},
+		{
+			name: "Wrong Type",
+			config: `pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+        weight: heavy
+`,
+			expected: []string{`line 5: pools[0].backends[0].weight: invalid int value "heavy"`},
+		},
+		{
+			name: "Invalid Duration",
+			config: `pools:
+  - name: web
+    health_check:
+      interval: often
+    backends:
+      - url: http://app1:80
+`,
+			expected: []string{`line 4: pools[0].health_check.interval: invalid duration "often"`},
+		},
+		{
+			name: "Bare Number Duration",
+			config: `pools:
+  - name: web
+    health_check:
+      interval: 30
+    backends:
+      - url: http://app1:80
+`,
+			expected: []string{"line 4: pools[0].health_check.interval: expected a duration such as 30s"},
+		},
+		{
+			name: "Semantic Errors",
+			config: `pools:
+  - name: web
+    strategy: random
+    backends:
+      - url: ftp://app1
+      - url: http://app2:80
+        weight: 0
+routes:
+  - path_prefix: api
+    pool: api
+  - path: /health
+    path_regex: ^/health$
+    pool: web
+  - path_regex: "[a-"
+    pool: web
+`,
+			expected: []string{
+				`line 3: pools[0].strategy: unknown strategy "random"`,
+				`line 5: pools[0].backends[0].url: invalid backend url "ftp://app1": scheme must be http or https`,
+				`line 7: pools[0].backends[1].weight: weight must be at least 1`,
+				`line 9: routes[0].path_prefix: path prefix must start with /`,
+				`line 10: routes[0].pool: unknown pool "api"`,
+				`line 11: routes[1]: only one of path, path_prefix and path_regex can be set`,
+				"line 14: routes[2].path_regex: invalid regular expression: error parsing regexp: missing closing ]: `[a-`",
+			},
+		},
+		{
+			name: "Missing Backends",
+			config: `pools:
+  - name: web
+`,
+			expected: []string{`line 2: pools[0].backends: at least one backend is required`},
+		},
+		{
+			name: "Invalid Sticky Cookie",
+			config: `pools:
+  - name: web
+    sticky:
+      cookie: lb backend
+    backends:
+      - url: http://app1:80
+`,
+			expected: []string{`line 4: pools[0].sticky.cookie: invalid cookie name "lb backend"`},
+		},
+		{
+			name:     "Empty",
+			config:   ``,
+			expected: []string{"configuration is empty"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.config))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("Expected error to contain %q, got:\n%s", e, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	if err := os.WriteFile(path, []byte(validYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Pools[0].Backends) != 2 {
+		t.Errorf("Expected 2 backends, got %d", len(cfg.Pools[0].Backends))
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestFromFlags(t *testing.T) {
+	cfg, err := FromFlags("http://app1:80,http://app2:80", 3030)
+	if err != nil {
+		t.Fatalf("FromFlags failed: %v", err)
+	}
+	if cfg.Listeners[0].Address != ":3030" {
+		t.Errorf("Expected :3030, got %s", cfg.Listeners[0].Address)
+	}
+	if len(cfg.Pools) != 1 || len(cfg.Pools[0].Backends) != 2 {
+		t.Errorf("Expected a single pool with 2 backends, got %+v", cfg.Pools)
+	}
+
+	if _, err := FromFlags("app1:80", 3030); err == nil {
+		t.Error("Expected error for backend without scheme")
+	}
+}
+
+func TestParse_Admin(t *testing.T) {
+	base := `pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+`
+	if _, err := Parse([]byte(base + `admin:
+  address: 127.0.0.1:3031
+  token: secret
+`)); err != nil {
+		t.Errorf("Parse failed: %v", err)
+	}
+
+	_, err := Parse([]byte(base + `admin:
+  address: 127.0.0.1:3031
+`))
+	if err == nil || !strings.Contains(err.Error(), "line 5: admin: a token or a tls.client_ca_file is required") {
+		t.Errorf("Expected unprotected admin API to be rejected, got %v", err)
+	}
+}
+
+func TestParse_Hosts(t *testing.T) {
+	cfg, err := Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+  - hosts: [example.com, "*.example.com"]
+    pool: web
+  - hosts: [example.org]
+    pool: web
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.UnknownHostStatus != 404 {
+		t.Errorf("Expected default unknown host status 404, got %d", cfg.UnknownHostStatus)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+  - hosts: [example.com, "a.*.com"]
+    pool: web
+  - hosts: [Example.com]
+    pool: web
+  - hosts: ["example.net:80"]
+    path: /
+    pool: web
+unknown_host_status: 400
+`))
+	for _, want := range []string{
+		`line 6: routes[0].hosts[1]: invalid host "a.*.com": expected a hostname or *.domain, without port`,
+		"line 8: routes[1]: only one default route (without path, path_prefix, path_regex or conditions) can be set per host",
+		`line 10: routes[2].hosts[0]: invalid host "example.net:80": expected a hostname or *.domain, without port`,
+		"line 13: unknown_host_status: unknown host status must be 404 or 421",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_Discovery(t *testing.T) {
+	cfg, err := Parse([]byte(`pools:
+  - name: web
+    discovery:
+      file:
+        path: /etc/lb/targets.yaml
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if f := cfg.Pools[0].Discovery.File; f.Interval != DefaultFileInterval || f.Debounce != DefaultFileDebounce {
+		t.Errorf("Expected default interval and debounce, got %+v", f)
+	}
+
+	cfg, err = Parse([]byte(`pools:
+  - name: web
+    discovery:
+      dns:
+        name: _http._tcp.web.service.consul
+        type: srv
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if d := cfg.Pools[0].Discovery.DNS; d.Scheme != "http" || d.MinInterval != DefaultDNSMinInterval || d.MaxInterval != DefaultDNSMaxInterval {
+		t.Errorf("Expected default scheme and intervals, got %+v", d)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    discovery:
+      dns:
+        name: web.internal
+        min_interval: 1m
+        max_interval: 10s
+`))
+	for _, want := range []string{
+		"line 4: pools[0].discovery.dns.port: a port between 1 and 65535 is required for A records",
+		"line 7: pools[0].discovery.dns.max_interval: max_interval must not be shorter than min_interval",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    discovery:
+      consul:
+        address: consul:8500
+        wait: 1h
+`))
+	for _, want := range []string{
+		`line 5: pools[0].discovery.consul.address: invalid catalog address "consul:8500": scheme must be http or https`,
+		"line 4: pools[0].discovery.consul.service: service is required",
+		"line 6: pools[0].discovery.consul.wait: wait must not exceed 10m",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+
+	cfg, err = Parse([]byte(`pools:
+  - name: web
+    discovery:
+      docker: {}
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if d := cfg.Pools[0].Discovery.Docker; d.Pool != "web" || d.Socket != DefaultDockerSocket || d.Scheme != "http" {
+		t.Errorf("Expected the pool name and default socket, got %+v", d)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    discovery:
+      consul:
+        address: http://consul:8500
+        service: web
+        wait: 500ms
+`))
+	if want := "line 7: pools[0].discovery.consul.wait: wait must be at least 1s"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    discovery: {}
+`))
+	if err == nil || !strings.Contains(err.Error(), "line 3: pools[0].discovery: exactly one discovery provider must be configured") {
+		t.Errorf("Expected discovery without provider to be rejected, got %v", err)
+	}
+}
+
+func TestParse_RouteConditions(t *testing.T) {
+	cfg, err := Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+  - headers:
+      - name: X-Canary
+        value: "1"
+    methods: [get, post]
+    client_cidrs: [10.0.0.0/8, 192.0.2.1]
+    pool: web
+  - pool: web
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if m := cfg.Routes[0].Methods; len(m) != 2 || m[0] != "GET" || m[1] != "POST" {
+		t.Errorf("Expected uppercased methods, got %v", m)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+  - headers:
+      - value: "1"
+    query:
+      - name: v
+        value: "2"
+        regex: "[0-9"
+    methods: ["GE T"]
+    client_cidrs: [10.0.0.0/33]
+    pool: web
+`))
+	for _, want := range []string{
+		"line 7: routes[0].headers[0].name: name is required",
+		"line 9: routes[0].query[0]: only one of value and regex can be set",
+		"line 11: routes[0].query[0].regex: invalid regular expression",
+		`line 12: routes[0].methods[0]: invalid method "GE T"`,
+		`line 13: routes[0].client_cidrs[0]: invalid client network "10.0.0.0/33": expected an IP address or CIDR`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_Split(t *testing.T) {
+	base := `pools:
+  - name: stable
+    backends:
+      - url: http://app1:80
+  - name: canary
+    backends:
+      - url: http://app2:80
+routes:
+`
+	cfg, err := Parse([]byte(base + `  - split:
+      - pool: stable
+        weight: 95
+      - pool: canary
+        weight: 5
+    sticky:
+      cookie: session
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if s := cfg.Routes[0].Split; len(s) != 2 || s[1].Weight != 5 || cfg.Routes[0].Sticky.Cookie != "session" {
+		t.Errorf("Unexpected split: %+v", cfg.Routes[0])
+	}
+
+	_, err = Parse([]byte(base + `  - pool: stable
+    split:
+      - pool: stable
+        weight: 0
+      - pool: stable
+        weight: -1
+      - pool: beta
+    sticky:
+      header: X-User
+      cookie: session
+  - path: /a
+    sticky:
+      header: X-User
+`))
+	for _, want := range []string{
+		"line 9: routes[0]: only one of pool and split can be set",
+		"line 10: routes[0].split: at least one weight must be positive",
+		`line 13: routes[0].split[1].pool: duplicate pool "stable"`,
+		"line 14: routes[0].split[1].weight: weight must not be negative",
+		`line 15: routes[0].split[2].pool: unknown pool "beta"`,
+		"line 16: routes[0].sticky: exactly one of header and cookie must be set",
+		"line 19: routes[1].pool: pool, split or redirect is required",
+		"line 20: routes[1].sticky: sticky requires a split",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_Canary(t *testing.T) {
+	base := `pools:
+  - name: stable
+    backends:
+      - url: http://app1:80
+  - name: canary
+    backends:
+      - url: http://app2:80
+routes:
+  - split:
+      - pool: stable
+        weight: 100
+      - pool: canary
+        weight: 0
+`
+	cfg, err := Parse([]byte(base + `    canary:
+      interval: 10m
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	c := cfg.Routes[0].Canary
+	if c.Pool != "canary" || len(c.Steps) != 4 || c.Window != 10*time.Minute || c.MinRequests != DefaultCanaryMinRequests || c.LatencyPercentile != 95 {
+		t.Errorf("Expected the last pool and default policy, got %+v", c)
+	}
+	if *c.MaxErrorRateIncrease != DefaultCanaryErrorRate {
+		t.Errorf("Expected the default max_error_rate_increase, got %v", *c.MaxErrorRateIncrease)
+	}
+
+	cfg, err = Parse([]byte(base + `    canary:
+      max_error_rate_increase: 0
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if c := cfg.Routes[0].Canary; *c.MaxErrorRateIncrease != 0 {
+		t.Errorf("Expected max_error_rate_increase 0 to be kept, got %v", *c.MaxErrorRateIncrease)
+	}
+
+	_, err = Parse([]byte(base + `    canary:
+      pool: beta
+      steps: [10, 5, 100]
+      max_latency_ratio: 0.5
+      latency_percentile: 101
+  - path: /a
+    pool: stable
+    canary: {}
+`))
+	for _, want := range []string{
+		`line 15: routes[0].canary.pool: pool "beta" is not part of the split`,
+		"line 16: routes[0].canary.steps: steps must be increasing percentages between 1 and 100",
+		"line 17: routes[0].canary.max_latency_ratio: max_latency_ratio must be at least 1",
+		"line 18: routes[0].canary.latency_percentile: latency_percentile must be between 0 and 100",
+		"line 21: routes[1].canary: canary requires a split between exactly two pools",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+
+	// A promoted canary receives all the traffic
+	_, err = Parse([]byte(base + `    canary:
+      steps: [5, 25]
+`))
+	want := "line 15: routes[0].canary.steps: the last step must be 100"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+}
+
+func TestParse_Mirror(t *testing.T) {
+	base := `pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+  - name: shadow
+    backends:
+      - url: http://app2:80
+routes:
+  - pool: web
+`
+	cfg, err := Parse([]byte(base + `    mirror:
+      pool: shadow
+      percent: 12.5
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	m := cfg.Routes[0].Mirror
+	if *m.Percent != 12.5 || *m.MaxBodySize != DefaultMirrorMaxBodySize || m.Header != DefaultMirrorHeader || m.Timeout != DefaultMirrorTimeout || m.MaxInFlight != DefaultMirrorMaxInFlight {
+		t.Errorf("Expected the default mirror settings, got %+v", m)
+	}
+
+	// 0 differs from omitted: bodiless requests only, or no request at all
+	cfg, err = Parse([]byte(base + `    mirror:
+      pool: shadow
+      max_body_size: 0
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if m := cfg.Routes[0].Mirror; *m.MaxBodySize != 0 || *m.Percent != DefaultMirrorPercent {
+		t.Errorf("Expected max_body_size 0 to be kept, got %d", *m.MaxBodySize)
+	}
+	_, err = Parse([]byte(base + `    mirror:
+      pool: shadow
+      percent: 0
+`))
+	if want := "line 12: routes[0].mirror.percent: percent must be between 0 and 100"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+
+	_, err = Parse([]byte(base + `    mirror:
+      pool: web
+      percent: 150
+      max_body_size: -1
+      header: "X Mirror"
+  - path: /a
+    pool: web
+    mirror:
+      pool: unknown
+`))
+	for _, want := range []string{
+		`line 11: routes[0].mirror.pool: pool "web" already serves the route`,
+		"line 12: routes[0].mirror.percent: percent must be between 0 and 100",
+		"line 13: routes[0].mirror.max_body_size: max_body_size must not be negative",
+		`line 14: routes[0].mirror.header: invalid header name "X Mirror"`,
+		`line 18: routes[1].mirror.pool: unknown pool "unknown"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_Rewrite(t *testing.T) {
+	base := `pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+`
+	cfg, err := Parse([]byte(base + `  - redirect:
+      scheme: https
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Routes[0].Redirect.Status != DefaultRedirectStatus {
+		t.Errorf("Expected the default redirect status, got %d", cfg.Routes[0].Redirect.Status)
+	}
+
+	_, err = Parse([]byte(base + `  - path: /a
+    pool: web
+    rewrite:
+      strip_prefix: api
+      replacement: /v2
+  - path: /b
+    redirect:
+      status: 303
+      scheme: ftp
+      host: "*.example.com"
+`))
+	for _, want := range []string{
+		"line 9: routes[0].rewrite.strip_prefix: prefix must start with /",
+		"line 10: routes[0].rewrite.replacement: replacement requires a regex",
+		"line 13: routes[1].redirect.status: redirect status must be 301, 302, 307 or 308",
+		"line 14: routes[1].redirect.scheme: scheme must be http or https",
+		`line 15: routes[1].redirect.host: invalid host "*.example.com": expected a hostname, without port`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_HeaderRules(t *testing.T) {
+	_, err := Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+    response_headers:
+      remove: ["Bad Name"]
+routes:
+  - pool: web
+    request_headers:
+      set:
+        X-Request-Start: t=${request_start}
+        X-Client: ${client}
+      add:
+        X-Via: ${pool}
+`))
+	for _, want := range []string{
+		`line 6: pools[0].response_headers.remove[0]: invalid header name "Bad Name"`,
+		`line 12: routes[0].request_headers.set.X-Client: unknown variable "client", expected one of client_ip, host`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+	if err != nil && strings.Count(err.Error(), "\n") != 1 {
+		t.Errorf("Expected two errors only, got %v", err)
+	}
+}
+
+func TestParse_TrustedProxies(t *testing.T) {
+	_, err := Parse([]byte(`pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+trusted_proxies: [10.0.0.0/8, 192.0.2.1, proxy.local]
+`))
+	want := `line 5: trusted_proxies[2]: invalid trusted proxy "proxy.local": expected an IP address or CIDR`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+}
+
+func TestParse_ListenerTLS(t *testing.T) {
+	pools := `pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+`
+	cfg, err := Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+` + pools))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	tc := cfg.Listeners[0].TLS
+	if len(tc.Certificates) != 1 || tc.MinVersion != DefaultTLSMinVersion || tc.ReloadInterval != DefaultTLSReloadInterval {
+		t.Errorf("Expected the default TLS settings, got %+v", tc)
+	}
+
+	_, err = Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+      min_version: "1.4"
+      cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_RC4_128_SHA]
+  - address: ":8443"
+    tls:
+      min_version: "1.3"
+      cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+` + pools))
+	for _, want := range []string{
+		"line 5: listeners[0].tls.certificates[0]: cert_file and key_file are required",
+		"line 6: listeners[0].tls.min_version: min_version must be 1.0, 1.1, 1.2 or 1.3",
+		`line 7: listeners[0].tls.cipher_suites[1]: unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+		"line 9: listeners[1].tls.certificates: at least one certificate is required",
+		"line 11: listeners[1].tls.cipher_suites: cipher_suites do not apply to TLS 1.3",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_ACME(t *testing.T) {
+	cfg, err := Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      acme: true
+pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+routes:
+  - hosts: [Shop.example.com, "*.example.com", 192.0.2.1]
+    pool: web
+  - hosts: [api.example.com]
+    pool: web
+acme:
+  accept_tos: true
+  email: ops@example.com
+  storage: /var/lib/lb/acme
+  hosts: [www.example.com, shop.example.com]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	a := cfg.ACME
+	if a.DirectoryURL != DefaultACMEDirectoryURL || !slices.Equal(a.Challenges, DefaultACMEChallenges) || a.RenewBefore != DefaultACMERenewBefore || a.CheckInterval != DefaultACMECheckInterval {
+		t.Errorf("Expected the default ACME settings, got %+v", a)
+	}
+	expected := []string{"api.example.com", "shop.example.com", "www.example.com"}
+	if hosts := cfg.ACMEHosts(); !slices.Equal(hosts, expected) {
+		t.Errorf("Expected hosts %v, got %v", expected, hosts)
+	}
+
+	_, err = Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+acme:
+  email: ops
+  directory_url: ftp://ca.example.com
+  challenges: [dns-01]
+  hosts: ["*.example.com"]
+`))
+	for _, want := range []string{
+		"line 11: acme: acme requires a listener with tls.acme: true",
+		"line 11: acme.accept_tos: accept_tos must be true",
+		"line 11: acme.storage: storage is required",
+		`line 12: acme.email: invalid email "ops"`,
+		`line 13: acme.directory_url: invalid directory_url "ftp://ca.example.com"`,
+		`line 14: acme.challenges[0]: unknown challenge "dns-01"`,
+		`line 15: acme.hosts[0]: wildcard host "*.example.com" requires a DNS-01 challenge`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+
+	_, err = Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      acme: true
+pools:
+  - name: web
+    backends:
+      - url: http://app1:80
+`))
+	want := "line 4: listeners[0].tls.acme: tls.acme requires the acme section"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+}
+
+func TestParse_MutualTLS(t *testing.T) {
+	cfg, err := Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+      client_ca_file: /etc/lb/clients.pem
+pools:
+  - name: billing
+    backend_tls:
+      ca_file: /etc/lb/backends.pem
+      cert_file: /etc/lb/lb.crt
+      key_file: /etc/lb/lb.key
+    backends:
+      - url: https://billing1:8443
+      - url: https://billing2:8443
+        tls:
+          server_name: billing.internal
+routes:
+  - path_prefix: /billing
+    pool: billing
+    client_cert:
+      subjects: ["CN=accounting,O=Example"]
+      sans: [accounting.example.com]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if auth := cfg.Listeners[0].TLS.ClientAuth; auth != ClientAuthOptional {
+		t.Errorf("Expected client_auth %s by default, got %q", ClientAuthOptional, auth)
+	}
+	p := &cfg.Pools[0]
+	if bt := p.BackendTLSConfig(&p.Backends[0]); bt != p.BackendTLS {
+		t.Errorf("Expected the pool backend_tls, got %+v", bt)
+	}
+	if bt := p.BackendTLSConfig(&p.Backends[1]); bt.ServerName != "billing.internal" || bt.CAFile != "" {
+		t.Errorf("Expected the backend tls, got %+v", bt)
+	}
+	if cc := cfg.Routes[0].ClientCert; len(cc.Subjects) != 1 || cc.SANs[0] != "accounting.example.com" {
+		t.Errorf("Expected the client_cert allow-lists, got %+v", cc)
+	}
+
+	_, err = Parse([]byte(`listeners:
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+      client_auth: always
+pools:
+  - name: billing
+    backend_tls:
+      cert_file: /etc/lb/lb.crt
+    backends:
+      - url: http://billing1:8080
+        tls:
+          ca_file: /etc/lb/backends.pem
+          insecure_skip_verify: true
+          server_name: "*.internal"
+routes:
+  - pool: billing
+    client_cert:
+      subjects: [""]
+`))
+	for _, want := range []string{
+		"line 7: listeners[0].tls.client_auth: client_auth must be optional or require",
+		"line 10: pools[0].backend_tls: cert_file and key_file must be set together",
+		"line 14: pools[0].backends[0].tls: tls requires an https backend url",
+		"line 16: pools[0].backends[0].tls.insecure_skip_verify: insecure_skip_verify cannot be set with ca_file",
+		`line 17: pools[0].backends[0].tls.server_name: invalid server_name "*.internal"`,
+		"line 20: routes[0].client_cert: client_cert requires a listener with tls.client_ca_file",
+		"line 21: routes[0].client_cert.subjects[0]: subject must not be empty",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_Protocols(t *testing.T) {
+	cfg, err := Parse([]byte(`listeners:
+  - address: ":80"
+  - address: ":8080"
+    protocols: [http1, h2c]
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+pools:
+  - name: grpc
+    protocol: h2c
+    max_streams: 100
+    backends:
+      - url: http://grpc1:50051
+      - url: https://grpc2:50051
+        protocol: h2
+        max_connections: 2
+        max_streams: 200
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	expected := [][]string{{ProtocolHTTP1}, {ProtocolHTTP1, ProtocolH2C}, {ProtocolHTTP1, ProtocolH2}}
+	for i, l := range cfg.Listeners {
+		if !slices.Equal(l.Protocols, expected[i]) {
+			t.Errorf("Expected listener %d protocols %v, got %v", i, expected[i], l.Protocols)
+		}
+	}
+	p := &cfg.Pools[0]
+	if bt := p.BackendTransport(&p.Backends[0]); bt.Protocol != ProtocolH2C || bt.MaxStreams != 100 || bt.MaxConnections != 0 {
+		t.Errorf("Expected the pool protocol and limits, got %+v", bt)
+	}
+	if bt := p.BackendTransport(&p.Backends[1]); bt.Protocol != ProtocolH2 || bt.MaxStreams != 200 || bt.MaxConnections != 2 {
+		t.Errorf("Expected the backend protocol and limits, got %+v", bt)
+	}
+
+	_, err = Parse([]byte(`listeners:
+  - address: ":80"
+    protocols: [h2, http3]
+  - address: ":443"
+    tls:
+      certificates:
+        - cert_file: /etc/lb/shop.crt
+          key_file: /etc/lb/shop.key
+    protocols: [h2c]
+pools:
+  - name: grpc
+    protocol: h2
+    max_connections: -1
+    backends:
+      - url: http://grpc1:50051
+      - url: https://grpc2:50051
+        protocol: h2c
+        max_streams: -1
+`))
+	for _, want := range []string{
+		"line 3: listeners[0].protocols[0]: h2 requires tls, h2c being cleartext HTTP/2",
+		`line 3: listeners[0].protocols[1]: unknown protocol "http3", expected http1, h2 or h2c`,
+		"line 9: listeners[1].protocols[0]: h2c requires a listener without tls",
+		"line 13: pools[0].max_connections: max_connections must not be negative",
+		"line 15: pools[0].backends[0].url: protocol h2 requires an https backend url",
+		"line 16: pools[0].backends[1].url: protocol h2c requires an http backend url",
+		"line 18: pools[0].backends[1].max_streams: max_streams must not be negative",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestParse_GRPC(t *testing.T) {
+	cfg, err := Parse([]byte(`pools:
+  - name: grpc
+    grpc:
+      timeout: 5s
+    backends:
+      - url: http://grpc1:50051
+      - url: https://grpc2:50051
+  - name: strict
+    grpc:
+      retry_on: []
+    backends:
+      - url: http://grpc3:50051
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	p := &cfg.Pools[0]
+	g := p.GRPC
+	if !slices.Equal(g.RetryOn, DefaultGRPCRetryOn) || g.MaxRetries != DefaultGRPCMaxRetries || g.MaxRetryBodySize != DefaultGRPCMaxRetryBody || g.Timeout != 5*time.Second {
+		t.Errorf("Expected the gRPC defaults, got %+v", g)
+	}
+	if bt := p.BackendTransport(&p.Backends[0]); bt.Protocol != ProtocolH2C {
+		t.Errorf("Expected h2c for an http backend, got %q", bt.Protocol)
+	}
+	if bt := p.BackendTransport(&p.Backends[1]); bt.Protocol != ProtocolH2 {
+		t.Errorf("Expected h2 for an https backend, got %q", bt.Protocol)
+	}
+	if retryOn := cfg.Pools[1].GRPC.RetryOn; len(retryOn) != 0 {
+		t.Errorf("Expected the retries disabled, got %v", retryOn)
+	}
+
+	_, err = Parse([]byte(`pools:
+  - name: grpc
+    protocol: http1
+    grpc:
+      retry_on: [unavailable, busy]
+      max_retries: -1
+      timeout: -1s
+    backends:
+      - url: http://grpc1:50051
+        protocol: http1
+`))
+	for _, want := range []string{
+		"line 3: pools[0].protocol: grpc requires an HTTP/2 protocol, h2 or h2c",
+		`line 5: pools[0].grpc.retry_on[1]: unknown gRPC status code "busy"`,
+		"line 6: pools[0].grpc.max_retries: max_retries must not be negative",
+		"line 7: pools[0].grpc.timeout: duration must be positive",
+		"line 10: pools[0].backends[0].protocol: grpc requires an HTTP/2 protocol, h2 or h2c",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
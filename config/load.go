@@ -0,0 +1,305 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a configuration problem, located by its line in the file
+// (when known) and its path in the configuration tree.
+type Error struct {
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// Load reads, validates and applies the defaults of a YAML or JSON configuration file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse decodes a YAML or JSON configuration (JSON being a subset of YAML).
+// Unknown fields and type mismatches are rejected with their line number.
+func Parse(data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if len(root.Content) == 0 {
+		return nil, errors.New("configuration is empty")
+	}
+
+	lines := map[string]int{}
+	v := &validator{lines: lines}
+	v.checkNode(root.Content[0], reflect.TypeOf(cfg).Elem(), "")
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	if err := root.Content[0].Decode(cfg); err != nil {
+		return nil, err
+	}
+	cfg.ApplyDefaults()
+	if err := cfg.validate(lines); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// validator collects configuration errors
+type validator struct {
+	// lines maps a path in the configuration tree to its line in the file
+	lines map[string]int
+	errs  []error
+}
+
+func (v *validator) errorf(path, format string, args ...any) {
+	line := v.lines[path]
+	// Fall back to the closest parent known, e.g. for omitted fields
+	for p := path; line == 0 && p != ""; {
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+		line = v.lines[p]
+	}
+	v.errs = append(v.errs, &Error{Line: line, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		return v.errs[i].(*Error).Line < v.errs[j].(*Error).Line
+	})
+	return errors.Join(v.errs...)
+}
+
+func (v *validator) positive(path string, d time.Duration) {
+	if d < 0 {
+		v.errorf(path, "duration must be positive")
+	}
+}
+
+func (v *validator) healthCheck(path string, hc *HealthCheck) {
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		v.errorf(path+".path", "path must start with /")
+	}
+	v.positive(path+".interval", hc.Interval)
+	v.positive(path+".timeout", hc.Timeout)
+	if hc.Interval > 0 && hc.Timeout > hc.Interval {
+		v.errorf(path+".timeout", "timeout (%s) must not exceed interval (%s)", hc.Timeout, hc.Interval)
+	}
+}
+
+func (v *validator) discovery(path string, d *Discovery) {
+	providers := 0
+	if d.File != nil {
+		providers++
+		if d.File.Path == "" {
+			v.errorf(path+".file.path", "path is required")
+		}
+		v.positive(path+".file.interval", d.File.Interval)
+		v.positive(path+".file.debounce", d.File.Debounce)
+	}
+	if d.DNS != nil {
+		providers++
+		dpath := path + ".dns"
+		if d.DNS.Name == "" {
+			v.errorf(dpath+".name", "name is required")
+		}
+		switch d.DNS.Type {
+		case DNSTypeA:
+			if d.DNS.Port < 1 || d.DNS.Port > 65535 {
+				v.errorf(dpath+".port", "a port between 1 and 65535 is required for A records")
+			}
+		case DNSTypeSRV:
+			if d.DNS.Port != 0 {
+				v.errorf(dpath+".port", "port must not be set for SRV records")
+			}
+		default:
+			v.errorf(dpath+".type", "unknown record type %q (expected %s or %s)", d.DNS.Type, DNSTypeA, DNSTypeSRV)
+		}
+		if d.DNS.Scheme != "http" && d.DNS.Scheme != "https" {
+			v.errorf(dpath+".scheme", "scheme must be http or https")
+		}
+		v.positive(dpath+".min_interval", d.DNS.MinInterval)
+		v.positive(dpath+".max_interval", d.DNS.MaxInterval)
+		if d.DNS.MaxInterval < d.DNS.MinInterval {
+			v.errorf(dpath+".max_interval", "max_interval must not be shorter than min_interval")
+		}
+	}
+	if d.Consul != nil {
+		providers++
+		cpath := path + ".consul"
+		if d.Consul.Address == "" {
+			v.errorf(cpath+".address", "address is required")
+		} else if err := ValidateBackendURL(d.Consul.Address); err != nil {
+			v.errorf(cpath+".address", "%s", strings.Replace(err.Error(), "backend url", "catalog address", 1))
+		}
+		if d.Consul.Service == "" {
+			v.errorf(cpath+".service", "service is required")
+		}
+		if d.Consul.Scheme != "http" && d.Consul.Scheme != "https" {
+			v.errorf(cpath+".scheme", "scheme must be http or https")
+		}
+		v.positive(cpath+".wait", d.Consul.Wait)
+		switch {
+		case d.Consul.Wait >= 0 && d.Consul.Wait < time.Second:
+			v.errorf(cpath+".wait", "wait must be at least 1s")
+		case d.Consul.Wait > 10*time.Minute:
+			v.errorf(cpath+".wait", "wait must not exceed 10m")
+		}
+	}
+	if d.Docker != nil {
+		providers++
+		if d.Docker.Scheme != "http" && d.Docker.Scheme != "https" {
+			v.errorf(path+".docker.scheme", "scheme must be http or https")
+		}
+	}
+	if providers != 1 {
+		v.errorf(path, "exactly one discovery provider must be configured")
+	}
+}
+
+// checkNode walks a YAML node alongside the Go type it decodes into,
+// recording the line of every path (the line of its key for fields) and reporting unknown fields and
+// nodes of the wrong kind.
+func (v *validator) checkNode(n *yaml.Node, t reflect.Type, path string) {
+	if _, ok := v.lines[path]; !ok && path != "" {
+		v.lines[path] = n.Line
+	}
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		// A bare number would be decoded as nanoseconds
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!str" {
+			v.errorf(path, "expected a duration such as 30s")
+		} else if _, err := time.ParseDuration(n.Value); err != nil {
+			v.errorf(path, "invalid duration %q", n.Value)
+		}
+
+	case t.Kind() == reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			v.errorf(path, "expected a mapping")
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			field, ok := fields[key.Value]
+			fpath := join(path, key.Value)
+			v.lines[fpath] = key.Line
+			if !ok {
+				v.errorf(fpath, "unknown field %q", key.Value)
+				continue
+			}
+			v.checkNode(val, field.Type, fpath)
+		}
+
+	case t.Kind() == reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			v.errorf(path, "expected a list")
+			return
+		}
+		for i, item := range n.Content {
+			v.checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case t.Kind() == reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			v.errorf(path, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			v.lines[join(path, key.Value)] = key.Line
+			v.checkNode(val, t.Elem(), join(path, key.Value))
+		}
+
+	default:
+		if n.Kind != yaml.ScalarNode {
+			v.errorf(path, "expected a scalar %s value", t.Kind())
+			return
+		}
+		v.checkScalar(n, t, path)
+	}
+}
+
+func (v *validator) checkScalar(n *yaml.Node, t reflect.Type, path string) {
+	var ok bool
+	switch t.Kind() {
+	case reflect.String:
+		ok = true
+	case reflect.Bool:
+		ok = n.Tag == "!!bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		ok = n.Tag == "!!int"
+	case reflect.Float32, reflect.Float64:
+		ok = n.Tag == "!!int" || n.Tag == "!!float"
+	default:
+		ok = true
+	}
+	if !ok {
+		v.errorf(path, "invalid %s value %q", t.Kind(), n.Value)
+	}
+}
+
+// yamlFields returns the fields of a struct type by their yaml name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -2,8 +2,12 @@ package core
 
 import (
 	"fmt"
+	"hash/fnv"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,35 +16,270 @@ import (
 // Backend is our unique server instance
 // Note: Capitalized fields are used to be accessible from other packages
 type Backend struct {
-	URL          *url.URL
-	Alive        bool
+	URL *url.URL
+	// Alive is read on every request, it is atomic to avoid locking in the hot path
+	Alive        atomic.Bool
 	Mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
-	StartTime    time.Time
-	MemoryUsage  uint64
+	// Transport connects to the backend for the proxy and the health checks,
+	// http.DefaultTransport when nil
+	Transport http.RoundTripper
+	// Protocol is the protocol spoken to the backend, e.g. h2c, empty when negotiated
+	Protocol string
+	// MaxStreams limits the requests in flight to the backend, 0 for no limit.
+	// It is read on every request, it is atomic to avoid locking in the hot path.
+	MaxStreams atomic.Uint64
+	// ActiveStreams is the number of HTTP/2 streams open to the backend
+	ActiveStreams atomic.Int64
+	StartTime     time.Time
+	MemoryUsage   uint64
+	// Weight is the relative share of traffic the backend receives (0 is treated as 1)
+	Weight int
+	// Tier is the preference group of the backend: only the lowest tier with an
+	// available backend receives traffic, higher tiers are fallbacks
+	Tier int
+	// Labels are arbitrary key/value pairs attached to the backend by the configuration
+	Labels map[string]string
+	// HealthCheck describes how the backend is probed
+	HealthCheck HealthCheck
+	// Status is the readiness state self-reported by the backend on its /health endpoint.
+	// An empty status is treated as StatusReady.
+	Status BackendStatus
+	// AdminState is the state forced by an operator. An empty state is treated as AdminEnabled.
+	AdminState AdminState
+	// Metrics holds the runtime metrics last reported by the backend on its /health endpoint.
+	Metrics HealthMetrics
+	// pool is notified when a change affects which backends can be picked
+	pool atomic.Pointer[ServerPool]
 	// ConnCount is the number of active requests currently being handled by this backend.
 	// Updated atomically to avoid locking in the hot path.
 	ConnCount uint64
 }
 
+// HealthCheck describes how a backend is probed by the active health checks
+type HealthCheck struct {
+	// Path is requested on the backend, its URL is used as-is when empty
+	Path    string
+	Timeout time.Duration
+	// GRPC probes the backend with the gRPC health checking protocol
+	GRPC bool
+}
+
+// BackendStatus is the readiness state reported by a backend
+type BackendStatus string
+
+const (
+	// StatusReady means the backend accepts new requests
+	StatusReady BackendStatus = "ready"
+	// StatusDraining means the backend is shutting down: in-flight requests
+	// are completed but no new requests should be sent to it
+	StatusDraining BackendStatus = "draining"
+	// StatusMaintenance means the backend is up but temporarily out of rotation
+	StatusMaintenance BackendStatus = "maintenance"
+)
+
+// AdminState is the state of a backend forced by an operator through the admin API
+type AdminState string
+
+const (
+	// AdminEnabled lets the backend receive traffic according to its health and status
+	AdminEnabled AdminState = "enabled"
+	// AdminDisabled takes the backend out of rotation
+	AdminDisabled AdminState = "disabled"
+	// AdminDraining takes the backend out of rotation while its in-flight requests complete
+	AdminDraining AdminState = "draining"
+)
+
+// ParseAdminState validates an admin state
+func ParseAdminState(s string) (AdminState, error) {
+	switch AdminState(s) {
+	case AdminEnabled, AdminDisabled, AdminDraining:
+		return AdminState(s), nil
+	}
+	return "", fmt.Errorf("unknown admin state %q", s)
+}
+
+// ParseBackendStatus validates a status reported by a backend.
+// An empty string is treated as StatusReady.
+func ParseBackendStatus(s string) (BackendStatus, error) {
+	switch BackendStatus(s) {
+	case "", StatusReady:
+		return StatusReady, nil
+	case StatusDraining, StatusMaintenance:
+		return BackendStatus(s), nil
+	}
+	return "", fmt.Errorf("unknown backend status %q", s)
+}
+
 // SetAlive is a thread-safe way to set the alive status of the backend
 func (b *Backend) SetAlive(alive bool) {
 	b.Mux.Lock()
-	defer b.Mux.Unlock()
-
 	// If we are transitioning to alive, reset the timer
-	if alive && !b.Alive {
+	if alive && !b.Alive.Load() {
 		b.StartTime = time.Now()
 	}
-	b.Alive = alive
+	changed := b.Alive.Swap(alive) != alive
+	b.Mux.Unlock()
+
+	if changed {
+		b.notifyPool()
+	}
 }
 
 // IsAlive is a thread-safe way to read the alive status of the backend
-func (b *Backend) IsAlive() (alive bool) {
+func (b *Backend) IsAlive() bool {
+	return b.Alive.Load()
+}
+
+// notifyPool lets the pool of the backend refresh its snapshot after a change
+func (b *Backend) notifyPool() {
+	if p := b.pool.Load(); p != nil {
+		p.refresh()
+	}
+}
+
+// SetStatus is a thread-safe way to set the readiness status of the backend
+func (b *Backend) SetStatus(status BackendStatus) {
+	b.Mux.Lock()
+	b.Status = status
+	b.Mux.Unlock()
+	b.notifyPool()
+}
+
+// GetStatus returns the readiness status of the backend
+func (b *Backend) GetStatus() BackendStatus {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	if b.Status == "" {
+		return StatusReady
+	}
+	return b.Status
+}
+
+// SetAdminState is a thread-safe way to set the admin state of the backend
+func (b *Backend) SetAdminState(state AdminState) {
+	b.Mux.Lock()
+	b.AdminState = state
+	b.Mux.Unlock()
+	b.notifyPool()
+}
+
+// GetAdminState returns the admin state of the backend
+func (b *Backend) GetAdminState() AdminState {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	if b.AdminState == "" {
+		return AdminEnabled
+	}
+	return b.AdminState
+}
+
+// IsAvailable reports whether the backend can receive new requests,
+// i.e. it is alive, not draining or in maintenance, and enabled by the operators.
+func (b *Backend) IsAvailable() bool {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	return b.Alive.Load() &&
+		(b.Status == "" || b.Status == StatusReady) &&
+		(b.AdminState == "" || b.AdminState == AdminEnabled)
+}
+
+// ID identifies the backend within its pool: its URL, as formatted by net/url,
+// so that backends on the same host and port with different paths differ
+func (b *Backend) ID() string {
+	return b.URL.String()
+}
+
+// KeepsSessions reports whether the backend still serves the clients stuck to it,
+// i.e. it is alive, and draining or available, whether drained by the operators or by itself.
+func (b *Backend) KeepsSessions() bool {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	return b.Alive.Load() &&
+		(b.Status == "" || b.Status == StatusReady || b.Status == StatusDraining) &&
+		(b.AdminState == "" || b.AdminState == AdminEnabled || b.AdminState == AdminDraining)
+}
+
+// SessionKey identifies the backend in the session cookies without revealing its URL
+func (b *Backend) SessionKey() string {
+	h := fnv.New64a()
+	h.Write([]byte(b.ID()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// SetWeight is a thread-safe way to set the weight of the backend
+func (b *Backend) SetWeight(weight int) {
+	b.Mux.Lock()
+	b.Weight = weight
+	b.Mux.Unlock()
+	b.notifyPool()
+}
+
+// GetWeight returns the weight of the backend, at least 1
+func (b *Backend) GetWeight() int {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	if b.Weight < 1 {
+		return 1
+	}
+	return b.Weight
+}
+
+// SetTier is a thread-safe way to set the tier of the backend
+func (b *Backend) SetTier(tier int) {
+	b.Mux.Lock()
+	b.Tier = tier
+	b.Mux.Unlock()
+	b.notifyPool()
+}
+
+// GetTier returns the tier of the backend
+func (b *Backend) GetTier() int {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	return b.Tier
+}
+
+// SetLabels replaces the labels of the backend
+func (b *Backend) SetLabels(labels map[string]string) {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+	b.Labels = labels
+}
+
+// GetLabels returns the labels of the backend.
+// The returned map must not be modified, use SetLabels instead.
+func (b *Backend) GetLabels() map[string]string {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	return b.Labels
+}
+
+// SetHealthCheck replaces the health check settings of the backend
+func (b *Backend) SetHealthCheck(hc HealthCheck) {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+	b.HealthCheck = hc
+}
+
+// GetHealthCheck returns the health check settings of the backend
+func (b *Backend) GetHealthCheck() HealthCheck {
 	b.Mux.RLock()
-	alive = b.Alive
-	b.Mux.RUnlock()
-	return
+	defer b.Mux.RUnlock()
+	return b.HealthCheck
+}
+
+// HealthCheckURL returns the URL probed by the active health checks
+func (b *Backend) HealthCheckURL() *url.URL {
+	hc := b.GetHealthCheck()
+	if hc.Path == "" {
+		return b.URL
+	}
+	u := b.URL.JoinPath(hc.Path)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return u
 }
 
 // GetUpTime returns the uptime in a human-readable format
@@ -52,7 +291,7 @@ func (b *Backend) GetUpTime() string {
 func (b *Backend) GetUpTimeInSeconds() uint64 {
 	b.Mux.RLock()
 	defer b.Mux.RUnlock()
-	if !b.Alive {
+	if !b.Alive.Load() {
 		return 0
 	}
 	return uint64(time.Since(b.StartTime).Seconds())
@@ -82,6 +321,12 @@ func (b *Backend) GetConnCount() uint64 {
 	return atomic.LoadUint64(&b.ConnCount)
 }
 
+// IsFull reports whether the backend has MaxStreams requests in flight
+func (b *Backend) IsFull() bool {
+	limit := b.MaxStreams.Load()
+	return limit > 0 && b.GetConnCount() >= limit
+}
+
 // SetMemoryUsage sets the memory usage of the backend
 func (b *Backend) SetMemoryUsage(mem uint64) {
 	b.Mux.Lock()
@@ -108,11 +353,82 @@ func (b *Backend) GetMemoryUsageString() string {
 	}
 }
 
+// HealthMetrics holds the runtime metrics a backend reports on its /health endpoint
+type HealthMetrics struct {
+	CPUUsage   float64
+	Goroutines uint64
+	InFlight   uint64
+	GCPause    time.Duration
+	Gauges     map[string]float64
+}
+
+// SetMetrics sets the runtime metrics of the backend
+func (b *Backend) SetMetrics(m HealthMetrics) {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+	b.Metrics = m
+}
+
+// GetMetrics returns a copy of the runtime metrics of the backend
+func (b *Backend) GetMetrics() HealthMetrics {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	m := b.Metrics
+	if b.Metrics.Gauges != nil {
+		m.Gauges = make(map[string]float64, len(b.Metrics.Gauges))
+		for k, v := range b.Metrics.Gauges {
+			m.Gauges[k] = v
+		}
+	}
+	return m
+}
+
+// GetStats returns the statistics of the backend
+func (b *Backend) GetStats() BackendStats {
+	m := b.GetMetrics()
+	return BackendStats{
+		ID:            b.ID(),
+		URL:           b.URL.String(),
+		Alive:         b.IsAlive(),
+		Status:        b.GetStatus(),
+		AdminState:    b.GetAdminState(),
+		Weight:        b.GetWeight(),
+		Tier:          b.GetTier(),
+		Labels:        b.GetLabels(),
+		UpTime:        b.GetUpTime(),
+		MemoryUsage:   b.GetMemoryUsageString(),
+		ConnCount:     b.GetConnCount(),
+		Protocol:      b.Protocol,
+		MaxStreams:    b.MaxStreams.Load(),
+		ActiveStreams: uint64(max(b.ActiveStreams.Load(), 0)),
+		CPUUsage:      m.CPUUsage,
+		Goroutines:    m.Goroutines,
+		InFlight:      m.InFlight,
+		GCPause:       m.GCPause.String(),
+		Gauges:        m.Gauges,
+	}
+}
+
 // BackendStats represents the statistics of a backend server
 type BackendStats struct {
-	URL         string `json:"url"`
-	Alive       bool   `json:"alive"`
-	UpTime      string `json:"uptime"`
-	MemoryUsage string `json:"memory_usage"`
-	ConnCount   uint64 `json:"conn_count"`
+	ID          string            `json:"id"`
+	URL         string            `json:"url"`
+	Alive       bool              `json:"alive"`
+	Status      BackendStatus     `json:"status"`
+	AdminState  AdminState        `json:"admin_state"`
+	Weight      int               `json:"weight"`
+	Tier        int               `json:"tier"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	UpTime      string            `json:"uptime"`
+	MemoryUsage string            `json:"memory_usage"`
+	ConnCount   uint64            `json:"conn_count"`
+	Protocol    string            `json:"protocol,omitempty"`
+	MaxStreams  uint64            `json:"max_streams,omitempty"`
+	// ActiveStreams counts the HTTP/2 streams open to the backend
+	ActiveStreams uint64             `json:"active_streams"`
+	CPUUsage      float64            `json:"cpu_usage"`
+	Goroutines    uint64             `json:"goroutines"`
+	InFlight      uint64             `json:"in_flight"`
+	GCPause       string             `json:"gc_pause"`
+	Gauges        map[string]float64 `json:"gauges,omitempty"`
 }
@@ -9,7 +9,7 @@ import (
 
 func TestBackend_SetAlive(t *testing.T) {
 	u, _ := url.Parse("http://localhost:8080")
-	b := &Backend{URL: u, Alive: false}
+	b := &Backend{URL: u}
 
 	tests := []struct {
 		name     string
@@ -32,7 +32,7 @@ func TestBackend_SetAlive(t *testing.T) {
 
 func TestBackend_ConcurrentAccess(t *testing.T) {
 	u, _ := url.Parse("http://localhost:8080")
-	b := &Backend{URL: u, Alive: false}
+	b := &Backend{URL: u}
 
 	t.Run("Concurrent SetAlive/IsAlive", func(t *testing.T) {
 		var wg sync.WaitGroup
@@ -107,7 +107,7 @@ func TestBackend_ConnectionCounters(t *testing.T) {
 
 func TestBackend_Uptime(t *testing.T) {
 	u, _ := url.Parse("http://localhost:8080")
-	b := &Backend{URL: u, Alive: false}
+	b := &Backend{URL: u}
 
 	t.Run("Uptime for Dead Backend", func(t *testing.T) {
 		if uptime := b.GetUpTimeInSeconds(); uptime != 0 {
@@ -156,3 +156,101 @@ func TestBackend_MemoryUsage(t *testing.T) {
 		}
 	})
 }
+
+func TestBackend_Metrics(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8080")
+	b := &Backend{URL: u}
+
+	b.SetMetrics(HealthMetrics{
+		CPUUsage:   12.5,
+		Goroutines: 8,
+		InFlight:   3,
+		GCPause:    250 * time.Microsecond,
+		Gauges:     map[string]float64{"queue_depth": 4},
+	})
+
+	m := b.GetMetrics()
+	if m.CPUUsage != 12.5 || m.Goroutines != 8 || m.InFlight != 3 || m.GCPause != 250*time.Microsecond {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// The returned gauges must be a copy
+	m.Gauges["queue_depth"] = 100
+	if got := b.GetMetrics().Gauges["queue_depth"]; got != 4 {
+		t.Errorf("Expected gauge to remain 4, got %v", got)
+	}
+}
+
+func TestBackend_Status(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8080")
+	b := &Backend{URL: u}
+	b.SetAlive(true)
+
+	if got := b.GetStatus(); got != StatusReady {
+		t.Errorf("Expected empty status to be reported as ready, got %s", got)
+	}
+
+	tests := []struct {
+		status    BackendStatus
+		available bool
+	}{
+		{StatusReady, true},
+		{StatusDraining, false},
+		{StatusMaintenance, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			b.SetStatus(tt.status)
+			if got := b.IsAvailable(); got != tt.available {
+				t.Errorf("IsAvailable() = %v, want %v", got, tt.available)
+			}
+		})
+	}
+
+	t.Run("Dead Backend Not Available", func(t *testing.T) {
+		b.SetStatus(StatusReady)
+		b.SetAlive(false)
+		if b.IsAvailable() {
+			t.Error("Expected dead backend to be unavailable")
+		}
+	})
+}
+
+func TestParseBackendStatus(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected BackendStatus
+		wantErr  bool
+	}{
+		{"", StatusReady, false},
+		{"ready", StatusReady, false},
+		{"draining", StatusDraining, false},
+		{"maintenance", StatusMaintenance, false},
+		{"sleeping", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBackendStatus(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBackendStatus(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.expected {
+			t.Errorf("ParseBackendStatus(%q) = %q, want %q", tt.in, got, tt.expected)
+		}
+	}
+}
+
+func TestBackend_HealthCheckURL(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8080")
+	b := &Backend{URL: u}
+
+	if got := b.HealthCheckURL().String(); got != "http://localhost:8080" {
+		t.Errorf("Expected backend URL, got %s", got)
+	}
+
+	b.HealthCheck.Path = "/health"
+	if got := b.HealthCheckURL().String(); got != "http://localhost:8080/health" {
+		t.Errorf("Expected /health URL, got %s", got)
+	}
+}
@@ -2,53 +2,228 @@ package core
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
+// Strategy is the algorithm used by a ServerPool to pick a backend
+type Strategy string
+
+const (
+	// LeastConn picks the backend with the fewest active connections relative to its weight
+	LeastConn Strategy = "least_conn"
+	// RoundRobin cycles through the backends, each one being picked as many times as its weight
+	RoundRobin Strategy = "round_robin"
+)
+
+// ServerPool is a named group of backends.
+//
+// The request path never locks: it reads an immutable snapshot of the pool
+// through an atomic pointer. Mutations (adding or removing a backend, or a
+// change of weight, health or state of one of its backends) build a new
+// snapshot and swap it in.
 type ServerPool struct {
-	Backends []*Backend
+	// Name identifies the pool in the configuration and in the stats
+	Name string
+	// Strategy defaults to LeastConn
+	Strategy Strategy
+	// StickyCookie, when set, names the cookie keeping each client on the
+	// backend which served it first, even once the backend is draining
+	StickyCookie string
+	// mu serializes the mutations
+	mu       sync.Mutex
+	snapshot atomic.Pointer[poolSnapshot]
 	current  uint64
 }
 
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.Backends)))
+// poolSnapshot is an immutable view of the backends of a pool
+type poolSnapshot struct {
+	// backends holds every backend of the pool, in insertion order
+	backends []*Backend
+	// available holds the backends of the preferred tier which can receive new requests
+	available []*Backend
+	// weights holds the weight of each available backend
+	weights []uint64
+	// slots holds each available backend as many times as its weight, for round-robin
+	slots []*Backend
+	// sessions holds every backend by its SessionKey
+	sessions map[string]*Backend
+}
+
+var emptySnapshot = &poolSnapshot{}
+
+// load returns the current snapshot, never nil
+func (s *ServerPool) load() *poolSnapshot {
+	if snap := s.snapshot.Load(); snap != nil {
+		return snap
+	}
+	return emptySnapshot
+}
+
+// store builds and publishes the snapshot of the given backends. Callers hold s.mu.
+// Only the lowest tier having an available backend is selectable.
+func (s *ServerPool) store(backends []*Backend) {
+	snap := &poolSnapshot{backends: backends, sessions: make(map[string]*Backend, len(backends))}
+	tier, found := 0, false
+	for _, b := range backends {
+		snap.sessions[b.SessionKey()] = b
+		if t := b.GetTier(); b.IsAvailable() && (!found || t < tier) {
+			tier, found = t, true
+		}
+	}
+	for _, b := range backends {
+		if !b.IsAvailable() || b.GetTier() != tier {
+			continue
+		}
+		w := b.GetWeight()
+		snap.available = append(snap.available, b)
+		snap.weights = append(snap.weights, uint64(w))
+		for ; w > 0; w-- {
+			snap.slots = append(snap.slots, b)
+		}
+	}
+	s.snapshot.Store(snap)
+}
+
+// refresh rebuilds the snapshot after a backend changed
+func (s *ServerPool) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(s.load().backends)
+}
+
+// GetPeer returns an available backend according to the pool strategy,
+// or nil if none is available.
+func (s *ServerPool) GetPeer() *Backend {
+	if s.Strategy == RoundRobin {
+		return s.GetNextPeer()
+	}
+	return s.GetLeastConnPeer()
+}
+
+// GetPeerExcept returns an available backend according to the pool strategy
+// other than the except ones, e.g. to retry a request on another backend,
+// or nil if none is available.
+func (s *ServerPool) GetPeerExcept(except map[*Backend]bool) *Backend {
+	if s.Strategy == RoundRobin {
+		return s.nextPeer(except)
+	}
+	return s.leastConnPeer(except)
 }
 
+// GetBackends returns the backends of the pool. The returned slice must not be modified.
+func (s *ServerPool) GetBackends() []*Backend {
+	return s.load().backends
+}
+
+// NextIndex advances the round-robin counter and returns the next slot
+// out of total slots.
+func (s *ServerPool) NextIndex(total int) int {
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(total))
+}
+
+// GetNextPeer returns the next available backend in weighted round-robin order.
+// Each backend owns as many consecutive slots as its weight. Backends having
+// reached their MaxStreams are skipped.
 func (s *ServerPool) GetNextPeer() *Backend {
-	next := s.NextIndex()
-	l := len(s.Backends) + next // prevent infinite loop
-	for i := next; i < l; i++ {
-		idx := i % len(s.Backends)
-		if s.Backends[idx].IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.Backends[idx]
+	return s.nextPeer(nil)
+}
+
+func (s *ServerPool) nextPeer(except map[*Backend]bool) *Backend {
+	slots := s.load().slots
+	if len(slots) == 0 {
+		return nil
+	}
+	next := s.NextIndex(len(slots))
+	for i := range slots {
+		if b := slots[(next+i)%len(slots)]; !b.IsFull() && !except[b] {
+			return b
 		}
 	}
 	return nil
 }
 
-// GetLeastConnPeer returns the alive backend with the least number of active connections.
+// GetLeastConnPeer returns the available backend with the least number of active connections
+// relative to its weight, skipping the backends having reached their MaxStreams.
 // If multiple backends have the same connection count, the first encountered is returned.
 func (s *ServerPool) GetLeastConnPeer() *Backend {
+	return s.leastConnPeer(nil)
+}
+
+func (s *ServerPool) leastConnPeer(except map[*Backend]bool) *Backend {
+	snap := s.load()
 	var best *Backend
-	var min uint64 = ^uint64(0) // max
-	for _, b := range s.Backends {
-		if !b.IsAlive() {
+	var bestConn, bestWeight uint64
+	for i, b := range snap.available {
+		if b.IsFull() || except[b] {
 			continue
 		}
-		c := b.GetConnCount()
-		if best == nil || c < min {
+		c, w := b.GetConnCount(), snap.weights[i]
+		// c/w < bestConn/bestWeight, without floating point
+		if best == nil || c*bestWeight < bestConn*w {
 			best = b
-			min = c
+			bestConn, bestWeight = c, w
 		}
 	}
 	return best
 }
 
+// GetSessionPeer returns the backend with the given SessionKey if it still
+// serves its sessions and has not reached its MaxStreams, or nil.
+func (s *ServerPool) GetSessionPeer(key string) *Backend {
+	b := s.load().sessions[key]
+	if b == nil || b.IsFull() || !b.KeepsSessions() {
+		return nil
+	}
+	return b
+}
+
 func (s *ServerPool) AddBackend(b *Backend) {
-	s.Backends = append(s.Backends, b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.pool.Store(s)
+	old := s.load().backends
+	backends := make([]*Backend, 0, len(old)+1)
+	backends = append(backends, old...)
+	s.store(append(backends, b))
+}
+
+// RemoveBackend removes a backend from the pool.
+// It returns false if the backend is not part of the pool.
+func (s *ServerPool) RemoveBackend(b *Backend) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.load().backends
+	for i, cur := range old {
+		if cur == b {
+			backends := make([]*Backend, 0, len(old)-1)
+			backends = append(backends, old[:i]...)
+			s.store(append(backends, old[i+1:]...))
+			b.pool.CompareAndSwap(s, nil)
+			return true
+		}
+	}
+	return false
+}
+
+// FindBackend returns the backend with the given ID, or nil. The host and
+// port of its URL also identify a backend, when no other backend shares them.
+func (s *ServerPool) FindBackend(id string) *Backend {
+	var found *Backend
+	hosts := 0
+	for _, b := range s.GetBackends() {
+		if b.ID() == id {
+			return b
+		}
+		if b.URL.Host == id {
+			found = b
+			hosts++
+		}
+	}
+	if hosts != 1 {
+		return nil
+	}
+	return found
 }
 
 // formatSecondsToDuration converts seconds to a human-readable duration string
@@ -62,7 +237,7 @@ func formatSecondsToDuration(seconds uint64) string {
 // GetUpTimeInSeconds returns the total uptime in seconds of all alive backends
 func (s *ServerPool) GetUpTimeInSeconds() uint64 {
 	var total uint64
-	for _, b := range s.Backends {
+	for _, b := range s.GetBackends() {
 		if b.IsAlive() {
 			total += b.GetUpTimeInSeconds()
 		}
@@ -74,7 +249,7 @@ func (s *ServerPool) GetUpTimeInSeconds() uint64 {
 func (s *ServerPool) GetUpTime() string {
 	var totalUpTime uint64
 	var aliveCount uint64
-	for _, b := range s.Backends {
+	for _, b := range s.GetBackends() {
 		if b.IsAlive() {
 			totalUpTime += b.GetUpTimeInSeconds()
 			aliveCount++
@@ -90,14 +265,8 @@ func (s *ServerPool) GetUpTime() string {
 // GetStats returns the statistics of all backends
 func (s *ServerPool) GetStats() []BackendStats {
 	var stats []BackendStats
-	for _, b := range s.Backends {
-		stats = append(stats, BackendStats{
-			URL:         b.URL.String(),
-			Alive:       b.IsAlive(),
-			UpTime:      b.GetUpTime(),
-			MemoryUsage: b.GetMemoryUsageString(),
-			ConnCount:   b.GetConnCount(),
-		})
+	for _, b := range s.GetBackends() {
+		stats = append(stats, b.GetStats())
 	}
 	return stats
 }
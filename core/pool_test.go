@@ -1,7 +1,10 @@
 package core
 
 import (
+	"fmt"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,8 +16,8 @@ func TestServerPool_AddBackend(t *testing.T) {
 
 	pool.AddBackend(b)
 
-	if len(pool.Backends) != 1 {
-		t.Errorf("Expected 1 backend, got %d", len(pool.Backends))
+	if len(pool.GetBackends()) != 1 {
+		t.Errorf("Expected 1 backend, got %d", len(pool.GetBackends()))
 	}
 }
 
@@ -24,9 +27,11 @@ func TestServerPool_GetNextPeer(t *testing.T) {
 	u2, _ := url.Parse("http://localhost:8082")
 	u3, _ := url.Parse("http://localhost:8083")
 
-	b1 := &Backend{URL: u1, Alive: true}
-	b2 := &Backend{URL: u2, Alive: true}
-	b3 := &Backend{URL: u3, Alive: false} // Dead backend
+	b1 := &Backend{URL: u1}
+	b1.SetAlive(true)
+	b2 := &Backend{URL: u2}
+	b2.SetAlive(true)
+	b3 := &Backend{URL: u3} // Dead backend
 
 	pool.AddBackend(b1)
 	pool.AddBackend(b2)
@@ -73,9 +78,12 @@ func TestServerPool_GetLeastConnPeer(t *testing.T) {
 	u2, _ := url.Parse("http://localhost:8082")
 	u3, _ := url.Parse("http://localhost:8083")
 
-	b1 := &Backend{URL: u1, Alive: true}
-	b2 := &Backend{URL: u2, Alive: true}
-	b3 := &Backend{URL: u3, Alive: true}
+	b1 := &Backend{URL: u1}
+	b1.SetAlive(true)
+	b2 := &Backend{URL: u2}
+	b2.SetAlive(true)
+	b3 := &Backend{URL: u3}
+	b3.SetAlive(true)
 
 	pool.AddBackend(b1)
 	pool.AddBackend(b2)
@@ -110,12 +118,22 @@ func TestServerPool_GetLeastConnPeer(t *testing.T) {
 			t.Errorf("Expected b3 (20 conns), got %v (%d conns)", peer.URL, peer.GetConnCount())
 		}
 	})
+
+	// Scenario 4: Ignore draining backends
+	b3.SetStatus(StatusDraining)
+	t.Run("Ignore Draining Backend", func(t *testing.T) {
+		peer := pool.GetLeastConnPeer()
+		if peer != b2 { // b1 dead, b2=100, b3 draining
+			t.Errorf("Expected b2 (100 conns), got %v (%d conns)", peer.URL, peer.GetConnCount())
+		}
+	})
 }
 
 func TestServerPool_GetStats(t *testing.T) {
 	pool := &ServerPool{}
 	u, _ := url.Parse("http://localhost:8080")
-	b := &Backend{URL: u, Alive: true}
+	b := &Backend{URL: u}
+	b.SetAlive(true)
 	pool.AddBackend(b)
 
 	stats := pool.GetStats()
@@ -134,8 +152,12 @@ func TestServerPool_Uptime(t *testing.T) {
 
 	// Simulate backends running for 10 seconds
 	startTime := time.Now().Add(-10 * time.Second)
-	b1 := &Backend{URL: u1, Alive: true, StartTime: startTime}
-	b2 := &Backend{URL: u2, Alive: true, StartTime: startTime}
+	b1 := &Backend{URL: u1}
+	b1.SetAlive(true)
+	b1.StartTime = startTime
+	b2 := &Backend{URL: u2}
+	b2.SetAlive(true)
+	b2.StartTime = startTime
 
 	pool.AddBackend(b1)
 	pool.AddBackend(b2)
@@ -166,3 +188,387 @@ func TestServerPool_Uptime(t *testing.T) {
 		}
 	})
 }
+
+func TestServerPool_GetSessionPeer(t *testing.T) {
+	u1, _ := url.Parse("http://localhost:8081")
+	u2, _ := url.Parse("http://localhost:8082")
+	b1, b2 := &Backend{URL: u1}, &Backend{URL: u2}
+	b1.SetAlive(true)
+	b2.SetAlive(true)
+	pool := &ServerPool{}
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	if b1.SessionKey() == b2.SessionKey() {
+		t.Fatalf("Expected distinct session keys, got %q twice", b1.SessionKey())
+	}
+	if strings.Contains(b1.SessionKey(), "localhost") {
+		t.Errorf("Expected the session key not to reveal the URL, got %q", b1.SessionKey())
+	}
+
+	tests := []struct {
+		name     string
+		status   BackendStatus
+		state    AdminState
+		alive    bool
+		expected *Backend
+	}{
+		{"Ready", StatusReady, AdminEnabled, true, b1},
+		{"Self Draining", StatusDraining, AdminEnabled, true, b1},
+		{"Admin Draining", StatusReady, AdminDraining, true, b1},
+		{"Maintenance", StatusMaintenance, AdminEnabled, true, nil},
+		{"Disabled", StatusReady, AdminDisabled, true, nil},
+		{"Dead", StatusDraining, AdminEnabled, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b1.SetStatus(tt.status)
+			b1.SetAdminState(tt.state)
+			b1.SetAlive(tt.alive)
+			if got := pool.GetSessionPeer(b1.SessionKey()); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	b1.SetStatus(StatusReady)
+	b1.SetAdminState(AdminEnabled)
+	b1.SetAlive(true)
+	b1.MaxStreams.Store(1)
+	b1.IncConn()
+	if got := pool.GetSessionPeer(b1.SessionKey()); got != nil {
+		t.Errorf("Expected no backend at its max streams, got %v", got.URL)
+	}
+	b1.DecConn()
+
+	if got := pool.GetSessionPeer("unknown"); got != nil {
+		t.Errorf("Expected no backend for an unknown key, got %v", got.URL)
+	}
+}
+
+func TestServerPool_Weighted(t *testing.T) {
+	u1, _ := url.Parse("http://localhost:8081")
+	u2, _ := url.Parse("http://localhost:8082")
+
+	t.Run("Round Robin", func(t *testing.T) {
+		b1 := &Backend{URL: u1, Weight: 3}
+		b1.SetAlive(true)
+		b2 := &Backend{URL: u2}
+		b2.SetAlive(true)
+		pool := &ServerPool{Strategy: RoundRobin}
+		pool.AddBackend(b1)
+		pool.AddBackend(b2)
+
+		counts := map[*Backend]int{}
+		for i := 0; i < 40; i++ {
+			counts[pool.GetPeer()]++
+		}
+		if counts[b1] != 30 || counts[b2] != 10 {
+			t.Errorf("Expected a 30/10 split, got %d/%d", counts[b1], counts[b2])
+		}
+	})
+
+	t.Run("Least Connections", func(t *testing.T) {
+		b1 := &Backend{URL: u1, Weight: 4, ConnCount: 6}
+		b1.SetAlive(true)
+		b2 := &Backend{URL: u2, ConnCount: 2}
+		b2.SetAlive(true)
+		pool := &ServerPool{Strategy: LeastConn}
+		pool.AddBackend(b1)
+		pool.AddBackend(b2)
+
+		// b1 has 6/4 = 1.5 connections per weight unit, b2 has 2
+		if peer := pool.GetPeer(); peer != b1 {
+			t.Errorf("Expected b1, got %v", peer.URL)
+		}
+	})
+
+	t.Run("Empty Pool", func(t *testing.T) {
+		pool := &ServerPool{Strategy: RoundRobin}
+		if peer := pool.GetPeer(); peer != nil {
+			t.Errorf("Expected nil, got %v", peer.URL)
+		}
+	})
+}
+
+func TestServerPool_RemoveBackend(t *testing.T) {
+	pool := &ServerPool{}
+	u1, _ := url.Parse("http://localhost:8081")
+	u2, _ := url.Parse("http://localhost:8082")
+	b1 := &Backend{URL: u1}
+	b1.SetAlive(true)
+	b2 := &Backend{URL: u2}
+	b2.SetAlive(true)
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	snapshot := pool.GetBackends()
+	if !pool.RemoveBackend(b1) {
+		t.Fatal("Expected b1 to be removed")
+	}
+	if pool.RemoveBackend(b1) {
+		t.Error("Expected second removal to fail")
+	}
+	if pool.FindBackend("localhost:8081") != nil || pool.FindBackend("localhost:8082") != b2 {
+		t.Error("Unexpected backends after removal")
+	}
+	if len(snapshot) != 2 || snapshot[0] != b1 {
+		t.Error("Expected previous snapshot to be unaffected")
+	}
+	if peer := pool.GetPeer(); peer != b2 {
+		t.Errorf("Expected b2, got %v", peer)
+	}
+}
+
+// newBenchPool returns a pool of n alive backends
+func newBenchPool(n int, strategy Strategy) *ServerPool {
+	pool := &ServerPool{Strategy: strategy}
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://localhost:%d", 8000+i))
+		b := &Backend{URL: u}
+		b.SetAlive(true)
+		pool.AddBackend(b)
+	}
+	return pool
+}
+
+// mutate keeps changing the pool until stop is closed: health flaps,
+// re-weighting, and adding/removing a backend.
+func mutate(pool *ServerPool, stop <-chan struct{}, done *sync.WaitGroup) {
+	defer done.Done()
+	u, _ := url.Parse("http://localhost:9999")
+	extra := &Backend{URL: u}
+	extra.SetAlive(true)
+	backends := pool.GetBackends()
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		b := backends[i%len(backends)]
+		b.SetAlive(i%2 == 0)
+		b.SetWeight(i%3 + 1)
+		if i%2 == 0 {
+			pool.AddBackend(extra)
+		} else {
+			pool.RemoveBackend(extra)
+		}
+	}
+}
+
+func TestServerPool_ConcurrentMutation(t *testing.T) {
+	for _, strategy := range []Strategy{LeastConn, RoundRobin} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool := newBenchPool(4, strategy)
+			stop := make(chan struct{})
+			var mutators sync.WaitGroup
+			mutators.Add(1)
+			go mutate(pool, stop, &mutators)
+
+			var readers sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					for j := 0; j < 2000; j++ {
+						if peer := pool.GetPeer(); peer != nil {
+							peer.IncConn()
+							peer.DecConn()
+						}
+						_ = pool.GetStats()
+					}
+				}()
+			}
+			readers.Wait()
+			close(stop)
+			mutators.Wait()
+		})
+	}
+}
+
+func TestServerPool_SnapshotFollowsBackendChanges(t *testing.T) {
+	pool := newBenchPool(2, RoundRobin)
+	backends := pool.GetBackends()
+
+	backends[0].SetAdminState(AdminDisabled)
+	for i := 0; i < 4; i++ {
+		if peer := pool.GetPeer(); peer != backends[1] {
+			t.Fatalf("Expected only the enabled backend to be picked, got %v", peer.URL)
+		}
+	}
+
+	backends[0].SetAdminState(AdminEnabled)
+	backends[0].SetWeight(3)
+	counts := map[*Backend]int{}
+	for i := 0; i < 8; i++ {
+		counts[pool.GetPeer()]++
+	}
+	if counts[backends[0]] != 6 || counts[backends[1]] != 2 {
+		t.Errorf("Expected a 6/2 split after re-weighting, got %d/%d", counts[backends[0]], counts[backends[1]])
+	}
+
+	// A removed backend does not affect its former pool anymore
+	pool.RemoveBackend(backends[1])
+	backends[1].SetAlive(false)
+	if got := len(pool.GetBackends()); got != 1 {
+		t.Errorf("Expected 1 backend, got %d", got)
+	}
+}
+
+func TestServerPool_Tiers(t *testing.T) {
+	pool := newBenchPool(3, RoundRobin)
+	backends := pool.GetBackends()
+	backends[1].SetTier(1)
+	backends[2].SetTier(1)
+
+	for i := 0; i < 4; i++ {
+		if peer := pool.GetPeer(); peer != backends[0] {
+			t.Fatalf("Expected only the tier 0 backend to be picked, got %v", peer.URL)
+		}
+	}
+
+	// The next tier takes over when the preferred one has no available backend
+	backends[0].SetAlive(false)
+	counts := map[*Backend]int{}
+	for i := 0; i < 4; i++ {
+		counts[pool.GetPeer()]++
+	}
+	if counts[backends[1]] != 2 || counts[backends[2]] != 2 {
+		t.Errorf("Expected the tier 1 backends to share traffic, got %d/%d", counts[backends[1]], counts[backends[2]])
+	}
+
+	backends[0].SetAlive(true)
+	if peer := pool.GetLeastConnPeer(); peer != backends[0] {
+		t.Errorf("Expected the tier 0 backend to be preferred again, got %v", peer.URL)
+	}
+}
+
+func TestServerPool_MaxStreams(t *testing.T) {
+	for _, strategy := range []Strategy{LeastConn, RoundRobin} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool := newBenchPool(2, strategy)
+			backends := pool.GetBackends()
+			backends[0].MaxStreams.Store(1)
+			backends[1].MaxStreams.Store(2)
+
+			// Each pick opens a stream, until every backend is at its limit
+			counts := map[*Backend]int{}
+			for i := 0; i < 3; i++ {
+				peer := pool.GetPeer()
+				if peer == nil {
+					t.Fatalf("Expected a backend for request %d", i)
+				}
+				peer.IncConn()
+				counts[peer]++
+			}
+			if counts[backends[0]] != 1 || counts[backends[1]] != 2 {
+				t.Errorf("Expected 1 and 2 streams, got %d and %d", counts[backends[0]], counts[backends[1]])
+			}
+			if peer := pool.GetPeer(); peer != nil {
+				t.Errorf("Expected no backend when all are full, got %v", peer.URL)
+			}
+
+			backends[0].DecConn()
+			if peer := pool.GetPeer(); peer != backends[0] {
+				t.Errorf("Expected the backend with a free stream, got %v", peer)
+			}
+		})
+	}
+}
+
+func TestServerPool_GetPeerExcept(t *testing.T) {
+	for _, strategy := range []Strategy{LeastConn, RoundRobin} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool := newBenchPool(3, strategy)
+			backends := pool.GetBackends()
+
+			tried := map[*Backend]bool{}
+			for i := 0; i < 3; i++ {
+				peer := pool.GetPeerExcept(tried)
+				if peer == nil || tried[peer] {
+					t.Fatalf("Expected an untried backend for attempt %d, got %v", i, peer)
+				}
+				tried[peer] = true
+			}
+			if peer := pool.GetPeerExcept(tried); peer != nil {
+				t.Errorf("Expected no backend when all were tried, got %v", peer.URL)
+			}
+
+			delete(tried, backends[1])
+			if peer := pool.GetPeerExcept(tried); peer != backends[1] {
+				t.Errorf("Expected the only untried backend, got %v", peer)
+			}
+		})
+	}
+}
+
+func benchmarkGetPeer(b *testing.B, strategy Strategy, withMutations bool) {
+	pool := newBenchPool(10, strategy)
+	var mutators sync.WaitGroup
+	stop := make(chan struct{})
+	if withMutations {
+		mutators.Add(1)
+		go mutate(pool, stop, &mutators)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if peer := pool.GetPeer(); peer != nil {
+				peer.IncConn()
+				peer.DecConn()
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	mutators.Wait()
+}
+
+func BenchmarkServerPool_LeastConn(b *testing.B) {
+	benchmarkGetPeer(b, LeastConn, false)
+}
+
+func BenchmarkServerPool_LeastConn_ConcurrentMutation(b *testing.B) {
+	benchmarkGetPeer(b, LeastConn, true)
+}
+
+func BenchmarkServerPool_RoundRobin(b *testing.B) {
+	benchmarkGetPeer(b, RoundRobin, false)
+}
+
+func BenchmarkServerPool_RoundRobin_ConcurrentMutation(b *testing.B) {
+	benchmarkGetPeer(b, RoundRobin, true)
+}
+
+func TestServerPool_FindBackend(t *testing.T) {
+	pool := &ServerPool{}
+	for _, raw := range []string{"http://localhost:8081", "http://localhost:8082/api", "http://localhost:8082/admin"} {
+		u, _ := url.Parse(raw)
+		pool.AddBackend(&Backend{URL: u})
+	}
+
+	tests := []struct {
+		name     string
+		id       string
+		expected string
+	}{
+		{"URL", "http://localhost:8082/api", "http://localhost:8082/api"},
+		{"Unique Host", "localhost:8081", "http://localhost:8081"},
+		{"Shared Host", "localhost:8082", ""},
+		{"Unknown", "http://localhost:8083", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if b := pool.FindBackend(tt.id); b != nil {
+				got = b.ID()
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delay before retrying a failed catalog query, doubled on each failure
+const (
+	consulMinRetry = time.Second
+	consulMaxRetry = 30 * time.Second
+)
+
+// consulMinInterval is the shortest time between the starts of two queries,
+// so that a catalog answering blocking queries immediately is not flooded
+const consulMinInterval = time.Second
+
+// Consul follows the passing instances of a service in a Consul-compatible
+// catalog through blocking queries on /v1/health/service/<service>.
+//
+// Each instance becomes a target. Its tags and metadata become labels: a
+// "key=value" tag sets the key label, any other tag is set to "true". The
+// "weight" and "tier" metadata set the weight and tier of the target, the
+// weight defaulting to the passing weight of the instance.
+// When the catalog is unreachable the last known set is kept.
+type Consul struct {
+	Address    string
+	Service    string
+	Tag        string
+	Datacenter string
+	Token      string
+	Scheme     string
+	Wait       time.Duration
+	// retry overrides consulMinRetry in tests
+	retry time.Duration
+	// interval overrides consulMinInterval in tests
+	interval time.Duration
+}
+
+// consulEntry is an instance returned by the health/service endpoint
+type consulEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// Name describes the provider in logs
+func (c *Consul) Name() string {
+	return "consul " + c.Service
+}
+
+// Run follows the catalog until ctx is done
+func (c *Consul) Run(ctx context.Context, updates chan<- []Target) {
+	minRetry := consulMinRetry
+	if c.retry > 0 {
+		minRetry = c.retry
+	}
+	retry := minRetry
+	interval := consulMinInterval
+	if c.interval > 0 {
+		interval = c.interval
+	}
+
+	var last []Target
+	var sent bool
+	var index uint64
+	var started time.Time
+	for {
+		if wait := interval - time.Since(started); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		started = time.Now()
+		targets, next, err := c.query(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Discovery (%s): keeping %d known targets: %s", c.Name(), len(last), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, consulMaxRetry)
+			continue
+		}
+		retry = minRetry
+
+		// The index must be reset when it goes backwards, e.g. after the catalog was restored
+		if next < index {
+			index = 0
+		} else {
+			index = next
+		}
+
+		if !sent || !Equal(targets, last) {
+			last, sent = targets, true
+			if !send(ctx, updates, targets) {
+				return
+			}
+		}
+	}
+}
+
+// query runs a blocking query returning once the catalog index is past index
+// (or immediately when index is 0), with the targets and the new index
+func (c *Consul) query(ctx context.Context, index uint64) ([]Target, uint64, error) {
+	params := url.Values{"passing": {"1"}}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", strconv.FormatInt(c.Wait.Milliseconds(), 10)+"ms")
+	}
+	if c.Tag != "" {
+		params.Set("tag", c.Tag)
+	}
+	if c.Datacenter != "" {
+		params.Set("dc", c.Datacenter)
+	}
+	u := strings.TrimSuffix(c.Address, "/") + "/v1/health/service/" + url.PathEscape(c.Service) + "?" + params.Encode()
+
+	// The catalog adds up to Wait/16 of jitter to blocking queries
+	ctx, cancel := context.WithTimeout(ctx, c.Wait+c.Wait/16+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("catalog answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || next == 0 {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	targets := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		targets = append(targets, c.target(e))
+	}
+	targets = dedupe(sorted(targets))
+	if err := Validate(targets); err != nil {
+		return nil, 0, err
+	}
+	return targets, next, nil
+}
+
+// target maps a catalog instance to a target
+func (c *Consul) target(e consulEntry) Target {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+	t := Target{
+		URL:    c.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+		Weight: e.Service.Weights.Passing,
+		Labels: map[string]string{"consul_node": e.Node.Node},
+	}
+	for _, tag := range e.Service.Tags {
+		if k, v, ok := strings.Cut(tag, "="); ok {
+			t.Labels[k] = v
+		} else {
+			t.Labels[tag] = "true"
+		}
+	}
+	for k, v := range e.Service.Meta {
+		t.Labels[k] = v
+	}
+	if w, err := strconv.Atoi(e.Service.Meta["weight"]); err == nil && w > 0 {
+		t.Weight = w
+	}
+	if tier, err := strconv.Atoi(e.Service.Meta["tier"]); err == nil && tier >= 0 {
+		t.Tier = tier
+	}
+	return t
+}
@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCatalog serves the health/service endpoint of a Consul-compatible catalog,
+// answering blocking queries when the index changes
+type fakeCatalog struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]any
+	// changed is closed and replaced on every change
+	changed chan struct{}
+	down    bool
+	queries []string
+}
+
+func newFakeCatalog(t *testing.T) (*fakeCatalog, *httptest.Server) {
+	c := &fakeCatalog{index: 1, changed: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		c.mu.Lock()
+		c.queries = append(c.queries, r.URL.RawQuery)
+		index, changed := c.index, c.changed
+		c.mu.Unlock()
+
+		if want, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); want == index {
+			wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.down {
+			http.Error(w, "No cluster leader", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+		json.NewEncoder(w).Encode(c.entries)
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+func (c *fakeCatalog) set(down bool, entries ...map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = down
+	c.entries = entries
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func instance(node, addr string, port int, tags []string, meta map[string]string) map[string]any {
+	return map[string]any{
+		"Node": map[string]any{"Node": node, "Address": addr},
+		"Service": map[string]any{
+			"ID": "web-" + node, "Service": "web", "Port": port, "Tags": tags, "Meta": meta,
+			"Weights": map[string]any{"Passing": 1, "Warning": 1},
+		},
+	}
+}
+
+func TestConsul(t *testing.T) {
+	catalog, srv := newFakeCatalog(t)
+	catalog.set(false,
+		instance("node1", "10.0.0.1", 8080, []string{"primary", "zone=a"}, map[string]string{"weight": "3", "version": "1.2"}),
+		instance("node2", "10.0.0.2", 8080, nil, nil),
+	)
+
+	c := &Consul{Address: srv.URL, Service: "web", Tag: "primary", Token: "secret", Scheme: "http", Wait: time.Minute, retry: 10 * time.Millisecond, interval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go c.Run(ctx, updates)
+
+	t.Run("Initial Set", func(t *testing.T) {
+		targets := next(t, updates)
+		if len(targets) != 2 {
+			t.Fatalf("Expected 2 targets, got %+v", targets)
+		}
+		got := targets[0]
+		if got.URL != "http://10.0.0.1:8080" || got.Weight != 3 {
+			t.Errorf("Expected the weight from the metadata, got %+v", got)
+		}
+		labels := got.Labels
+		if labels["zone"] != "a" || labels["primary"] != "true" || labels["version"] != "1.2" || labels["consul_node"] != "node1" {
+			t.Errorf("Expected tags and metadata as labels, got %v", labels)
+		}
+		if targets[1].Weight != 1 {
+			t.Errorf("Expected the passing weight, got %d", targets[1].Weight)
+		}
+	})
+
+	t.Run("Blocking Query Returns On Change", func(t *testing.T) {
+		start := time.Now()
+		catalog.set(false, instance("node1", "10.0.0.1", 8080, nil, nil))
+		targets := next(t, updates)
+		if len(targets) != 1 || time.Since(start) > time.Second {
+			t.Errorf("Expected the change to be seen immediately, got %+v", targets)
+		}
+
+		catalog.mu.Lock()
+		last := catalog.queries[len(catalog.queries)-1]
+		catalog.mu.Unlock()
+		for _, param := range []string{"passing=1", "tag=primary", "wait=60000ms", "index="} {
+			if !strings.Contains(last, param) {
+				t.Errorf("Expected %q in the query, got %s", param, last)
+			}
+		}
+	})
+
+	t.Run("Outage Keeps Targets", func(t *testing.T) {
+		catalog.set(true)
+		none(t, updates, 100*time.Millisecond)
+
+		catalog.set(false, instance("node3", "10.0.0.3", 9090, nil, nil))
+		if targets := next(t, updates); len(targets) != 1 || targets[0].URL != "http://10.0.0.3:9090" {
+			t.Errorf("Expected the set to be updated after the outage, got %+v", targets)
+		}
+	})
+}
+
+func TestConsul_MinInterval(t *testing.T) {
+	// A catalog answering blocking queries immediately, e.g. behind a misbehaving proxy
+	var queries atomic.Int64
+	var wait atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		wait.Store(r.URL.Query().Get("wait"))
+		w.Header().Set("X-Consul-Index", "1")
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	c := &Consul{Address: srv.URL, Service: "web", Scheme: "http", Wait: 1500 * time.Millisecond, interval: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 220*time.Millisecond)
+	defer cancel()
+	updates := make(chan []Target, 1)
+	c.Run(ctx, updates)
+
+	if n := queries.Load(); n < 2 || n > 5 {
+		t.Errorf("Expected a query every 50ms, got %d queries", n)
+	}
+	// Sub-second waits are kept
+	if w := wait.Load(); w != "1500ms" {
+		t.Errorf("Expected wait=1500ms, got %v", w)
+	}
+}
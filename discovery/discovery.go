@@ -0,0 +1,94 @@
+// Package discovery finds the backends of a pool dynamically.
+//
+// A Provider watches a source (a file, DNS, a service catalog...) and sends
+// the complete set of targets each time it changes. Applying the targets to
+// a pool is left to the caller.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/P4ST4S/go-load-balancer/config"
+)
+
+// Target is a backend found by a provider
+type Target struct {
+	URL    string            `yaml:"url"`
+	Weight int               `yaml:"weight"`
+	Tier   int               `yaml:"tier"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Provider watches a source of targets
+type Provider interface {
+	// Name describes the provider in logs
+	Name() string
+	// Run sends the complete set of targets on updates each time it changes,
+	// until ctx is done. When the source is unavailable the last known set is kept.
+	Run(ctx context.Context, updates chan<- []Target)
+}
+
+// Validate checks the targets, returning an error for the first invalid one
+func Validate(targets []Target) error {
+	seen := make(map[string]bool, len(targets))
+	for i, t := range targets {
+		if err := config.ValidateBackendURL(t.URL); err != nil {
+			return fmt.Errorf("target %d: %w", i, err)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("target %d: weight must not be negative", i)
+		}
+		if t.Tier < 0 {
+			return fmt.Errorf("target %d: tier must not be negative", i)
+		}
+		if seen[t.URL] {
+			return fmt.Errorf("target %d: duplicate url %q", i, t.URL)
+		}
+		seen[t.URL] = true
+	}
+	return nil
+}
+
+// Equal reports whether two sets of targets are identical, regardless of their order
+func Equal(a, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byURL := make(map[string]Target, len(a))
+	for _, t := range a {
+		byURL[t.URL] = t
+	}
+	for _, t := range b {
+		o, ok := byURL[t.URL]
+		if !ok || o.Weight != t.Weight || o.Tier != t.Tier || !maps.Equal(o.Labels, t.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// sorted returns the targets sorted by URL, for stable logs and comparisons
+func sorted(targets []Target) []Target {
+	return slices.SortedFunc(slices.Values(targets), func(a, b Target) int {
+		switch {
+		case a.URL < b.URL:
+			return -1
+		case a.URL > b.URL:
+			return 1
+		}
+		return 0
+	})
+}
+
+// send delivers targets on updates unless ctx is done
+func send(ctx context.Context, updates chan<- []Target, targets []Target) bool {
+	select {
+	case updates <- targets:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,351 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTimeout bounds a single DNS exchange
+const dnsTimeout = 2 * time.Second
+
+// DNS resolves a domain into targets, either from its A/AAAA records (each
+// address with Port) or from its SRV records. SRV priorities become backend
+// tiers and SRV weights backend weights.
+//
+// The domain is resolved again when the shortest TTL of the answer expires,
+// but not more often than MinInterval nor less often than MaxInterval.
+// When resolution fails or returns no record, the last known set is kept.
+type DNS struct {
+	Domain string
+	SRV    bool
+	Port   int
+	Scheme string
+	// Server is the address of the DNS server, the first nameserver of /etc/resolv.conf when empty
+	Server      string
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// Name describes the provider in logs
+func (d *DNS) Name() string {
+	if d.SRV {
+		return "dns srv " + d.Domain
+	}
+	return "dns " + d.Domain
+}
+
+// Run resolves the domain until ctx is done
+func (d *DNS) Run(ctx context.Context, updates chan<- []Target) {
+	var last []Target
+	var sent bool
+	retry := d.MinInterval
+
+	for {
+		wait := retry
+		targets, ttl, err := d.resolve(ctx)
+		if err == nil && len(targets) == 0 {
+			err = errors.New("no record found")
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Discovery (%s): keeping %d known targets: %s", d.Name(), len(last), err)
+			// Back off while the server is failing
+			retry = min(retry*2, d.MaxInterval)
+		} else {
+			retry = d.MinInterval
+			wait = min(max(ttl, d.MinInterval), d.MaxInterval)
+			if !sent || !Equal(targets, last) {
+				last, sent = targets, true
+				if !send(ctx, updates, targets) {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolve returns the targets of the domain and the shortest TTL of the records used
+func (d *DNS) resolve(ctx context.Context) ([]Target, time.Duration, error) {
+	server := d.Server
+	if server == "" {
+		var err error
+		if server, err = systemNameserver(); err != nil {
+			return nil, 0, err
+		}
+	}
+	r := &dnsResolver{server: server, ttl: -1}
+
+	var targets []Target
+	if d.SRV {
+		srvs, err := r.srv(ctx, d.Domain)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, srv := range srvs {
+			for _, ip := range srv.addrs {
+				targets = append(targets, Target{
+					URL:    d.url(ip, srv.Port),
+					Weight: max(int(srv.Weight), 1),
+					Tier:   int(srv.Priority),
+					Labels: map[string]string{"srv_target": strings.TrimSuffix(srv.Target.String(), ".")},
+				})
+			}
+		}
+		normalizeWeights(targets)
+	} else {
+		ips, err := r.addrs(ctx, d.Domain)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			targets = append(targets, Target{URL: d.url(ip, uint16(d.Port))})
+		}
+	}
+	return dedupe(sorted(targets)), time.Duration(max(r.ttl, 0)) * time.Second, nil
+}
+
+func (d *DNS) url(ip netip.Addr, port uint16) string {
+	return d.Scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// normalizeWeights divides the weights by their greatest common divisor: SRV weights
+// go up to 65535 and round-robin allocates one slot per weight unit
+func normalizeWeights(targets []Target) {
+	g := 0
+	for _, t := range targets {
+		g = gcd(g, t.Weight)
+	}
+	if g <= 1 {
+		return
+	}
+	for i := range targets {
+		targets[i].Weight /= g
+	}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// dedupe drops the targets of sorted whose URL was already seen,
+// when several records point to the same address
+func dedupe(sorted []Target) []Target {
+	out := sorted[:0]
+	for i, t := range sorted {
+		if i == 0 || t.URL != sorted[i-1].URL {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// systemNameserver returns the address of the first nameserver of /etc/resolv.conf
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver found in /etc/resolv.conf")
+}
+
+// dnsResolver queries a DNS server, tracking the shortest TTL of the records it used
+type dnsResolver struct {
+	server string
+	// ttl is the shortest TTL seen in seconds, -1 before any record
+	ttl int64
+}
+
+// srvRecord is an SRV record with the addresses of its target
+type srvRecord struct {
+	dnsmessage.SRVResource
+	addrs []netip.Addr
+}
+
+func (r *dnsResolver) seen(h dnsmessage.ResourceHeader) {
+	if r.ttl < 0 || int64(h.TTL) < r.ttl {
+		r.ttl = int64(h.TTL)
+	}
+}
+
+// srv returns the SRV records of name with the addresses of their targets,
+// taken from the additional section when the server provides them
+func (r *dnsResolver) srv(ctx context.Context, name string) ([]srvRecord, error) {
+	msg, err := r.exchange(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	additional := map[string][]netip.Addr{}
+	for _, rr := range msg.Additionals {
+		if ip, ok := addr(rr); ok {
+			key := strings.ToLower(rr.Header.Name.String())
+			additional[key] = append(additional[key], ip)
+			r.seen(rr.Header)
+		}
+	}
+
+	var records []srvRecord
+	for _, rr := range msg.Answers {
+		srv, ok := rr.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		r.seen(rr.Header)
+		if srv.Target.String() == "." {
+			// The service is decidedly not available at this domain (RFC 2782)
+			continue
+		}
+		rec := srvRecord{SRVResource: *srv, addrs: additional[strings.ToLower(srv.Target.String())]}
+		if len(rec.addrs) == 0 {
+			if rec.addrs, err = r.addrs(ctx, srv.Target.String()); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// addrs returns the A and AAAA records of name
+func (r *dnsResolver) addrs(ctx context.Context, name string) ([]netip.Addr, error) {
+	var ips []netip.Addr
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := r.exchange(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range msg.Answers {
+			if ip, ok := addr(rr); ok {
+				ips = append(ips, ip)
+				r.seen(rr.Header)
+			}
+		}
+	}
+	return ips, nil
+}
+
+func addr(rr dnsmessage.Resource) (netip.Addr, bool) {
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A), true
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA), true
+	}
+	return netip.Addr{}, false
+}
+
+// exchange sends a query over UDP, and again over TCP if the answer was truncated.
+// A name which does not exist yields a message without answers.
+func (r *dnsResolver) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := r.roundTrip(ctx, "udp", packed)
+	if err == nil && msg.Truncated {
+		msg, err = r.roundTrip(ctx, "tcp", packed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query %s %s: %w", qtype, name, err)
+	}
+	if msg.ID != query.ID {
+		return nil, fmt.Errorf("query %s %s: mismatched response id", qtype, name)
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, fmt.Errorf("query %s %s: server answered %s", qtype, name, msg.RCode)
+	}
+	return msg, nil
+}
+
+func (r *dnsResolver) roundTrip(ctx context.Context, network string, query []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var resp []byte
+	if network == "tcp" {
+		// Messages over TCP are prefixed by their length
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, 65535)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,267 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is an in-process DNS server answering from a fixed set of records,
+// over UDP and TCP on the same port
+type fakeDNS struct {
+	addr string
+	mu   sync.Mutex
+	// records by lowercase name and type
+	records map[string][]dnsmessage.Resource
+	// truncate answers with an empty truncated message over UDP
+	truncate bool
+	queries  map[string]int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	s := &fakeDNS{addr: udp.LocalAddr().String(), records: map[string][]dnsmessage.Resource{}, queries: map[string]int{}}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.answer(buf[:n], true), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			io.ReadFull(conn, length[:])
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			io.ReadFull(conn, query)
+			resp := s.answer(query, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+func key(name string, qtype dnsmessage.Type) string {
+	return strings.ToLower(name) + " " + qtype.String()
+}
+
+func (s *fakeDNS) set(name string, qtype dnsmessage.Type, records ...dnsmessage.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key(name, qtype)] = records
+}
+
+func (s *fakeDNS) count(name string, qtype dnsmessage.Type) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[key(name, qtype)]
+}
+
+func (s *fakeDNS) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[key(q.Name.String(), q.Type)]++
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: msg.Questions,
+	}
+	if udp && s.truncate {
+		resp.Truncated = true
+	} else if records, ok := s.records[key(q.Name.String(), q.Type)]; ok {
+		resp.RCode = dnsmessage.RCodeSuccess
+		resp.Answers = records
+	}
+	packed, _ := resp.Pack()
+	return packed
+}
+
+func a(name, ip string, ttl uint32) dnsmessage.Resource {
+	addr := netip.MustParseAddr(ip)
+	h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl}
+	if addr.Is4() {
+		return dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: addr.As4()}}
+	}
+	return dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}}
+}
+
+func srv(name, target string, priority, weight, port uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Priority: priority, Weight: weight, Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestDNS_A(t *testing.T) {
+	server := newFakeDNS(t)
+	server.set("web.test.", dnsmessage.TypeA, a("web.test.", "10.0.0.2", 60), a("web.test.", "10.0.0.1", 30))
+	server.set("web.test.", dnsmessage.TypeAAAA, a("web.test.", "fd00::1", 60))
+
+	d := &DNS{Domain: "web.test", Port: 8080, Scheme: "http", Server: server.addr, MinInterval: time.Second, MaxInterval: time.Minute}
+	targets, ttl, err := d.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[fd00::1]:8080"}
+	if len(targets) != len(want) {
+		t.Fatalf("Expected %d targets, got %+v", len(want), targets)
+	}
+	for i, u := range want {
+		if targets[i].URL != u {
+			t.Errorf("Expected %s, got %s", u, targets[i].URL)
+		}
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("Expected the shortest TTL (30s), got %s", ttl)
+	}
+}
+
+func TestDNS_SRV(t *testing.T) {
+	server := newFakeDNS(t)
+	name := "_http._tcp.web.test."
+	server.set(name, dnsmessage.TypeSRV,
+		srv(name, "app1.test.", 10, 60, 8081, 60),
+		srv(name, "app2.test.", 10, 20, 8082, 60),
+		srv(name, "backup.test.", 20, 0, 8083, 60),
+	)
+	server.set("app1.test.", dnsmessage.TypeA, a("app1.test.", "10.0.0.1", 60))
+	server.set("app2.test.", dnsmessage.TypeA, a("app2.test.", "10.0.0.2", 60))
+	server.set("backup.test.", dnsmessage.TypeAAAA, a("backup.test.", "fd00::3", 60))
+
+	d := &DNS{Domain: name, SRV: true, Scheme: "https", Server: server.addr}
+	targets, _, err := d.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+
+	want := []Target{
+		{URL: "https://10.0.0.1:8081", Weight: 60, Tier: 10},
+		{URL: "https://10.0.0.2:8082", Weight: 20, Tier: 10},
+		{URL: "https://[fd00::3]:8083", Weight: 1, Tier: 20},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("Expected %d targets, got %+v", len(want), targets)
+	}
+	for i, w := range want {
+		got := targets[i]
+		if got.URL != w.URL || got.Weight != w.Weight || got.Tier != w.Tier {
+			t.Errorf("Expected %+v, got %+v", w, got)
+		}
+	}
+	if targets[0].Labels["srv_target"] != "app1.test" {
+		t.Errorf("Expected the SRV target in the labels, got %v", targets[0].Labels)
+	}
+
+	t.Run("Weights Are Reduced", func(t *testing.T) {
+		server.set(name, dnsmessage.TypeSRV,
+			srv(name, "app1.test.", 10, 60, 8081, 60),
+			srv(name, "app2.test.", 10, 20, 8082, 60),
+		)
+		targets, _, _ := d.resolve(context.Background())
+		if len(targets) != 2 || targets[0].Weight != 3 || targets[1].Weight != 1 {
+			t.Errorf("Expected weights 3 and 1, got %+v", targets)
+		}
+	})
+
+	t.Run("Service Not Available", func(t *testing.T) {
+		// A target of "." means the service is decidedly not available, even
+		// when the root name resolves
+		server.set(name, dnsmessage.TypeSRV,
+			srv(name, "app1.test.", 10, 60, 8081, 60),
+			srv(name, ".", 0, 0, 8080, 60),
+		)
+		server.set(".", dnsmessage.TypeA, a(".", "10.0.0.9", 60))
+		targets, _, err := d.resolve(context.Background())
+		if err != nil || len(targets) != 1 || targets[0].URL != "https://10.0.0.1:8081" {
+			t.Errorf("Expected the records without target to be skipped, got %+v, %v", targets, err)
+		}
+		if n := server.count(".", dnsmessage.TypeA); n != 0 {
+			t.Errorf("Expected no address lookup of the root, got %d", n)
+		}
+		server.set(name, dnsmessage.TypeSRV,
+			srv(name, "app1.test.", 10, 60, 8081, 60),
+			srv(name, "app2.test.", 10, 20, 8082, 60),
+		)
+	})
+
+	t.Run("TCP Fallback", func(t *testing.T) {
+		server.mu.Lock()
+		server.truncate = true
+		server.mu.Unlock()
+		targets, _, err := d.resolve(context.Background())
+		if err != nil || len(targets) != 2 {
+			t.Errorf("Expected the truncated answer to be retried over TCP, got %+v, %v", targets, err)
+		}
+	})
+}
+
+func TestDNS_Run(t *testing.T) {
+	server := newFakeDNS(t)
+	server.set("web.test.", dnsmessage.TypeA, a("web.test.", "10.0.0.1", 0))
+
+	d := &DNS{Domain: "web.test", Port: 80, Scheme: "http", Server: server.addr, MinInterval: 20 * time.Millisecond, MaxInterval: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go d.Run(ctx, updates)
+
+	if targets := next(t, updates); len(targets) != 1 || targets[0].URL != "http://10.0.0.1:80" {
+		t.Fatalf("Unexpected targets: %+v", targets)
+	}
+
+	t.Run("Change Is Picked Up", func(t *testing.T) {
+		server.set("web.test.", dnsmessage.TypeA, a("web.test.", "10.0.0.1", 0), a("web.test.", "10.0.0.2", 0))
+		if targets := next(t, updates); len(targets) != 2 {
+			t.Errorf("Expected 2 targets, got %+v", targets)
+		}
+	})
+
+	t.Run("Outage Keeps Targets", func(t *testing.T) {
+		server.set("web.test.", dnsmessage.TypeA)
+		none(t, updates, 100*time.Millisecond)
+	})
+
+	t.Run("TTL Is Respected", func(t *testing.T) {
+		server.set("web.test.", dnsmessage.TypeA, a("web.test.", "10.0.0.3", 3600))
+		next(t, updates)
+		before := server.count("web.test.", dnsmessage.TypeA)
+		time.Sleep(100 * time.Millisecond)
+		if after := server.count("web.test.", dnsmessage.TypeA); after != before {
+			t.Errorf("Expected no query before the TTL expires, got %d", after-before)
+		}
+	})
+}
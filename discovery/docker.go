@@ -0,0 +1,258 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Container labels read by the Docker provider
+const (
+	DockerPoolLabel   = "lb.pool"
+	DockerPortLabel   = "lb.port"
+	DockerWeightLabel = "lb.weight"
+	DockerTierLabel   = "lb.tier"
+)
+
+// Delay before reconnecting to the engine, doubled on each failure
+const (
+	dockerMinRetry = time.Second
+	dockerMaxRetry = 30 * time.Second
+)
+
+// Docker follows the running containers labelled lb.pool=<Pool> through the
+// Docker Engine API. Each container becomes a target at its IP address and
+// the port of its lb.port label, with the weight of its optional lb.weight
+// label. Containers are listed again on every start and die event.
+// When the engine is unreachable the last known set is kept.
+type Docker struct {
+	// Socket is the Unix socket of the engine
+	Socket string
+	Pool   string
+	// Network selects the address of the containers attached to several networks
+	Network string
+	Scheme  string
+	// retry overrides dockerMinRetry in tests
+	retry time.Duration
+}
+
+// dockerContainer is a container returned by /containers/json
+type dockerContainer struct {
+	ID              string `json:"Id"`
+	Names           []string
+	Labels          map[string]string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string
+			GlobalIPv6Address string
+		}
+	}
+}
+
+// Name describes the provider in logs
+func (d *Docker) Name() string {
+	return "docker " + DockerPoolLabel + "=" + d.Pool
+}
+
+// Run follows the engine until ctx is done
+func (d *Docker) Run(ctx context.Context, updates chan<- []Target) {
+	client := d.client()
+	defer client.CloseIdleConnections()
+	minRetry := dockerMinRetry
+	if d.retry > 0 {
+		minRetry = d.retry
+	}
+	retry := minRetry
+
+	var last []Target
+	var sent bool
+	for {
+		err := d.follow(ctx, client, func(targets []Target) bool {
+			retry = minRetry
+			if sent && Equal(targets, last) {
+				return true
+			}
+			last, sent = targets, true
+			return send(ctx, updates, targets)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Discovery (%s): keeping %d known targets: %s", d.Name(), len(last), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, dockerMaxRetry)
+	}
+}
+
+// follow subscribes to the container events, then lists the containers once
+// and again on every event, until the stream breaks or apply returns false
+func (d *Docker) follow(ctx context.Context, client *http.Client, apply func([]Target) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribing first ensures no event is missed between the list and the stream
+	filters := d.filters(map[string][]string{"type": {"container"}, "event": {"start", "die"}})
+	resp, err := d.get(ctx, client, "/events?filters="+filters)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	events := make(chan struct{}, 1)
+	closed := make(chan error, 1)
+	go func() {
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var event json.RawMessage
+			if err := dec.Decode(&event); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = errors.New("event stream closed")
+				}
+				closed <- err
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+				// A list is already pending
+			}
+		}
+	}()
+
+	for {
+		targets, err := d.list(ctx, client)
+		if err != nil {
+			return err
+		}
+		if !apply(targets) {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-closed:
+			return err
+		case <-events:
+		}
+	}
+}
+
+// list returns the targets of the running containers of the pool
+func (d *Docker) list(ctx context.Context, client *http.Client) ([]Target, error) {
+	resp, err := d.get(ctx, client, "/containers/json?filters="+d.filters(map[string][]string{"status": {"running"}}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(containers))
+	for _, c := range containers {
+		t, err := d.target(c)
+		if err != nil {
+			log.Printf("Discovery (%s): ignoring container %s: %s", d.Name(), containerName(c), err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	targets = dedupe(sorted(targets))
+	return targets, Validate(targets)
+}
+
+// target maps a container to a target
+func (d *Docker) target(c dockerContainer) (Target, error) {
+	port, err := strconv.Atoi(c.Labels[DockerPortLabel])
+	if err != nil || port < 1 || port > 65535 {
+		return Target{}, fmt.Errorf("invalid %s label %q", DockerPortLabel, c.Labels[DockerPortLabel])
+	}
+	t := Target{Weight: 1, Labels: map[string]string{"container": containerName(c)}}
+	if w := c.Labels[DockerWeightLabel]; w != "" {
+		if t.Weight, err = strconv.Atoi(w); err != nil || t.Weight < 1 {
+			return Target{}, fmt.Errorf("invalid %s label %q", DockerWeightLabel, w)
+		}
+	}
+	if tier := c.Labels[DockerTierLabel]; tier != "" {
+		if t.Tier, err = strconv.Atoi(tier); err != nil || t.Tier < 0 {
+			return Target{}, fmt.Errorf("invalid %s label %q", DockerTierLabel, tier)
+		}
+	}
+
+	networks := c.NetworkSettings.Networks
+	for _, name := range slices.Sorted(maps.Keys(networks)) {
+		if d.Network != "" && name != d.Network {
+			continue
+		}
+		n := networks[name]
+		ip := n.IPAddress
+		if ip == "" {
+			ip = n.GlobalIPv6Address
+		}
+		if ip != "" {
+			t.URL = d.Scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port))
+			return t, nil
+		}
+	}
+	if d.Network != "" {
+		return Target{}, fmt.Errorf("no address on network %s", d.Network)
+	}
+	return Target{}, errors.New("no network address")
+}
+
+func containerName(c dockerContainer) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// filters encodes the filters of an API call, always selecting the containers of the pool
+func (d *Docker) filters(f map[string][]string) string {
+	f["label"] = []string{DockerPoolLabel + "=" + d.Pool}
+	data, _ := json.Marshal(f)
+	return url.QueryEscape(string(data))
+}
+
+// client returns an HTTP client connecting to the engine socket
+func (d *Docker) client() *http.Client {
+	var dialer net.Dialer
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", d.Socket)
+		},
+	}}
+}
+
+func (d *Docker) get(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("engine answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,197 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEngine serves the containers and events endpoints of the Docker Engine API on a Unix socket
+type fakeEngine struct {
+	mu         sync.Mutex
+	containers []map[string]any
+	// events receives the messages sent to the subscribers of the event stream
+	events chan map[string]any
+	down   bool
+}
+
+func newFakeEngine(t *testing.T) (*fakeEngine, string) {
+	dir, err := os.MkdirTemp("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &fakeEngine{events: make(chan map[string]any)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.down {
+			http.Error(w, `{"message": "engine unavailable"}`, http.StatusInternalServerError)
+			return
+		}
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		var running []map[string]any
+		for _, c := range e.containers {
+			labels := c["Labels"].(map[string]string)
+			if len(filters["label"]) == 1 && filters["label"][0] == "lb.pool="+labels["lb.pool"] {
+				running = append(running, c)
+			}
+		}
+		json.NewEncoder(w).Encode(running)
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("filters"), `"event":["start","die"]`) {
+			http.Error(w, "unexpected filters", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-e.events:
+				if !ok {
+					return
+				}
+				if event == nil {
+					// Close the stream
+					return
+				}
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	})
+	return e, socket
+}
+
+func container(name, ip string, labels map[string]string) map[string]any {
+	return map[string]any{
+		"Id":     name + "-id",
+		"Names":  []string{"/" + name},
+		"Labels": labels,
+		"NetworkSettings": map[string]any{
+			"Networks": map[string]any{"bridge": map[string]any{"IPAddress": ip}},
+		},
+	}
+}
+
+// start adds a container and publishes its start event
+func (e *fakeEngine) start(c map[string]any) {
+	e.mu.Lock()
+	e.containers = append(e.containers, c)
+	e.mu.Unlock()
+	e.events <- map[string]any{"Type": "container", "Action": "start", "Actor": map[string]any{"ID": c["Id"]}}
+}
+
+// stop removes a container and publishes its die event
+func (e *fakeEngine) stop(name string) {
+	e.mu.Lock()
+	for i, c := range e.containers {
+		if c["Names"].([]string)[0] == "/"+name {
+			e.containers = append(e.containers[:i], e.containers[i+1:]...)
+			break
+		}
+	}
+	e.mu.Unlock()
+	e.events <- map[string]any{"Type": "container", "Action": "die", "Actor": map[string]any{"ID": name + "-id"}}
+}
+
+func TestDocker(t *testing.T) {
+	engine, socket := newFakeEngine(t)
+	engine.containers = []map[string]any{
+		container("app1", "172.17.0.2", map[string]string{"lb.pool": "web", "lb.port": "80", "lb.weight": "3"}),
+		container("db", "172.17.0.9", map[string]string{"lb.pool": "db", "lb.port": "5432"}),
+		container("broken", "172.17.0.8", map[string]string{"lb.pool": "web"}),
+	}
+
+	d := &Docker{Socket: socket, Pool: "web", Scheme: "http", retry: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go d.Run(ctx, updates)
+
+	t.Run("Initial Set", func(t *testing.T) {
+		targets := next(t, updates)
+		if len(targets) != 1 || targets[0].URL != "http://172.17.0.2:80" || targets[0].Weight != 3 || targets[0].Labels["container"] != "app1" {
+			t.Errorf("Expected only the labelled container of the pool, got %+v", targets)
+		}
+	})
+
+	t.Run("Start Event", func(t *testing.T) {
+		engine.start(container("app2", "172.17.0.3", map[string]string{"lb.pool": "web", "lb.port": "8080"}))
+		targets := next(t, updates)
+		if len(targets) != 2 || targets[1].URL != "http://172.17.0.3:8080" || targets[1].Weight != 1 {
+			t.Errorf("Expected the started container to be added, got %+v", targets)
+		}
+	})
+
+	t.Run("Die Event", func(t *testing.T) {
+		engine.stop("app1")
+		targets := next(t, updates)
+		if len(targets) != 1 || targets[0].Labels["container"] != "app2" {
+			t.Errorf("Expected the stopped container to be removed, got %+v", targets)
+		}
+	})
+
+	t.Run("Engine Outage Keeps Targets", func(t *testing.T) {
+		engine.mu.Lock()
+		engine.down = true
+		engine.mu.Unlock()
+		// Break the stream: the provider reconnects and fails to list the containers
+		engine.events <- nil
+		none(t, updates, 100*time.Millisecond)
+
+		engine.mu.Lock()
+		engine.down = false
+		engine.containers = append(engine.containers, container("app3", "172.17.0.4", map[string]string{"lb.pool": "web", "lb.port": "80"}))
+		engine.mu.Unlock()
+		if targets := next(t, updates); len(targets) != 2 {
+			t.Errorf("Expected the containers to be listed again after the outage, got %+v", targets)
+		}
+	})
+}
+
+func TestDocker_Target(t *testing.T) {
+	d := &Docker{Pool: "web", Network: "backend", Scheme: "https"}
+	c := container("app", "172.17.0.2", map[string]string{"lb.port": "443", "lb.tier": "1"})
+	c["NetworkSettings"] = map[string]any{"Networks": map[string]any{
+		"bridge":  map[string]any{"IPAddress": "172.17.0.2"},
+		"backend": map[string]any{"IPAddress": "", "GlobalIPv6Address": "fd00::2"},
+	}}
+	data, _ := json.Marshal(c)
+	var dc dockerContainer
+	json.Unmarshal(data, &dc)
+
+	tgt, err := d.target(dc)
+	if err != nil || tgt.URL != "https://[fd00::2]:443" || tgt.Tier != 1 {
+		t.Errorf("Expected the address of the selected network, got %+v, %v", tgt, err)
+	}
+
+	dc.Labels["lb.weight"] = "heavy"
+	if _, err := d.target(dc); err == nil {
+		t.Error("Expected an invalid weight label to be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File watches a YAML or JSON file holding a list of targets, e.g.
+// [{"url": "http://10.0.0.1:80", "weight": 2, "labels": {"zone": "a"}}].
+//
+// The file is polled every Interval and only applied once its size and
+// modification time have stayed unchanged for Debounce, including while it
+// is read, so rapid successive edits are applied once and a file still being
+// written, even cut at a line boundary, is not. A file that is empty, cannot
+// be parsed or holds invalid targets is considered partially written: it is
+// ignored and the last known set kept.
+type File struct {
+	Path     string
+	Interval time.Duration
+	Debounce time.Duration
+}
+
+// Name describes the provider in logs
+func (f *File) Name() string {
+	return "file " + f.Path
+}
+
+// Run polls the file until ctx is done
+func (f *File) Run(ctx context.Context, updates chan<- []Target) {
+	t := time.NewTicker(f.Interval)
+	defer t.Stop()
+
+	var last []Target
+	var sent bool
+	var changedAt time.Time
+	lastStat, _ := os.Stat(f.Path)
+	if lastStat != nil {
+		// A file modified just before the start may still be being written
+		changedAt = lastStat.ModTime()
+	}
+	pending := true // read the file on start
+
+	for {
+		if pending && time.Since(changedAt) >= f.Debounce {
+			targets, fi, err := f.read()
+			switch {
+			case fi != nil && changed(fi, lastStat):
+				// Modified since it was last polled, wait for it to settle again
+				lastStat, changedAt = fi, time.Now()
+			case err != nil:
+				pending = false
+				log.Printf("Discovery (%s): ignoring file, keeping %d known targets: %s", f.Name(), len(last), err)
+			default:
+				pending = false
+				if !sent || !Equal(targets, last) {
+					last, sent = targets, true
+					if !send(ctx, updates, targets) {
+						return
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			continue
+		}
+		if changed(fi, lastStat) {
+			lastStat = fi
+			pending = true
+			changedAt = time.Now()
+		}
+	}
+}
+
+// changed reports whether the size or modification time of the file differ from the last ones seen
+func changed(fi, last os.FileInfo) bool {
+	return last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size()
+}
+
+// read parses and validates the targets of the file. It also returns the
+// state of the file once read, or nil if it cannot be read.
+func (f *File) read() ([]Target, os.FileInfo, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fi, errors.New("file is empty")
+	}
+
+	var targets []Target
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&targets); err != nil {
+		return nil, fi, err
+	}
+	if err := Validate(targets); err != nil {
+		return nil, fi, err
+	}
+	return sorted(targets), fi, nil
+}
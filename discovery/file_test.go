@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// next waits for the next set of targets sent by a provider
+func next(t *testing.T, updates <-chan []Target) []Target {
+	t.Helper()
+	select {
+	case targets := <-updates:
+		return targets
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for targets")
+		return nil
+	}
+}
+
+// none checks that a provider sends nothing for a while
+func none(t *testing.T, updates <-chan []Target, wait time.Duration) {
+	t.Helper()
+	select {
+	case targets := <-updates:
+		t.Fatalf("Expected no update, got %+v", targets)
+	case <-time.After(wait):
+	}
+}
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	write(t, path, `
+- url: http://10.0.0.2:80
+- url: http://10.0.0.1:80
+  weight: 2
+  labels:
+    zone: a
+`)
+
+	f := &File{Path: path, Interval: 5 * time.Millisecond, Debounce: 30 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go f.Run(ctx, updates)
+
+	t.Run("Initial Read", func(t *testing.T) {
+		targets := next(t, updates)
+		if len(targets) != 2 || targets[0].URL != "http://10.0.0.1:80" || targets[0].Weight != 2 || targets[0].Labels["zone"] != "a" {
+			t.Errorf("Unexpected targets: %+v", targets)
+		}
+	})
+
+	t.Run("Partially Written File", func(t *testing.T) {
+		write(t, path, "")
+		none(t, updates, 100*time.Millisecond)
+		write(t, path, "- url: http://10.0.0.3:80\n- url:")
+		none(t, updates, 100*time.Millisecond)
+	})
+
+	t.Run("Debounced Edits", func(t *testing.T) {
+		write(t, path, `[{"url": "http://10.0.0.3:80"}]`)
+		time.Sleep(10 * time.Millisecond)
+		write(t, path, `[{"url": "http://10.0.0.3:80"}, {"url": "http://10.0.0.4:80"}]`)
+
+		targets := next(t, updates)
+		if len(targets) != 2 || targets[1].URL != "http://10.0.0.4:80" {
+			t.Errorf("Expected the last edit only, got %+v", targets)
+		}
+		none(t, updates, 100*time.Millisecond)
+	})
+
+	t.Run("Invalid Targets", func(t *testing.T) {
+		write(t, path, "- url: 10.0.0.5\n")
+		none(t, updates, 100*time.Millisecond)
+		write(t, path, "- address: http://10.0.0.5:80\n")
+		none(t, updates, 100*time.Millisecond)
+	})
+}
+
+func TestFile_TruncatedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	full := "- url: http://10.0.0.1:80\n- url: http://10.0.0.2:80\n"
+	// The file is cut at a line boundary, the rest is written shortly after
+	write(t, path, "- url: http://10.0.0.1:80\n")
+
+	f := &File{Path: path, Interval: 5 * time.Millisecond, Debounce: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go f.Run(ctx, updates)
+
+	t.Run("On Start", func(t *testing.T) {
+		time.Sleep(20 * time.Millisecond)
+		write(t, path, full)
+		if targets := next(t, updates); len(targets) != 2 {
+			t.Errorf("Expected the complete file only, got %+v", targets)
+		}
+	})
+
+	t.Run("While Running", func(t *testing.T) {
+		write(t, path, "- url: http://10.0.0.1:80\n")
+		time.Sleep(20 * time.Millisecond)
+		write(t, path, full+"- url: http://10.0.0.3:80\n")
+		if targets := next(t, updates); len(targets) != 3 {
+			t.Errorf("Expected the complete file only, got %+v", targets)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		valid   bool
+	}{
+		{"Valid", []Target{{URL: "http://a:80"}, {URL: "https://b:443", Weight: 2}}, true},
+		{"Empty", nil, true},
+		{"Invalid URL", []Target{{URL: "a:80"}}, false},
+		{"Negative Weight", []Target{{URL: "http://a:80", Weight: -1}}, false},
+		{"Duplicate", []Target{{URL: "http://a:80"}, {URL: "http://a:80"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.targets); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := []Target{{URL: "http://a:80", Labels: map[string]string{"zone": "a"}}, {URL: "http://b:80"}}
+	b := []Target{{URL: "http://b:80"}, {URL: "http://a:80", Labels: map[string]string{"zone": "a"}}}
+	if !Equal(a, b) {
+		t.Error("Expected targets in a different order to be equal")
+	}
+	b[0].Weight = 3
+	if Equal(a, b) {
+		t.Error("Expected a weight change to be detected")
+	}
+	if Equal(a, a[:1]) {
+		t.Error("Expected a removal to be detected")
+	}
+}
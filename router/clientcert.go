@@ -0,0 +1,91 @@
+package router
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Headers describing the verified client certificate of a request to the backends
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertIssuer      = "X-Client-Cert-Issuer"
+	HeaderClientCertSAN         = "X-Client-Cert-SAN"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// ClientCert restricts a route to the clients presenting a certificate
+// verified against the client CA of the listener
+type ClientCert struct {
+	// Subjects and SANs allow the certificates whose subject, e.g.
+	// "CN=billing,O=Example", or one of whose subject alternative names is
+	// listed. Any verified certificate is allowed when both are empty.
+	Subjects []string
+	SANs     []string
+}
+
+// Allow returns an error when the request has no verified client
+// certificate, or one the allow-lists do not contain
+func (c *ClientCert) Allow(r *http.Request) error {
+	cert := VerifiedClientCert(r)
+	if cert == nil {
+		return errors.New("a client certificate is required")
+	}
+	if len(c.Subjects) == 0 && len(c.SANs) == 0 {
+		return nil
+	}
+	if slices.Contains(c.Subjects, cert.Subject.String()) {
+		return nil
+	}
+	if slices.ContainsFunc(SANs(cert), func(san string) bool { return slices.Contains(c.SANs, san) }) {
+		return nil
+	}
+	return fmt.Errorf("client certificate %q is not allowed", cert.Subject)
+}
+
+// VerifiedClientCert returns the client certificate of a request verified
+// by the listener, or nil
+func VerifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// SANs returns the subject alternative names of a certificate: DNS names,
+// email addresses, URIs then IP addresses
+func SANs(cert *x509.Certificate) []string {
+	sans := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// SetClientCertHeaders replaces the client certificate headers of a request
+// proxied to a backend by those describing cert, so that clients cannot
+// forge them. They are only removed when cert is nil.
+func SetClientCertHeaders(h http.Header, cert *x509.Certificate) {
+	h.Del(HeaderClientCertSubject)
+	h.Del(HeaderClientCertIssuer)
+	h.Del(HeaderClientCertSAN)
+	h.Del(HeaderClientCertFingerprint)
+	if cert == nil {
+		return
+	}
+	sum := sha256.Sum256(cert.Raw)
+	h.Set(HeaderClientCertSubject, cert.Subject.String())
+	h.Set(HeaderClientCertIssuer, cert.Issuer.String())
+	if sans := SANs(cert); len(sans) > 0 {
+		h.Set(HeaderClientCertSAN, strings.Join(sans, ", "))
+	}
+	h.Set(HeaderClientCertFingerprint, hex.EncodeToString(sum[:]))
+}
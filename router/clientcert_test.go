@@ -0,0 +1,85 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestClientCert_Allow(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+		DNSNames:    []string{"billing.example.com"},
+		URIs:        []*url.URL{spiffe},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	tests := []struct {
+		name     string
+		cc       ClientCert
+		cert     *x509.Certificate
+		expected string
+	}{
+		{"Any Certificate", ClientCert{}, cert, ""},
+		{"Allowed Subject", ClientCert{Subjects: []string{"CN=billing,O=Example"}}, cert, ""},
+		{"Allowed DNS Name", ClientCert{SANs: []string{"billing.example.com"}}, cert, ""},
+		{"Allowed URI", ClientCert{SANs: []string{"spiffe://example.com/billing"}}, cert, ""},
+		{"Allowed IP", ClientCert{SANs: []string{"10.0.0.1"}}, cert, ""},
+		{"Denied", ClientCert{Subjects: []string{"CN=billing"}, SANs: []string{"shop.example.com"}}, cert, `client certificate "CN=billing,O=Example" is not allowed`},
+		{"Missing Certificate", ClientCert{}, nil, "a client certificate is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://shop.example.com/", nil)
+			r.TLS = &tls.ConnectionState{}
+			if tt.cert != nil {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{tt.cert}}
+			}
+			got := ""
+			if err := tt.cc.Allow(r); err != nil {
+				got = err.Error()
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSetClientCertHeaders(t *testing.T) {
+	cert := &x509.Certificate{
+		Raw:      []byte("certificate"),
+		Subject:  pkix.Name{CommonName: "billing"},
+		Issuer:   pkix.Name{CommonName: "Example CA"},
+		DNSNames: []string{"billing.example.com", "billing.internal"},
+	}
+
+	h := http.Header{}
+	h.Set(HeaderClientCertSubject, "CN=forged")
+	h.Set(HeaderClientCertSAN, "forged.example.com")
+	SetClientCertHeaders(h, cert)
+	expected := map[string]string{
+		HeaderClientCertSubject:     "CN=billing",
+		HeaderClientCertIssuer:      "CN=Example CA",
+		HeaderClientCertSAN:         "billing.example.com, billing.internal",
+		HeaderClientCertFingerprint: "03d66dd08835c1ca3f128cceacd1f31ac94163096b20f445ae84285bc0832d72",
+	}
+	for name, value := range expected {
+		if got := h.Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	SetClientCertHeaders(h, nil)
+	for name := range expected {
+		if got := h.Get(name); got != "" {
+			t.Errorf("Expected %s removed, got %q", name, got)
+		}
+	}
+}
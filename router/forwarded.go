@@ -0,0 +1,215 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TrustedProxies are the networks of the proxies in front of the load
+// balancer, whose X-Forwarded-* and Forwarded headers are believed
+type TrustedProxies []netip.Prefix
+
+// Contains reports whether addr is a trusted proxy
+func (p TrustedProxies) Contains(addr netip.Addr) bool {
+	return slices.ContainsFunc(p, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// Client is the client of a request as seen through the trusted proxies
+type Client struct {
+	// Addr is the real IP address of the client
+	Addr netip.Addr
+	// Chain holds the client then the trusted proxies the request went
+	// through, the last one being the peer of the load balancer
+	Chain []netip.Addr
+	// Proto, Host and Port are those the client requested
+	Proto, Host, Port string
+}
+
+type clientKey struct{}
+
+// Client returns the client of a request. The X-Forwarded-For chain, or the
+// for= parameters of the Forwarded header, are walked from the peer of the
+// load balancer backwards as long as the hops are trusted proxies: the first
+// untrusted hop is the client. The protocol, host and port forwarded by a
+// trusted peer are kept, those of the request are used otherwise.
+func (p TrustedProxies) Client(r *http.Request) *Client {
+	peer := remoteAddr(r)
+	c := &Client{Addr: peer, Chain: []netip.Addr{peer}, Proto: "http", Host: r.Host, Port: localPort(r)}
+	if r.TLS != nil {
+		c.Proto = "https"
+	}
+	if !peer.IsValid() || !p.Contains(peer) {
+		return c
+	}
+
+	hops, proto, host := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0 && p.Contains(c.Addr); i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// An obfuscated or invalid hop, the last trusted proxy is the best known client
+			break
+		}
+		c.Addr = addr
+		c.Chain = slices.Insert(c.Chain, 0, addr)
+	}
+
+	if v := first(r.Header.Get("X-Forwarded-Proto")); v == "http" || v == "https" {
+		c.Proto = v
+	} else if proto == "http" || proto == "https" {
+		c.Proto = proto
+	}
+	if v := first(r.Header.Get("X-Forwarded-Host")); v != "" {
+		c.Host = v
+	} else if host != "" {
+		c.Host = host
+	}
+	if v := first(r.Header.Get("X-Forwarded-Port")); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 16); err == nil {
+			c.Port = v
+		}
+	}
+	return c
+}
+
+// SetHeaders replaces the X-Forwarded-* and Forwarded headers of a request
+// proxied to a backend by those describing the client. The peer is left out
+// of X-Forwarded-For, the reverse proxy appending it.
+func (c *Client) SetHeaders(h http.Header) {
+	hops := make([]string, len(c.Chain))
+	elements := make([]string, len(c.Chain))
+	for i, addr := range c.Chain {
+		hops[i] = addr.String()
+		elements[i] = "for=" + forwardedNode(addr)
+	}
+	elements[0] += ";host=" + quote(c.Host) + ";proto=" + c.Proto
+
+	if len(hops) > 1 {
+		h.Set("X-Forwarded-For", strings.Join(hops[:len(hops)-1], ", "))
+	} else {
+		h.Del("X-Forwarded-For")
+	}
+	h.Set("X-Forwarded-Proto", c.Proto)
+	h.Set("X-Forwarded-Host", c.Host)
+	if c.Port != "" {
+		h.Set("X-Forwarded-Port", c.Port)
+	} else {
+		h.Del("X-Forwarded-Port")
+	}
+	h.Set("Forwarded", strings.Join(elements, ", "))
+}
+
+// WithClient returns a shallow copy of the request carrying its client
+func WithClient(r *http.Request, c *Client) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, c))
+}
+
+// ClientOf returns the client carried by the request, or nil
+func ClientOf(r *http.Request) *Client {
+	c, _ := r.Context().Value(clientKey{}).(*Client)
+	return c
+}
+
+// forwardedFor returns the hops of the X-Forwarded-For header, or else of the
+// Forwarded header with the proto and host of its first element
+func forwardedFor(h http.Header) (hops []string, proto, host string) {
+	if values := h.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, v := range values {
+			for hop := range strings.SplitSeq(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		return hops, "", ""
+	}
+	for i, element := range commaSeparated(h.Values("Forwarded")) {
+		for pair := range strings.SplitSeq(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(key) {
+			case "for":
+				hops = append(hops, value)
+			case "proto":
+				if i == 0 {
+					proto = strings.ToLower(value)
+				}
+			case "host":
+				if i == 0 {
+					host = value
+				}
+			}
+		}
+	}
+	return hops, proto, host
+}
+
+func commaSeparated(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for element := range strings.SplitSeq(v, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				out = append(out, element)
+			}
+		}
+	}
+	return out
+}
+
+// parseHop parses a hop of a forwarding chain: an IP address, with an optional
+// port, IPv6 addresses being bracketed when they have one
+func parseHop(hop string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	return addr.Unmap(), err == nil
+}
+
+// forwardedNode formats an address as a node of the Forwarded header, IPv6 addresses being quoted
+func forwardedNode(addr netip.Addr) string {
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+// quote quotes a Forwarded parameter value unless it is a token
+func quote(v string) string {
+	if v != "" && !strings.ContainsFunc(v, func(c rune) bool {
+		return c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+	}) {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+// first returns the first value of a comma-separated header
+func first(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	return strings.TrimSpace(v)
+}
+
+// remoteAddr returns the IP address of the peer of the load balancer
+func remoteAddr(r *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		addr, _ := netip.ParseAddr(r.RemoteAddr)
+		return addr.Unmap()
+	}
+	return ap.Addr().Unmap()
+}
+
+// localPort returns the port of the listener which received the request, or
+// else the port of its Host header
+func localPort(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+			return strconv.Itoa(int(ap.Port()))
+		}
+	}
+	_, port := splitHost(r.Host)
+	return port
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestTrustedProxies_Client(t *testing.T) {
+	proxies := TrustedProxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	tests := []struct {
+		name          string
+		remote        string
+		headers       map[string]string
+		expectedAddr  string
+		expectedChain int
+		expectedProto string
+		expectedHost  string
+	}{
+		{
+			name:          "Untrusted Peer Cannot Spoof",
+			remote:        "198.51.100.7:4000",
+			headers:       map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil"},
+			expectedAddr:  "198.51.100.7",
+			expectedChain: 1,
+			expectedProto: "http",
+			expectedHost:  "shop.example.com",
+		},
+		{
+			name:          "Trusted Chain",
+			remote:        "10.0.0.2:4000",
+			headers:       map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.9, 10.0.0.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "www.example.com"},
+			expectedAddr:  "203.0.113.9",
+			expectedChain: 3,
+			expectedProto: "https",
+			expectedHost:  "www.example.com",
+		},
+		{
+			name:          "Every Hop Trusted",
+			remote:        "10.0.0.2:4000",
+			headers:       map[string]string{"X-Forwarded-For": "10.0.0.9"},
+			expectedAddr:  "10.0.0.9",
+			expectedChain: 2,
+			expectedProto: "http",
+			expectedHost:  "shop.example.com",
+		},
+		{
+			name:          "Forwarded Header",
+			remote:        "[2001:db8::1]:4000",
+			headers:       map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https;host=www.example.com, for=10.0.0.1`},
+			expectedAddr:  "2001:db8:cafe::17",
+			expectedChain: 3,
+			expectedProto: "https",
+			expectedHost:  "www.example.com",
+		},
+		{
+			name:          "Obfuscated Hop",
+			remote:        "10.0.0.2:4000",
+			headers:       map[string]string{"Forwarded": "for=_hidden, for=10.0.0.1"},
+			expectedAddr:  "10.0.0.1",
+			expectedChain: 2,
+			expectedProto: "http",
+			expectedHost:  "shop.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			c := proxies.Client(r)
+			if c.Addr.String() != tt.expectedAddr || len(c.Chain) != tt.expectedChain {
+				t.Errorf("Expected client %s through %d hops, got %s through %v", tt.expectedAddr, tt.expectedChain, c.Addr, c.Chain)
+			}
+			if c.Proto != tt.expectedProto || c.Host != tt.expectedHost {
+				t.Errorf("Expected %s://%s, got %s://%s", tt.expectedProto, tt.expectedHost, c.Proto, c.Host)
+			}
+
+			r = WithClient(r, c)
+			if ClientAddr(r) != c.Addr || Scheme(r) != c.Proto {
+				t.Errorf("Expected ClientAddr and Scheme to follow the client, got %s and %s", ClientAddr(r), Scheme(r))
+			}
+		})
+	}
+}
+
+func TestClient_SetHeaders(t *testing.T) {
+	c := &Client{
+		Addr:  netip.MustParseAddr("203.0.113.9"),
+		Chain: []netip.Addr{netip.MustParseAddr("203.0.113.9"), netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.2")},
+		Proto: "https",
+		Host:  "www.example.com:8443",
+		Port:  "8443",
+	}
+	h := http.Header{}
+	c.SetHeaders(h)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "203.0.113.9, 2001:db8::1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "www.example.com:8443",
+		"X-Forwarded-Port":  "8443",
+		"Forwarded":         `for=203.0.113.9;host="www.example.com:8443";proto=https, for="[2001:db8::1]", for=10.0.0.2`,
+	}
+	for name, value := range expected {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+
+	// A direct client leaves X-Forwarded-For to the reverse proxy
+	h.Set("X-Forwarded-For", "1.2.3.4")
+	(&Client{Addr: c.Addr, Chain: c.Chain[:1], Proto: "http", Host: "example.com"}).SetHeaders(h)
+	if _, ok := h["X-Forwarded-For"]; ok || h.Get("X-Forwarded-Port") != "" {
+		t.Errorf("Expected the spoofed X-Forwarded-For removed, got %v", h)
+	}
+}
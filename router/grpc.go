@@ -0,0 +1,169 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	GRPCOK                 = 0
+	GRPCCanceled           = 1
+	GRPCUnknown            = 2
+	GRPCInvalidArgument    = 3
+	GRPCDeadlineExceeded   = 4
+	GRPCNotFound           = 5
+	GRPCAlreadyExists      = 6
+	GRPCPermissionDenied   = 7
+	GRPCResourceExhausted  = 8
+	GRPCFailedPrecondition = 9
+	GRPCAborted            = 10
+	GRPCOutOfRange         = 11
+	GRPCUnimplemented      = 12
+	GRPCInternal           = 13
+	GRPCUnavailable        = 14
+	GRPCDataLoss           = 15
+	GRPCUnauthenticated    = 16
+)
+
+// gRPC headers and trailers
+const (
+	HeaderGRPCStatus  = "Grpc-Status"
+	HeaderGRPCMessage = "Grpc-Message"
+	HeaderGRPCTimeout = "Grpc-Timeout"
+)
+
+// IsGRPC reports whether a request is a gRPC call
+func IsGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ParseGRPCTimeout parses a grpc-timeout header: at most 8 digits followed by a unit
+func ParseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", v)
+	}
+	n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	if n > uint64(math.MaxInt64/unit) {
+		// Beyond 292 years
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// FormatGRPCTimeout formats a grpc-timeout header with the finest unit
+// representing d in 8 digits, rounding up
+func FormatGRPCTimeout(d time.Duration) string {
+	for _, u := range []struct {
+		unit byte
+		d    time.Duration
+	}{{'n', time.Nanosecond}, {'u', time.Microsecond}, {'m', time.Millisecond}, {'S', time.Second}, {'M', time.Minute}} {
+		if n := ceilDiv(d, u.d); n < 1e8 {
+			return strconv.FormatInt(int64(max(n, 1)), 10) + string(u.unit)
+		}
+	}
+	return strconv.FormatInt(int64(min(ceilDiv(d, time.Hour), 1e8-1)), 10) + "H"
+}
+
+func ceilDiv(d, unit time.Duration) time.Duration {
+	n := d / unit
+	if d%unit > 0 {
+		n++
+	}
+	return n
+}
+
+// GRPCStatus returns the grpc-status of a response from its headers, either
+// as a trailer or in the headers of a Trailers-Only response
+func GRPCStatus(h http.Header) (int, bool) {
+	v := h.Get(HeaderGRPCStatus)
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + HeaderGRPCStatus)
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// GRPCHTTPStatus maps a gRPC status code to the HTTP status code recorded in
+// the error stats, so that backend failures count as 5xx responses
+func GRPCHTTPStatus(code int) int {
+	switch code {
+	case GRPCOK:
+		return http.StatusOK
+	case GRPCCanceled:
+		return 499
+	case GRPCInvalidArgument, GRPCFailedPrecondition, GRPCOutOfRange:
+		return http.StatusBadRequest
+	case GRPCDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case GRPCNotFound:
+		return http.StatusNotFound
+	case GRPCAlreadyExists, GRPCAborted:
+		return http.StatusConflict
+	case GRPCPermissionDenied:
+		return http.StatusForbidden
+	case GRPCResourceExhausted:
+		return http.StatusTooManyRequests
+	case GRPCUnimplemented:
+		return http.StatusNotImplemented
+	case GRPCUnavailable:
+		return http.StatusServiceUnavailable
+	case GRPCUnauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCodeFromHTTP maps the HTTP status of a response carrying no
+// grpc-status to the gRPC status code gRPC clients report for it
+func GRPCCodeFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return GRPCInternal
+	case http.StatusUnauthorized:
+		return GRPCUnauthenticated
+	case http.StatusForbidden:
+		return GRPCPermissionDenied
+	case http.StatusNotFound:
+		return GRPCUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GRPCUnavailable
+	default:
+		return GRPCUnknown
+	}
+}
+
+// WriteGRPCError answers a gRPC call with a Trailers-Only response carrying
+// code and msg, the way gRPC servers fail a call before any message
+func WriteGRPCError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set(HeaderGRPCStatus, strconv.Itoa(code))
+	h.Set(HeaderGRPCMessage, url.PathEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
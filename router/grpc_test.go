@@ -0,0 +1,159 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsGRPC(t *testing.T) {
+	tests := []struct {
+		name        string
+		protoMajor  int
+		contentType string
+		expected    bool
+	}{
+		{"gRPC", 2, "application/grpc", true},
+		{"gRPC With Codec", 2, "application/grpc+proto", true},
+		{"HTTP/1 Request", 1, "application/grpc", false},
+		{"gRPC-Web", 2, "application/grpc-web", true},
+		{"JSON", 2, "application/json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+			r.ProtoMajor = tt.protoMajor
+			r.Header.Set("Content-Type", tt.contentType)
+			if got := IsGRPC(r); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"1H", time.Hour, true},
+		{"2M", 2 * time.Minute, true},
+		{"30S", 30 * time.Second, true},
+		{"250m", 250 * time.Millisecond, true},
+		{"100u", 100 * time.Microsecond, true},
+		{"99999999n", 99999999, true},
+		{"123456789n", 0, false},
+		{"10", 0, false},
+		{"10s", 0, false},
+		{"m", 0, false},
+		{"-1S", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseGRPCTimeout(tt.value)
+			if (err == nil) != tt.valid || got != tt.expected {
+				t.Errorf("Expected %v (valid %v), got %v, %v", tt.expected, tt.valid, got, err)
+			}
+		})
+	}
+}
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "1n"},
+		{50 * time.Millisecond, "50000000n"},
+		{250 * time.Millisecond, "250000u"},
+		{90 * time.Second, "90000000u"},
+		{10 * time.Minute, "600000m"},
+		{30 * time.Hour, "108000S"},
+		{time.Duration(1<<63 - 1), "2562048H"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.d.String(), func(t *testing.T) {
+			got := FormatGRPCTimeout(tt.d)
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+			if d, err := ParseGRPCTimeout(got); err != nil || d < tt.d {
+				t.Errorf("Expected %q to parse to at least %v, got %v, %v", got, tt.d, d, err)
+			}
+		})
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected int
+		found    bool
+	}{
+		{"Trailers-Only", http.Header{"Grpc-Status": {"14"}}, GRPCUnavailable, true},
+		{"Trailer", http.Header{http.TrailerPrefix + "Grpc-Status": {"0"}}, GRPCOK, true},
+		{"Missing", http.Header{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, found := GRPCStatus(tt.header)
+			if code != tt.expected || found != tt.found {
+				t.Errorf("Expected %d (%v), got %d (%v)", tt.expected, tt.found, code, found)
+			}
+		})
+	}
+}
+
+func TestGRPCHTTPStatus(t *testing.T) {
+	expected := map[int]int{
+		GRPCOK:                http.StatusOK,
+		GRPCInvalidArgument:   http.StatusBadRequest,
+		GRPCDeadlineExceeded:  http.StatusGatewayTimeout,
+		GRPCResourceExhausted: http.StatusTooManyRequests,
+		GRPCUnavailable:       http.StatusServiceUnavailable,
+		GRPCInternal:          http.StatusInternalServerError,
+		42:                    http.StatusInternalServerError,
+	}
+	for code, status := range expected {
+		if got := GRPCHTTPStatus(code); got != status {
+			t.Errorf("Expected %d for code %d, got %d", status, code, got)
+		}
+	}
+}
+
+func TestGRPCCodeFromHTTP(t *testing.T) {
+	expected := map[int]int{
+		http.StatusNotFound:           GRPCUnimplemented,
+		http.StatusTooManyRequests:    GRPCUnavailable,
+		http.StatusBadGateway:         GRPCUnavailable,
+		http.StatusServiceUnavailable: GRPCUnavailable,
+		http.StatusOK:                 GRPCUnknown,
+		http.StatusTeapot:             GRPCUnknown,
+	}
+	for status, code := range expected {
+		if got := GRPCCodeFromHTTP(status); got != code {
+			t.Errorf("Expected code %d for %d, got %d", code, status, got)
+		}
+	}
+}
+
+func TestWriteGRPCError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteGRPCError(w, GRPCUnavailable, "no backend: 100% busy")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	expected := map[string]string{
+		"Content-Type":    "application/grpc",
+		HeaderGRPCStatus:  "14",
+		HeaderGRPCMessage: "no%20backend:%20100%25%20busy",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+}
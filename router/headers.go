@@ -0,0 +1,111 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderRules changes the headers of the requests sent to the backends, or of
+// the responses sent to the clients. Headers are removed first, then set,
+// then added. Values can refer to the variables of HeaderVars as ${name}.
+type HeaderRules struct {
+	Remove []string
+	Set    []Header
+	Add    []Header
+}
+
+// Header is a header name and its value template
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Apply changes the headers h, expanding the values with the variables v
+func (rules *HeaderRules) Apply(h http.Header, v *HeaderVars) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for _, s := range rules.Set {
+		h.Set(s.Name, v.Expand(s.Value))
+	}
+	for _, a := range rules.Add {
+		h.Add(a.Name, v.Expand(a.Value))
+	}
+}
+
+// HeaderVars holds the variables available to header values:
+//
+//	client_ip      IP address of the client
+//	host           host requested by the client, as received
+//	method         request method
+//	path           request path, as received
+//	scheme         http or https
+//	route          name of the route serving the request
+//	pool           name of the pool serving the request
+//	backend_url    URL of the backend serving the request
+//	request_id     X-Request-ID of the request, or a random ID when it has none
+//	request_start  time the request was received, in microseconds since the Unix epoch
+type HeaderVars struct {
+	Request *http.Request
+	// Host and Path are those received, before any rewrite
+	Host, Path  string
+	Route, Pool string
+	Backend     string
+	Start       time.Time
+	requestID   string
+}
+
+// NewHeaderVars returns the variables of a request received at start
+func NewHeaderVars(r *http.Request, start time.Time) *HeaderVars {
+	return &HeaderVars{Request: r, Host: r.Host, Path: r.URL.Path, Start: start, requestID: r.Header.Get("X-Request-ID")}
+}
+
+// Expand replaces the ${name} variables of a header value
+func (v *HeaderVars) Expand(value string) string {
+	if !strings.Contains(value, "$") {
+		return value
+	}
+	return os.Expand(value, v.lookup)
+}
+
+func (v *HeaderVars) lookup(name string) string {
+	switch name {
+	case "client_ip":
+		return ClientAddr(v.Request).String()
+	case "host":
+		return v.Host
+	case "method":
+		return v.Request.Method
+	case "path":
+		return v.Path
+	case "scheme":
+		return Scheme(v.Request)
+	case "route":
+		return v.Route
+	case "pool":
+		return v.Pool
+	case "backend_url":
+		return v.Backend
+	case "request_id":
+		return v.RequestID()
+	case "request_start":
+		return strconv.FormatInt(v.Start.UnixMicro(), 10)
+	}
+	return ""
+}
+
+// RequestID returns the X-Request-ID of the request, or a random ID when it has none,
+// the same one for the request and its response
+func (v *HeaderVars) RequestID() string {
+	if v.requestID == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		v.requestID = hex.EncodeToString(b)
+	}
+	return v.requestID
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderRules_Apply(t *testing.T) {
+	rules := &HeaderRules{
+		Remove: []string{"Server", "X-Powered-By"},
+		Set:    []Header{{"Strict-Transport-Security", "max-age=63072000"}, {"X-Via", "${pool}/${route}"}},
+		Add:    []Header{{"Vary", "Origin"}},
+	}
+	h := http.Header{}
+	h.Set("Server", "nginx")
+	h.Set("X-Via", "backend")
+	h.Set("Vary", "Accept")
+
+	rules.Apply(h, &HeaderVars{Request: httptest.NewRequest("GET", "/", nil), Route: "web", Pool: "blue"})
+	if h.Get("Server") != "" || h.Get("Strict-Transport-Security") != "max-age=63072000" || h.Get("X-Via") != "blue/web" {
+		t.Errorf("Expected Server removed and the headers set, got %v", h)
+	}
+	if vary := h.Values("Vary"); len(vary) != 2 || vary[1] != "Origin" {
+		t.Errorf("Expected Origin added to Vary, got %v", vary)
+	}
+}
+
+func TestHeaderVars_Expand(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://shop.example.com/cart", nil)
+	r.RemoteAddr = "[::ffff:10.0.0.7]:51234"
+	start := time.UnixMicro(1700000000123456)
+	v := NewHeaderVars(r, start)
+	v.Route, v.Pool, v.Backend = "shop", "blue", "http://app1:80"
+	// Rewrites happen after the variables are captured
+	r.URL.Path, r.Host = "/v2/cart", "internal"
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"static", "static"},
+		{"${client_ip}", "10.0.0.7"},
+		{"${method} ${scheme}://${host}${path}", "POST http://shop.example.com/cart"},
+		{"${route} ${pool} ${backend_url}", "shop blue http://app1:80"},
+		{"t=${request_start}", "t=1700000000123456"},
+		{"${unknown}", ""},
+	}
+	for _, tt := range tests {
+		if got := v.Expand(tt.value); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.value, tt.expected, got)
+		}
+	}
+
+	id := v.Expand("${request_id}")
+	if len(id) != 32 || v.Expand("${request_id}") != id {
+		t.Errorf("Expected a stable random request ID, got %q", id)
+	}
+	r.Header.Set("X-Request-ID", "abc")
+	if got := NewHeaderVars(r, start).RequestID(); got != "abc" {
+		t.Errorf("Expected the request ID of the client, got %q", got)
+	}
+}
@@ -0,0 +1,203 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+// Mirror sends a copy of a share of the requests of a route to a shadow pool.
+//
+// A copy is sent fire-and-forget once the primary response is written, so
+// that the shadow pool never delays the client nor the primary latency. The
+// shadow responses are discarded, only their status codes are counted.
+type Mirror struct {
+	Pool *core.ServerPool
+	// Percent is the share of the requests mirrored, between 0 and 100
+	Percent float64
+	// MaxBodySize is the largest request body mirrored, larger requests are skipped
+	MaxBodySize int64
+	// Header is set to Value on the mirrored requests
+	Header, Value string
+	// Timeout bounds each mirrored request
+	Timeout time.Duration
+	// CompareStatus counts the shadow status codes differing from the primary ones
+	CompareStatus bool
+
+	// inflight holds a token per mirrored request being sent
+	inflight chan struct{}
+
+	mirrored atomic.Uint64
+	skipped  atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+	matched  atomic.Uint64
+
+	mu sync.Mutex
+	// mismatches counts the shadow status codes by primary status code
+	mismatches map[[2]int]uint64
+}
+
+// MirrorCounts is the outcome of the mirrored requests of a route
+type MirrorCounts struct {
+	// Mirrored requests were sent to the shadow pool
+	Mirrored uint64
+	// Skipped requests had a body larger than MaxBodySize
+	Skipped uint64
+	// Dropped requests found no shadow backend, or too many mirrored requests in flight
+	Dropped uint64
+	// Failed requests got a 5xx shadow response or no response at all
+	Failed uint64
+	// Matched and Mismatches compare the shadow and primary status codes, when CompareStatus is set.
+	// Mismatches are keyed by "primary/shadow", e.g. "200/500".
+	Matched    uint64
+	Mismatches map[string]uint64
+}
+
+// NewMirror creates a mirror to a shadow pool sending at most maxInFlight requests at once
+func NewMirror(pool *core.ServerPool, maxInFlight int) *Mirror {
+	return &Mirror{
+		Pool:       pool,
+		Percent:    100,
+		inflight:   make(chan struct{}, maxInFlight),
+		mismatches: map[[2]int]uint64{},
+	}
+}
+
+// Sample reports whether a request is to be mirrored
+func (m *Mirror) Sample() bool {
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
+
+// Capture reads the body of a request to mirror it, leaving the body readable
+// for the primary pool. It reports false when the body is larger than
+// MaxBodySize: the request is then not mirrored.
+func (m *Mirror) Capture(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.MaxBodySize {
+		m.skipped.Add(1)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBodySize+1))
+	// The primary pool reads the captured bytes, then whatever is left
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || int64(len(body)) > m.MaxBodySize {
+		m.skipped.Add(1)
+		return nil, false
+	}
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Send mirrors a request with its captured body to a backend of the shadow
+// pool, without waiting for the response. primary is the status code of the
+// primary response, to compare it to the shadow one.
+func (m *Mirror) Send(r *http.Request, body []byte, primary int) {
+	peer := m.Pool.GetPeer()
+	if peer == nil {
+		m.dropped.Add(1)
+		return
+	}
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+
+	// The copy outlives the client request, it gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	req := r.Clone(ctx)
+	req.Body, req.ContentLength = http.NoBody, 0
+	if len(body) > 0 {
+		req.Body, req.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	}
+	req.Header.Set(m.Header, m.Value)
+	m.mirrored.Add(1)
+
+	go func() {
+		defer func() { <-m.inflight }()
+		defer cancel()
+		peer.IncConn()
+		defer peer.DecConn()
+
+		w := &discardWriter{header: http.Header{}, status: http.StatusOK}
+		peer.ReverseProxy.ServeHTTP(w, req)
+		status := w.status
+		if code, ok := GRPCStatus(w.header); ok && IsGRPC(req) {
+			// gRPC failures are answered with 200, compare their status codes
+			status = GRPCHTTPStatus(code)
+		}
+		m.done(primary, status)
+	}()
+}
+
+// done records the status code of a shadow response
+func (m *Mirror) done(primary, shadow int) {
+	if shadow >= http.StatusInternalServerError {
+		m.failed.Add(1)
+	}
+	if !m.CompareStatus {
+		return
+	}
+	if primary == shadow {
+		m.matched.Add(1)
+		return
+	}
+	m.mu.Lock()
+	m.mismatches[[2]int{primary, shadow}]++
+	m.mu.Unlock()
+}
+
+// Counts returns the outcome of the mirrored requests
+func (m *Mirror) Counts() MirrorCounts {
+	c := MirrorCounts{
+		Mirrored: m.mirrored.Load(),
+		Skipped:  m.skipped.Load(),
+		Dropped:  m.dropped.Load(),
+		Failed:   m.failed.Load(),
+		Matched:  m.matched.Load(),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mismatches) > 0 {
+		c.Mismatches = map[string]uint64{}
+		for k, n := range m.mismatches {
+			c.Mismatches[fmt.Sprintf("%d/%d", k[0], k[1])] = n
+		}
+	}
+	return c
+}
+
+// discardWriter is the response writer of mirrored requests, only keeping the status code
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	// Informational responses precede the final one
+	w.status = status
+}
@@ -0,0 +1,80 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func TestMirror_Capture(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		length   int64
+		expected bool
+	}{
+		{"No Body", "", 0, true},
+		{"Small Body", "hello", 5, true},
+		{"Body At The Limit", "0123456789", 10, true},
+		{"Large Body", "0123456789a", 11, false},
+		{"Large Body Without Length", "0123456789a", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMirror(&core.ServerPool{}, 1)
+			m.MaxBodySize = 10
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.ContentLength = tt.length
+
+			body, ok := m.Capture(r)
+			if ok != tt.expected {
+				t.Fatalf("Expected %v, got %v", tt.expected, ok)
+			}
+			if ok && string(body) != tt.body {
+				t.Errorf("Expected the captured body %q, got %q", tt.body, body)
+			}
+			// The primary pool still reads the whole body
+			if rest, _ := io.ReadAll(r.Body); string(rest) != tt.body {
+				t.Errorf("Expected the request body %q, got %q", tt.body, rest)
+			}
+			if skipped := m.Counts().Skipped; (skipped == 1) == tt.expected {
+				t.Errorf("Expected skipped requests to be counted, got %d", skipped)
+			}
+		})
+	}
+}
+
+func TestMirror_Sample(t *testing.T) {
+	m := NewMirror(&core.ServerPool{}, 1)
+	m.Percent = 20
+	sampled := 0
+	for range 10000 {
+		if m.Sample() {
+			sampled++
+		}
+	}
+	if sampled < 1700 || sampled > 2300 {
+		t.Errorf("Expected about 20%% of the requests to be mirrored, got %d/10000", sampled)
+	}
+}
+
+func TestMirror_Counts(t *testing.T) {
+	m := NewMirror(&core.ServerPool{}, 1)
+	m.done(http.StatusOK, http.StatusBadGateway)
+	if c := m.Counts(); c.Failed != 1 || c.Matched != 0 || c.Mismatches != nil {
+		t.Errorf("Expected a failure and no comparison, got %+v", c)
+	}
+
+	m.CompareStatus = true
+	for _, shadow := range []int{200, 200, 500, 404} {
+		m.done(http.StatusOK, shadow)
+	}
+	c := m.Counts()
+	if c.Matched != 2 || c.Mismatches["200/500"] != 1 || c.Mismatches["200/404"] != 1 || c.Failed != 2 {
+		t.Errorf("Expected 2 matches and 2 mismatches, got %+v", c)
+	}
+}
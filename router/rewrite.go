@@ -0,0 +1,131 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rewrite changes the path and host of the requests of a route before they
+// are proxied. The prefix is stripped first, then the regular expression is
+// replaced, and the prefix is added last.
+type Rewrite struct {
+	StripPrefix string
+	// Regex is replaced in the path by Replacement, which can refer to its
+	// capture groups as $1 or ${name}
+	Regex       *regexp.Regexp
+	Replacement string
+	AddPrefix   string
+	// Host replaces the Host header sent to the backend
+	Host string
+}
+
+// Path returns the rewritten path
+func (rw *Rewrite) Path(path string) string {
+	if rw.StripPrefix != "" {
+		if p, ok := strings.CutPrefix(path, rw.StripPrefix); ok {
+			path = p
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+		}
+	}
+	if rw.Regex != nil {
+		path = rw.Regex.ReplaceAllString(path, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+	return path
+}
+
+// Apply rewrites the path and host of a request
+func (rw *Rewrite) Apply(r *http.Request) {
+	if path := rw.Path(r.URL.Path); path != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+	if rw.Host != "" {
+		r.Host = rw.Host
+	}
+}
+
+// Redirect answers the requests of a route with a redirect instead of proxying them
+type Redirect struct {
+	// Status is 301, 302, 307 or 308
+	Status int
+	// Scheme, Host and Port replace those of the request when set. Changing the
+	// scheme without setting Port drops the port of the request.
+	Scheme string
+	Host   string
+	Port   int
+}
+
+// Location returns the URL a request is redirected to, the path being
+// rewritten by rw when set. It reports false when the request already is at
+// that URL, e.g. a request over HTTPS for a redirect to HTTPS.
+func (rd *Redirect) Location(r *http.Request, rw *Rewrite) (string, bool) {
+	scheme := Scheme(r)
+	hostport := r.Host
+	if c := ClientOf(r); c != nil {
+		// The host requested from the trusted proxy
+		hostport = c.Host
+	}
+	host, port := splitHost(hostport)
+	u := url.URL{Scheme: scheme, Host: joinHost(scheme, host, port), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	current := u
+
+	if rd.Scheme != "" && rd.Scheme != scheme {
+		u.Scheme, port = rd.Scheme, ""
+	}
+	if rd.Host != "" {
+		host = rd.Host
+	}
+	if rd.Port != 0 {
+		port = strconv.Itoa(rd.Port)
+	}
+	u.Host = joinHost(u.Scheme, host, port)
+	if rw != nil {
+		u.Path = rw.Path(u.Path)
+	}
+
+	if u.Scheme == current.Scheme && strings.EqualFold(u.Host, current.Host) && u.Path == current.Path {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// Scheme returns the scheme requested by the client: the one forwarded by a
+// trusted proxy when the request carries its Client, or else https when the
+// request was received over TLS
+func Scheme(r *http.Request) string {
+	if c := ClientOf(r); c != nil {
+		return c.Proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// splitHost splits a Host header into its hostname and port, if any
+func splitHost(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return strings.Trim(hostport, "[]"), ""
+}
+
+// joinHost joins a hostname and port, omitting the default port of the scheme
+func joinHost(scheme, host, port string) string {
+	if port == "" || (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(host, ":") {
+			// IPv6 address
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
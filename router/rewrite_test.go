@@ -0,0 +1,71 @@
+package router
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRewrite_Path(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewrite  Rewrite
+		path     string
+		expected string
+	}{
+		{"Strip Prefix", Rewrite{StripPrefix: "/api"}, "/api/users", "/users"},
+		{"Strip Whole Path", Rewrite{StripPrefix: "/api"}, "/api", "/"},
+		{"Strip Missing Prefix", Rewrite{StripPrefix: "/api"}, "/web/users", "/web/users"},
+		{"Add Prefix", Rewrite{AddPrefix: "/v2/"}, "/users", "/v2/users"},
+		{"Replace Prefix", Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}, "/api/users", "/v2/users"},
+		{"Regex", Rewrite{Regex: regexp.MustCompile(`^/users/(\d+)/orders$`), Replacement: "/orders/$1"}, "/users/42/orders", "/orders/42"},
+		{"Named Group", Rewrite{Regex: regexp.MustCompile(`^/(?P<lang>en|fr)/docs$`), Replacement: "/docs/${lang}"}, "/fr/docs", "/docs/fr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rewrite.Path(tt.path); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewrite_Apply(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://shop.example.com/api/caf%C3%A9?q=1", nil)
+	(&Rewrite{StripPrefix: "/api", Host: "internal:8080"}).Apply(r)
+	if r.URL.Path != "/café" || r.URL.RawQuery != "q=1" || r.Host != "internal:8080" {
+		t.Errorf("Expected /café?q=1 on internal:8080, got %s on %s", r.URL, r.Host)
+	}
+}
+
+func TestRedirect_Location(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect Redirect
+		rewrite  *Rewrite
+		url      string
+		tls      bool
+		expected string
+	}{
+		{"To HTTPS", Redirect{Scheme: "https"}, nil, "http://example.com/cart?id=1", false, "https://example.com/cart?id=1"},
+		{"To HTTPS Drops The Port", Redirect{Scheme: "https"}, nil, "http://example.com:8080/", false, "https://example.com/"},
+		{"To HTTPS Port", Redirect{Scheme: "https", Port: 8443}, nil, "http://example.com:8080/", false, "https://example.com:8443/"},
+		{"Already HTTPS", Redirect{Scheme: "https"}, nil, "https://example.com/", true, ""},
+		{"Host", Redirect{Host: "www.example.com"}, nil, "http://example.com:8080/a", false, "http://www.example.com:8080/a"},
+		{"Rewritten Path", Redirect{}, &Rewrite{StripPrefix: "/old", AddPrefix: "/new"}, "http://example.com/old/page", false, "http://example.com/new/page"},
+		{"IPv6", Redirect{Scheme: "https"}, nil, "http://[::1]:8080/", false, "https://[::1]/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			location, ok := tt.redirect.Location(r, tt.rewrite)
+			if ok != (tt.expected != "") || location != tt.expected {
+				t.Errorf("Expected %q, got %q (%v)", tt.expected, location, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+// Package router selects the route, and so the pool, serving a request.
+package router
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+// Route sends the matching requests to Pool.
+// At most one of Path, PathPrefix and PathRegex is set; a route without any
+// of them matches every path of its hosts. Every condition set must hold.
+type Route struct {
+	Name string
+	// Hosts restricts the route to these hostnames, any host when empty.
+	// A "*." prefix matches every subdomain, e.g. *.example.com matches a.example.com.
+	Hosts []string
+	// Path matches the request path exactly
+	Path string
+	// PathPrefix matches the paths starting with it
+	PathPrefix string
+	// PathRegex matches the paths it matches, it should be anchored with ^ and $
+	PathRegex *regexp.Regexp
+	// Headers and Query must all be present in the request, with a matching value if set
+	Headers []ValueMatch
+	Query   []ValueMatch
+	// Methods restricts the route to these HTTP methods
+	Methods []string
+	// ClientCIDRs restricts the route to clients in these networks
+	ClientCIDRs []netip.Prefix
+	// ClientCert requires a verified client certificate, the other requests
+	// being answered 403 Forbidden
+	ClientCert *ClientCert
+	// Pool serves the requests of the route, unless Split is set
+	Pool  *core.ServerPool
+	Split *Split
+	// Mirror copies a share of the requests to a shadow pool
+	Mirror *Mirror
+	// Rewrite changes the path and host of the requests before they are proxied
+	Rewrite *Rewrite
+	// Redirect answers the requests with a redirect, the requests already at
+	// its location being served by the pool of the route if any
+	Redirect *Redirect
+	// RequestHeaders and ResponseHeaders change the headers sent to the backends and to the clients
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+}
+
+// Target returns the pool serving a request of the route, and the split target it belongs to if any.
+// The pool is nil for a redirect route without pool.
+func (r *Route) Target(req *http.Request) (*core.ServerPool, *SplitTarget) {
+	if r.Split == nil {
+		return r.Pool, nil
+	}
+	t := r.Split.Pick(req)
+	return t.Pool, t
+}
+
+// ValueMatch matches a header or query parameter: its value must be equal to
+// Value, or match Regex, or when neither is set the parameter must be present.
+type ValueMatch struct {
+	Name  string
+	Value string
+	Regex *regexp.Regexp
+}
+
+// conditions is the number of conditions of the route besides its host and path:
+// among routes of the same host and path, the route having more conditions is tried first
+func (r *Route) conditions() int {
+	n := len(r.Headers) + len(r.Query)
+	if len(r.Methods) > 0 {
+		n++
+	}
+	if len(r.ClientCIDRs) > 0 {
+		n++
+	}
+	return n
+}
+
+// Table is an immutable set of routes.
+//
+// The routes of the request host are tried first: the routes of its exact
+// hostname, then those of the matching wildcards, the most specific first,
+// and finally the routes without hosts. Within each of these groups, exact
+// paths are tried first, then the longest matching prefix, then regular
+// expressions in their configuration order, and finally the routes without
+// path. Routes of the same group and path are tried from the one having the
+// most conditions (headers, query parameters, methods and client networks)
+// to the one having the least, then in their configuration order.
+type Table struct {
+	routes    []*Route
+	hosts     map[string]*paths
+	wildcards []wildcard
+	any       *paths
+}
+
+// wildcard holds the routes of a *.domain host, suffix being .domain
+type wildcard struct {
+	suffix string
+	paths  *paths
+}
+
+// paths holds the routes of a host group, by kind of path matching
+type paths struct {
+	exact    map[string][]*Route
+	prefixes []*Route
+	regexes  []*Route
+	fallback []*Route
+	// all holds every route of the group in priority order, to explain a match
+	all []*Route
+}
+
+// New builds a table from routes in their configuration order
+func New(routes []*Route) *Table {
+	t := &Table{routes: routes, hosts: map[string]*paths{}, any: newPaths()}
+	wildcards := map[string]*paths{}
+	for _, r := range routes {
+		if len(r.Hosts) == 0 {
+			t.any.add(r)
+		}
+		for _, h := range r.Hosts {
+			h = normalizeHost(h)
+			if suffix, ok := strings.CutPrefix(h, "*"); ok {
+				if wildcards[suffix] == nil {
+					wildcards[suffix] = newPaths()
+					t.wildcards = append(t.wildcards, wildcard{suffix: suffix, paths: wildcards[suffix]})
+				}
+				wildcards[suffix].add(r)
+				continue
+			}
+			if t.hosts[h] == nil {
+				t.hosts[h] = newPaths()
+			}
+			t.hosts[h].add(r)
+		}
+	}
+	// Most specific wildcard first
+	slices.SortStableFunc(t.wildcards, func(a, b wildcard) int {
+		return cmp.Compare(len(b.suffix), len(a.suffix))
+	})
+	return t
+}
+
+// Routes returns the routes of the table in their configuration order
+func (t *Table) Routes() []*Route {
+	return t.routes
+}
+
+// Route returns the route with the given name, or nil
+func (t *Table) Route(name string) *Route {
+	for _, r := range t.routes {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Match returns the route serving the request, or nil if none matches
+func (t *Table) Match(r *http.Request) *Route {
+	return t.match(r, nil)
+}
+
+// Step is a route considered while matching a request, in priority order
+type Step struct {
+	Route *Route
+	// Group is the host group of the route: a hostname, a *.domain wildcard, or * for the routes without hosts
+	Group string
+	// Reason explains why the route does not match, it is empty for the matching route
+	Reason string
+}
+
+// Explain returns the route serving the request, or nil, and the routes
+// considered before it with the reason they were skipped
+func (t *Table) Explain(r *http.Request) (*Route, []Step) {
+	var steps []Step
+	route := t.match(r, &steps)
+	return route, steps
+}
+
+func (t *Table) match(r *http.Request, trace *[]Step) *Route {
+	host := normalizeHost(r.Host)
+	if p, ok := t.hosts[host]; ok {
+		if route := p.match(r, host, trace); route != nil {
+			return route
+		}
+	}
+	for _, w := range t.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			if route := w.paths.match(r, "*"+w.suffix, trace); route != nil {
+				return route
+			}
+		}
+	}
+	return t.any.match(r, "*", trace)
+}
+
+// VirtualHosts reports whether some routes are restricted to hosts
+func (t *Table) VirtualHosts() bool {
+	return len(t.hosts) > 0 || len(t.wildcards) > 0
+}
+
+// KnownHost reports whether some routes are restricted to the host of the request
+func (t *Table) KnownHost(r *http.Request) bool {
+	host := normalizeHost(r.Host)
+	if _, ok := t.hosts[host]; ok {
+		return true
+	}
+	for _, w := range t.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost removes the port and trailing dot of a host and lowercases it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func newPaths() *paths {
+	return &paths{exact: map[string][]*Route{}}
+}
+
+// byConditions sorts routes by decreasing number of conditions, keeping the configuration order
+func byConditions(a, b *Route) int {
+	return cmp.Compare(b.conditions(), a.conditions())
+}
+
+func (p *paths) add(r *Route) {
+	switch {
+	case r.Path != "":
+		p.exact[r.Path] = append(p.exact[r.Path], r)
+		slices.SortStableFunc(p.exact[r.Path], byConditions)
+	case r.PathPrefix != "":
+		p.prefixes = append(p.prefixes, r)
+		// Longest prefix first
+		slices.SortStableFunc(p.prefixes, func(a, b *Route) int {
+			return cmp.Or(cmp.Compare(len(b.PathPrefix), len(a.PathPrefix)), byConditions(a, b))
+		})
+	case r.PathRegex != nil:
+		p.regexes = append(p.regexes, r)
+		slices.SortStableFunc(p.regexes, byConditions)
+	default:
+		p.fallback = append(p.fallback, r)
+		slices.SortStableFunc(p.fallback, byConditions)
+	}
+
+	p.all = p.all[:0]
+	for _, path := range slices.Sorted(maps.Keys(p.exact)) {
+		p.all = append(p.all, p.exact[path]...)
+	}
+	p.all = append(p.all, p.prefixes...)
+	p.all = append(p.all, p.regexes...)
+	p.all = append(p.all, p.fallback...)
+}
+
+func (p *paths) match(r *http.Request, group string, trace *[]Step) *Route {
+	if trace != nil {
+		// Walk the routes in priority order, recording why each one is skipped
+		for _, route := range p.all {
+			reason := route.mismatch(r, true)
+			*trace = append(*trace, Step{Route: route, Group: group, Reason: reason})
+			if reason == "" {
+				return route
+			}
+		}
+		return nil
+	}
+	return p.first(r)
+}
+
+// first returns the route of highest priority matching the request
+func (p *paths) first(r *http.Request) *Route {
+	path := r.URL.Path
+	for _, route := range p.exact[path] {
+		if route.mismatch(r, false) == "" {
+			return route
+		}
+	}
+	for _, route := range p.prefixes {
+		if strings.HasPrefix(path, route.PathPrefix) && route.mismatch(r, false) == "" {
+			return route
+		}
+	}
+	for _, route := range p.regexes {
+		if route.PathRegex.MatchString(path) && route.mismatch(r, false) == "" {
+			return route
+		}
+	}
+	for _, route := range p.fallback {
+		if route.mismatch(r, false) == "" {
+			return route
+		}
+	}
+	return nil
+}
+
+// mismatch returns why the route does not match the request, or "" if it matches.
+// The path is only checked when checkPath is set.
+func (route *Route) mismatch(r *http.Request, checkPath bool) string {
+	path := r.URL.Path
+	if checkPath {
+		switch {
+		case route.Path != "" && path != route.Path:
+			return fmt.Sprintf("path is not %s", route.Path)
+		case route.PathPrefix != "" && !strings.HasPrefix(path, route.PathPrefix):
+			return fmt.Sprintf("path does not start with %s", route.PathPrefix)
+		case route.PathRegex != nil && !route.PathRegex.MatchString(path):
+			return fmt.Sprintf("path does not match %s", route.PathRegex)
+		}
+	}
+
+	if len(route.Methods) > 0 && !slices.Contains(route.Methods, r.Method) {
+		return fmt.Sprintf("method %s is not one of %s", r.Method, strings.Join(route.Methods, ", "))
+	}
+	if len(route.ClientCIDRs) > 0 {
+		addr := ClientAddr(r)
+		if !slices.ContainsFunc(route.ClientCIDRs, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return fmt.Sprintf("client %s is not in %s", addr, prefixes(route.ClientCIDRs))
+		}
+	}
+	for _, h := range route.Headers {
+		if reason := h.mismatch("header", r.Header.Values(h.Name)); reason != "" {
+			return reason
+		}
+	}
+	if len(route.Query) > 0 {
+		query := r.URL.Query()
+		for _, q := range route.Query {
+			if reason := q.mismatch("query parameter", query[q.Name]); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// mismatch returns why none of the values matches, or "" if one does
+func (m ValueMatch) mismatch(kind string, values []string) string {
+	if len(values) == 0 {
+		return fmt.Sprintf("%s %s is missing", kind, m.Name)
+	}
+	switch {
+	case m.Regex != nil:
+		if !slices.ContainsFunc(values, m.Regex.MatchString) {
+			return fmt.Sprintf("%s %s does not match %s", kind, m.Name, m.Regex)
+		}
+	case m.Value != "":
+		if !slices.Contains(values, m.Value) {
+			return fmt.Sprintf("%s %s is not %q", kind, m.Name, m.Value)
+		}
+	}
+	return ""
+}
+
+// ClientAddr returns the IP address of the client of the request, as resolved
+// through the trusted proxies when the request carries its Client
+func ClientAddr(r *http.Request) netip.Addr {
+	if c := ClientOf(r); c != nil {
+		return c.Addr
+	}
+	return remoteAddr(r)
+}
+
+func prefixes(ps []netip.Prefix) string {
+	s := make([]string, len(ps))
+	for i, p := range ps {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,180 @@
+package router
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func TestTable_Match(t *testing.T) {
+	api := &Route{Name: "api", PathPrefix: "/api", Pool: &core.ServerPool{Name: "api"}}
+	apiV2 := &Route{Name: "api-v2", PathPrefix: "/api/v2", Pool: &core.ServerPool{Name: "api-v2"}}
+	health := &Route{Name: "health", Path: "/api/health", Pool: &core.ServerPool{Name: "ops"}}
+	static := &Route{Name: "static", PathRegex: regexp.MustCompile(`\.(js|css)$`), Pool: &core.ServerPool{Name: "cdn"}}
+	apiJS := &Route{Name: "api-js", PathRegex: regexp.MustCompile(`^/api/.*\.js$`), Pool: &core.ServerPool{Name: "cdn"}}
+	web := &Route{Name: "web", Pool: &core.ServerPool{Name: "web"}}
+
+	// Routes are given out of order: the table decides the priority
+	table := New([]*Route{api, static, web, apiJS, apiV2, health})
+
+	tests := []struct {
+		name     string
+		path     string
+		expected *Route
+	}{
+		{"Exact Path", "/api/health", health},
+		{"Exact Path Is Not A Prefix", "/api/health/db", api},
+		{"Longest Prefix", "/api/v2/users", apiV2},
+		{"Shorter Prefix", "/api/v1/users", api},
+		{"Prefix Before Regex", "/api/app.js", api},
+		{"First Regex In Order", "/assets/app.js", static},
+		{"Default Route", "/index.html", web},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := table.Match(httptest.NewRequest("GET", tt.path, nil))
+			if got != tt.expected {
+				t.Errorf("Expected route %s, got %v", tt.expected.Name, got)
+			}
+		})
+	}
+
+	t.Run("No Default Route", func(t *testing.T) {
+		table := New([]*Route{api})
+		if got := table.Match(httptest.NewRequest("GET", "/", nil)); got != nil {
+			t.Errorf("Expected no route, got %s", got.Name)
+		}
+	})
+}
+
+func TestTable_MatchHost(t *testing.T) {
+	shop := &Route{Name: "shop", Hosts: []string{"shop.example.com"}, Pool: &core.ServerPool{Name: "shop"}}
+	shopAPI := &Route{Name: "shop-api", Hosts: []string{"shop.example.com"}, PathPrefix: "/api", Pool: &core.ServerPool{Name: "api"}}
+	tenants := &Route{Name: "tenants", Hosts: []string{"*.example.com"}, Pool: &core.ServerPool{Name: "tenants"}}
+	eu := &Route{Name: "eu", Hosts: []string{"*.eu.example.com", "EU.example.org"}, Pool: &core.ServerPool{Name: "eu"}}
+	health := &Route{Name: "health", Path: "/healthz", Pool: &core.ServerPool{Name: "ops"}}
+
+	table := New([]*Route{health, tenants, eu, shop, shopAPI})
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		expected *Route
+	}{
+		{"Exact Host", "shop.example.com", "/cart", shop},
+		{"Exact Host With Path", "shop.example.com", "/api/items", shopAPI},
+		{"Port And Case Are Ignored", "Shop.Example.com:8443", "/", shop},
+		{"Wildcard", "acme.example.com", "/", tenants},
+		{"Most Specific Wildcard", "paris.eu.example.com", "/", eu},
+		{"Wildcard Does Not Match Apex", "example.com", "/", nil},
+		{"Host Routes Before Routes Without Hosts", "acme.example.com", "/healthz", tenants},
+		{"Routes Without Hosts For Unknown Host", "other.net", "/healthz", health},
+		{"Unknown Host", "other.net", "/", nil},
+		{"Second Host Of A Route", "eu.example.org", "/", eu},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			if got := table.Match(r); got != tt.expected {
+				t.Errorf("Expected route %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if !table.VirtualHosts() {
+		t.Error("Expected virtual hosts")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "other.net"
+	if table.KnownHost(r) {
+		t.Error("Expected other.net to be unknown")
+	}
+	r.Host = "a.example.com"
+	if !table.KnownHost(r) {
+		t.Error("Expected a.example.com to be known")
+	}
+}
+
+func TestTable_MatchConditions(t *testing.T) {
+	canary := &Route{Name: "canary", PathPrefix: "/api", Headers: []ValueMatch{{Name: "X-Canary", Value: "1"}}, Pool: &core.ServerPool{Name: "canary"}}
+	beta := &Route{Name: "beta", PathPrefix: "/api", Query: []ValueMatch{{Name: "beta"}}, Methods: []string{"GET"}, Pool: &core.ServerPool{Name: "beta"}}
+	mobile := &Route{Name: "mobile", PathPrefix: "/api", Headers: []ValueMatch{{Name: "User-Agent", Regex: regexp.MustCompile(`(?i)android|iphone`)}}, Pool: &core.ServerPool{Name: "mobile"}}
+	internal := &Route{Name: "internal", PathPrefix: "/api", ClientCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Pool: &core.ServerPool{Name: "internal"}}
+	api := &Route{Name: "api", PathPrefix: "/api", Pool: &core.ServerPool{Name: "api"}}
+	writes := &Route{Name: "writes", Methods: []string{"POST", "PUT"}, Pool: &core.ServerPool{Name: "writes"}}
+
+	table := New([]*Route{api, canary, mobile, internal, beta, writes})
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   map[string]string
+		remote   string
+		expected *Route
+	}{
+		{"No Condition Met", "GET", "/api/users", nil, "192.0.2.1:1234", api},
+		{"Header Value", "GET", "/api/users", map[string]string{"X-Canary": "1"}, "192.0.2.1:1234", canary},
+		{"Header Wrong Value", "GET", "/api/users", map[string]string{"X-Canary": "0"}, "192.0.2.1:1234", api},
+		{"Header Regex", "GET", "/api/users", map[string]string{"User-Agent": "Mozilla (iPhone)"}, "192.0.2.1:1234", mobile},
+		{"Query Presence And Method", "GET", "/api/users?beta", nil, "192.0.2.1:1234", beta},
+		{"Query Presence With Wrong Method", "DELETE", "/api/users?beta=1", nil, "192.0.2.1:1234", api},
+		{"More Conditions First", "GET", "/api/users?beta", map[string]string{"X-Canary": "1"}, "192.0.2.1:1234", beta},
+		{"Configuration Order Among Equals", "GET", "/api/users", map[string]string{"X-Canary": "1", "User-Agent": "android"}, "192.0.2.1:1234", canary},
+		{"Client CIDR", "GET", "/api/users", nil, "10.1.2.3:1234", internal},
+		{"Client CIDR IPv4 Mapped", "GET", "/api/users", nil, "[::ffff:10.1.2.3]:1234", internal},
+		{"Longer Path Before Conditions", "POST", "/api/users", nil, "192.0.2.1:1234", api},
+		{"Method Without Path", "PUT", "/upload", nil, "192.0.2.1:1234", writes},
+		{"No Match", "GET", "/upload", nil, "192.0.2.1:1234", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := table.Match(r); got != tt.expected {
+				t.Errorf("Expected route %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTable_Explain(t *testing.T) {
+	health := &Route{Name: "health", Path: "/healthz", Pool: &core.ServerPool{Name: "ops"}}
+	canary := &Route{Name: "canary", Hosts: []string{"shop.example.com"}, Headers: []ValueMatch{{Name: "X-Canary"}}, Pool: &core.ServerPool{Name: "canary"}}
+	shop := &Route{Name: "shop", Hosts: []string{"shop.example.com"}, Methods: []string{"GET"}, Pool: &core.ServerPool{Name: "shop"}}
+	table := New([]*Route{health, shop, canary})
+
+	r := httptest.NewRequest("POST", "/healthz", nil)
+	r.Host = "shop.example.com"
+	route, steps := table.Explain(r)
+	if route != health {
+		t.Fatalf("Expected route health, got %v", route)
+	}
+
+	expected := []Step{
+		{shop, "shop.example.com", "method POST is not one of GET"},
+		{canary, "shop.example.com", "header X-Canary is missing"},
+		{health, "*", ""},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("Expected %d steps, got %+v", len(expected), steps)
+	}
+	for i, s := range steps {
+		if s != expected[i] {
+			t.Errorf("Expected step %d to be %+v, got %+v", i, expected[i], s)
+		}
+	}
+
+	r.URL.Path = "/"
+	if route, steps := table.Explain(r); route != nil || len(steps) != 3 || steps[2].Reason != "path is not /healthz" {
+		t.Errorf("Expected no route with the reasons of every route, got %v %+v", route, steps)
+	}
+}
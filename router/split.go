@@ -0,0 +1,256 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+// Split spreads the requests of a route among pools in proportion to their
+// weights, e.g. 95 and 5 for a canary release. The weights can be changed
+// at runtime with SetWeights.
+//
+// When StickyHeader or StickyCookie is set, the request value is hashed so
+// that a client keeps being served by the same pool. Targets keep their order
+// on the hash line: raising the weight of the last target only moves clients
+// from the other targets to it.
+type Split struct {
+	Targets      []*SplitTarget
+	StickyHeader string
+	StickyCookie string
+	weights      atomic.Pointer[[]int]
+	// origin is the split this one was rebound from, holding the weights
+	origin *Split
+}
+
+// SplitTarget is a pool of a split and the outcome of the requests it served
+type SplitTarget struct {
+	Pool *core.ServerPool
+	// origin is the target this one was rebound from, holding the counts
+	origin   *SplitTarget
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	// latencies counts the requests by latency bucket, the last one holding the slowest
+	latencies [len(latencyBuckets) + 1]atomic.Uint64
+}
+
+// latencyBuckets are the upper bounds of the latency histogram of split targets,
+// growing by 25% from 500µs to about a minute so that quantiles are estimated
+// within 25%
+var latencyBuckets = func() (b [53]time.Duration) {
+	bound := float64(500 * time.Microsecond)
+	for i := range b {
+		b[i] = time.Duration(bound)
+		bound *= 1.25
+	}
+	return b
+}()
+
+// Counts is the outcome of the requests served by a split target since it was created
+type Counts struct {
+	Requests  uint64
+	Errors    uint64
+	Latencies [len(latencyBuckets) + 1]uint64
+}
+
+// NewSplit creates a split among pools with their initial weights
+func NewSplit(pools []*core.ServerPool, weights []int) (*Split, error) {
+	if len(pools) != len(weights) {
+		return nil, fmt.Errorf("%d weights for %d pools", len(weights), len(pools))
+	}
+	s := &Split{}
+	for _, p := range pools {
+		s.Targets = append(s.Targets, &SplitTarget{Pool: p})
+	}
+	if err := s.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rebind returns a split of the same targets served by pools, e.g. the pools
+// of a reloaded configuration. The splits share their weights and counts, so
+// that weights changed at runtime and the outcome of the requests are kept.
+func (s *Split) Rebind(pools []*core.ServerPool) (*Split, error) {
+	if len(pools) != len(s.Targets) {
+		return nil, fmt.Errorf("%d pools for %d targets", len(pools), len(s.Targets))
+	}
+	n := &Split{StickyHeader: s.StickyHeader, StickyCookie: s.StickyCookie, origin: s.root()}
+	for i, p := range pools {
+		n.Targets = append(n.Targets, &SplitTarget{Pool: p, origin: s.Targets[i].root()})
+	}
+	return n, nil
+}
+
+// root returns the split holding the weights
+func (s *Split) root() *Split {
+	if s.origin != nil {
+		return s.origin
+	}
+	return s
+}
+
+// Weights returns a copy of the current weights, in the order of the targets
+func (s *Split) Weights() []int {
+	return slices.Clone(*s.root().weights.Load())
+}
+
+// SetWeights replaces the weights atomically, in the order of the targets
+func (s *Split) SetWeights(weights []int) error {
+	if len(weights) != len(s.Targets) {
+		return fmt.Errorf("expected %d weights, got %d", len(s.Targets), len(weights))
+	}
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("weight must not be negative")
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	weights = slices.Clone(weights)
+	s.root().weights.Store(&weights)
+	return nil
+}
+
+// Pick returns the target serving the request
+func (s *Split) Pick(r *http.Request) *SplitTarget {
+	weights := *s.root().weights.Load()
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	// point is uniformly spread over [0, total)
+	var point int
+	if key, ok := s.stickyKey(r); ok {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		// Scale the hash rather than taking a modulo, so that the clients of
+		// a target stay on it when the weights of the following targets change
+		point = int(float64(mix(h.Sum64())>>11) / (1 << 53) * float64(total))
+	} else {
+		point = rand.IntN(total)
+	}
+
+	for i, w := range weights {
+		if point < w {
+			return s.Targets[i]
+		}
+		point -= w
+	}
+	return s.Targets[len(s.Targets)-1]
+}
+
+// stickyKey returns the request value identifying the client, if any
+func (s *Split) stickyKey(r *http.Request) (string, bool) {
+	switch {
+	case s.StickyHeader != "":
+		v := r.Header.Get(s.StickyHeader)
+		return v, v != ""
+	case s.StickyCookie != "":
+		c, err := r.Cookie(s.StickyCookie)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return c.Value, true
+	}
+	return "", false
+}
+
+// Done records a request served by the target with the given status code and latency.
+// 5xx responses count as errors.
+func (t *SplitTarget) Done(status int, latency time.Duration) {
+	t = t.root()
+	t.requests.Add(1)
+	if status >= http.StatusInternalServerError {
+		t.errors.Add(1)
+	}
+	i, _ := slices.BinarySearch(latencyBuckets[:], latency)
+	t.latencies[i].Add(1)
+}
+
+// Counts returns the outcome of the requests served by the target
+func (t *SplitTarget) Counts() Counts {
+	t = t.root()
+	c := Counts{Requests: t.requests.Load(), Errors: t.errors.Load()}
+	for i := range t.latencies {
+		c.Latencies[i] = t.latencies[i].Load()
+	}
+	return c
+}
+
+// root returns the target holding the counts
+func (t *SplitTarget) root() *SplitTarget {
+	if t.origin != nil {
+		return t.origin
+	}
+	return t
+}
+
+// Sub returns the outcome of the requests served between the earlier counts o and c
+func (c Counts) Sub(o Counts) Counts {
+	d := Counts{Requests: c.Requests - o.Requests, Errors: c.Errors - o.Errors}
+	for i := range c.Latencies {
+		d.Latencies[i] = c.Latencies[i] - o.Latencies[i]
+	}
+	return d
+}
+
+// ErrorRate returns the share of errors among the requests, between 0 and 1
+func (c Counts) ErrorRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Requests)
+}
+
+// Quantile estimates the latency under which a share q of the requests were
+// served, interpolating within the histogram bucket. It returns 0 without requests.
+func (c Counts) Quantile(q float64) time.Duration {
+	var total uint64
+	for _, n := range c.Latencies {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen float64
+	for i, n := range c.Latencies {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(latencyBuckets) {
+			// Slower than the last bucket: its bound is the best estimate
+			return latencyBuckets[i-1]
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + time.Duration(float64(latencyBuckets[i]-lower)*(rank-seen)/float64(n))
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// mix spreads the bits of an FNV hash, whose high bits barely depend on the
+// last bytes of short keys (splitmix64 finalizer)
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
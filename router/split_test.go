@@ -0,0 +1,209 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/P4ST4S/go-load-balancer/core"
+)
+
+func newTestSplit(t *testing.T, weights ...int) *Split {
+	t.Helper()
+	pools := []*core.ServerPool{{Name: "stable"}, {Name: "canary"}}
+	s, err := NewSplit(pools, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSplit_Pick(t *testing.T) {
+	s := newTestSplit(t, 90, 10)
+
+	counts := map[string]int{}
+	for range 10000 {
+		counts[s.Pick(httptest.NewRequest("GET", "/", nil)).Pool.Name]++
+	}
+	if counts["canary"] < 700 || counts["canary"] > 1300 {
+		t.Errorf("Expected about 10%% of the requests on the canary, got %d/10000", counts["canary"])
+	}
+
+	s.SetWeights([]int{0, 1})
+	if got := s.Pick(httptest.NewRequest("GET", "/", nil)).Pool.Name; got != "canary" {
+		t.Errorf("Expected every request on the canary, got %s", got)
+	}
+}
+
+func TestSplit_Sticky(t *testing.T) {
+	t.Run("Header", func(t *testing.T) {
+		s := newTestSplit(t, 50, 50)
+		s.StickyHeader = "X-User"
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", "alice")
+		first := s.Pick(r)
+		for range 20 {
+			if got := s.Pick(r); got != first {
+				t.Fatalf("Expected alice to stay on %s, got %s", first.Pool.Name, got.Pool.Name)
+			}
+		}
+	})
+
+	t.Run("Cookie", func(t *testing.T) {
+		s := newTestSplit(t, 50, 50)
+		s.StickyCookie = "session"
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+		first := s.Pick(r)
+		for range 20 {
+			if got := s.Pick(r); got != first {
+				t.Fatalf("Expected the session to stay on %s, got %s", first.Pool.Name, got.Pool.Name)
+			}
+		}
+	})
+
+	t.Run("Raising The Canary Only Moves Stable Users", func(t *testing.T) {
+		s := newTestSplit(t, 95, 5)
+		s.StickyHeader = "X-User"
+		before := map[string]string{}
+		requests := map[string]*http.Request{}
+		for i := range 1000 {
+			user := fmt.Sprintf("user-%d", i)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-User", user)
+			requests[user] = r
+			before[user] = s.Pick(r).Pool.Name
+		}
+
+		s.SetWeights([]int{75, 25})
+		moved := 0
+		for user, r := range requests {
+			after := s.Pick(r).Pool.Name
+			if before[user] == "canary" && after != "canary" {
+				t.Fatalf("Expected %s to stay on the canary", user)
+			}
+			if before[user] != after {
+				moved++
+			}
+		}
+		if moved < 120 || moved > 280 {
+			t.Errorf("Expected about 20%% of the users to move to the canary, got %d/1000", moved)
+		}
+	})
+}
+
+func TestSplit_SetWeights(t *testing.T) {
+	s := newTestSplit(t, 90, 10)
+	for _, weights := range [][]int{{1}, {-1, 2}, {0, 0}} {
+		if err := s.SetWeights(weights); err == nil {
+			t.Errorf("Expected weights %v to be rejected", weights)
+		}
+	}
+	if w := s.Weights(); w[0] != 90 || w[1] != 10 {
+		t.Errorf("Expected rejected weights to leave 90/10, got %v", w)
+	}
+
+	w := s.Weights()
+	w[0] = 0
+	if s.Weights()[0] != 90 {
+		t.Error("Expected Weights to return a copy")
+	}
+
+	if _, err := NewSplit([]*core.ServerPool{{Name: "stable"}}, []int{1, 2}); err == nil {
+		t.Error("Expected a weight count mismatch to be rejected")
+	}
+}
+
+func TestSplit_Rebind(t *testing.T) {
+	s := newTestSplit(t, 90, 10)
+	s.Targets[1].Done(http.StatusBadGateway, time.Millisecond)
+
+	pools := []*core.ServerPool{{Name: "stable"}, {Name: "canary"}}
+	rebound, err := s.Rebind(pools)
+	if err != nil {
+		t.Fatalf("Rebind failed: %v", err)
+	}
+	if rebound.Targets[1].Pool != pools[1] {
+		t.Error("Expected the targets to be served by the new pools")
+	}
+	if c := rebound.Targets[1].Counts(); c.Requests != 1 || c.Errors != 1 {
+		t.Errorf("Expected the counts carried over, got %+v", c)
+	}
+
+	// Both splits share their weights and counts, e.g. for in-flight requests
+	if err := rebound.SetWeights([]int{50, 50}); err != nil {
+		t.Fatal(err)
+	}
+	s.Targets[1].Done(http.StatusOK, time.Millisecond)
+	if w := s.Weights(); w[0] != 50 {
+		t.Errorf("Expected shared weights, got %v", w)
+	}
+	if again, _ := rebound.Rebind(pools); again.Targets[1].Counts().Requests != 2 {
+		t.Errorf("Expected shared counts, got %+v", again.Targets[1].Counts())
+	}
+
+	if _, err := s.Rebind(pools[:1]); err == nil {
+		t.Error("Expected a pool count mismatch to be rejected")
+	}
+}
+
+func TestSplitTarget_Done(t *testing.T) {
+	target := &SplitTarget{}
+	for _, status := range []int{200, 404, 502, 503, 200} {
+		target.Done(status, 3*time.Millisecond)
+	}
+	c := target.Counts()
+	if c.Requests != 5 || c.Errors != 2 || c.ErrorRate() != 0.4 {
+		t.Errorf("Expected 5 requests and 2 errors, got %+v", c)
+	}
+
+	target.Done(200, 20*time.Second)
+	d := target.Counts().Sub(c)
+	if d.Requests != 1 || d.Errors != 0 {
+		t.Errorf("Expected the difference to hold the slow request only, got %+v", d)
+	}
+	if q := d.Quantile(0.5); q < 16*time.Second || q > 25*time.Second {
+		t.Errorf("Expected a median latency close to 20s, got %s", q)
+	}
+}
+
+func TestCounts_Quantile(t *testing.T) {
+	target := &SplitTarget{}
+	for i := range 100 {
+		// 90 fast requests and 10 slow ones
+		latency := 20 * time.Millisecond
+		if i >= 90 {
+			latency = 300 * time.Millisecond
+		}
+		target.Done(200, latency)
+	}
+	c := target.Counts()
+
+	tests := []struct {
+		name     string
+		q        float64
+		expected time.Duration
+	}{
+		{"Median", 0.5, 20 * time.Millisecond},
+		{"P90", 0.9, 20 * time.Millisecond},
+		{"P95", 0.95, 300 * time.Millisecond},
+		{"Max", 1, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Estimates are within the 25% width of a bucket
+			if got := c.Quantile(tt.q); got < tt.expected*4/5 || got > tt.expected*5/4 {
+				t.Errorf("Expected about %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	if got := (Counts{Latencies: [len(latencyBuckets) + 1]uint64{len(latencyBuckets): 1}}).Quantile(1); got != latencyBuckets[len(latencyBuckets)-1] {
+		t.Errorf("Expected the last bound for requests slower than every bucket, got %s", got)
+	}
+	if (Counts{}).Quantile(0.95) != 0 {
+		t.Error("Expected 0 without requests")
+	}
+}
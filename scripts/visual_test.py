@@ -59,10 +59,11 @@ async def poll_stats(session, interval=0.5):
                 if resp.status == 200:
                     data = await resp.json()
                     parts = []
-                    for b in data:
-                        url = b.get("url", "?")
-                        conn = b.get("conn_count", 0)
-                        parts.append(f"{url.split('//')[-1]}:{conn}")
+                    for pool in data:
+                        for b in pool.get("backends", []):
+                            url = b.get("url", "?")
+                            conn = b.get("conn_count", 0)
+                            parts.append(f"{url.split('//')[-1]}:{conn}")
                     line = " | ".join(parts)
                     print(f"{BLUE}STATS{RESET} {line}")
         except Exception: